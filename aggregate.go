@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/prober"
+)
+
+// aggregateProber is the prober of modules that probe the target with each of
+// their sub-modules
+const aggregateProber = "aggregate"
+
+// targetNotAllowedError is returned when a target isn't allowed by
+// --probe.allowed-targets
+type targetNotAllowedError struct {
+	target string
+}
+
+func (e *targetNotAllowedError) Error() string {
+	return fmt.Sprintf("Target %q is not allowed", e.target)
+}
+
+// newAggregateExporters returns an exporter for each of the sub-modules of an
+// aggregate module, keyed by the name of the sub-module. The sub-modules are
+// probed concurrently when the exporters are collected by the same registry.
+func newAggregateExporters(target string, module config.Module, conf *config.Config, timeout time.Duration) (map[string]*Exporter, error) {
+	if strings.Contains(target, "://") {
+		return nil, fmt.Errorf("The target of an aggregate module must be a host or host:port, not a URL")
+	}
+	if len(module.Aggregate) == 0 {
+		return nil, fmt.Errorf("The aggregate module has no sub-modules")
+	}
+
+	exporters := map[string]*Exporter{}
+	for _, sub := range module.Aggregate {
+		if _, ok := exporters[sub.Module]; ok {
+			return nil, fmt.Errorf("Module %q is in the aggregate module more than once", sub.Module)
+		}
+		subModule, ok := conf.Modules[sub.Module]
+		if !ok {
+			return nil, fmt.Errorf("Unknown module %q in the aggregate module", sub.Module)
+		}
+		if subModule.Prober == aggregateProber {
+			return nil, fmt.Errorf("Module %q can't be in an aggregate module, because it's an aggregate module itself", sub.Module)
+		}
+		if first, ok := conf.Modules[module.Aggregate[0].Module]; ok && !subModule.CertLabels.Equal(first.CertLabels) {
+			return nil, fmt.Errorf("Modules %q and %q in the aggregate module have different cert_labels", module.Aggregate[0].Module, sub.Module)
+		}
+		probeFn, ok := prober.Probers[subModule.Prober]
+		if !ok {
+			return nil, fmt.Errorf("Unknown prober %q in module %q", subModule.Prober, sub.Module)
+		}
+
+		subTarget := setTargetPort(target, sub.Port)
+		if !allowedTargets.allows(subTarget) {
+			return nil, &targetNotAllowedError{target: subTarget}
+		}
+
+		exporters[sub.Module] = &Exporter{
+			target:     subTarget,
+			prober:     probeFn,
+			timeout:    timeout,
+			module:     config.ExpandModule(subModule, subTarget),
+			moduleName: sub.Module,
+		}
+	}
+
+	return exporters, nil
+}
+
+// registerAggregate registers the exporters of the sub-modules, with their
+// metrics labelled by the name of the sub-module
+func registerAggregate(registry prometheus.Registerer, exporters map[string]*Exporter) error {
+	for name, exporter := range exporters {
+		labels := prometheus.Labels{"sub_module": name}
+		if err := prometheus.WrapRegistererWith(labels, registry).Register(exporter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setTargetPort replaces the port of a host or host:port target. The target
+// is returned as it is when the port is empty.
+func setTargetPort(target, port string) string {
+	if port == "" {
+		return target
+	}
+	host := target
+	if h, _, err := net.SplitHostPort(target); err == nil {
+		host = h
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestProbeHandlerAggregate tests probing a host on two ports with the
+// sub-modules of an aggregate module
+func TestProbeHandlerAggregate(t *testing.T) {
+	tcpServer, _, _, tcpCAFile, tcpTeardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpTeardown()
+
+	tcpServer.StartTLS()
+	defer tcpServer.Close()
+
+	httpsServer, _, _, httpsCAFile, httpsTeardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpsTeardown()
+
+	httpsServer.StartTLS()
+	defer httpsServer.Close()
+
+	_, tcpPort, _ := net.SplitHostPort(tcpServer.Listener.Addr().String())
+	_, httpsPort, _ := net.SplitHostPort(httpsServer.Listener.Addr().String())
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: tcpCAFile,
+				},
+			},
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: httpsCAFile,
+				},
+			},
+			"both": config.Module{
+				Prober: "aggregate",
+				Aggregate: []config.SubModule{
+					{Module: "tcp", Port: tcpPort},
+					{Module: "https", Port: httpsPort},
+				},
+			},
+		},
+	}
+
+	rr, err := probe("127.0.0.1", "both", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		`ssl_tls_connect_success{sub_module="tcp"} 1`,
+		`ssl_tls_connect_success{sub_module="https"} 1`,
+		`ssl_prober{prober="tcp",sub_module="tcp"} 1`,
+		`ssl_prober{prober="https",sub_module="https"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected `%s`", expected)
+		}
+	}
+}
+
+// TestProbeHandlerAggregateInvalid tests that aggregate modules with invalid
+// sub-modules are rejected
+func TestProbeHandlerAggregateInvalid(t *testing.T) {
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+			},
+			"empty": config.Module{
+				Prober: "aggregate",
+			},
+			"unknown": config.Module{
+				Prober:    "aggregate",
+				Aggregate: []config.SubModule{{Module: "smtp"}},
+			},
+			"duplicate": config.Module{
+				Prober:    "aggregate",
+				Aggregate: []config.SubModule{{Module: "tcp", Port: "443"}, {Module: "tcp", Port: "25"}},
+			},
+			"nested": config.Module{
+				Prober:    "aggregate",
+				Aggregate: []config.SubModule{{Module: "empty"}},
+			},
+			"tcp_cn": config.Module{
+				Prober:     "tcp",
+				CertLabels: config.CertLabels{"serial_no", "issuer_cn"},
+			},
+			"cert_labels": config.Module{
+				Prober:    "aggregate",
+				Aggregate: []config.SubModule{{Module: "tcp", Port: "443"}, {Module: "tcp_cn", Port: "25"}},
+			},
+		},
+	}
+
+	for _, module := range []string{"empty", "unknown", "duplicate", "nested", "cert_labels"} {
+		rr, err := probe("127.0.0.1", module, conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected a 400 for the module %s, got %d", module, rr.Code)
+		}
+	}
+}
+
+// TestProbeHandlerAggregateNotAllowed tests that an aggregate module that
+// would probe a target that isn't allowed is refused like a direct probe
+func TestProbeHandlerAggregateNotAllowed(t *testing.T) {
+	allowlist, err := newTargetAllowlist([]string{"127\\.0\\.0\\.1:443"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	allowedTargets = allowlist
+	defer func() { allowedTargets = nil }()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+			},
+			"https": config.Module{
+				Prober: "https",
+			},
+			"both": config.Module{
+				Prober: "aggregate",
+				Aggregate: []config.SubModule{
+					{Module: "tcp", Port: "443"},
+					{Module: "https", Port: "25"},
+				},
+			},
+		},
+	}
+
+	rr, err := probe("127.0.0.1:443", "both", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rr.Code)
+	}
+}
+
+func TestSetTargetPort(t *testing.T) {
+	for _, tc := range []struct {
+		target   string
+		port     string
+		expected string
+	}{
+		{"example.com", "443", "example.com:443"},
+		{"example.com:25", "443", "example.com:443"},
+		{"example.com:25", "", "example.com:25"},
+		{"::1", "443", "[::1]:443"},
+		{"[::1]:25", "443", "[::1]:443"},
+	} {
+		if got := setTargetPort(tc.target, tc.port); got != tc.expected {
+			t.Errorf("expected %s for %s and %s, got %s", tc.expected, tc.target, tc.port, got)
+		}
+	}
+}
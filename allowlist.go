@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// allowedTargets, when set, restricts the targets that can be probed through
+// the probe endpoint
+var allowedTargets *targetAllowlist
+
+// targetAllowlist matches targets against a list of CIDRs and regular
+// expressions
+type targetAllowlist struct {
+	nets     []*net.IPNet
+	patterns []*regexp.Regexp
+}
+
+// newTargetAllowlist parses the entries of the allowlist. An entry that is a
+// CIDR matches targets with an IP address in the range. Any other entry is a
+// regular expression that must match the whole host or host:port of the
+// target.
+func newTargetAllowlist(entries []string) (*targetAllowlist, error) {
+	a := &targetAllowlist{}
+	for _, entry := range entries {
+		if _, ipNet, err := net.ParseCIDR(entry); err == nil {
+			a.nets = append(a.nets, ipNet)
+			continue
+		}
+		pattern, err := regexp.Compile("^(?:" + entry + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid allowed target %q: %s", entry, err)
+		}
+		a.patterns = append(a.patterns, pattern)
+	}
+
+	return a, nil
+}
+
+// allows returns true if the target matches an entry in the allowlist. Every
+// target is allowed when the allowlist is nil.
+func (a *targetAllowlist) allows(target string) bool {
+	if a == nil {
+		return true
+	}
+
+	host := getTargetHost(target)
+	if ip := net.ParseIP(host); ip != nil {
+		for _, ipNet := range a.nets {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+
+	hostPort := getTargetHostPort(target)
+	for _, pattern := range a.patterns {
+		if pattern.MatchString(host) || pattern.MatchString(hostPort) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getTargetHostPort returns the host and port of the target, or just the host
+// when the target doesn't have a port
+func getTargetHostPort(target string) string {
+	if strings.Contains(target, "://") {
+		if u, err := url.Parse(target); err == nil {
+			return u.Host
+		}
+	}
+	return target
+}
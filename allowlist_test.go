@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// TestTargetAllowlist tests matching targets against CIDRs and regular
+// expressions
+func TestTargetAllowlist(t *testing.T) {
+	allowlist, err := newTargetAllowlist([]string{
+		"10.0.0.0/8",
+		"example\\.com",
+		".*\\.example\\.org:443",
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for target, expected := range map[string]bool{
+		"10.1.2.3:443":                 true,
+		"10.1.2.3":                     true,
+		"https://10.1.2.3:8443/path":   true,
+		"192.168.0.1:443":              false,
+		"example.com:443":              true,
+		"example.com:8443":             true,
+		"https://example.com":          true,
+		"www.example.com:443":          false,
+		"www.example.org:443":          true,
+		"www.example.org:8443":         false,
+		"https://www.example.org:443/": true,
+		"https://www.example.org/":     false,
+		"example.com.evil.com:443":     false,
+	} {
+		if allowed := allowlist.allows(target); allowed != expected {
+			t.Errorf("expected allows(%q) to be %t", target, expected)
+		}
+	}
+}
+
+// TestTargetAllowlistNil tests that a nil allowlist allows every target
+func TestTargetAllowlistNil(t *testing.T) {
+	var allowlist *targetAllowlist
+	if !allowlist.allows("192.168.0.1:443") {
+		t.Errorf("expected a nil allowlist to allow every target")
+	}
+}
+
+// TestTargetAllowlistInvalid tests that an invalid regular expression is
+// rejected
+func TestTargetAllowlistInvalid(t *testing.T) {
+	if _, err := newTargetAllowlist([]string{"(example.com"}); err == nil {
+		t.Errorf("expected an error for an invalid regular expression")
+	}
+}
+
+// TestProbeHandlerAllowedTargets tests that the probe handler refuses to
+// probe targets that aren't allowed
+func TestProbeHandlerAllowedTargets(t *testing.T) {
+	allowlist, err := newTargetAllowlist([]string{"example\\.com"})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	allowedTargets = allowlist
+	defer func() { allowedTargets = nil }()
+
+	rr, err := probe("192.168.0.1:443", "tcp", config.DefaultConfig)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected status %d, got %d", http.StatusForbidden, rr.Code)
+	}
+}
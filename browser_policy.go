@@ -0,0 +1,53 @@
+package main
+
+import (
+	"crypto/x509"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// browserPolicy is the longest validity period that browsers accept for
+// certificates issued from each date, from the CA/Browser Forum Baseline
+// Requirements and the root programs that enforce them. Modules can replace it
+// with browser_policy as the rules change.
+var browserPolicy = []config.ValidityPolicy{
+	{IssuedFrom: time.Date(2015, 4, 1, 0, 0, 0, 0, time.UTC), MaxDays: 1185},
+	{IssuedFrom: time.Date(2018, 3, 1, 0, 0, 0, 0, time.UTC), MaxDays: 825},
+	{IssuedFrom: time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC), MaxDays: 398},
+	{IssuedFrom: time.Date(2026, 3, 15, 0, 0, 0, 0, time.UTC), MaxDays: 200},
+	{IssuedFrom: time.Date(2027, 3, 15, 0, 0, 0, 0, time.UTC), MaxDays: 100},
+	{IssuedFrom: time.Date(2029, 3, 15, 0, 0, 0, 0, time.UTC), MaxDays: 47},
+}
+
+// getBrowserPolicyCompliant returns 1 if the validity period of the
+// certificate is within the limit for the date it was issued, which is the
+// limit of the latest entry of the policy that starts on or before NotBefore.
+// The module's policy replaces the default one when it has any entries.
+//
+// The validity period includes both NotBefore and NotAfter, so it's one second
+// longer than the difference between them.
+func getBrowserPolicyCompliant(cert *x509.Certificate, policy []config.ValidityPolicy) float64 {
+	if len(policy) == 0 {
+		policy = browserPolicy
+	}
+
+	var limit *config.ValidityPolicy
+	for i, p := range policy {
+		if p.IssuedFrom.After(cert.NotBefore) {
+			continue
+		}
+		if limit == nil || p.IssuedFrom.After(limit.IssuedFrom) {
+			limit = &policy[i]
+		}
+	}
+	if limit == nil {
+		return 1
+	}
+
+	validity := cert.NotAfter.Sub(cert.NotBefore) + time.Second
+	if validity > time.Duration(limit.MaxDays)*24*time.Hour {
+		return 0
+	}
+	return 1
+}
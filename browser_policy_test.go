@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+func TestGetBrowserPolicyCompliant(t *testing.T) {
+	day := 24 * time.Hour
+	date := func(year int, month time.Month, d int) time.Time {
+		return time.Date(year, month, d, 0, 0, 0, 0, time.UTC)
+	}
+	policy := []config.ValidityPolicy{
+		{IssuedFrom: date(2024, 1, 1), MaxDays: 30},
+	}
+
+	for _, tc := range []struct {
+		name      string
+		notBefore time.Time
+		validity  time.Duration
+		policy    []config.ValidityPolicy
+		expected  float64
+	}{
+		{
+			name:      "before any policy",
+			notBefore: date(2014, 1, 1),
+			validity:  5 * 365 * day,
+			expected:  1,
+		},
+		{
+			name:      "825 days before the 398 day limit",
+			notBefore: date(2020, 8, 31),
+			validity:  825*day - time.Second,
+			expected:  1,
+		},
+		{
+			name:      "825 days after the 398 day limit",
+			notBefore: date(2020, 9, 1),
+			validity:  825*day - time.Second,
+			expected:  0,
+		},
+		{
+			name:      "exactly 398 days",
+			notBefore: date(2024, 6, 1),
+			validity:  398*day - time.Second,
+			expected:  1,
+		},
+		{
+			name:      "398 days and a second",
+			notBefore: date(2024, 6, 1),
+			validity:  398 * day,
+			expected:  0,
+		},
+		{
+			name:      "398 days after the 200 day limit",
+			notBefore: date(2026, 3, 15),
+			validity:  398*day - time.Second,
+			expected:  0,
+		},
+		{
+			name:      "90 days after the 47 day limit",
+			notBefore: date(2029, 6, 1),
+			validity:  90*day - time.Second,
+			expected:  0,
+		},
+		{
+			name:      "module policy",
+			notBefore: date(2024, 6, 1),
+			validity:  90*day - time.Second,
+			policy:    policy,
+			expected:  0,
+		},
+		{
+			name:      "before the module policy",
+			notBefore: date(2023, 6, 1),
+			validity:  398*day - time.Second,
+			policy:    policy,
+			expected:  1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cert := &x509.Certificate{NotBefore: tc.notBefore, NotAfter: tc.notBefore.Add(tc.validity)}
+			if compliant := getBrowserPolicyCompliant(cert, tc.policy); compliant != tc.expected {
+				t.Errorf("expected %v but got %v", tc.expected, compliant)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/ribbybibby/ssl_exporter/prober"
+)
+
+// caaIssuerDomains are the domains that CAs recognise in the issue property
+// of CAA records, by the organization of the certificates they issue from.
+// Modules can give the domains of other CAs with caa_issuer_domains.
+var caaIssuerDomains = []struct {
+	organization string
+	domains      []string
+}{
+	{"let's encrypt", []string{"letsencrypt.org"}},
+	{"google trust services", []string{"pki.goog"}},
+	{"digicert", []string{"digicert.com", "www.digicert.com"}},
+	{"sectigo", []string{"sectigo.com", "comodoca.com"}},
+	{"comodo", []string{"sectigo.com", "comodoca.com"}},
+	{"zerossl", []string{"sectigo.com"}},
+	{"amazon", []string{"amazon.com", "amazontrust.com", "awstrust.com", "amazonaws.com"}},
+	{"globalsign", []string{"globalsign.com"}},
+	{"godaddy", []string{"godaddy.com"}},
+	{"starfield", []string{"starfieldtech.com"}},
+	{"entrust", []string{"entrust.net"}},
+	{"microsoft", []string{"microsoft.com"}},
+	{"buypass", []string{"buypass.com", "buypass.no"}},
+	{"ssl corp", []string{"ssl.com"}},
+}
+
+// caaTags are the properties defined for CAA records. A critical record with
+// any other tag prevents issuance.
+var caaTags = map[string]bool{
+	"issue":        true,
+	"issuewild":    true,
+	"iodef":        true,
+	"contactemail": true,
+	"contactphone": true,
+	"issuemail":    true,
+	"issuevmc":     true,
+}
+
+// getCAAIssuerDomains returns the domains in the module, or the domains of the
+// CA that issued the certificate when the module doesn't have any
+func getCAAIssuerDomains(cert *x509.Certificate, domains []string) []string {
+	if len(domains) > 0 {
+		return domains
+	}
+
+	for _, org := range cert.Issuer.Organization {
+		org = strings.ToLower(org)
+		for _, ca := range caaIssuerDomains {
+			if strings.Contains(org, ca.organization) {
+				return ca.domains
+			}
+		}
+	}
+
+	return nil
+}
+
+// getCAAAuthorized returns 1 if the CAA records allow a CA with one of the
+// domains to issue the certificate. The issuewild property applies instead of
+// issue to wildcard certificates when the records have it, and any CA is
+// allowed when they have neither.
+//
+// See https://www.rfc-editor.org/rfc/rfc8659#section-4.2
+func getCAAAuthorized(records []prober.CAARecord, cert *x509.Certificate, domains []string) float64 {
+	tag := "issue"
+	for _, name := range cert.DNSNames {
+		if strings.HasPrefix(name, "*.") {
+			for _, record := range records {
+				if record.Tag == "issuewild" {
+					tag = "issuewild"
+				}
+			}
+			break
+		}
+	}
+
+	restricted := false
+	authorized := false
+	for _, record := range records {
+		if record.Critical && !caaTags[record.Tag] {
+			return 0
+		}
+		if record.Tag != tag {
+			continue
+		}
+		restricted = true
+
+		// The domain comes before any parameters and is empty when the
+		// record doesn't allow any CA
+		domain := strings.TrimSpace(strings.SplitN(record.Value, ";", 2)[0])
+		for _, d := range domains {
+			if domain != "" && strings.EqualFold(domain, d) {
+				authorized = true
+			}
+		}
+	}
+
+	if !restricted || authorized {
+		return 1
+	}
+	return 0
+}
+
+// collectCAA looks up the CAA records of the target host and exports whether
+// they allow the CA that issued the certificate to issue it. The server name
+// in the module is used when the target is an IP address, which can't have
+// CAA records.
+func (e *Exporter) collectCAA(ctx context.Context, cert *x509.Certificate, ch chan<- prometheus.Metric) {
+	host := getTargetHost(e.target)
+	if net.ParseIP(host) != nil {
+		host = e.module.TLSConfig.ServerName
+	}
+	if host == "" {
+		return
+	}
+
+	records, err := prober.LookupCAA(ctx, e.module, host)
+	if err != nil {
+		log.Errorf("error=%s target=%s prober=%s msg=unable to look up CAA records", err, e.target, e.module.Prober)
+		return
+	}
+
+	var present float64
+	if len(records) > 0 {
+		present = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		caaPresent, prometheus.GaugeValue, present,
+	)
+
+	domains := getCAAIssuerDomains(cert, e.module.CAAIssuerDomains)
+	if len(domains) == 0 {
+		log.Errorf("error=unknown CA %q target=%s prober=%s msg=set caa_issuer_domains to check the CAA records", cert.Issuer.String(), e.target, e.module.Prober)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(
+		caaIssuerAuthorized, prometheus.GaugeValue, getCAAAuthorized(records, cert, domains),
+	)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/prober"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+func TestGetCAAAuthorized(t *testing.T) {
+	cert := &x509.Certificate{DNSNames: []string{"example.ribbybibby.me"}}
+	wildcard := &x509.Certificate{DNSNames: []string{"*.ribbybibby.me"}}
+	domains := []string{"letsencrypt.org"}
+
+	for _, tc := range []struct {
+		name     string
+		records  []prober.CAARecord
+		cert     *x509.Certificate
+		expected float64
+	}{
+		{
+			name:     "no records",
+			cert:     cert,
+			expected: 1,
+		},
+		{
+			name: "authorized",
+			records: []prober.CAARecord{
+				{Tag: "issue", Value: "pki.goog"},
+				{Tag: "issue", Value: "LetsEncrypt.org; validationmethods=dns-01"},
+			},
+			cert:     cert,
+			expected: 1,
+		},
+		{
+			name: "not authorized",
+			records: []prober.CAARecord{
+				{Tag: "issue", Value: "pki.goog"},
+			},
+			cert:     cert,
+			expected: 0,
+		},
+		{
+			name: "no CA authorized",
+			records: []prober.CAARecord{
+				{Tag: "issue", Value: ";"},
+			},
+			cert:     cert,
+			expected: 0,
+		},
+		{
+			name: "no issue property",
+			records: []prober.CAARecord{
+				{Tag: "iodef", Value: "mailto:me@ribbybibby.me"},
+			},
+			cert:     cert,
+			expected: 1,
+		},
+		{
+			name: "issuewild for a wildcard",
+			records: []prober.CAARecord{
+				{Tag: "issue", Value: "letsencrypt.org"},
+				{Tag: "issuewild", Value: "pki.goog"},
+			},
+			cert:     wildcard,
+			expected: 0,
+		},
+		{
+			name: "issuewild for a certificate without a wildcard",
+			records: []prober.CAARecord{
+				{Tag: "issue", Value: "letsencrypt.org"},
+				{Tag: "issuewild", Value: "pki.goog"},
+			},
+			cert:     cert,
+			expected: 1,
+		},
+		{
+			name: "issue for a wildcard without issuewild",
+			records: []prober.CAARecord{
+				{Tag: "issue", Value: "letsencrypt.org"},
+			},
+			cert:     wildcard,
+			expected: 1,
+		},
+		{
+			name: "unknown critical property",
+			records: []prober.CAARecord{
+				{Tag: "issue", Value: "letsencrypt.org"},
+				{Critical: true, Tag: "tbs", Value: "value"},
+			},
+			cert:     cert,
+			expected: 0,
+		},
+	} {
+		if authorized := getCAAAuthorized(tc.records, tc.cert, domains); authorized != tc.expected {
+			t.Errorf("%s: expected %v, but got %v", tc.name, tc.expected, authorized)
+		}
+	}
+}
+
+func TestGetCAAIssuerDomains(t *testing.T) {
+	cert := &x509.Certificate{
+		Issuer: pkix.Name{Organization: []string{"Let's Encrypt"}},
+	}
+
+	if domains := getCAAIssuerDomains(cert, nil); !reflect.DeepEqual(domains, []string{"letsencrypt.org"}) {
+		t.Errorf("unexpected domains for Let's Encrypt: %v", domains)
+	}
+	if domains := getCAAIssuerDomains(cert, []string{"ribbybibby.me"}); !reflect.DeepEqual(domains, []string{"ribbybibby.me"}) {
+		t.Errorf("expected the domains in the module, but got %v", domains)
+	}
+	if domains := getCAAIssuerDomains(&x509.Certificate{}, nil); domains != nil {
+		t.Errorf("expected no domains for an unknown CA, but got %v", domains)
+	}
+}
+
+// TestProbeHandlerCAA tests the CAA metrics of a target that is probed by IP
+// address, with the records of the server name
+func TestProbeHandlerCAA(t *testing.T) {
+	dnsServer, err := test.SetupDNSServer(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsServer.Close()
+
+	for _, tc := range []struct {
+		records  []string
+		expected []string
+	}{
+		{
+			records:  []string{"issue ribbybibby.me"},
+			expected: []string{"ssl_dns_caa_present 1", "ssl_dns_caa_issuer_authorized 1"},
+		},
+		{
+			records:  []string{"issue letsencrypt.org"},
+			expected: []string{"ssl_dns_caa_present 1", "ssl_dns_caa_issuer_authorized 0"},
+		},
+		{
+			expected: []string{"ssl_dns_caa_present 0", "ssl_dns_caa_issuer_authorized 1"},
+		},
+	} {
+		dnsServer.SetCAA("ribbybibby.me", tc.records...)
+
+		server, _, _, caFile, teardown, err := test.SetupTCPServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"caa": config.Module{
+					Prober: "tcp",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile:     caFile,
+						ServerName: "example.ribbybibby.me",
+					},
+					Resolver:         dnsServer.Conn.LocalAddr().String(),
+					CheckCAA:         true,
+					CAAIssuerDomains: []string{"ribbybibby.me"},
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "caa", conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		teardown()
+
+		for _, expected := range tc.expected {
+			if !strings.Contains(rr.Body.String(), expected) {
+				t.Errorf("expected `%s` for the records %v", expected, tc.records)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/prober"
+)
+
+// canaryRetryInterval is how often the canary target is probed until a probe
+// succeeds
+const canaryRetryInterval = 10 * time.Second
+
+// canary gates the readiness of the exporter on a successful probe of a
+// target, which shows that it can reach the network and complete handshakes
+type canary struct {
+	target  string
+	module  config.Module
+	probeFn prober.ProbeFn
+	timeout time.Duration
+
+	mtx   sync.RWMutex
+	ready bool
+	err   error
+}
+
+// newCanary returns a canary that probes the target with the module
+func newCanary(target, moduleName string, conf *config.Config, timeout time.Duration) (*canary, error) {
+	if moduleName == "" {
+		moduleName = "tcp"
+	}
+	module, ok := conf.Modules[moduleName]
+	if !ok {
+		return nil, fmt.Errorf("Unknown module %q for the canary target", moduleName)
+	}
+
+	probeFn, ok := prober.Probers[module.Prober]
+	if !ok {
+		return nil, fmt.Errorf("Unknown prober %q for the canary target", module.Prober)
+	}
+
+	return &canary{
+		target:  target,
+		module:  config.ExpandModule(module, target),
+		probeFn: probeFn,
+		timeout: timeout,
+	}, nil
+}
+
+// probe probes the target and returns true if the probe succeeded
+func (c *canary) probe() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	_, err := c.probeFn(ctx, c.target, c.module, c.timeout, nil)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.err = err
+	if err == nil {
+		c.ready = true
+	}
+
+	return c.ready
+}
+
+// run probes the target every interval until a probe succeeds or the stop
+// channel is closed
+func (c *canary) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for !c.probe() {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// readyHandler responds with a 200 when the exporter is ready to be scraped,
+// which is once a probe of the canary target has succeeded when there is one
+func readyHandler(c *canary) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c != nil {
+			c.mtx.RLock()
+			ready, err := c.ready, c.err
+			c.mtx.RUnlock()
+
+			if !ready {
+				msg := fmt.Sprintf("Not ready: the canary target %s hasn't been probed yet", c.target)
+				if err != nil {
+					msg = fmt.Sprintf("Not ready: the probe of the canary target %s failed: %s", c.target, err)
+				}
+				http.Error(w, msg, http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		_, _ = w.Write([]byte("Ready\n"))
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestCanaryReadiness tests that /-/ready responds with a 503 until a probe of
+// the canary target succeeds
+func TestCanaryReadiness(t *testing.T) {
+	// Nothing is listening on the address of a closed listener
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ln.Close()
+
+	c, err := newCanary("https://"+ln.Addr().String(), "https", config.DefaultConfig, 5*time.Second)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	checkReady := func(code int, body string) {
+		t.Helper()
+		rr := httptest.NewRecorder()
+		readyHandler(c).ServeHTTP(rr, httptest.NewRequest("GET", "/-/ready", nil))
+		if rr.Code != code {
+			t.Errorf("expected status %d, but got %d", code, rr.Code)
+		}
+		if !strings.Contains(rr.Body.String(), body) {
+			t.Errorf("expected %q in the response, but got %q", body, rr.Body.String())
+		}
+	}
+
+	checkReady(http.StatusServiceUnavailable, "hasn't been probed yet")
+
+	if c.probe() {
+		t.Fatalf("expected the probe of the canary target to fail")
+	}
+	checkReady(http.StatusServiceUnavailable, "the probe of the canary target")
+
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+	c, err = newCanary(server.URL, "https", conf, 5*time.Second)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		c.run(10*time.Millisecond, stop)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		close(stop)
+		t.Fatalf("expected the canary to stop probing once a probe succeeded")
+	}
+	checkReady(http.StatusOK, "Ready")
+}
+
+// TestCanaryUnknownModule tests that the canary module must exist
+func TestCanaryUnknownModule(t *testing.T) {
+	if _, err := newCanary("example.com:443", "missing", config.DefaultConfig, time.Second); err == nil {
+		t.Fatalf("expected error, but err was nil")
+	}
+}
+
+// TestReadyWithoutCanary tests that the exporter is always ready without a
+// canary target
+func TestReadyWithoutCanary(t *testing.T) {
+	rr := httptest.NewRecorder()
+	readyHandler(nil).ServeHTTP(rr, httptest.NewRequest("GET", "/-/ready", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d, but got %d", http.StatusOK, rr.Code)
+	}
+}
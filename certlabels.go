@@ -0,0 +1,185 @@
+package main
+
+import (
+	"crypto/x509"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+var (
+	// defaultCertDescs are the descriptors of the certificate metrics with
+	// every one of certLabels
+	defaultCertDescs = newCertDescs(certLabels)
+
+	// certDescsCache holds the descriptors built for each selection of
+	// cert_labels, by the selected labels joined with commas
+	certDescsCache = struct {
+		sync.Mutex
+		descs map[string]*certDescs
+	}{descs: map[string]*certDescs{}}
+)
+
+// certDescs are the descriptors of the metrics that identify a certificate
+// with certLabels, built with the labels selected by a module
+type certDescs struct {
+	// indexes are the positions in certLabels of the selected labels
+	indexes []int
+
+	notBefore          *prometheus.Desc
+	notAfter           *prometheus.Desc
+	verifiedNotBefore  *prometheus.Desc
+	verifiedNotAfter   *prometheus.Desc
+	weakSignature      *prometheus.Desc
+	uriSANsCount       *prometheus.Desc
+	aiaInfo            *prometheus.Desc
+	subjectDN          *prometheus.Desc
+	issuerDN           *prometheus.Desc
+	notAfterTimestamp  *prometheus.Desc
+	notBeforeTimestamp *prometheus.Desc
+	maxPathLen         *prometheus.Desc
+}
+
+// newCertDescs returns the descriptors for the certificate metrics with the
+// labels in certLabels that are in the selection
+func newCertDescs(selected []string) *certDescs {
+	var (
+		labels  []string
+		indexes []int
+	)
+	for i, label := range certLabels {
+		for _, s := range selected {
+			if s == label {
+				labels = append(labels, label)
+				indexes = append(indexes, i)
+				break
+			}
+		}
+	}
+
+	return &certDescs{
+		indexes: indexes,
+		notBefore: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cert_not_before"),
+			"NotBefore expressed as a Unix Epoch Time",
+			concatLabels(labels, []string{"chain_index"}), nil,
+		),
+		notAfter: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cert_not_after"),
+			"NotAfter expressed as a Unix Epoch Time",
+			concatLabels(labels, []string{"chain_index"}), nil,
+		),
+		verifiedNotBefore: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "verified_cert_not_before"),
+			"NotBefore expressed as a Unix Epoch Time for a certificate in the list of verified chains",
+			concatLabels([]string{"chain_no"}, labels), nil,
+		),
+		verifiedNotAfter: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "verfied_cert_not_after"),
+			"NotAfter expressed as a Unix Epoch Time for a certificate in the list of verified chains",
+			concatLabels([]string{"chain_no"}, labels), nil,
+		),
+		weakSignature: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cert_weak_signature"),
+			"If a peer certificate is signed with a deprecated algorithm based on MD2, MD5 or SHA-1",
+			labels, nil,
+		),
+		uriSANsCount: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cert_uri_sans_count"),
+			"The number of URI SANs in a peer certificate",
+			labels, nil,
+		),
+		aiaInfo: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cert_aia_info"),
+			"The OCSP and CA issuer URLs in the Authority Information Access extension of a peer certificate",
+			concatLabels(labels, []string{"ocsp_server", "ca_issuer"}), nil,
+		),
+		subjectDN: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cert_subject_dn"),
+			"The distinguished name of the subject of a peer certificate, in the format of RFC 2253",
+			concatLabels(labels, []string{"dn"}), nil,
+		),
+		issuerDN: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cert_issuer_dn"),
+			"The distinguished name of the issuer of a peer certificate, in the format of RFC 2253",
+			concatLabels(labels, []string{"dn"}), nil,
+		),
+		notAfterTimestamp: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cert_not_after_timestamp"),
+			"NotAfter expressed as a RFC3339 timestamp in the value label",
+			concatLabels(labels, []string{"value"}), nil,
+		),
+		notBeforeTimestamp: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cert_not_before_timestamp"),
+			"NotBefore expressed as a RFC3339 timestamp in the value label",
+			concatLabels(labels, []string{"value"}), nil,
+		),
+		maxPathLen: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "cert_max_path_len"),
+			"The path length constraint of a CA peer certificate. -1 if the path length is unconstrained",
+			labels, nil,
+		),
+	}
+}
+
+// getCertDescs returns the descriptors for the labels selected in the
+// module. Every label is included when there's no selection.
+func getCertDescs(selected config.CertLabels) *certDescs {
+	if len(selected) == 0 {
+		return defaultCertDescs
+	}
+
+	key := strings.Join(selected, ",")
+
+	certDescsCache.Lock()
+	defer certDescsCache.Unlock()
+
+	descs, ok := certDescsCache.descs[key]
+	if !ok {
+		descs = newCertDescs(selected)
+		certDescsCache.descs[key] = descs
+	}
+
+	return descs
+}
+
+// labelValues returns the values of the selected labels for the certificate
+func (d *certDescs) labelValues(cert *x509.Certificate, sanLabels config.SANLabels) []string {
+	return d.selectLabelValues(getCertLabelValues(cert, sanLabels))
+}
+
+// selectLabelValues returns the values of the selected labels from the values
+// of every one of certLabels
+func (d *certDescs) selectLabelValues(all []string) []string {
+	values := make([]string, 0, len(d.indexes))
+	for _, i := range d.indexes {
+		values = append(values, all[i])
+	}
+
+	return values
+}
+
+// describe sends every descriptor to the channel
+func (d *certDescs) describe(ch chan<- *prometheus.Desc) {
+	ch <- d.notBefore
+	ch <- d.notAfter
+	ch <- d.verifiedNotBefore
+	ch <- d.verifiedNotAfter
+	ch <- d.weakSignature
+	ch <- d.uriSANsCount
+	ch <- d.aiaInfo
+	ch <- d.subjectDN
+	ch <- d.issuerDN
+	ch <- d.notAfterTimestamp
+	ch <- d.notBeforeTimestamp
+	ch <- d.maxPathLen
+}
+
+// concatLabels returns a new slice with the labels in a followed by those in b
+func concatLabels(a, b []string) []string {
+	labels := make([]string, 0, len(a)+len(b))
+	labels = append(labels, a...)
+	return append(labels, b...)
+}
@@ -1,17 +1,28 @@
 package config
 
 import (
+	"bytes"
+	"encoding/asn1"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	"github.com/prometheus/common/config"
 	yaml "gopkg.in/yaml.v3"
 )
 
 var (
 	DefaultConfig = &Config{
-		map[string]Module{
+		Modules: map[string]Module{
 			"tcp": Module{
 				Prober: "tcp",
 			},
@@ -21,6 +32,12 @@ var (
 			"https": Module{
 				Prober: "https",
 			},
+			"rdp": Module{
+				Prober: "rdp",
+			},
+			"mssql": Module{
+				Prober: "mssql",
+			},
 		},
 	}
 )
@@ -33,7 +50,42 @@ func LoadConfig(confFile string) (*Config, error) {
 		return c, fmt.Errorf("error reading config file: %s", err)
 	}
 	defer yamlReader.Close()
-	decoder := yaml.NewDecoder(yamlReader)
+
+	// JSON is a subset of YAML so it can be read by the YAML decoder, but TOML
+	// must be converted first
+	var reader io.Reader = yamlReader
+	if ext := strings.ToLower(filepath.Ext(confFile)); ext == ".toml" {
+		reader, err = tomlToYAML(yamlReader)
+		if err != nil {
+			return c, fmt.Errorf("error parsing config file: %s", err)
+		}
+	}
+
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return c, fmt.Errorf("error reading config file: %s", err)
+	}
+
+	// Merge the defaults into the modules before decoding, so that the
+	// merged modules are validated like any other. The document is only
+	// re-encoded when there are defaults, to keep the line numbers in errors
+	// accurate otherwise.
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return c, fmt.Errorf("error parsing config file: %s", err)
+	}
+	merged, err := applyDefaults(&doc)
+	if err != nil {
+		return c, fmt.Errorf("error parsing config file: %s", err)
+	}
+	if merged {
+		data, err = yaml.Marshal(&doc)
+		if err != nil {
+			return c, fmt.Errorf("error parsing config file: %s", err)
+		}
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
 	decoder.KnownFields(true)
 
 	if err = decoder.Decode(&c); err != nil {
@@ -44,23 +96,368 @@ func LoadConfig(confFile string) (*Config, error) {
 
 }
 
+// tomlToYAML converts a TOML document into YAML, so that it can be decoded
+// with the same field names and validation as a YAML config
+func tomlToYAML(r io.Reader) (io.Reader, error) {
+	var doc map[string]interface{}
+	if _, err := toml.DecodeReader(r, &doc); err != nil {
+		return nil, err
+	}
+
+	out, err := yaml.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(out), nil
+}
+
 type Config struct {
-	Modules map[string]Module `yaml:"modules"`
+	Defaults *Module           `yaml:"defaults,omitempty"`
+	Modules  map[string]Module `yaml:"modules"`
+	Targets  []Target          `yaml:"targets,omitempty"`
+}
+
+// Target is a target that the exporter probes on its own schedule
+type Target struct {
+	Target string `yaml:"target"`
+	Module string `yaml:"module,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for Config.
+func (c *Config) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Config
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+
+	// The sub-modules of an aggregate module are registered with the same
+	// registry, so their metrics must have the same labels
+	for name, module := range c.Modules {
+		if len(module.Aggregate) == 0 {
+			continue
+		}
+		first, ok := c.Modules[module.Aggregate[0].Module]
+		if !ok {
+			continue
+		}
+		for _, sub := range module.Aggregate[1:] {
+			if subModule, ok := c.Modules[sub.Module]; ok && !subModule.CertLabels.Equal(first.CertLabels) {
+				return fmt.Errorf("the sub-modules %q and %q of the aggregate module %q have different cert_labels, but the sub-modules of an aggregate module must have the same cert_labels", module.Aggregate[0].Module, sub.Module, name)
+			}
+		}
+	}
+
+	// The targets are registered with the same registry, so their metrics
+	// must have the same labels
+	var first *Target
+	for i, t := range c.Targets {
+		module, ok := c.Modules[t.moduleName()]
+		if !ok {
+			continue
+		}
+		if first == nil {
+			first = &c.Targets[i]
+			continue
+		}
+		if !module.CertLabels.Equal(c.Modules[first.moduleName()].CertLabels) {
+			return fmt.Errorf("the modules of targets %q and %q have different cert_labels, but the targets in the configuration must have the same cert_labels", first.Target, t.Target)
+		}
+	}
+
+	return nil
+}
+
+// moduleName returns the name of the module that the target is probed with
+func (t Target) moduleName() string {
+	if t.Module == "" {
+		return "tcp"
+	}
+	return t.Module
 }
 
 type Module struct {
-	Prober    string           `yaml:"prober,omitempty"`
-	TLSConfig config.TLSConfig `yaml:"tls_config,omitempty"`
-	HTTPS     HTTPSProbe       `yaml:"https,omitempty"`
-	TCP       TCPProbe         `yaml:"tcp,omitempty"`
+	Prober             string           `yaml:"prober,omitempty"`
+	TLSConfig          config.TLSConfig `yaml:"tls_config,omitempty"`
+	ClientCertificates []ClientCert     `yaml:"client_certificates,omitempty"`
+	HTTPS              HTTPSProbe       `yaml:"https,omitempty"`
+	TCP                TCPProbe         `yaml:"tcp,omitempty"`
+	OpenVPN            OpenVPNProbe     `yaml:"openvpn,omitempty"`
+	Cassandra          CassandraProbe   `yaml:"cassandra,omitempty"`
+	WebSocket          WebSocketProbe   `yaml:"websocket,omitempty"`
+	RFC3339Timestamps  bool             `yaml:"rfc3339_timestamps,omitempty"`
+	ProbeAllIPs        bool             `yaml:"probe_all_ips,omitempty"`
+	Resolver           string           `yaml:"resolver,omitempty"`
+	Socket             SocketOptions    `yaml:"socket,omitempty"`
+	FetchIntermediates bool             `yaml:"fetch_intermediates,omitempty"`
+	PinSPKISHA256      []string         `yaml:"pin_spki_sha256,omitempty"`
+	PinSPKIStrict      bool             `yaml:"pin_spki_strict,omitempty"`
+	ExpectedNotSerial  string           `yaml:"expected_not_serial,omitempty"`
+	RequireALPN        string           `yaml:"require_alpn,omitempty"`
+	MinDaysValid       int              `yaml:"min_days_valid,omitempty"`
+	MinDaysValidFail   bool             `yaml:"min_days_valid_fail,omitempty"`
+	RenewBefore        time.Duration    `yaml:"renew_before,omitempty"`
+	ServerNames        []string         `yaml:"server_names,omitempty"`
+	CheckTLS13         bool             `yaml:"check_tls13,omitempty"`
+	CheckSNIRequired   bool             `yaml:"check_sni_required,omitempty"`
+	VerifyCTInclusion  bool             `yaml:"verify_ct_inclusion,omitempty"`
+	CheckCAA           bool             `yaml:"check_caa,omitempty"`
+	CAAIssuerDomains   []string         `yaml:"caa_issuer_domains,omitempty"`
+	BrowserPolicy      []ValidityPolicy `yaml:"browser_policy,omitempty"`
+	SANLabels          SANLabels        `yaml:"san_labels,omitempty"`
+	SSHTunnel          SSHTunnel        `yaml:"ssh_tunnel,omitempty"`
+	ZeroOnFailure      bool             `yaml:"zero_on_failure,omitempty"`
+	CertLabels         CertLabels       `yaml:"cert_labels,omitempty"`
+	PrivateIPRanges    []CIDR           `yaml:"private_ip_ranges,omitempty"`
+	InternalSuffixes   []string         `yaml:"internal_suffixes,omitempty"`
+	EVPolicyOIDs       []OID            `yaml:"ev_policy_oids,omitempty"`
+	SHA1IncludeRoots   bool             `yaml:"sha1_include_roots,omitempty"`
+	ECH                ECH              `yaml:"ech,omitempty"`
+	Aggregate          []SubModule      `yaml:"aggregate,omitempty"`
+
+	// TLSVersion pins the version of TLS negotiated by the probers. It's
+	// set by the exporter for additional handshakes, rather than in the
+	// configuration.
+	TLSVersion uint16 `yaml:"-"`
 }
 
 type TCPProbe struct {
-	StartTLS string `yaml:"starttls,omitempty"`
+	StartTLS        string          `yaml:"starttls,omitempty"`
+	QueryResponse   []QueryResponse `yaml:"query_response,omitempty"`
+	ProtocolTimeout time.Duration   `yaml:"protocol_timeout,omitempty"`
+	ReadDeadline    time.Duration   `yaml:"read_deadline,omitempty"`
+}
+
+// QueryResponse is a step in a conversation with a tcp target. A step with
+// StartTLS set upgrades the connection to TLS after its expect and send have
+// been processed.
+type QueryResponse struct {
+	Expect   Regexp `yaml:"expect,omitempty"`
+	Send     string `yaml:"send,omitempty"`
+	StartTLS bool   `yaml:"starttls,omitempty"`
+}
+
+// OpenVPNProbe configures the openvpn prober. When TLSAuthKeyFile is set the
+// control channel packets are authenticated like OpenVPN's tls-auth option.
+// A nil KeyDirection uses the same key in both directions.
+type OpenVPNProbe struct {
+	TLSAuthKeyFile string `yaml:"tls_auth_key_file,omitempty"`
+	KeyDirection   *int   `yaml:"key_direction,omitempty"`
+	Auth           string `yaml:"auth,omitempty"`
+}
+
+// CassandraProbe configures the cassandra prober. SendOptions checks that a
+// node answers an OPTIONS request after the handshake.
+type CassandraProbe struct {
+	SendOptions bool `yaml:"send_options,omitempty"`
+}
+
+// WebSocketProbe configures the websocket prober.
+// RequireSwitchingProtocols fails the probe unless the target accepts the
+// upgrade.
+type WebSocketProbe struct {
+	RequireSwitchingProtocols bool `yaml:"require_switching_protocols,omitempty"`
+}
+
+// SSHTunnel configures an SSH bastion that the probers connect to the target
+// through
+type SSHTunnel struct {
+	Address        string `yaml:"address,omitempty"`
+	User           string `yaml:"user,omitempty"`
+	PrivateKeyFile string `yaml:"private_key_file,omitempty"`
+	KnownHostsFile string `yaml:"known_hosts_file,omitempty"`
+}
+
+// SubModule is a module that an aggregate module probes the target with. When
+// Port is set the target is probed on that port instead.
+type SubModule struct {
+	Module string `yaml:"module"`
+	Port   string `yaml:"port,omitempty"`
+}
+
+// ClientCert is a client certificate and its key. A module can have more than
+// one, and the first that the server accepts is sent.
+type ClientCert struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+}
+
+// SocketOptions are set on the sockets of the connections made for a probe.
+// DSCP marks the packets for QoS, in the TOS field of IPv4 packets or the
+// traffic class of IPv6 packets. Mark is the SO_MARK of the sockets, which is
+// only supported on Linux.
+type SocketOptions struct {
+	DSCP int `yaml:"dscp,omitempty"`
+	Mark int `yaml:"mark,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for SocketOptions.
+func (o *SocketOptions) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SocketOptions
+	var opts plain
+	if err := unmarshal(&opts); err != nil {
+		return err
+	}
+
+	if opts.DSCP < 0 || opts.DSCP > 63 {
+		return fmt.Errorf("dscp must be between 0 and 63, got %d", opts.DSCP)
+	}
+	if opts.Mark < 0 {
+		return fmt.Errorf("mark can't be negative, got %d", opts.Mark)
+	}
+	*o = SocketOptions(opts)
+	return nil
+}
+
+// Enabled returns whether any of the options are set
+func (o SocketOptions) Enabled() bool {
+	return o.DSCP != 0 || o.Mark != 0
+}
+
+// ECH configures Encrypted Client Hello. ConfigList is a base64 encoded
+// ECHConfigList. When FetchFromDNS is set, the list is taken from the HTTPS
+// record of the target instead.
+type ECH struct {
+	ConfigList   string `yaml:"config_list,omitempty"`
+	FetchFromDNS bool   `yaml:"fetch_from_dns,omitempty"`
+}
+
+// Enabled returns whether the module negotiates ECH
+func (e ECH) Enabled() bool {
+	return e.ConfigList != "" || e.FetchFromDNS
+}
+
+// ValidityPolicy is the longest validity period, in days, that browsers accept
+// for certificates issued from a date
+type ValidityPolicy struct {
+	IssuedFrom time.Time `yaml:"issued_from"`
+	MaxDays    int       `yaml:"max_days"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for ValidityPolicy.
+func (v *ValidityPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ValidityPolicy
+	var policy plain
+	if err := unmarshal(&policy); err != nil {
+		return err
+	}
+
+	if policy.IssuedFrom.IsZero() {
+		return fmt.Errorf("browser_policy entries must have an issued_from date")
+	}
+	if policy.MaxDays <= 0 {
+		return fmt.Errorf("max_days must be greater than 0, got %d", policy.MaxDays)
+	}
+	*v = ValidityPolicy(policy)
+	return nil
+}
+
+// SANLabels configures the format of the dnsnames, ips and emails labels
+type SANLabels struct {
+	Canonical  bool `yaml:"canonical,omitempty"`
+	TrimCommas bool `yaml:"trim_commas,omitempty"`
 }
 
 type HTTPSProbe struct {
-	ProxyURL URL `yaml:"proxy_url,omitempty"`
+	ProxyURL       URL  `yaml:"proxy_url,omitempty"`
+	IsolateStreams bool `yaml:"isolate_streams,omitempty"`
+	HSTS           bool `yaml:"hsts,omitempty"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for HTTPSProbe.
+func (h *HTTPSProbe) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain HTTPSProbe
+	var probe plain
+	if err := unmarshal(&probe); err != nil {
+		return err
+	}
+
+	if probe.IsolateStreams && probe.ProxyURL.URL != nil && !IsSOCKS5(probe.ProxyURL.URL) {
+		return fmt.Errorf("isolate_streams requires a socks5 or socks5h proxy_url, got %s", probe.ProxyURL.Scheme)
+	}
+	*h = HTTPSProbe(probe)
+	return nil
+}
+
+// IsSOCKS5 returns true if the proxy URL is for a SOCKS5 proxy
+func IsSOCKS5(u *url.URL) bool {
+	return u.Scheme == "socks5" || u.Scheme == "socks5h"
+}
+
+// CertLabelNames are the labels that identify a certificate in the metrics
+// about it
+var CertLabelNames = []string{"serial_no", "issuer_cn", "cn", "dnsnames", "ips", "emails", "ou"}
+
+// CertLabels is a selection of CertLabelNames that allows validation at
+// configuration load time
+type CertLabels []string
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for CertLabels.
+func (c *CertLabels) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var labels []string
+	if err := unmarshal(&labels); err != nil {
+		return err
+	}
+
+	for _, label := range labels {
+		valid := false
+		for _, name := range CertLabelNames {
+			if label == name {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return fmt.Errorf("unknown cert label %q, expected one of %s", label, strings.Join(CertLabelNames, ", "))
+		}
+	}
+
+	// Without both of these the certificates in a chain can have the same
+	// label values, and their metrics would collide
+	for _, required := range []string{"serial_no", "issuer_cn"} {
+		found := false
+		for _, label := range labels {
+			if label == required {
+				found = true
+				break
+			}
+		}
+		if len(labels) > 0 && !found {
+			return fmt.Errorf("cert_labels must include serial_no and issuer_cn, which tell the certificates in a chain apart")
+		}
+	}
+
+	*c = labels
+	return nil
+}
+
+// Equal returns true if the labels are the same as the other labels, in any
+// order. No labels are the same as all of CertLabelNames.
+func (c CertLabels) Equal(other CertLabels) bool {
+	a, b := c.set(), other.set()
+	if len(a) != len(b) {
+		return false
+	}
+	for label := range a {
+		if !b[label] {
+			return false
+		}
+	}
+	return true
+}
+
+// set returns the selected labels as a set
+func (c CertLabels) set() map[string]bool {
+	labels := []string(c)
+	if len(labels) == 0 {
+		labels = CertLabelNames
+	}
+
+	set := map[string]bool{}
+	for _, label := range labels {
+		set[label] = true
+	}
+	return set
 }
 
 // URL is a custom URL type that allows validation at configuration load time
@@ -82,3 +479,84 @@ func (u *URL) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	u.URL = urlp
 	return nil
 }
+
+// Regexp is a custom regexp type that allows validation at configuration load
+// time
+type Regexp struct {
+	*regexp.Regexp
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for Regexps.
+func (r *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	regex, err := regexp.Compile(s)
+	if err != nil {
+		return err
+	}
+	r.Regexp = regex
+	return nil
+}
+
+// CIDR is a custom IP network type that allows validation at configuration
+// load time
+type CIDR struct {
+	*net.IPNet
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for CIDRs.
+func (c *CIDR) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return err
+	}
+	c.IPNet = ipNet
+	return nil
+}
+
+// OID is a custom object identifier type that allows validation at
+// configuration load time. It's written in dotted form, like 2.23.140.1.1.
+type OID struct {
+	asn1.ObjectIdentifier
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface for OIDs.
+func (o *OID) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	oid, err := ParseOID(s)
+	if err != nil {
+		return err
+	}
+	o.ObjectIdentifier = oid
+	return nil
+}
+
+// ParseOID parses an object identifier in dotted form
+func ParseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+
+	var oid asn1.ObjectIdentifier
+	for _, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid = append(oid, n)
+	}
+	return oid, nil
+}
@@ -0,0 +1,498 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var (
+	testYAMLConfig = `modules:
+  tcp_smtp:
+    prober: tcp
+    tls_config:
+      insecure_skip_verify: true
+    tcp:
+      starttls: smtp
+      protocol_timeout: 5s
+      query_response:
+        - expect: "^220"
+`
+	testJSONConfig = `{
+  "modules": {
+    "tcp_smtp": {
+      "prober": "tcp",
+      "tls_config": {
+        "insecure_skip_verify": true
+      },
+      "tcp": {
+        "starttls": "smtp",
+        "protocol_timeout": "5s",
+        "query_response": [
+          {"expect": "^220"}
+        ]
+      }
+    }
+  }
+}
+`
+	testTOMLConfig = `[modules.tcp_smtp]
+prober = "tcp"
+
+[modules.tcp_smtp.tls_config]
+insecure_skip_verify = true
+
+[modules.tcp_smtp.tcp]
+starttls = "smtp"
+protocol_timeout = "5s"
+
+[[modules.tcp_smtp.tcp.query_response]]
+expect = "^220"
+`
+)
+
+// TestLoadConfigFormats tests that the same config can be loaded from YAML,
+// JSON and TOML files
+func TestLoadConfigFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	for name, contents := range map[string]string{
+		"config.yaml": testYAMLConfig,
+		"config.yml":  testYAMLConfig,
+		"config.json": testJSONConfig,
+		"config.toml": testTOMLConfig,
+	} {
+		file := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(file, []byte(contents), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		c, err := LoadConfig(file)
+		if err != nil {
+			t.Fatalf("error loading %s: %s", name, err)
+		}
+
+		module, ok := c.Modules["tcp_smtp"]
+		if !ok {
+			t.Fatalf("expected module tcp_smtp in %s", name)
+		}
+		if module.Prober != "tcp" {
+			t.Errorf("expected prober tcp in %s, got %s", name, module.Prober)
+		}
+		if !module.TLSConfig.InsecureSkipVerify {
+			t.Errorf("expected insecure_skip_verify in %s", name)
+		}
+		if module.TCP.StartTLS != "smtp" {
+			t.Errorf("expected starttls smtp in %s, got %s", name, module.TCP.StartTLS)
+		}
+		if module.TCP.ProtocolTimeout != 5*time.Second {
+			t.Errorf("expected protocol_timeout 5s in %s, got %s", name, module.TCP.ProtocolTimeout)
+		}
+		if len(module.TCP.QueryResponse) != 1 || module.TCP.QueryResponse[0].Expect.String() != "^220" {
+			t.Errorf("expected a query_response step in %s", name)
+		}
+	}
+}
+
+// TestLoadConfigTOMLUnknownField tests that unknown fields are rejected in
+// TOML as they are in YAML
+func TestLoadConfigTOMLUnknownField(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.toml")
+	if err := ioutil.WriteFile(file, []byte("[modules.tcp]\nprobr = \"tcp\"\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if _, err := LoadConfig(file); err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+}
+
+// TestLoadConfigCertLabels tests that cert_labels only accepts the labels of
+// the certificate metrics
+func TestLoadConfigCertLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("modules:\n  tcp:\n    cert_labels: [cn, serial_no, issuer_cn]\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	c, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if labels := c.Modules["tcp"].CertLabels; len(labels) != 3 || labels[0] != "cn" || labels[1] != "serial_no" || labels[2] != "issuer_cn" {
+		t.Errorf("expected cert_labels [cn serial_no issuer_cn], got %v", labels)
+	}
+
+	// Unknown labels, and selections that can't tell the certificates in a
+	// chain apart, are rejected
+	for _, labels := range []string{"[cn, sans, serial_no, issuer_cn]", "[cn, serial_no]", "[issuer_cn]", "[ou]"} {
+		if err := ioutil.WriteFile(file, []byte("modules:\n  tcp:\n    cert_labels: "+labels+"\n"), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if _, err := LoadConfig(file); err == nil {
+			t.Errorf("expected error for %s but err was nil", labels)
+		}
+	}
+}
+
+// TestLoadConfigTargetsCertLabels tests that the modules of the targets must
+// have the same cert_labels
+func TestLoadConfigTargetsCertLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	for _, tc := range []struct {
+		tcp, other string
+		valid      bool
+	}{
+		{"[cn, serial_no, issuer_cn]", "[issuer_cn, serial_no, cn]", true},
+		{"[]", "[serial_no, issuer_cn, cn, dnsnames, ips, emails, ou]", true},
+		{"[cn, serial_no, issuer_cn]", "[serial_no, issuer_cn]", false},
+		{"[]", "[serial_no, issuer_cn]", false},
+	} {
+		conf := "modules:\n  tcp:\n    cert_labels: " + tc.tcp + "\n  other:\n    cert_labels: " + tc.other + "\n" +
+			"targets:\n  - target: example.com:443\n  - target: example.org:443\n    module: other\n"
+		if err := ioutil.WriteFile(file, []byte(conf), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		_, err := LoadConfig(file)
+		if tc.valid && err != nil {
+			t.Errorf("unexpected error for %s and %s: %s", tc.tcp, tc.other, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("expected error for %s and %s but err was nil", tc.tcp, tc.other)
+		}
+	}
+}
+
+// TestLoadConfigAggregateCertLabels tests that the sub-modules of an aggregate
+// module must have the same cert_labels
+func TestLoadConfigAggregateCertLabels(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	for _, tc := range []struct {
+		tcp, https string
+		valid      bool
+	}{
+		{"[cn, serial_no, issuer_cn]", "[issuer_cn, serial_no, cn]", true},
+		{"[]", "[]", true},
+		{"[cn, serial_no, issuer_cn]", "[serial_no, issuer_cn]", false},
+		{"[]", "[serial_no, issuer_cn]", false},
+	} {
+		conf := "modules:\n  tcp:\n    prober: tcp\n    cert_labels: " + tc.tcp + "\n  https:\n    prober: https\n    cert_labels: " + tc.https + "\n" +
+			"  both:\n    prober: aggregate\n    aggregate:\n      - module: tcp\n      - module: https\n"
+		if err := ioutil.WriteFile(file, []byte(conf), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		_, err := LoadConfig(file)
+		if tc.valid && err != nil {
+			t.Errorf("unexpected error for %s and %s: %s", tc.tcp, tc.https, err)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("expected error for %s and %s but err was nil", tc.tcp, tc.https)
+		}
+	}
+}
+
+// TestLoadConfigBrowserPolicy tests that browser_policy entries need a date
+// and a positive number of days
+func TestLoadConfigBrowserPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("modules:\n  tcp:\n    browser_policy:\n      - issued_from: 2020-09-01\n        max_days: 398\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	c, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	policy := c.Modules["tcp"].BrowserPolicy
+	if len(policy) != 1 {
+		t.Fatalf("expected 1 browser_policy entry, got %d", len(policy))
+	}
+	if !policy[0].IssuedFrom.Equal(time.Date(2020, 9, 1, 0, 0, 0, 0, time.UTC)) || policy[0].MaxDays != 398 {
+		t.Errorf("unexpected browser_policy entry: %+v", policy[0])
+	}
+
+	for _, entry := range []string{"max_days: 398", "issued_from: 2020-09-01\n        max_days: 0"} {
+		if err := ioutil.WriteFile(file, []byte("modules:\n  tcp:\n    browser_policy:\n      - "+entry+"\n"), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if _, err := LoadConfig(file); err == nil {
+			t.Errorf("expected error for %q but err was nil", entry)
+		}
+	}
+}
+
+// TestLoadConfigPrivateIPRanges tests that private_ip_ranges only accepts
+// CIDRs
+func TestLoadConfigPrivateIPRanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("modules:\n  tcp:\n    private_ip_ranges: [10.0.0.0/8, \"fc00::/7\"]\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	c, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ranges := c.Modules["tcp"].PrivateIPRanges; len(ranges) != 2 || ranges[0].String() != "10.0.0.0/8" || ranges[1].String() != "fc00::/7" {
+		t.Errorf("expected private_ip_ranges [10.0.0.0/8 fc00::/7], got %v", ranges)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("modules:\n  tcp:\n    private_ip_ranges: [10.0.0.0]\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := LoadConfig(file); err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+}
+
+// TestLoadConfigEVPolicyOIDs tests that ev_policy_oids only accepts OIDs in
+// dotted form
+func TestLoadConfigEVPolicyOIDs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("modules:\n  tcp:\n    ev_policy_oids: [2.23.140.1.1, 1.3.6.1.4.1.4146.1.1]\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	c, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if oids := c.Modules["tcp"].EVPolicyOIDs; len(oids) != 2 || oids[0].String() != "2.23.140.1.1" || oids[1].String() != "1.3.6.1.4.1.4146.1.1" {
+		t.Errorf("expected ev_policy_oids [2.23.140.1.1 1.3.6.1.4.1.4146.1.1], got %v", oids)
+	}
+
+	for _, oid := range []string{"2", "2.23.x", "2..23", "2.-1"} {
+		if err := ioutil.WriteFile(file, []byte("modules:\n  tcp:\n    ev_policy_oids: [\""+oid+"\"]\n"), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if _, err := LoadConfig(file); err == nil {
+			t.Errorf("expected error for %s but err was nil", oid)
+		}
+	}
+}
+
+// TestLoadConfigIsolateStreams tests that isolate_streams can only be used
+// with a SOCKS5 proxy_url
+func TestLoadConfigIsolateStreams(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	for _, tc := range []struct {
+		proxyURL string
+		valid    bool
+	}{
+		{"socks5://127.0.0.1:9050", true},
+		{"socks5h://127.0.0.1:9050", true},
+		{"", true},
+		{"http://127.0.0.1:3128", false},
+	} {
+		conf := "modules:\n  https:\n    https:\n      isolate_streams: true\n"
+		if tc.proxyURL != "" {
+			conf += "      proxy_url: " + tc.proxyURL + "\n"
+		}
+		if err := ioutil.WriteFile(file, []byte(conf), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		c, err := LoadConfig(file)
+		if tc.valid && err != nil {
+			t.Errorf("unexpected error for %q: %s", tc.proxyURL, err)
+		}
+		if tc.valid && err == nil && !c.Modules["https"].HTTPS.IsolateStreams {
+			t.Errorf("expected isolate_streams to be set for %q", tc.proxyURL)
+		}
+		if !tc.valid && err == nil {
+			t.Errorf("expected error for %q but err was nil", tc.proxyURL)
+		}
+	}
+}
+
+// TestLoadConfigSocket tests that the dscp of the socket options is a six bit
+// value
+func TestLoadConfigSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte("modules:\n  tcp:\n    socket:\n      dscp: 46\n      mark: 10\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	c, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if socket := c.Modules["tcp"].Socket; socket.DSCP != 46 || socket.Mark != 10 {
+		t.Errorf("expected dscp 46 and mark 10, got %+v", socket)
+	}
+
+	for _, socket := range []string{"dscp: 64", "dscp: -1", "mark: -1"} {
+		if err := ioutil.WriteFile(file, []byte("modules:\n  tcp:\n    socket:\n      "+socket+"\n"), 0644); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if _, err := LoadConfig(file); err == nil {
+			t.Errorf("expected error for %q but err was nil", socket)
+		}
+	}
+}
+
+// TestLoadConfigDefaults tests merging the defaults block into the modules
+func TestLoadConfigDefaults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ssl_exporter")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(file, []byte(`
+defaults:
+  prober: tcp
+  tls_config:
+    ca_file: /etc/ssl/ca.pem
+    insecure_skip_verify: true
+  tcp:
+    starttls: smtp
+modules:
+  smtp:
+  imap:
+    tls_config:
+      server_name: ${host}
+      insecure_skip_verify: false
+    tcp:
+      starttls: imap
+  https:
+    prober: https
+`), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	c, err := LoadConfig(file)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	smtp := c.Modules["smtp"]
+	if smtp.Prober != "tcp" || smtp.TCP.StartTLS != "smtp" || smtp.TLSConfig.CAFile != "/etc/ssl/ca.pem" || !smtp.TLSConfig.InsecureSkipVerify {
+		t.Errorf("expected the smtp module to be the defaults, got %+v", smtp)
+	}
+
+	imap := c.Modules["imap"]
+	if imap.Prober != "tcp" || imap.TCP.StartTLS != "imap" || imap.TLSConfig.CAFile != "/etc/ssl/ca.pem" || imap.TLSConfig.InsecureSkipVerify || imap.TLSConfig.ServerName != "${host}" {
+		t.Errorf("expected the imap module to be merged with the defaults, got %+v", imap)
+	}
+
+	https := c.Modules["https"]
+	if https.Prober != "https" || https.TLSConfig.CAFile != "/etc/ssl/ca.pem" {
+		t.Errorf("expected the https module to be merged with the defaults, got %+v", https)
+	}
+
+	// The merged modules are validated
+	if err := ioutil.WriteFile(file, []byte("defaults:\n  probr: tcp\nmodules:\n  tcp:\n"), 0644); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := LoadConfig(file); err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+}
+
+// TestExpandModule tests deriving the settings of a module from the target
+func TestExpandModule(t *testing.T) {
+	module := Module{
+		TCP: TCPProbe{
+			QueryResponse: []QueryResponse{
+				{Send: "EHLO ${host}"},
+			},
+		},
+		ServerNames: []string{"www.${host}"},
+		Resolver:    "${host}:53",
+		SSHTunnel:   SSHTunnel{Address: "${host}:22"},
+	}
+	module.TLSConfig.ServerName = "${host}"
+	module.TLSConfig.CAFile = "/etc/ssl/${host}.pem"
+
+	for target, expected := range map[string][2]string{
+		"example.com:25":           {"example.com", "www.example.com"},
+		"https://example.com:8443": {"example.com", "www.example.com"},
+		"example.com":              {"example.com", "www.example.com"},
+	} {
+		expanded := ExpandModule(module, target)
+		if expanded.TLSConfig.ServerName != expected[0] {
+			t.Errorf("%s: expected server_name %q, got %q", target, expected[0], expanded.TLSConfig.ServerName)
+		}
+		if expanded.ServerNames[0] != expected[1] {
+			t.Errorf("%s: expected server_names %q, got %q", target, expected[1], expanded.ServerNames[0])
+		}
+
+		// Only the server names are expanded
+		if expanded.TLSConfig.CAFile != "/etc/ssl/${host}.pem" || expanded.Resolver != "${host}:53" || expanded.SSHTunnel.Address != "${host}:22" || expanded.TCP.QueryResponse[0].Send != "EHLO ${host}" {
+			t.Errorf("%s: expected the other settings to be unchanged, got %+v", target, expanded)
+		}
+	}
+
+	if expanded := ExpandModule(Module{ServerNames: []string{"${port}.${target}"}}, "example.com:25"); expanded.ServerNames[0] != "25.example.com:25" {
+		t.Errorf("expected the port and target to be expanded, got %q", expanded.ServerNames[0])
+	}
+
+	// The module that was expanded is left alone
+	if module.TLSConfig.ServerName != "${host}" || module.ServerNames[0] != "www.${host}" {
+		t.Errorf("expected the original module to be unchanged, got %+v", module)
+	}
+}
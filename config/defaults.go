@@ -0,0 +1,155 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// applyDefaults merges the defaults block of a config document into every
+// module in it. Settings in a module take precedence over the defaults and
+// nested blocks are merged key by key, so a module only has to give the
+// settings that differ. It returns whether the document was changed.
+func applyDefaults(doc *yaml.Node) (bool, error) {
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return false, nil
+	}
+	root := resolveAlias(doc.Content[0])
+	if root.Kind != yaml.MappingNode {
+		return false, nil
+	}
+
+	defaults := mappingValue(root, "defaults")
+	if defaults == nil {
+		return false, nil
+	}
+	if defaults.Kind != yaml.MappingNode {
+		return false, fmt.Errorf("line %d: defaults must be a mapping", defaults.Line)
+	}
+
+	modules := mappingValue(root, "modules")
+	if modules == nil {
+		return false, nil
+	}
+	if modules.Kind != yaml.MappingNode {
+		return false, fmt.Errorf("line %d: modules must be a mapping", modules.Line)
+	}
+
+	for i := 1; i < len(modules.Content); i += 2 {
+		module := resolveAlias(modules.Content[i])
+		if module.Kind == yaml.ScalarNode && module.Tag == "!!null" {
+			module = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		}
+		if module.Kind != yaml.MappingNode {
+			return false, fmt.Errorf("line %d: module %q must be a mapping", module.Line, modules.Content[i-1].Value)
+		}
+		modules.Content[i] = mergeMappings(module, defaults)
+	}
+
+	return true, nil
+}
+
+// mergeMappings returns a copy of the mapping with the keys that are only in
+// the defaults added to it. Mappings under the same key are merged in the same
+// way.
+func mergeMappings(mapping, defaults *yaml.Node) *yaml.Node {
+	merged := copyNode(mapping)
+	for i := 0; i+1 < len(defaults.Content); i += 2 {
+		key, value := defaults.Content[i], resolveAlias(defaults.Content[i+1])
+
+		existing := mappingValue(merged, key.Value)
+		if existing == nil {
+			merged.Content = append(merged.Content, copyNode(key), copyNode(value))
+			continue
+		}
+		if existing.Kind == yaml.MappingNode && value.Kind == yaml.MappingNode {
+			for j := 1; j < len(merged.Content); j += 2 {
+				if merged.Content[j-1].Value == key.Value {
+					merged.Content[j] = mergeMappings(existing, value)
+				}
+			}
+		}
+	}
+
+	return merged
+}
+
+// mappingValue returns the value of the key in the mapping, or nil when the
+// key isn't in it
+func mappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return resolveAlias(mapping.Content[i+1])
+		}
+	}
+	return nil
+}
+
+// resolveAlias returns the node that an alias refers to
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+// copyNode returns a deep copy of the node with its aliases resolved, so that
+// merging into it doesn't change the nodes it was copied from
+func copyNode(node *yaml.Node) *yaml.Node {
+	node = resolveAlias(node)
+
+	c := *node
+	c.Anchor = ""
+	c.Content = make([]*yaml.Node, len(node.Content))
+	for i, n := range node.Content {
+		c.Content[i] = copyNode(n)
+	}
+
+	return &c
+}
+
+// ExpandModule returns a copy of the module with ${host}, ${port} and
+// ${target} in its server_name and server_names replaced by the host, port and
+// whole of the target, so that one module can serve many targets that differ
+// only in those. The port is empty when the target doesn't have one. Other
+// settings are left alone, so that a target can't pick the files, tunnel or
+// resolver that a module uses.
+func ExpandModule(module Module, target string) Module {
+	host, port := splitTarget(target)
+	replacer := strings.NewReplacer(
+		"${host}", host,
+		"${port}", port,
+		"${target}", target,
+	)
+
+	module.TLSConfig.ServerName = replacer.Replace(module.TLSConfig.ServerName)
+
+	// The module shares the slice with the config, so it's copied before
+	// it's changed
+	if len(module.ServerNames) > 0 {
+		serverNames := make([]string, len(module.ServerNames))
+		for i, serverName := range module.ServerNames {
+			serverNames[i] = replacer.Replace(serverName)
+		}
+		module.ServerNames = serverNames
+	}
+
+	return module
+}
+
+// splitTarget returns the host and port of a target, which may be a URL or a
+// host:port address
+func splitTarget(target string) (string, string) {
+	if strings.Contains(target, "://") {
+		if u, err := url.Parse(target); err == nil {
+			return u.Hostname(), u.Port()
+		}
+	}
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		return host, port
+	}
+	return target, ""
+}
@@ -0,0 +1,25 @@
+//go:build go1.23
+// +build go1.23
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+)
+
+// getECHAccepted returns whether the target accepted the encrypted client
+// hello
+func getECHAccepted(state *tls.ConnectionState) (float64, bool) {
+	if state.ECHAccepted {
+		return 1, true
+	}
+	return 0, true
+}
+
+// isECHRejected returns whether the handshake failed because the target
+// rejected the encrypted client hello
+func isECHRejected(err error) bool {
+	var echErr *tls.ECHRejectionError
+	return errors.As(err, &echErr)
+}
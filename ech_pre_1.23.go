@@ -0,0 +1,20 @@
+//go:build !go1.23
+// +build !go1.23
+
+package main
+
+import (
+	"crypto/tls"
+)
+
+// getECHAccepted always returns false because ECH isn't supported by
+// crypto/tls before go 1.23
+func getECHAccepted(state *tls.ConnectionState) (float64, bool) {
+	return 0, false
+}
+
+// isECHRejected always returns false because ECH isn't supported by
+// crypto/tls before go 1.23
+func isECHRejected(err error) bool {
+	return false
+}
@@ -0,0 +1,83 @@
+//go:build go1.24
+// +build go1.24
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestProbeHandlerECH tests that ssl_tls_ech_accepted is exported when ECH is
+// accepted and rejected, and not at all when it isn't enabled
+func TestProbeHandlerECH(t *testing.T) {
+	configList, key, err := test.GenerateECHKey(1, "example-2.ribbybibby.me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherConfigList, _, err := test.GenerateECHKey(2, "example-2.ribbybibby.me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		configList string
+		expected   []string
+	}{
+		{
+			configList: base64.StdEncoding.EncodeToString(configList),
+			expected:   []string{"ssl_tls_ech_accepted 1", "ssl_tls_connect_success 1"},
+		},
+		{
+			configList: base64.StdEncoding.EncodeToString(otherConfigList),
+			expected:   []string{"ssl_tls_ech_accepted 0", `ssl_probe_failure_reason{reason="ech_rejected"} 1`},
+		},
+		{
+			expected: []string{"ssl_tls_connect_success 1"},
+		},
+	} {
+		server, _, _, caFile, teardown, err := test.SetupTCPServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.TLS.EncryptedClientHelloKeys = []tls.EncryptedClientHelloKey{key}
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"ech": config.Module{
+					Prober: "tcp",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile:     caFile,
+						ServerName: "example.ribbybibby.me",
+					},
+					ECH: config.ECH{
+						ConfigList: tc.configList,
+					},
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "ech", conf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		teardown()
+
+		for _, expected := range tc.expected {
+			if !strings.Contains(rr.Body.String(), expected) {
+				t.Errorf("expected `%s` in:\n%s", expected, rr.Body.String())
+			}
+		}
+		if tc.configList == "" && strings.Contains(rr.Body.String(), "ssl_tls_ech_accepted") {
+			t.Errorf("unexpected `ssl_tls_ech_accepted` without ECH enabled")
+		}
+	}
+}
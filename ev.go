@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// evPolicyOIDs are the certificate policies that mark a certificate as
+// extended validation: the CA/Browser Forum's own and those of the larger
+// CAs that predate it. Modules can give other policies with ev_policy_oids.
+var evPolicyOIDs = mustParseOIDs(
+	"2.23.140.1.1",
+	"2.16.840.1.114412.2.1",
+	"2.16.840.1.114028.10.1.2",
+	"1.3.6.1.4.1.4146.1.1",
+	"1.3.6.1.4.1.6449.1.2.1.5.1",
+	"2.16.840.1.114413.1.7.23.3",
+	"2.16.840.1.114414.1.7.23.3",
+	"1.3.6.1.4.1.8024.0.2.100.1.2",
+	"2.16.840.1.113733.1.7.23.6",
+	"1.3.6.1.4.1.14370.1.6",
+	"2.16.756.1.89.1.2.1.1",
+)
+
+// oidJurisdiction is the arc of the jurisdictionLocalityName,
+// jurisdictionStateOrProvinceName and jurisdictionCountryName attributes that
+// EV certificates have in their subject
+var oidJurisdiction = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 60, 2, 1}
+
+func mustParseOIDs(oids ...string) []config.OID {
+	var parsed []config.OID
+	for _, s := range oids {
+		oid, err := config.ParseOID(s)
+		if err != nil {
+			panic(err)
+		}
+		parsed = append(parsed, config.OID{ObjectIdentifier: oid})
+	}
+	return parsed
+}
+
+// getIsEV returns 1 if the certificate looks like an extended validation
+// certificate: it asserts one of the EV policies, or one of the default
+// policies when there aren't any, and its subject has an organization and a
+// jurisdiction. It isn't authoritative, as that depends on the policies each
+// root is trusted for.
+func getIsEV(cert *x509.Certificate, oids []config.OID) float64 {
+	if len(oids) == 0 {
+		oids = evPolicyOIDs
+	}
+
+	var hasPolicy bool
+	for _, policy := range cert.PolicyIdentifiers {
+		for _, oid := range oids {
+			if policy.Equal(oid.ObjectIdentifier) {
+				hasPolicy = true
+			}
+		}
+	}
+	if !hasPolicy || len(cert.Subject.Organization) == 0 {
+		return 0
+	}
+
+	for _, name := range cert.Subject.Names {
+		if len(name.Type) == len(oidJurisdiction)+1 && name.Type[:len(oidJurisdiction)].Equal(oidJurisdiction) {
+			return 1
+		}
+	}
+	return 0
+}
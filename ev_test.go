@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"strings"
+	"testing"
+	"time"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+var oidJurisdictionCountry = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 60, 2, 1, 3}
+
+func TestGetIsEV(t *testing.T) {
+	ev := asn1.ObjectIdentifier{2, 23, 140, 1, 1}
+	ov := asn1.ObjectIdentifier{2, 23, 140, 1, 2, 2}
+	custom := asn1.ObjectIdentifier{1, 2, 3, 4}
+	jurisdiction := []pkix.AttributeTypeAndValue{{Type: oidJurisdictionCountry, Value: "GB"}}
+
+	for _, tc := range []struct {
+		name         string
+		policies     []asn1.ObjectIdentifier
+		organization []string
+		names        []pkix.AttributeTypeAndValue
+		oids         []config.OID
+		expected     float64
+	}{
+		{"ev", []asn1.ObjectIdentifier{ov, ev}, []string{"Example Ltd"}, jurisdiction, nil, 1},
+		{"no policies", nil, []string{"Example Ltd"}, jurisdiction, nil, 0},
+		{"ov", []asn1.ObjectIdentifier{ov}, []string{"Example Ltd"}, jurisdiction, nil, 0},
+		{"no organization", []asn1.ObjectIdentifier{ev}, nil, jurisdiction, nil, 0},
+		{"no jurisdiction", []asn1.ObjectIdentifier{ev}, []string{"Example Ltd"}, nil, nil, 0},
+		{"configured policy", []asn1.ObjectIdentifier{custom}, []string{"Example Ltd"}, jurisdiction, mustParseOIDs("1.2.3.4"), 1},
+		{"default policy not configured", []asn1.ObjectIdentifier{ev}, []string{"Example Ltd"}, jurisdiction, mustParseOIDs("1.2.3.4"), 0},
+	} {
+		cert := &x509.Certificate{
+			PolicyIdentifiers: tc.policies,
+			Subject: pkix.Name{
+				Organization: tc.organization,
+				Names:        tc.names,
+			},
+		}
+		if got := getIsEV(cert, tc.oids); got != tc.expected {
+			t.Errorf("%s: expected %v but got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+// TestProbeHandlerIsEV tests ssl_cert_is_ev for a certificate with the EV
+// policy and a jurisdiction in its subject, and for the test certificate,
+// which has neither
+func TestProbeHandlerIsEV(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 1))
+	tmpl.PolicyIdentifiers = []asn1.ObjectIdentifier{{2, 23, 140, 1, 1}}
+	tmpl.Subject.ExtraNames = []pkix.AttributeTypeAndValue{{Type: oidJurisdictionCountry, Value: "GB"}}
+	_, evCertPEM := test.GenerateSelfSignedCertificateWithPrivateKey(tmpl, key)
+	evKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	dvCertPEM, dvKeyPEM := test.GenerateTestCertificate(time.Now().AddDate(0, 0, 1))
+
+	for _, tc := range []struct {
+		certPEM, keyPEM []byte
+		expected        string
+	}{
+		{evCertPEM, evKeyPEM, "ssl_cert_is_ev 1"},
+		{dvCertPEM, dvKeyPEM, "ssl_cert_is_ev 0"},
+	} {
+		server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(tc.certPEM, tc.certPEM, tc.keyPEM)
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"tcp": config.Module{
+					Prober:    "tcp",
+					TLSConfig: pconfig.TLSConfig{CAFile: caFile},
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		server.Close()
+		teardown()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.Contains(rr.Body.String(), tc.expected) {
+			t.Errorf("expected `%s`", tc.expected)
+		}
+	}
+}
@@ -0,0 +1,17 @@
+//go:build go1.25
+// +build go1.25
+
+package main
+
+import (
+	"crypto/tls"
+)
+
+// getKeyExchange returns the name of the group negotiated for the key
+// exchange, if there was one
+func getKeyExchange(state *tls.ConnectionState) (string, bool) {
+	if state.CurveID == 0 {
+		return "", false
+	}
+	return state.CurveID.String(), true
+}
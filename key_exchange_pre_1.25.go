@@ -0,0 +1,14 @@
+//go:build !go1.25
+// +build !go1.25
+
+package main
+
+import (
+	"crypto/tls"
+)
+
+// getKeyExchange always returns false because the negotiated group isn't
+// exposed in the connection state before go 1.25
+func getKeyExchange(state *tls.ConnectionState) (string, bool) {
+	return "", false
+}
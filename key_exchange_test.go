@@ -0,0 +1,46 @@
+//go:build go1.25
+// +build go1.25
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestProbeHandlerKeyExchange tests that the negotiated group is exported when
+// it is available
+func TestProbeHandlerKeyExchange(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_tls_key_exchange_info{group=\""); !ok {
+		t.Errorf("expected `ssl_tls_key_exchange_info`")
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/prober"
+)
+
+// pushGateway is a Prometheus Pushgateway that oneshot pushes the metrics of
+// the probe to, for probes run by cron jobs that exit before they could be
+// scraped
+type pushGateway struct {
+	url string
+	job string
+
+	// grouping are the labels of the group the metrics are pushed to, in
+	// addition to the job. The instance label is the target unless it's set.
+	grouping map[string]string
+}
+
+// push replaces the metrics in the group of the target with the ones gathered
+// by g
+func (p *pushGateway) push(target string, g prometheus.Gatherer) error {
+	pusher := push.New(p.url, p.job).Gatherer(g)
+	if _, ok := p.grouping["instance"]; !ok {
+		pusher = pusher.Grouping("instance", target)
+	}
+	for name, value := range p.grouping {
+		pusher = pusher.Grouping(name, value)
+	}
+
+	if err := pusher.Push(); err != nil {
+		return fmt.Errorf("error pushing to the Pushgateway: %s", err)
+	}
+	return nil
+}
+
+// oneshot probes the target once with the given module, writes the metrics to
+// out in the Prometheus text format, pushes them to the gateway when it isn't
+// nil and returns whether the probe was a success
+func oneshot(out io.Writer, target, moduleName string, conf *config.Config, timeout time.Duration, gateway *pushGateway) (bool, error) {
+	if moduleName == "" {
+		moduleName = "tcp"
+	}
+	module, ok := conf.Modules[moduleName]
+	if !ok {
+		return false, fmt.Errorf("Unknown module %q", moduleName)
+	}
+
+	if target == "" {
+		return false, fmt.Errorf("Target parameter is missing")
+	}
+
+	probeFn, ok := prober.Probers[module.Prober]
+	if !ok {
+		return false, fmt.Errorf("Unknown prober %q", module.Prober)
+	}
+
+	exporter := &Exporter{
+		target:     target,
+		prober:     probeFn,
+		timeout:    timeout,
+		module:     config.ExpandModule(module, target),
+		moduleName: moduleName,
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(exporter)
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		return false, err
+	}
+
+	success := false
+	enc := expfmt.NewEncoder(out, expfmt.FmtText)
+	for _, mf := range mfs {
+		if mf.GetName() == prometheus.BuildFQName(namespace, "", "tls_connect_success") {
+			for _, m := range mf.GetMetric() {
+				if m.GetGauge().GetValue() == 1 {
+					success = true
+				}
+			}
+		}
+		if err := enc.Encode(mf); err != nil {
+			return false, err
+		}
+	}
+
+	// Push the metrics that were printed, rather than probing again
+	if gateway != nil {
+		gatherer := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return mfs, nil
+		})
+		if err := gateway.push(target, gatherer); err != nil {
+			return success, err
+		}
+	}
+
+	return success, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestOneshot tests a successful oneshot probe
+func TestOneshot(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	out := &bytes.Buffer{}
+	success, err := oneshot(out, server.Listener.Addr().String(), "tcp", conf, 10*time.Second, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if !success {
+		t.Errorf("expected the probe to succeed")
+	}
+
+	if ok := strings.Contains(out.String(), "ssl_tls_connect_success 1"); !ok {
+		t.Errorf("expected `ssl_tls_connect_success 1`")
+	}
+}
+
+// TestOneshotNoServer tests that a failed oneshot probe is reported as such
+func TestOneshotNoServer(t *testing.T) {
+	out := &bytes.Buffer{}
+	success, err := oneshot(out, "localhost:6666", "tcp", config.DefaultConfig, 10*time.Second, nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if success {
+		t.Errorf("expected the probe to fail")
+	}
+
+	if ok := strings.Contains(out.String(), "ssl_tls_connect_success 0"); !ok {
+		t.Errorf("expected `ssl_tls_connect_success 0`")
+	}
+}
+
+// TestOneshotPushGateway tests pushing the metrics of a oneshot probe to a
+// Pushgateway
+func TestOneshotPushGateway(t *testing.T) {
+	var (
+		method, path string
+		body         []byte
+	)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		method, path = r.Method, r.URL.Path
+		body, _ = ioutil.ReadAll(r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer gateway.Close()
+
+	tests := []struct {
+		grouping map[string]string
+		labels   map[string]string
+	}{
+		{nil, map[string]string{"job": "ssl_exporter", "instance": "localhost:6666"}},
+		{map[string]string{"instance": "cron"}, map[string]string{"job": "ssl_exporter", "instance": "cron"}},
+		{map[string]string{"env": "prod"}, map[string]string{"job": "ssl_exporter", "instance": "localhost:6666", "env": "prod"}},
+	}
+
+	for _, tt := range tests {
+		out := &bytes.Buffer{}
+		_, err := oneshot(out, "localhost:6666", "tcp", config.DefaultConfig, 10*time.Second, &pushGateway{
+			url:      gateway.URL,
+			job:      "ssl_exporter",
+			grouping: tt.grouping,
+		})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if method != http.MethodPut {
+			t.Errorf("expected a PUT request, got %s", method)
+		}
+		// The order of the grouping labels in the path isn't fixed
+		labels := map[string]string{}
+		parts := strings.Split(strings.TrimPrefix(path, "/metrics/"), "/")
+		for i := 0; i+1 < len(parts); i += 2 {
+			labels[parts[i]] = parts[i+1]
+		}
+		if !reflect.DeepEqual(labels, tt.labels) {
+			t.Errorf("expected the grouping labels %v, got %v from %s", tt.labels, labels, path)
+		}
+		if !bytes.Contains(body, []byte("ssl_tls_connect_success")) {
+			t.Errorf("expected ssl_tls_connect_success in the pushed metrics")
+		}
+		if !strings.Contains(out.String(), "ssl_tls_connect_success 0") {
+			t.Errorf("expected `ssl_tls_connect_success 0` in the output")
+		}
+	}
+}
+
+// TestOneshotPushGatewayError tests that an error from the Pushgateway is
+// returned
+func TestOneshotPushGatewayError(t *testing.T) {
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer gateway.Close()
+
+	out := &bytes.Buffer{}
+	if _, err := oneshot(out, "localhost:6666", "tcp", config.DefaultConfig, 10*time.Second, &pushGateway{url: gateway.URL, job: "ssl_exporter"}); err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+}
+
+// TestOneshotUnknownModule tests that an unknown module returns an error
+func TestOneshotUnknownModule(t *testing.T) {
+	out := &bytes.Buffer{}
+	if _, err := oneshot(out, "localhost:6666", "unknown", config.DefaultConfig, 10*time.Second, nil); err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+}
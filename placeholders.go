@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/x509"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// defaultPlaceholderRetention is how long the labels of the certificates of a
+// target are remembered after its last successful probe, by default
+const defaultPlaceholderRetention = 24 * time.Hour
+
+// lastCertLabels remembers the labels of the peer certificates from the last
+// successful probe of each target with a module that has zero_on_failure set
+var lastCertLabels = newCertLabelCache(defaultPlaceholderRetention)
+
+// placeholderLabels are the values of every one of certLabels for the
+// certificates seen by the last successful probe of a target, and their
+// positions in the chain it presented
+type placeholderLabels struct {
+	labels       [][]string
+	chainIndexes []int
+	seen         time.Time
+}
+
+// certLabelCache holds the values of every one of certLabels for the
+// certificates, by module and target. Targets that haven't been probed
+// successfully for the retention period are forgotten, unless it's 0.
+type certLabelCache struct {
+	retention time.Duration
+
+	mtx    sync.Mutex
+	labels map[string]placeholderLabels
+}
+
+func newCertLabelCache(retention time.Duration) *certLabelCache {
+	return &certLabelCache{
+		retention: retention,
+		labels:    map[string]placeholderLabels{},
+	}
+}
+
+// record replaces the labels remembered for the target with those of the
+// certificates, which are at the given positions in the chain
+func (c *certLabelCache) record(target, module string, certs []*x509.Certificate, chainIndexes []int, sanLabels config.SANLabels) {
+	now := time.Now()
+
+	var labels [][]string
+	for _, cert := range certs {
+		labels = append(labels, getCertLabelValues(cert, sanLabels))
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.labels[module+"/"+target] = placeholderLabels{labels: labels, chainIndexes: chainIndexes, seen: now}
+
+	c.prune(now)
+}
+
+// get returns the labels remembered for the target and the positions of the
+// certificates in the chain
+func (c *certLabelCache) get(target, module string) ([][]string, []int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.prune(time.Now())
+
+	labels := c.labels[module+"/"+target]
+	return labels.labels, labels.chainIndexes
+}
+
+// prune forgets the targets that haven't been probed successfully within the
+// retention period. The caller must hold the lock.
+func (c *certLabelCache) prune(now time.Time) {
+	if c.retention <= 0 {
+		return
+	}
+	for key, labels := range c.labels {
+		if now.Sub(labels.seen) > c.retention {
+			delete(c.labels, key)
+		}
+	}
+}
+
+// collectPlaceholders emits ssl_cert_not_after and ssl_cert_not_before with a
+// value of 0 for the certificates seen by the last successful probe, so that
+// the series don't disappear when a probe fails
+func (e *Exporter) collectPlaceholders(ch chan<- prometheus.Metric) {
+	if !e.module.ZeroOnFailure {
+		return
+	}
+	descs := getCertDescs(e.module.CertLabels)
+	certLabels, chainIndexes := lastCertLabels.get(e.target, e.moduleName)
+	for i, labels := range certLabels {
+		labels = append(descs.selectLabelValues(labels), strconv.Itoa(chainIndexes[i]))
+		ch <- prometheus.MustNewConstMetric(descs.notAfter, prometheus.GaugeValue, 0, labels...)
+		ch <- prometheus.MustNewConstMetric(descs.notBefore, prometheus.GaugeValue, 0, labels...)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// TestCertLabelCache tests that the labels of the certificates of a target
+// are remembered until it hasn't been probed successfully for the retention
+// period
+func TestCertLabelCache(t *testing.T) {
+	cert := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+	}
+
+	cache := newCertLabelCache(time.Hour)
+	cache.record("example.com:443", "tcp", []*x509.Certificate{cert}, []int{0}, config.SANLabels{})
+	cache.record("example.org:443", "tcp", []*x509.Certificate{cert}, []int{0}, config.SANLabels{})
+
+	if labels, _ := cache.get("example.com:443", "tcp"); len(labels) != 1 {
+		t.Fatalf("expected the labels of 1 certificate, got %d", len(labels))
+	}
+	if labels, _ := cache.get("example.com:443", "https"); len(labels) != 0 {
+		t.Errorf("expected no labels for a different module, got %d", len(labels))
+	}
+
+	// Age one of the targets beyond the retention period
+	cache.mtx.Lock()
+	labels := cache.labels["tcp/example.org:443"]
+	labels.seen = time.Now().Add(-2 * time.Hour)
+	cache.labels["tcp/example.org:443"] = labels
+	cache.mtx.Unlock()
+
+	if labels, _ := cache.get("example.org:443", "tcp"); len(labels) != 0 {
+		t.Errorf("expected the labels to be forgotten after the retention period, got %d", len(labels))
+	}
+	if len(cache.labels) != 1 {
+		t.Errorf("expected 1 target to be remembered, got %d", len(cache.labels))
+	}
+
+	// Targets are never forgotten without a retention period
+	cache = newCertLabelCache(0)
+	cache.record("example.com:443", "tcp", []*x509.Certificate{cert}, []int{0}, config.SANLabels{})
+	cache.mtx.Lock()
+	labels = cache.labels["tcp/example.com:443"]
+	labels.seen = time.Now().Add(-24 * 365 * time.Hour)
+	cache.labels["tcp/example.com:443"] = labels
+	cache.mtx.Unlock()
+
+	if labels, _ := cache.get("example.com:443", "tcp"); len(labels) != 1 {
+		t.Errorf("expected the labels to be remembered without a retention period, got %d", len(labels))
+	}
+}
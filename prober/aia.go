@@ -0,0 +1,183 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+const (
+	// maxAIAFetches limits the number of issuers that will be fetched to
+	// complete a single chain
+	maxAIAFetches = 4
+
+	// maxAIACertSize limits the size of a fetched issuer certificate
+	maxAIACertSize = 1 << 16
+)
+
+// aiaVerifier verifies the peer certificates in place of crypto/tls,
+// fetching missing intermediates from the caIssuers URL in the Authority
+// Information Access extension of the certificates
+type aiaVerifier struct {
+	ctx        context.Context
+	client     *http.Client
+	roots      *x509.CertPool
+	serverName string
+	chains     [][]*x509.Certificate
+	fetched    bool
+}
+
+// newAIAVerifier takes over verification from the tls.Config when the module
+// enables fetch_intermediates. It returns nil when it isn't needed.
+func newAIAVerifier(ctx context.Context, tlsConfig *tls.Config, module config.Module, serverName string, timeout time.Duration) *aiaVerifier {
+	if !module.FetchIntermediates || tlsConfig.InsecureSkipVerify {
+		return nil
+	}
+
+	v := &aiaVerifier{
+		ctx: ctx,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       newDialer(module, timeout).DialContext,
+				DisableKeepAlives: true,
+			},
+			Timeout: timeout,
+		},
+		roots:      tlsConfig.RootCAs,
+		serverName: serverName,
+	}
+
+	tlsConfig.InsecureSkipVerify = true
+	tlsConfig.VerifyPeerCertificate = v.verifyPeerCertificate
+
+	return v
+}
+
+// verifyPeerCertificate verifies the certificates presented by the peer,
+// fetching issuers that weren't presented by the peer
+func (v *aiaVerifier) verifyPeerCertificate(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificates presented by the peer")
+	}
+
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		certs[i] = cert
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         v.roots,
+		DNSName:       v.serverName,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	chains, err := certs[0].Verify(opts)
+
+	// Fetch the issuer of the last certificate added to the chain until the
+	// chain verifies or there's nothing left to fetch
+	last := certs[0]
+	for i := 0; i < maxAIAFetches && err != nil; i++ {
+		var unknownAuthorityErr x509.UnknownAuthorityError
+		if !errors.As(err, &unknownAuthorityErr) {
+			break
+		}
+
+		issuer, fetchErr := v.fetchIssuer(last)
+		if fetchErr != nil {
+			return fmt.Errorf("%s: %s", err, fetchErr)
+		}
+		v.fetched = true
+		opts.Intermediates.AddCert(issuer)
+		last = issuer
+
+		chains, err = certs[0].Verify(opts)
+	}
+	if err != nil {
+		return err
+	}
+
+	v.chains = chains
+
+	return nil
+}
+
+// fetchIssuer downloads the issuer of the certificate from the first of its
+// caIssuers URLs that returns a certificate
+func (v *aiaVerifier) fetchIssuer(cert *x509.Certificate) (*x509.Certificate, error) {
+	if len(cert.IssuingCertificateURL) == 0 {
+		return nil, fmt.Errorf("certificate has no caIssuers URL to fetch the issuer from")
+	}
+
+	var err error
+	for _, url := range cert.IssuingCertificateURL {
+		var issuer *x509.Certificate
+		issuer, err = v.fetchCertificate(url)
+		if err == nil {
+			return issuer, nil
+		}
+	}
+
+	return nil, err
+}
+
+// fetchCertificate downloads a DER or PEM encoded certificate
+func (v *aiaVerifier) fetchCertificate(url string) (*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(v.ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	setUserAgent(req)
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status fetching %s: %s", url, resp.Status)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxAIACertSize))
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(body); block != nil {
+		body = block.Bytes
+	}
+
+	return x509.ParseCertificate(body)
+}
+
+// complete sets the verified chains on the connection state and emits a
+// metric describing whether issuers had to be fetched. The verifier can be
+// nil.
+func (v *aiaVerifier) complete(state *tls.ConnectionState, ch chan<- prometheus.Metric) {
+	if v == nil {
+		return
+	}
+
+	state.VerifiedChains = v.chains
+
+	var fetched float64
+	if v.fetched {
+		fetched = 1
+	}
+	emit(ch, prometheus.MustNewConstMetric(requiredAIAFetch, prometheus.GaugeValue, fetched))
+}
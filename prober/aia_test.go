@@ -0,0 +1,99 @@
+package prober
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+
+	pconfig "github.com/prometheus/common/config"
+)
+
+// TestProbeTCPFetchIntermediates tests that a server that doesn't send its
+// intermediate only verifies when fetching intermediates is enabled
+func TestProbeTCPFetchIntermediates(t *testing.T) {
+	rootPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rootCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 5))
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.SerialNumber = big.NewInt(1)
+	rootCert, rootCertPem := test.GenerateSelfSignedCertificateWithPrivateKey(rootCertTmpl, rootPrivateKey)
+
+	intermediateCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 4))
+	intermediateCertTmpl.IsCA = true
+	intermediateCertTmpl.SerialNumber = big.NewInt(2)
+	intermediateCert, _, intermediateKeyPem := test.GenerateSignedCertificate(intermediateCertTmpl, rootCert, rootPrivateKey)
+
+	block, _ := pem.Decode(intermediateKeyPem)
+	intermediateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	aiaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/pkix-cert")
+		w.Write(intermediateCert.Raw)
+	}))
+	defer aiaServer.Close()
+
+	serverCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 3))
+	serverCertTmpl.SerialNumber = big.NewInt(3)
+	serverCertTmpl.IssuingCertificateURL = []string{aiaServer.URL + "/intermediate.crt"}
+	_, serverCertPem, serverKey := test.GenerateSignedCertificate(serverCertTmpl, intermediateCert, intermediateKey)
+
+	for _, fetch := range []bool{false, true} {
+		server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(rootCertPem, serverCertPem, serverKey)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.StartTLS()
+
+		module := config.Module{
+			TLSConfig: pconfig.TLSConfig{
+				CAFile: caFile,
+			},
+			FetchIntermediates: fetch,
+		}
+
+		ch := make(chan prometheus.Metric, 1)
+		state, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, ch)
+		server.Close()
+
+		if !fetch {
+			if err == nil {
+				t.Fatalf("expected error without fetch_intermediates, but err was nil")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+		if len(state.VerifiedChains) != 1 || len(state.VerifiedChains[0]) != 3 {
+			t.Errorf("expected a verified chain of 3 certificates but got %v", state.VerifiedChains)
+		}
+		select {
+		case m := <-ch:
+			if m.Desc() != requiredAIAFetch {
+				t.Errorf("unexpected metric: %s", m.Desc())
+			}
+		default:
+			t.Errorf("expected the prober to emit %s", requiredAIAFetch)
+		}
+	}
+}
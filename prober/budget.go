@@ -0,0 +1,75 @@
+package prober
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrBudgetExhausted is returned when a probe tries to make more outbound
+// connections than its budget allows
+var ErrBudgetExhausted = errors.New("outbound request budget exhausted")
+
+// Budget limits the number of outbound connections that can be made on behalf
+// of a single probe, including connections to proxies and any follow-on
+// requests. This stops a target from using the exporter to make an unbounded
+// number of requests.
+type Budget struct {
+	mtx       sync.Mutex
+	remaining int
+	exhausted bool
+}
+
+// NewBudget returns a budget that allows the given number of connections. A
+// limit of 0 or less is unlimited.
+func NewBudget(limit int) *Budget {
+	if limit <= 0 {
+		return nil
+	}
+	return &Budget{remaining: limit}
+}
+
+// Take uses one connection from the budget. A nil budget is unlimited.
+func (b *Budget) Take() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	if b.remaining <= 0 {
+		b.exhausted = true
+		return ErrBudgetExhausted
+	}
+	b.remaining--
+
+	return nil
+}
+
+// Exhausted returns true if a connection was refused because the budget had
+// run out. A nil budget is never exhausted.
+func (b *Budget) Exhausted() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	return b.exhausted
+}
+
+type budgetKey struct{}
+
+// WithBudget returns a copy of the context that carries the budget
+func WithBudget(ctx context.Context, budget *Budget) context.Context {
+	return context.WithValue(ctx, budgetKey{}, budget)
+}
+
+// budgetFromContext returns the budget in the context, or nil if there isn't
+// one
+func budgetFromContext(ctx context.Context) *Budget {
+	budget, _ := ctx.Value(budgetKey{}).(*Budget)
+	return budget
+}
@@ -0,0 +1,80 @@
+package prober
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// TestBudget tests that a budget allows the given number of connections
+func TestBudget(t *testing.T) {
+	budget := NewBudget(2)
+
+	for i := 0; i < 2; i++ {
+		if err := budget.Take(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if budget.Exhausted() {
+		t.Errorf("expected the budget not to be exhausted before a connection was refused")
+	}
+
+	if err := budget.Take(); err != ErrBudgetExhausted {
+		t.Fatalf("expected ErrBudgetExhausted, got: %v", err)
+	}
+
+	if !budget.Exhausted() {
+		t.Errorf("expected the budget to be exhausted")
+	}
+}
+
+// TestBudgetUnlimited tests that a limit of 0 doesn't restrict connections
+func TestBudgetUnlimited(t *testing.T) {
+	budget := NewBudget(0)
+
+	for i := 0; i < 100; i++ {
+		if err := budget.Take(); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if budget.Exhausted() {
+		t.Errorf("expected an unlimited budget never to be exhausted")
+	}
+}
+
+// TestProbeTCPBudgetExhausted tests that the tcp prober doesn't connect when
+// the budget has been used up
+func TestProbeTCPBudgetExhausted(t *testing.T) {
+	budget := NewBudget(1)
+	if err := budget.Take(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ctx := WithBudget(context.Background(), budget)
+	if _, err := ProbeTCP(ctx, "localhost:6666", config.Module{}, 10*time.Second, nil); err != ErrBudgetExhausted {
+		t.Fatalf("expected ErrBudgetExhausted, got: %v", err)
+	}
+}
+
+// TestProbeHTTPSBudgetExhausted tests that the https prober doesn't connect
+// when the budget has been used up
+func TestProbeHTTPSBudgetExhausted(t *testing.T) {
+	budget := NewBudget(1)
+	if err := budget.Take(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	ctx := WithBudget(context.Background(), budget)
+	_, err := ProbeHTTPS(ctx, "https://localhost:6666", config.Module{}, 10*time.Second, nil)
+	if err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("expected ErrBudgetExhausted, got: %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// dnsTypeCAA is the type of the CAA record
+//
+// See https://www.rfc-editor.org/rfc/rfc8659#section-4.1
+const dnsTypeCAA = 257
+
+// CAARecord is a Certification Authority Authorization record, which
+// restricts the CAs that can issue certificates for a domain
+type CAARecord struct {
+	Critical bool
+	Tag      string
+	Value    string
+}
+
+// LookupCAA returns the CAA records that apply to the host. These are the
+// records of the host or, when it doesn't have any, of the closest parent
+// domain that does. There are no records when none of them have any.
+func LookupCAA(ctx context.Context, module config.Module, host string) ([]CAARecord, error) {
+	name := strings.TrimSuffix(strings.ToLower(host), ".")
+	for name != "" {
+		rdatas, err := lookupDNS(ctx, module, name, dnsTypeCAA)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up the CAA records of %s: %s", name, err)
+		}
+		if len(rdatas) > 0 {
+			records := make([]CAARecord, 0, len(rdatas))
+			for _, rdata := range rdatas {
+				record, err := parseCAARecord(rdata)
+				if err != nil {
+					return nil, fmt.Errorf("error parsing the CAA records of %s: %s", name, err)
+				}
+				records = append(records, record)
+			}
+			return records, nil
+		}
+
+		i := strings.Index(name, ".")
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+
+	return nil, nil
+}
+
+// parseCAARecord parses the flags, tag and value in the data of a CAA record
+func parseCAARecord(rdata []byte) (CAARecord, error) {
+	if len(rdata) < 2 || len(rdata) < 2+int(rdata[1]) {
+		return CAARecord{}, errShortDNSMessage
+	}
+	tagEnd := 2 + int(rdata[1])
+
+	return CAARecord{
+		Critical: rdata[0]&0x80 != 0,
+		Tag:      strings.ToLower(string(rdata[2:tagEnd])),
+		Value:    string(rdata[tagEnd:]),
+	}, nil
+}
@@ -0,0 +1,80 @@
+package prober
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestLookupCAA tests that the records of the closest domain with any are
+// returned
+func TestLookupCAA(t *testing.T) {
+	dnsServer, err := test.SetupDNSServer(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsServer.Close()
+	dnsServer.SetCAA("ribbybibby.me", "issue letsencrypt.org", "iodef mailto:me@ribbybibby.me")
+	dnsServer.SetCAA("other.ribbybibby.me", "issue ;")
+	dnsServer.SetCAA("example.ribbybibby.com", "issuewild pki.goog; policy=ev")
+
+	module := config.Module{
+		Resolver: dnsServer.Conn.LocalAddr().String(),
+	}
+
+	for _, tc := range []struct {
+		host     string
+		expected []CAARecord
+	}{
+		{
+			host: "example.ribbybibby.me",
+			expected: []CAARecord{
+				CAARecord{Tag: "issue", Value: "letsencrypt.org"},
+				CAARecord{Tag: "iodef", Value: "mailto:me@ribbybibby.me"},
+			},
+		},
+		{
+			host: "www.other.ribbybibby.me",
+			expected: []CAARecord{
+				CAARecord{Tag: "issue", Value: ";"},
+			},
+		},
+		{
+			host: "example.ribbybibby.com",
+			expected: []CAARecord{
+				CAARecord{Tag: "issuewild", Value: "pki.goog; policy=ev"},
+			},
+		},
+		{
+			host: "ribbybibby.org",
+		},
+	} {
+		records, err := LookupCAA(context.Background(), module, tc.host)
+		if err != nil {
+			t.Fatalf("%s: %s", tc.host, err)
+		}
+		if !reflect.DeepEqual(records, tc.expected) {
+			t.Errorf("%s: expected %v, but got %v", tc.host, tc.expected, records)
+		}
+	}
+}
+
+// TestParseCAARecordCritical tests parsing the issuer critical flag
+func TestParseCAARecordCritical(t *testing.T) {
+	record, err := parseCAARecord([]byte("\x80\x03TBSvalue"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := CAARecord{Critical: true, Tag: "tbs", Value: "value"}
+	if record != expected {
+		t.Errorf("expected %v, but got %v", expected, record)
+	}
+
+	if _, err := parseCAARecord([]byte("\x00\x09issue")); err == nil {
+		t.Errorf("expected an error for a truncated tag")
+	}
+}
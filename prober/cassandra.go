@@ -0,0 +1,131 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+const (
+	// cassandraProtocolVersion is the version of the native protocol used
+	// for the OPTIONS request. Version 4 is supported by Cassandra 2.2 and
+	// later, and by ScyllaDB.
+	cassandraProtocolVersion = 0x04
+
+	// Opcodes of the native protocol frames used by the prober
+	cassandraOpError     = 0x00
+	cassandraOpOptions   = 0x05
+	cassandraOpSupported = 0x06
+
+	// maxCassandraFrameSize limits the size of the body of the response
+	maxCassandraFrameSize = 1 << 16
+)
+
+// ProbeCassandra performs a TLS handshake with a Cassandra or ScyllaDB node
+// that has client encryption enabled. When the module asks for it, an
+// OPTIONS request is sent after the handshake to check that a node answers.
+func ProbeCassandra(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error) {
+	dialer := newDialer(module, timeout)
+
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("Error setting deadline")
+	}
+
+	tlsConfig, err := newTLSConfig(module)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		targetAddress, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = targetAddress
+	}
+
+	verifier := newAIAVerifier(ctx, tlsConfig, module, tlsConfig.ServerName, timeout)
+	certificateRequest := recordCertificateRequest(tlsConfig)
+	defer certificateRequest.collect(ch)
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	defer tlsConn.Close()
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, handshakeError(err)
+	}
+
+	if module.Cassandra.SendOptions {
+		if err := cassandraOptions(tlsConn); err != nil {
+			return nil, err
+		}
+	}
+
+	state := tlsConn.ConnectionState()
+	if err := checkALPN(module, &state); err != nil {
+		return nil, err
+	}
+	verifier.complete(&state, ch)
+
+	return &state, nil
+}
+
+// cassandraOptions sends an OPTIONS request and checks that the node responds
+// with SUPPORTED
+//
+// See https://github.com/apache/cassandra/blob/trunk/doc/native_protocol_v4.spec
+func cassandraOptions(conn io.ReadWriter) error {
+	// The frame header: version, flags, stream, opcode and the length of
+	// the empty body
+	req := []byte{cassandraProtocolVersion, 0x00, 0x00, 0x00, cassandraOpOptions, 0x00, 0x00, 0x00, 0x00}
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return fmt.Errorf("error reading the response to OPTIONS: %s", err)
+	}
+	if header[0]&0x80 == 0 {
+		return fmt.Errorf("the response to OPTIONS isn't a native protocol response frame")
+	}
+	length := binary.BigEndian.Uint32(header[5:])
+	if length > maxCassandraFrameSize {
+		return fmt.Errorf("the response to OPTIONS is too large: %d bytes", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(conn, body); err != nil {
+		return fmt.Errorf("error reading the response to OPTIONS: %s", err)
+	}
+
+	switch header[4] {
+	case cassandraOpSupported:
+		return nil
+	case cassandraOpError:
+		// The body of an error is the code followed by a string with
+		// the message
+		if len(body) >= 6 {
+			code := binary.BigEndian.Uint32(body)
+			n := int(binary.BigEndian.Uint16(body[4:]))
+			if len(body) >= 6+n {
+				return fmt.Errorf("error response to OPTIONS: %#x: %s", code, body[6:6+n])
+			}
+		}
+		return fmt.Errorf("error response to OPTIONS")
+	default:
+		return fmt.Errorf("unexpected response to OPTIONS with opcode %#x", header[4])
+	}
+}
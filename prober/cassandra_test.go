@@ -0,0 +1,75 @@
+package prober
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+
+	pconfig "github.com/prometheus/common/config"
+)
+
+// TestProbeCassandra tests the typical case, with and without the OPTIONS
+// request
+func TestProbeCassandra(t *testing.T) {
+	for _, sendOptions := range []bool{false, true} {
+		server, _, _, caFile, teardown, err := test.SetupTCPServer()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.StartCassandra(true)
+
+		module := config.Module{
+			TLSConfig: pconfig.TLSConfig{
+				CAFile: caFile,
+			},
+			Cassandra: config.CassandraProbe{
+				SendOptions: sendOptions,
+			},
+		}
+
+		state, err := ProbeCassandra(context.Background(), server.Listener.Addr().String(), module, 5*time.Second, nil)
+		server.Close()
+		if err != nil {
+			t.Fatalf("send_options=%t: error: %s", sendOptions, err)
+		}
+		if state == nil {
+			t.Fatalf("send_options=%t: expected state but got nil", sendOptions)
+		}
+	}
+}
+
+// TestProbeCassandraError tests that an error in response to OPTIONS fails
+// the probe
+func TestProbeCassandraError(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartCassandra(false)
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+		Cassandra: config.CassandraProbe{
+			SendOptions: true,
+		},
+	}
+
+	_, err = ProbeCassandra(context.Background(), server.Listener.Addr().String(), module, 5*time.Second, nil)
+	if err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+	if !strings.Contains(err.Error(), "unavailable") {
+		t.Errorf("expected the error message from the response, got: %s", err)
+	}
+}
@@ -0,0 +1,103 @@
+package prober
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// signatureSchemeNames maps signature schemes to their names in the TLS
+	// SignatureScheme registry
+	signatureSchemeNames = map[tls.SignatureScheme]string{
+		tls.PKCS1WithSHA256:        "rsa_pkcs1_sha256",
+		tls.PKCS1WithSHA384:        "rsa_pkcs1_sha384",
+		tls.PKCS1WithSHA512:        "rsa_pkcs1_sha512",
+		tls.PSSWithSHA256:          "rsa_pss_rsae_sha256",
+		tls.PSSWithSHA384:          "rsa_pss_rsae_sha384",
+		tls.PSSWithSHA512:          "rsa_pss_rsae_sha512",
+		tls.ECDSAWithP256AndSHA256: "ecdsa_secp256r1_sha256",
+		tls.ECDSAWithP384AndSHA384: "ecdsa_secp384r1_sha384",
+		tls.ECDSAWithP521AndSHA512: "ecdsa_secp521r1_sha512",
+		tls.Ed25519:                "ed25519",
+		tls.PKCS1WithSHA1:          "rsa_pkcs1_sha1",
+		tls.ECDSAWithSHA1:          "ecdsa_sha1",
+	}
+)
+
+// certificateRequestRecorder records the signature schemes that the server
+// accepts for client certificates, if it asks for one, and the certificate
+// that was sent
+type certificateRequestRecorder struct {
+	mtx         sync.Mutex
+	schemes     []tls.SignatureScheme
+	certificate *tls.Certificate
+}
+
+// recordCertificateRequest wraps the GetClientCertificate callback of the
+// tls.Config so that the CertificateRequest sent by the server is recorded.
+// When the module doesn't configure a client certificate no certificate is
+// sent, as before.
+func recordCertificateRequest(tlsConfig *tls.Config) *certificateRequestRecorder {
+	r := &certificateRequestRecorder{}
+
+	getClientCertificate := tlsConfig.GetClientCertificate
+	tlsConfig.GetClientCertificate = func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		r.mtx.Lock()
+		r.schemes = append([]tls.SignatureScheme{}, cri.SignatureSchemes...)
+		r.mtx.Unlock()
+		if getClientCertificate == nil {
+			return &tls.Certificate{}, nil
+		}
+
+		cert, err := getClientCertificate(cri)
+		if err == nil && cert != nil && len(cert.Certificate) > 0 {
+			r.mtx.Lock()
+			r.certificate = cert
+			r.mtx.Unlock()
+		}
+		return cert, err
+	}
+
+	return r
+}
+
+// collect emits the signature schemes the server accepts and the client
+// certificate that was sent. Nothing is emitted when the server didn't ask for
+// a client certificate.
+func (r *certificateRequestRecorder) collect(ch chan<- prometheus.Metric) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	for _, scheme := range r.schemes {
+		emit(ch, prometheus.MustNewConstMetric(
+			serverAcceptedSignatureSchemes, prometheus.GaugeValue, 1, signatureSchemeName(scheme),
+		))
+	}
+
+	if r.certificate == nil {
+		return
+	}
+	leaf := r.certificate.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(r.certificate.Certificate[0]); err != nil {
+			return
+		}
+	}
+	emit(ch, prometheus.MustNewConstMetric(
+		clientCertSelected, prometheus.GaugeValue, 1, leaf.SerialNumber.String(), leaf.Issuer.CommonName, leaf.Subject.CommonName,
+	))
+}
+
+// signatureSchemeName returns the name of the signature scheme, or its code
+// point if it isn't known
+func signatureSchemeName(scheme tls.SignatureScheme) string {
+	if name, ok := signatureSchemeNames[scheme]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", uint16(scheme))
+}
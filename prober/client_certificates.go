@@ -0,0 +1,38 @@
+package prober
+
+import (
+	"crypto/tls"
+	"fmt"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// loadClientCertificates loads the client certificates of the module, from
+// the files or from Vault
+func loadClientCertificates(clientCerts []config.ClientCert) ([]tls.Certificate, error) {
+	var certs []tls.Certificate
+	for _, c := range clientCerts {
+		cert, err := loadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use client certificate %s: %s", c.CertFile, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	return certs, nil
+}
+
+// selectClientCertificate returns a GetClientCertificate callback that sends
+// the first of the certificates that the server accepts, going by the CAs and
+// signature schemes in its CertificateRequest. No certificate is sent when it
+// accepts none of them.
+func selectClientCertificate(certs []tls.Certificate) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		for i := range certs {
+			if err := cri.SupportsCertificate(&certs[i]); err == nil {
+				return &certs[i], nil
+			}
+		}
+		return &tls.Certificate{}, nil
+	}
+}
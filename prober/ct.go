@@ -0,0 +1,521 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+const (
+	// ctLogListTTL is how long the log list is cached for
+	ctLogListTTL = 24 * time.Hour
+
+	// ctLogListRetryInterval is how long a failure to fetch the log list is
+	// cached for, so that probes don't each wait for a fetch that is likely
+	// to fail again
+	ctLogListRetryInterval = time.Minute
+
+	// maxCTResponseSize limits the size of the responses from the log list
+	// and the logs
+	maxCTResponseSize = 4 << 20
+)
+
+var (
+	// CTLogListURL is the URL of the list of Certificate Transparency logs,
+	// in the format of https://www.gstatic.com/ct/log_list/v3/log_list.json
+	CTLogListURL string
+
+	// oidSCTList is the extension that embeds SCTs in a certificate
+	oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+
+	// ctLogs caches the log list between probes
+	ctLogs = &ctLogCache{}
+)
+
+// ctLog is a log from the log list
+type ctLog struct {
+	URL string
+	Key crypto.PublicKey
+}
+
+// ctLogCache holds the logs from the log list, by log ID. The lock is only
+// held to use the cache, and probes that need the log list at once wait for a
+// single fetch.
+type ctLogCache struct {
+	mtx     sync.Mutex
+	url     string
+	fetched time.Time
+	logs    map[[sha256.Size]byte]ctLog
+
+	// The last failed fetch of the log list
+	errURL string
+	failed time.Time
+	err    error
+
+	fetch *ctLogFetch
+}
+
+// ctLogFetch is a fetch of the log list that is in flight
+type ctLogFetch struct {
+	done chan struct{}
+	logs map[[sha256.Size]byte]ctLog
+	err  error
+}
+
+// sct is the part of a SignedCertificateTimestamp needed to find the entry in
+// the log
+type sct struct {
+	LogID      [sha256.Size]byte
+	Timestamp  uint64
+	Extensions []byte
+}
+
+// ctClient queries Certificate Transparency logs
+type ctClient struct {
+	ctx    context.Context
+	client *http.Client
+}
+
+// VerifyCTInclusion returns true if one of the logs that issued an SCT
+// embedded in the certificate proves that it includes the certificate. The
+// issuer is needed to reconstruct the precertificate that was logged.
+func VerifyCTInclusion(ctx context.Context, module config.Module, cert, issuer *x509.Certificate, timeout time.Duration) (bool, error) {
+	scts, err := parseEmbeddedSCTs(cert)
+	if err != nil {
+		return false, err
+	}
+	if len(scts) == 0 {
+		return false, fmt.Errorf("the certificate doesn't have embedded SCTs")
+	}
+
+	tbs, err := precertTBS(cert)
+	if err != nil {
+		return false, err
+	}
+	issuerKeyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+
+	c := &ctClient{
+		ctx: ctx,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext:       newDialer(module, timeout).DialContext,
+				DisableKeepAlives: true,
+			},
+			Timeout: timeout,
+		},
+	}
+
+	logs, err := ctLogs.get(c)
+	if err != nil {
+		return false, err
+	}
+
+	for _, s := range scts {
+		l, ok := logs[s.LogID]
+		if !ok {
+			err = fmt.Errorf("log %s isn't in the log list", base64.StdEncoding.EncodeToString(s.LogID[:]))
+			continue
+		}
+		leafHash := precertLeafHash(s, issuerKeyHash, tbs)
+		if err = c.verifyInclusion(l, leafHash); err == nil {
+			return true, nil
+		}
+	}
+
+	return false, err
+}
+
+// get returns the logs in the log list, fetching it again when it has expired
+// or the URL has changed. A failed fetch is returned until the retry
+// interval has passed.
+func (lc *ctLogCache) get(c *ctClient) (map[[sha256.Size]byte]ctLog, error) {
+	lc.mtx.Lock()
+	if lc.logs != nil && lc.url == CTLogListURL && time.Since(lc.fetched) < ctLogListTTL {
+		logs := lc.logs
+		lc.mtx.Unlock()
+		return logs, nil
+	}
+	if lc.err != nil && lc.errURL == CTLogListURL && time.Since(lc.failed) < ctLogListRetryInterval {
+		err := lc.err
+		lc.mtx.Unlock()
+		return nil, err
+	}
+
+	// Wait for the fetch that is already in flight, for as long as the probe
+	// allows
+	if fetch := lc.fetch; fetch != nil {
+		lc.mtx.Unlock()
+		select {
+		case <-fetch.done:
+			return fetch.logs, fetch.err
+		case <-c.ctx.Done():
+			return nil, c.ctx.Err()
+		}
+	}
+
+	fetch := &ctLogFetch{done: make(chan struct{})}
+	lc.fetch = fetch
+	u := CTLogListURL
+	lc.mtx.Unlock()
+
+	fetch.logs, fetch.err = c.getLogList(u)
+
+	lc.mtx.Lock()
+	lc.fetch = nil
+	if fetch.err != nil {
+		lc.errURL = u
+		lc.failed = time.Now()
+		lc.err = fetch.err
+	} else {
+		lc.url = u
+		lc.fetched = time.Now()
+		lc.logs = fetch.logs
+		lc.err = nil
+	}
+	lc.mtx.Unlock()
+	close(fetch.done)
+
+	return fetch.logs, fetch.err
+}
+
+// getLogList fetches the log list from the URL and returns the logs in it,
+// by log ID
+func (c *ctClient) getLogList(u string) (map[[sha256.Size]byte]ctLog, error) {
+	var list struct {
+		Operators []struct {
+			Logs []struct {
+				LogID string `json:"log_id"`
+				Key   string `json:"key"`
+				URL   string `json:"url"`
+			} `json:"logs"`
+		} `json:"operators"`
+	}
+	if err := c.getJSON(u, &list); err != nil {
+		return nil, fmt.Errorf("unable to fetch the CT log list: %s", err)
+	}
+
+	logs := map[[sha256.Size]byte]ctLog{}
+	for _, operator := range list.Operators {
+		for _, l := range operator.Logs {
+			logID, err := base64.StdEncoding.DecodeString(l.LogID)
+			if err != nil || len(logID) != sha256.Size {
+				continue
+			}
+			der, err := base64.StdEncoding.DecodeString(l.Key)
+			if err != nil {
+				continue
+			}
+			key, err := x509.ParsePKIXPublicKey(der)
+			if err != nil {
+				continue
+			}
+			var id [sha256.Size]byte
+			copy(id[:], logID)
+			logs[id] = ctLog{URL: l.URL, Key: key}
+		}
+	}
+
+	return logs, nil
+}
+
+// verifyInclusion fetches the latest signed tree head of the log and checks
+// that the log can prove the leaf is in the tree
+func (c *ctClient) verifyInclusion(l ctLog, leafHash [sha256.Size]byte) error {
+	var sth struct {
+		TreeSize          uint64 `json:"tree_size"`
+		Timestamp         uint64 `json:"timestamp"`
+		SHA256RootHash    []byte `json:"sha256_root_hash"`
+		TreeHeadSignature []byte `json:"tree_head_signature"`
+	}
+	if err := c.getJSON(l.URL+"ct/v1/get-sth", &sth); err != nil {
+		return err
+	}
+	if len(sth.SHA256RootHash) != sha256.Size {
+		return fmt.Errorf("invalid root hash in the tree head of %s", l.URL)
+	}
+	if err := verifySTHSignature(l.Key, sth.Timestamp, sth.TreeSize, sth.SHA256RootHash, sth.TreeHeadSignature); err != nil {
+		return fmt.Errorf("invalid tree head from %s: %s", l.URL, err)
+	}
+
+	var proof struct {
+		LeafIndex uint64   `json:"leaf_index"`
+		AuditPath [][]byte `json:"audit_path"`
+	}
+	query := url.Values{}
+	query.Set("hash", base64.StdEncoding.EncodeToString(leafHash[:]))
+	query.Set("tree_size", strconv.FormatUint(sth.TreeSize, 10))
+	if err := c.getJSON(l.URL+"ct/v1/get-proof-by-hash?"+query.Encode(), &proof); err != nil {
+		return err
+	}
+
+	return verifyInclusionProof(leafHash[:], proof.LeafIndex, sth.TreeSize, proof.AuditPath, sth.SHA256RootHash)
+}
+
+// getJSON decodes the JSON response from the URL
+func (c *ctClient) getJSON(u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(c.ctx, "GET", u, nil)
+	if err != nil {
+		return err
+	}
+	setUserAgent(req)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status fetching %s: %s", u, resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, maxCTResponseSize)).Decode(v)
+}
+
+// parseEmbeddedSCTs returns the SCTs in the SCT list extension of the
+// certificate
+//
+// See https://tools.ietf.org/html/rfc6962#section-3.3
+func parseEmbeddedSCTs(cert *x509.Certificate) ([]sct, error) {
+	var value []byte
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidSCTList) {
+			if _, err := asn1.Unmarshal(ext.Value, &value); err != nil {
+				return nil, fmt.Errorf("invalid SCT list: %s", err)
+			}
+			break
+		}
+	}
+	if value == nil {
+		return nil, nil
+	}
+
+	list, _, ok := readVector16(value)
+	if !ok {
+		return nil, fmt.Errorf("invalid SCT list")
+	}
+
+	var scts []sct
+	for len(list) > 0 {
+		var b []byte
+		b, list, ok = readVector16(list)
+		if !ok || len(b) < 1+sha256.Size+8 {
+			return nil, fmt.Errorf("invalid SCT in the SCT list")
+		}
+		if b[0] != 0 {
+			// Only v1 SCTs are defined
+			continue
+		}
+
+		var s sct
+		copy(s.LogID[:], b[1:1+sha256.Size])
+		s.Timestamp = binary.BigEndian.Uint64(b[1+sha256.Size:])
+		s.Extensions, _, ok = readVector16(b[1+sha256.Size+8:])
+		if !ok {
+			return nil, fmt.Errorf("invalid SCT extensions in the SCT list")
+		}
+		scts = append(scts, s)
+	}
+
+	return scts, nil
+}
+
+// readVector16 reads a byte vector with a 16 bit length prefix, returning the
+// vector and what follows it
+func readVector16(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 2 {
+		return nil, nil, false
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return nil, nil, false
+	}
+	return b[2 : 2+n], b[2+n:], true
+}
+
+// precertTBS returns the TBSCertificate of the precertificate that was logged
+// for the certificate, which is its own TBSCertificate without the SCT list
+// extension
+func precertTBS(cert *x509.Certificate) ([]byte, error) {
+	var tbs asn1.RawValue
+	if _, err := asn1.Unmarshal(cert.RawTBSCertificate, &tbs); err != nil {
+		return nil, err
+	}
+
+	var fields []byte
+	for rest := tbs.Bytes; len(rest) > 0; {
+		var field asn1.RawValue
+		var err error
+		rest, err = asn1.Unmarshal(rest, &field)
+		if err != nil {
+			return nil, err
+		}
+
+		// The extensions are explicitly tagged [3]
+		if field.Class != asn1.ClassContextSpecific || field.Tag != 3 {
+			fields = append(fields, field.FullBytes...)
+			continue
+		}
+
+		var exts asn1.RawValue
+		if _, err := asn1.Unmarshal(field.Bytes, &exts); err != nil {
+			return nil, err
+		}
+		var kept []byte
+		for extRest := exts.Bytes; len(extRest) > 0; {
+			var ext asn1.RawValue
+			extRest, err = asn1.Unmarshal(extRest, &ext)
+			if err != nil {
+				return nil, err
+			}
+			var e pkix.Extension
+			if _, err := asn1.Unmarshal(ext.FullBytes, &e); err == nil && e.Id.Equal(oidSCTList) {
+				continue
+			}
+			kept = append(kept, ext.FullBytes...)
+		}
+
+		extsDER, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: kept})
+		if err != nil {
+			return nil, err
+		}
+		fieldDER, err := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 3, IsCompound: true, Bytes: extsDER})
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, fieldDER...)
+	}
+
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSequence, IsCompound: true, Bytes: fields})
+}
+
+// precertLeafHash returns the hash of the MerkleTreeLeaf for a precertificate
+// entry
+//
+// See https://tools.ietf.org/html/rfc6962#section-3.4
+func precertLeafHash(s sct, issuerKeyHash [sha256.Size]byte, tbs []byte) [sha256.Size]byte {
+	var leaf bytes.Buffer
+
+	// Version v1 and leaf type timestamped_entry
+	leaf.Write([]byte{0, 0})
+	binary.Write(&leaf, binary.BigEndian, s.Timestamp)
+	// Entry type precert_entry
+	leaf.Write([]byte{0, 1})
+	leaf.Write(issuerKeyHash[:])
+	leaf.Write([]byte{byte(len(tbs) >> 16), byte(len(tbs) >> 8), byte(len(tbs))})
+	leaf.Write(tbs)
+	binary.Write(&leaf, binary.BigEndian, uint16(len(s.Extensions)))
+	leaf.Write(s.Extensions)
+
+	return sha256.Sum256(append([]byte{0}, leaf.Bytes()...))
+}
+
+// verifySTHSignature verifies the signature over a signed tree head
+//
+// See https://tools.ietf.org/html/rfc6962#section-3.5
+func verifySTHSignature(key crypto.PublicKey, timestamp, treeSize uint64, rootHash, signature []byte) error {
+	// The signature is a DigitallySigned struct: the hash and signature
+	// algorithms followed by the signature itself
+	if len(signature) < 2 {
+		return fmt.Errorf("invalid signature")
+	}
+	if signature[0] != 4 {
+		return fmt.Errorf("unsupported hash algorithm %d", signature[0])
+	}
+	sig, _, ok := readVector16(signature[2:])
+	if !ok {
+		return fmt.Errorf("invalid signature")
+	}
+
+	var signed bytes.Buffer
+	// Version v1 and signature type tree_hash
+	signed.Write([]byte{0, 1})
+	binary.Write(&signed, binary.BigEndian, timestamp)
+	binary.Write(&signed, binary.BigEndian, treeSize)
+	signed.Write(rootHash)
+	digest := sha256.Sum256(signed.Bytes())
+
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		var esig struct {
+			R, S *big.Int
+		}
+		if _, err := asn1.Unmarshal(sig, &esig); err != nil {
+			return err
+		}
+		if !ecdsa.Verify(k, digest[:], esig.R, esig.S) {
+			return fmt.Errorf("ECDSA verification failure")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], sig)
+	}
+
+	return fmt.Errorf("unsupported log key type %T", key)
+}
+
+// verifyInclusionProof checks that the audit path proves that the leaf is in
+// the tree with the root hash
+//
+// See https://tools.ietf.org/html/rfc9162#section-2.1.3.2
+func verifyInclusionProof(leafHash []byte, leafIndex, treeSize uint64, auditPath [][]byte, rootHash []byte) error {
+	if leafIndex >= treeSize {
+		return fmt.Errorf("leaf index %d is outside the tree of size %d", leafIndex, treeSize)
+	}
+
+	fn, sn := leafIndex, treeSize-1
+	r := leafHash
+	for _, p := range auditPath {
+		if sn == 0 {
+			return errors.New("the audit path is too long")
+		}
+		if fn&1 == 1 || fn == sn {
+			r = hashChildren(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = hashChildren(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+
+	if sn != 0 {
+		return errors.New("the audit path is too short")
+	}
+	if !bytes.Equal(r, rootHash) {
+		return errors.New("the audit path doesn't lead to the root hash")
+	}
+
+	return nil
+}
+
+// hashChildren returns the hash of an interior node of a Merkle tree
+func hashChildren(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
@@ -0,0 +1,393 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// ctTestLog is a Certificate Transparency log that serves a fixed tree
+type ctTestLog struct {
+	key    *ecdsa.PrivateKey
+	leaves [][]byte
+}
+
+// handler serves the log list, with the log in it, and the log's API
+func (l *ctTestLog) handler(t *testing.T, url *string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/log_list.json", func(w http.ResponseWriter, r *http.Request) {
+		spki, err := x509.MarshalPKIXPublicKey(&l.key.PublicKey)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		logID := sha256.Sum256(spki)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"operators": []map[string]interface{}{
+				{
+					"logs": []map[string]interface{}{
+						{
+							"log_id": base64.StdEncoding.EncodeToString(logID[:]),
+							"key":    base64.StdEncoding.EncodeToString(spki),
+							"url":    *url + "/log/",
+						},
+					},
+				},
+			},
+		})
+	})
+	mux.HandleFunc("/log/ct/v1/get-sth", func(w http.ResponseWriter, r *http.Request) {
+		treeSize := uint64(len(l.leaves))
+		timestamp := uint64(time.Now().UnixNano() / 1e6)
+		root := merkleTreeHash(l.leaves)
+
+		var signed bytes.Buffer
+		signed.Write([]byte{0, 1})
+		binary.Write(&signed, binary.BigEndian, timestamp)
+		binary.Write(&signed, binary.BigEndian, treeSize)
+		signed.Write(root)
+		digest := sha256.Sum256(signed.Bytes())
+		r1, s1, err := ecdsa.Sign(rand.Reader, l.key, digest[:])
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		sig, err := asn1.Marshal(struct{ R, S *big.Int }{r1, s1})
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		digitallySigned := append([]byte{4, 3, byte(len(sig) >> 8), byte(len(sig))}, sig...)
+
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"tree_size":           treeSize,
+			"timestamp":           timestamp,
+			"sha256_root_hash":    root,
+			"tree_head_signature": digitallySigned,
+		})
+	})
+	mux.HandleFunc("/log/ct/v1/get-proof-by-hash", func(w http.ResponseWriter, r *http.Request) {
+		hash, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("hash"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		for i, leaf := range l.leaves {
+			if bytes.Equal(leaf, hash) {
+				json.NewEncoder(w).Encode(map[string]interface{}{
+					"leaf_index": i,
+					"audit_path": merkleAuditPath(i, l.leaves),
+				})
+				return
+			}
+		}
+		http.NotFound(w, r)
+	})
+
+	return mux
+}
+
+// merkleTreeHash returns the root hash of the tree with the leaf hashes
+//
+// See https://tools.ietf.org/html/rfc6962#section-2.1
+func merkleTreeHash(leaves [][]byte) []byte {
+	if len(leaves) == 1 {
+		return leaves[0]
+	}
+	k := merkleSplit(len(leaves))
+	return hashChildren(merkleTreeHash(leaves[:k]), merkleTreeHash(leaves[k:]))
+}
+
+// merkleAuditPath returns the audit path for the leaf at index m
+//
+// See https://tools.ietf.org/html/rfc6962#section-2.1.1
+func merkleAuditPath(m int, leaves [][]byte) [][]byte {
+	if len(leaves) == 1 {
+		return nil
+	}
+	k := merkleSplit(len(leaves))
+	if m < k {
+		return append(merkleAuditPath(m, leaves[:k]), merkleTreeHash(leaves[k:]))
+	}
+	return append(merkleAuditPath(m-k, leaves[k:]), merkleTreeHash(leaves[:k]))
+}
+
+// merkleSplit returns the largest power of two smaller than n
+func merkleSplit(n int) int {
+	k := 1
+	for k<<1 < n {
+		k <<= 1
+	}
+	return k
+}
+
+// testLeafHashes returns n distinct leaf hashes
+func testLeafHashes(n int) [][]byte {
+	var leaves [][]byte
+	for i := 0; i < n; i++ {
+		h := sha256.Sum256([]byte{0, byte(i)})
+		leaves = append(leaves, h[:])
+	}
+	return leaves
+}
+
+// generateCTCertificates returns an issuer, the precertificate that it logged
+// and the final certificate with the SCT from the log embedded in it
+func generateCTCertificates(t *testing.T, logKey *ecdsa.PrivateKey) (*x509.Certificate, *x509.Certificate, *x509.Certificate, sct) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "CT test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(0, 0, 1),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "ct.example.com"},
+		DNSNames:     []string{"ct.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, 1),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	precertDER, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	precert, err := x509.ParseCertificate(precertDER)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	spki, err := x509.MarshalPKIXPublicKey(&logKey.PublicKey)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	s := sct{
+		LogID:      sha256.Sum256(spki),
+		Timestamp:  uint64(time.Now().UnixNano() / 1e6),
+		Extensions: []byte{},
+	}
+
+	// The signature over the SCT isn't checked, so any will do
+	var b bytes.Buffer
+	b.WriteByte(0)
+	b.Write(s.LogID[:])
+	binary.Write(&b, binary.BigEndian, s.Timestamp)
+	b.Write([]byte{0, 0})
+	b.Write([]byte{4, 3, 0, 1, 0})
+	sctBytes := append([]byte{byte(b.Len() >> 8), byte(b.Len())}, b.Bytes()...)
+	list := append([]byte{byte(len(sctBytes) >> 8), byte(len(sctBytes))}, sctBytes...)
+	value, err := asn1.Marshal(list)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	tmpl.ExtraExtensions = []pkix.Extension{{Id: oidSCTList, Value: value}}
+	certDER, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	return ca, precert, cert, s
+}
+
+// TestVerifyCTInclusion tests verifying that a log includes a certificate
+// with an SCT from it
+func TestVerifyCTInclusion(t *testing.T) {
+	logKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ca, precert, cert, s := generateCTCertificates(t, logKey)
+
+	issuerKeyHash := sha256.Sum256(ca.RawSubjectPublicKeyInfo)
+	leafHash := precertLeafHash(s, issuerKeyHash, precert.RawTBSCertificate)
+
+	for _, tc := range []struct {
+		name     string
+		leaves   [][]byte
+		expected bool
+	}{
+		{"logged", append(testLeafHashes(5), leafHash[:]), true},
+		{"not logged", testLeafHashes(5), false},
+	} {
+		log := &ctTestLog{key: logKey, leaves: tc.leaves}
+		var serverURL string
+		server := httptest.NewServer(log.handler(t, &serverURL))
+		serverURL = server.URL
+
+		CTLogListURL = server.URL + "/log_list.json"
+		verified, err := VerifyCTInclusion(context.Background(), config.Module{}, cert, ca, 5*time.Second)
+		server.Close()
+
+		if verified != tc.expected {
+			t.Errorf("%s: expected %t, got %t: %v", tc.name, tc.expected, verified, err)
+		}
+	}
+	CTLogListURL = ""
+}
+
+// TestCTLogCache tests that probes that need the log list at once share a
+// single fetch, that waiting for it is bounded by the probe's context and
+// that a failed fetch is cached
+func TestCTLogCache(t *testing.T) {
+	var (
+		mtx      sync.Mutex
+		requests int
+	)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		requests++
+		mtx.Unlock()
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	CTLogListURL = server.URL + "/log_list.json"
+	defer func() { CTLogListURL = "" }()
+
+	lc := &ctLogCache{}
+	newClient := func(ctx context.Context) *ctClient {
+		return &ctClient{ctx: ctx, client: &http.Client{Timeout: 10 * time.Second}}
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := lc.get(newClient(context.Background())); err == nil {
+				t.Errorf("expected an error fetching the log list")
+			}
+		}()
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := lc.get(newClient(ctx)); err != context.DeadlineExceeded {
+		t.Errorf("expected the wait for the fetch to end with the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the wait to end after 100ms, took %s", elapsed)
+	}
+
+	close(release)
+	wg.Wait()
+
+	// The failure is returned without fetching the log list again
+	if _, err := lc.get(newClient(context.Background())); err == nil {
+		t.Errorf("expected the failed fetch to be cached")
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if requests != 1 {
+		t.Errorf("expected the log list to be fetched once, but it was fetched %d times", requests)
+	}
+}
+
+// TestVerifyCTInclusionNoSCTs tests a certificate without embedded SCTs
+func TestVerifyCTInclusionNoSCTs(t *testing.T) {
+	logKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	ca, precert, _, _ := generateCTCertificates(t, logKey)
+
+	if verified, err := VerifyCTInclusion(context.Background(), config.Module{}, precert, ca, 5*time.Second); verified || err == nil {
+		t.Errorf("expected an error for a certificate without SCTs")
+	}
+}
+
+// TestPrecertTBS tests that removing the SCT list from a certificate gives
+// the TBSCertificate of the precertificate
+func TestPrecertTBS(t *testing.T) {
+	logKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	_, precert, cert, s := generateCTCertificates(t, logKey)
+
+	tbs, err := precertTBS(cert)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if !bytes.Equal(tbs, precert.RawTBSCertificate) {
+		t.Errorf("expected the TBSCertificate of the precertificate")
+	}
+
+	scts, err := parseEmbeddedSCTs(cert)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(scts) != 1 || scts[0].LogID != s.LogID || scts[0].Timestamp != s.Timestamp {
+		t.Errorf("expected the embedded SCT, got %v", scts)
+	}
+}
+
+// TestVerifyInclusionProof tests the audit path of every leaf in trees of
+// different sizes
+func TestVerifyInclusionProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := testLeafHashes(n)
+		root := merkleTreeHash(leaves)
+		for m := 0; m < n; m++ {
+			path := merkleAuditPath(m, leaves)
+			if err := verifyInclusionProof(leaves[m], uint64(m), uint64(n), path, root); err != nil {
+				t.Errorf("leaf %d of %d: %s", m, n, err)
+			}
+			if n > 1 {
+				if err := verifyInclusionProof(leaves[(m+1)%n], uint64(m), uint64(n), path, root); err == nil {
+					t.Errorf("leaf %d of %d: expected an error for the wrong leaf", m, n)
+				}
+			}
+		}
+	}
+}
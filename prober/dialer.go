@@ -0,0 +1,82 @@
+package prober
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// NewResolver returns a resolver that queries the DNS server configured in the
+// module, or the system resolver if there isn't one
+func NewResolver(module config.Module) *net.Resolver {
+	if module.Resolver == "" {
+		return net.DefaultResolver
+	}
+
+	server := module.Resolver
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialer := &net.Dialer{}
+			return dialer.DialContext(ctx, network, server)
+		},
+	}
+}
+
+// budgetDialer is a net.Dialer that takes a connection from the budget in the
+// context before every dial. Connections go through the SSH bastion when a
+// tunnel is configured.
+type budgetDialer struct {
+	*net.Dialer
+	tunnel config.SSHTunnel
+}
+
+// DialContext connects to the address if the budget in the context allows it
+func (d *budgetDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if err := budgetFromContext(ctx).Take(); err != nil {
+		return nil, err
+	}
+	if d.tunnel.Address != "" {
+		return sshTunnels.dialContext(ctx, d.tunnel, d.Dialer, network, address)
+	}
+	return d.Dialer.DialContext(ctx, network, address)
+}
+
+// newDialer returns a dialer with the given timeout that resolves names with
+// the resolver configured in the module, or connects through the SSH tunnel
+// configured in the module
+func newDialer(module config.Module, timeout time.Duration) *budgetDialer {
+	dialer := &net.Dialer{
+		Timeout:  timeout,
+		Resolver: NewResolver(module),
+	}
+	if module.Socket.Enabled() {
+		dialer.Control = socketControl(module.Socket)
+	}
+
+	return &budgetDialer{
+		Dialer: dialer,
+		tunnel: module.SSHTunnel,
+	}
+}
+
+// socketControl returns a Control function for a net.Dialer that sets the
+// socket options on the socket before it connects
+func socketControl(opts config.SocketOptions) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var sockErr error
+		if err := c.Control(func(fd uintptr) {
+			sockErr = setSocketOptions(fd, network, address, opts)
+		}); err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,57 @@
+package prober
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+
+	pconfig "github.com/prometheus/common/config"
+)
+
+// TestProbeTCPResolver tests resolving the target with the resolver in the
+// module
+func TestProbeTCPResolver(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	dnsServer, err := test.SetupDNSServer(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer dnsServer.Close()
+
+	_, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	module := config.Module{
+		Resolver: dnsServer.Conn.LocalAddr().String(),
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:     caFile,
+			ServerName: "127.0.0.1",
+		},
+	}
+
+	if _, err := ProbeTCP(context.Background(), net.JoinHostPort("example.ribbybibby.invalid", port), module, 10*time.Second, nil); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+}
+
+// TestNewResolverDefault tests that the system resolver is used when the
+// module doesn't configure one
+func TestNewResolverDefault(t *testing.T) {
+	if NewResolver(config.Module{}) != net.DefaultResolver {
+		t.Fatalf("expected the system resolver")
+	}
+}
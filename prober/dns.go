@@ -0,0 +1,225 @@
+package prober
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// resolvConf is the file that the nameserver is read from when the module
+// doesn't configure a resolver
+var resolvConf = "/etc/resolv.conf"
+
+// errShortDNSMessage is returned when a DNS message ends before a field in it
+var errShortDNSMessage = errors.New("short DNS message")
+
+// lookupDNS returns the data of the records of the type in the answer to a
+// query for the name. The net package can only look up a few types of record,
+// so the query is made directly to the nameserver. A name that doesn't exist
+// has no records.
+func lookupDNS(ctx context.Context, module config.Module, name string, qtype uint16) ([][]byte, error) {
+	server, err := nameserver(module)
+	if err != nil {
+		return nil, err
+	}
+
+	query, id, err := newDNSQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := exchangeDNS(ctx, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+	// Retry over TCP when the response didn't fit in a datagram
+	if len(resp) > 2 && resp[2]&0x02 != 0 {
+		resp, err = exchangeDNS(ctx, "tcp", server, query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return parseDNSResponse(resp, id, qtype)
+}
+
+// nameserver returns the address of the DNS server configured in the module,
+// or the first nameserver in resolv.conf
+func nameserver(module config.Module) (string, error) {
+	if module.Resolver != "" {
+		if _, _, err := net.SplitHostPort(module.Resolver); err != nil {
+			return net.JoinHostPort(module.Resolver, "53"), nil
+		}
+		return module.Resolver, nil
+	}
+
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return "", fmt.Errorf("error reading the nameserver: %s", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) > 1 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", fmt.Errorf("error reading the nameserver: %s", err)
+	}
+
+	return "", fmt.Errorf("no nameserver in %s", resolvConf)
+}
+
+// newDNSQuery returns a recursive query for the records of the type and the
+// id of the query
+func newDNSQuery(name string, qtype uint16) ([]byte, uint16, error) {
+	var idBytes [2]byte
+	if _, err := rand.Read(idBytes[:]); err != nil {
+		return nil, 0, err
+	}
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	// The header: the id, recursion desired and a single question
+	query := []byte{idBytes[0], idBytes[1], 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid name: %q", name)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	// The root label, the type and class IN
+	query = append(query, 0x00, byte(qtype>>8), byte(qtype), 0x00, 0x01)
+
+	return query, id, nil
+}
+
+// exchangeDNS sends the query to the server and returns the response. Over
+// TCP the messages are prefixed with their length.
+func exchangeDNS(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return nil, err
+		}
+	}
+
+	if network == "tcp" {
+		msg := make([]byte, 2, len(query)+2)
+		binary.BigEndian.PutUint16(msg, uint16(len(query)))
+		if _, err := conn.Write(append(msg, query...)); err != nil {
+			return nil, err
+		}
+
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		return resp, nil
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, 65535)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	return resp[:n], nil
+}
+
+// parseDNSResponse returns the data of the records of the type in the answer
+// section of the response. Other records, like the CNAMEs that lead to them,
+// are skipped.
+func parseDNSResponse(resp []byte, id, qtype uint16) ([][]byte, error) {
+	if len(resp) < 12 {
+		return nil, errShortDNSMessage
+	}
+	if binary.BigEndian.Uint16(resp) != id {
+		return nil, fmt.Errorf("unexpected id in the response")
+	}
+	switch rcode := resp[3] & 0x0f; rcode {
+	case 0:
+	case 3:
+		// NXDOMAIN
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("the server responded with rcode %d", rcode)
+	}
+	questions := int(binary.BigEndian.Uint16(resp[4:]))
+	answers := int(binary.BigEndian.Uint16(resp[6:]))
+
+	off := 12
+	for i := 0; i < questions; i++ {
+		end, err := skipDNSName(resp, off)
+		if err != nil {
+			return nil, err
+		}
+		off = end + 4
+	}
+
+	var rdatas [][]byte
+	for i := 0; i < answers; i++ {
+		end, err := skipDNSName(resp, off)
+		if err != nil {
+			return nil, err
+		}
+		if end+10 > len(resp) {
+			return nil, errShortDNSMessage
+		}
+		rrType := binary.BigEndian.Uint16(resp[end:])
+		length := int(binary.BigEndian.Uint16(resp[end+8:]))
+		off = end + 10 + length
+		if off > len(resp) {
+			return nil, errShortDNSMessage
+		}
+		if rrType == qtype {
+			rdatas = append(rdatas, resp[end+10:off])
+		}
+	}
+
+	return rdatas, nil
+}
+
+// skipDNSName returns the offset of the end of the name that starts at off,
+// which may be compressed
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errShortDNSMessage
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xc0 == 0xc0:
+			// A pointer ends the name
+			return off + 2, nil
+		}
+		off += length + 1
+	}
+}
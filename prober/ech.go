@@ -0,0 +1,28 @@
+//go:build go1.23
+// +build go1.23
+
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// setECHConfig sets the ECHConfigList in the TLS config when the module
+// enables ECH, so that the handshake is made with the server name hidden from
+// the front end
+func setECHConfig(ctx context.Context, tlsConfig *tls.Config, module config.Module, host, port string) error {
+	if !module.ECH.Enabled() {
+		return nil
+	}
+
+	configList, err := echConfigList(ctx, module, host, port)
+	if err != nil {
+		return err
+	}
+	tlsConfig.EncryptedClientHelloConfigList = configList
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package prober
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+const (
+	// dnsTypeHTTPS is the type of the HTTPS record
+	//
+	// See https://www.rfc-editor.org/rfc/rfc9460#section-14.1
+	dnsTypeHTTPS = 65
+
+	// svcParamECH is the key of the parameter of an HTTPS record that holds
+	// the ECHConfigList
+	svcParamECH = 5
+)
+
+// echConfigList returns the ECHConfigList configured in the module, or looks
+// it up in DNS
+func echConfigList(ctx context.Context, module config.Module, host, port string) ([]byte, error) {
+	if module.ECH.ConfigList == "" {
+		return lookupECHConfigList(ctx, module, host, port)
+	}
+
+	configList, err := base64.StdEncoding.DecodeString(module.ECH.ConfigList)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the ECH config list: %s", err)
+	}
+
+	return configList, nil
+}
+
+// lookupECHConfigList returns the ech parameter of the ServiceMode HTTPS
+// record of the host with the lowest priority. Ports other than 443 are looked
+// up under the port prefixed name described in RFC 9460.
+func lookupECHConfigList(ctx context.Context, module config.Module, host, port string) ([]byte, error) {
+	name := host
+	if port != "" && port != "443" {
+		name = "_" + port + "._https." + host
+	}
+
+	rdatas, err := lookupDNS(ctx, module, name, dnsTypeHTTPS)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up the HTTPS record of %s: %s", name, err)
+	}
+
+	var (
+		configList []byte
+		priority   uint16
+	)
+	for _, rdata := range rdatas {
+		if len(rdata) < 2 {
+			return nil, errShortDNSMessage
+		}
+		// Records in AliasMode have a priority of 0 and no parameters
+		p := binary.BigEndian.Uint16(rdata)
+		if p == 0 || (configList != nil && p >= priority) {
+			continue
+		}
+
+		ech, err := svcParam(rdata, svcParamECH)
+		if err != nil {
+			return nil, fmt.Errorf("error looking up the HTTPS record of %s: %s", name, err)
+		}
+		if ech != nil {
+			configList, priority = ech, p
+		}
+	}
+	if configList == nil {
+		return nil, fmt.Errorf("no ECH config in the HTTPS record of %s", name)
+	}
+
+	return configList, nil
+}
+
+// svcParam returns the value of the parameter with the key in the rdata of an
+// HTTPS record, or nil when the record doesn't have it
+func svcParam(rdata []byte, key uint16) ([]byte, error) {
+	// The target name isn't compressed, so it ends at the first empty label
+	off := 2
+	for {
+		if off >= len(rdata) {
+			return nil, errShortDNSMessage
+		}
+		length := int(rdata[off])
+		off++
+		if length == 0 {
+			break
+		}
+		off += length
+	}
+
+	for off+4 <= len(rdata) {
+		k := binary.BigEndian.Uint16(rdata[off:])
+		length := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		off += 4
+		if off+length > len(rdata) {
+			return nil, errShortDNSMessage
+		}
+		if k == key {
+			return rdata[off : off+length], nil
+		}
+		off += length
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,21 @@
+//go:build !go1.23
+// +build !go1.23
+
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// setECHConfig returns an error when the module enables ECH because the
+// client side of ECH isn't supported by crypto/tls before go 1.23
+func setECHConfig(ctx context.Context, tlsConfig *tls.Config, module config.Module, host, port string) error {
+	if !module.ECH.Enabled() {
+		return nil
+	}
+	return fmt.Errorf("ECH requires the exporter to be built with go 1.23 or later")
+}
@@ -0,0 +1,162 @@
+//go:build go1.24
+// +build go1.24
+
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestProbeHTTPSECH tests that the encrypted client hello is accepted when
+// the module has the server's ECH config
+func TestProbeHTTPSECH(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	configList, key, err := test.GenerateECHKey(1, "public.ribbybibby.me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS.EncryptedClientHelloKeys = []tls.EncryptedClientHelloKey{key}
+
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:     caFile,
+			ServerName: "example.ribbybibby.me",
+		},
+		ECH: config.ECH{
+			ConfigList: base64.StdEncoding.EncodeToString(configList),
+		},
+	}
+
+	state, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if !state.ECHAccepted {
+		t.Fatalf("expected ECH to be accepted")
+	}
+}
+
+// TestProbeHTTPSECHRejected tests that the probe fails when the server can't
+// decrypt the encrypted client hello
+func TestProbeHTTPSECHRejected(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	_, key, err := test.GenerateECHKey(1, "example.ribbybibby.me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS.EncryptedClientHelloKeys = []tls.EncryptedClientHelloKey{key}
+
+	server.StartTLS()
+	defer server.Close()
+
+	// A config with a different key
+	configList, _, err := test.GenerateECHKey(2, "example.ribbybibby.me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:     caFile,
+			ServerName: "example.ribbybibby.me",
+		},
+		ECH: config.ECH{
+			ConfigList: base64.StdEncoding.EncodeToString(configList),
+		},
+	}
+
+	_, err = ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil)
+	var echErr *tls.ECHRejectionError
+	if !errors.As(err, &echErr) {
+		t.Fatalf("expected an ECH rejection error, but got: %v", err)
+	}
+}
+
+// TestProbeTCPECHFromDNS tests taking the ECH config from the HTTPS record of
+// the target
+func TestProbeTCPECHFromDNS(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	configList, key, err := test.GenerateECHKey(1, "public.ribbybibby.me")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.TLS.EncryptedClientHelloKeys = []tls.EncryptedClientHelloKey{key}
+
+	server.StartTLS()
+	defer server.Close()
+
+	dnsServer, err := test.SetupDNSServer(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsServer.Close()
+	dnsServer.SetECHConfigList(configList)
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:     caFile,
+			ServerName: "example.ribbybibby.me",
+		},
+		Resolver: dnsServer.Conn.LocalAddr().String(),
+		ECH: config.ECH{
+			FetchFromDNS: true,
+		},
+	}
+
+	state, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if !state.ECHAccepted {
+		t.Fatalf("expected ECH to be accepted")
+	}
+}
+
+// TestProbeTCPECHNoRecord tests that the probe fails when there isn't an ECH
+// config in DNS
+func TestProbeTCPECHNoRecord(t *testing.T) {
+	dnsServer, err := test.SetupDNSServer(net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dnsServer.Close()
+
+	module := config.Module{
+		Resolver: dnsServer.Conn.LocalAddr().String(),
+		ECH: config.ECH{
+			FetchFromDNS: true,
+		},
+	}
+
+	if _, err := echConfigList(context.Background(), module, "example.ribbybibby.me", "8443"); err == nil {
+		t.Fatalf("expected error, but err was nil")
+	}
+}
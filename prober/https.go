@@ -1,23 +1,32 @@
 package prober
 
 import (
+	"context"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 	"github.com/ribbybibby/ssl_exporter/config"
-
-	pconfig "github.com/prometheus/common/config"
 )
 
 // ProbeHTTPS performs a https probe
-func ProbeHTTPS(target string, module config.Module, timeout time.Duration) (*tls.ConnectionState, error) {
+func ProbeHTTPS(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error) {
+	return probeHTTPS(ctx, target, module, timeout, ch, nil, nil)
+}
+
+// probeHTTPS issues a GET request to the target and returns the state of the
+// TLS connection. The request is passed to prepareRequest, when it's given,
+// before it's sent. The response is passed to handleResponse, when it's
+// given, after the connection has been checked.
+func probeHTTPS(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric, prepareRequest func(*http.Request) error, handleResponse func(*http.Response) error) (*tls.ConnectionState, error) {
 	if strings.HasPrefix(target, "http://") {
 		return nil, fmt.Errorf("Target is using http scheme: %s", target)
 	}
@@ -31,37 +40,76 @@ func ProbeHTTPS(target string, module config.Module, timeout time.Duration) (*tl
 		return nil, err
 	}
 
-	tlsConfig, err := pconfig.NewTLSConfig(&module.TLSConfig)
+	tlsConfig, err := newTLSConfig(module)
 	if err != nil {
 		return nil, err
 	}
 
-	proxy := http.ProxyFromEnvironment
-	if module.HTTPS.ProxyURL.URL != nil {
-		proxy = http.ProxyURL(module.HTTPS.ProxyURL.URL)
+	serverName := tlsConfig.ServerName
+	if serverName == "" {
+		serverName = targetURL.Hostname()
 	}
 
+	port := targetURL.Port()
+	if port == "" {
+		port = "443"
+	}
+	if err := setECHConfig(ctx, tlsConfig, module, serverName, port); err != nil {
+		return nil, err
+	}
+
+	verifier := newAIAVerifier(ctx, tlsConfig, module, serverName, timeout)
+	certificateRequest := recordCertificateRequest(tlsConfig)
+	defer certificateRequest.collect(ch)
+
 	client := &http.Client{
 		CheckRedirect: func(req *http.Request, via []*http.Request) error {
 			return http.ErrUseLastResponse
 		},
 		Transport: &http.Transport{
+			DialContext:       newDialer(module, timeout).DialContext,
 			TLSClientConfig:   tlsConfig,
-			Proxy:             proxy,
 			DisableKeepAlives: true,
+			// HTTP/2 has to be enabled explicitly when the transport
+			// has a custom dialer or TLS config
+			ForceAttemptHTTP2: module.RequireALPN == "h2",
 		},
 		Timeout: timeout,
 	}
 
 	// Issue a GET request to the target
-	resp, err := client.Get(targetURL.String())
+	req, err := http.NewRequestWithContext(ctx, "GET", targetURL.String(), nil)
 	if err != nil {
 		return nil, err
 	}
+	setUserAgent(req)
+	if prepareRequest != nil {
+		if err := prepareRequest(req); err != nil {
+			return nil, err
+		}
+	}
+
+	// The proxy is resolved up front so that it can be reported, and so that
+	// an isolated stream gets its credentials
+	proxyURL, err := getProxy(module, req)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport.(*http.Transport).Proxy = http.ProxyURL(proxyURL)
+	collectProxy(ch, proxyURL)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, handshakeError(err)
+	}
 	defer func() {
-		_, err := io.Copy(ioutil.Discard, resp.Body)
-		if err != nil {
-			log.Errorln(err)
+		// The body of a 101 is the upgraded connection, which would
+		// be read until the timeout
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			_, err := io.Copy(ioutil.Discard, resp.Body)
+			if err != nil {
+				log.Errorln(err)
+			}
 		}
 		resp.Body.Close()
 	}()
@@ -71,5 +119,74 @@ func ProbeHTTPS(target string, module config.Module, timeout time.Duration) (*tl
 		return nil, fmt.Errorf("The response from %s is unencrypted", targetURL.String())
 	}
 
+	if err := checkALPN(module, resp.TLS); err != nil {
+		return nil, err
+	}
+	verifier.complete(resp.TLS, ch)
+
+	if module.HTTPS.HSTS {
+		collectHSTS(ch, resp.Header.Get("Strict-Transport-Security"))
+	}
+
+	if handleResponse != nil {
+		if err := handleResponse(resp); err != nil {
+			return nil, err
+		}
+	}
+
 	return resp.TLS, nil
 }
+
+// setUserAgent sets the User-Agent header of the request to UserAgent, if it
+// has been set
+func setUserAgent(req *http.Request) {
+	if UserAgent != "" {
+		req.Header.Set("User-Agent", UserAgent)
+	}
+}
+
+// collectHSTS emits metrics describing the Strict-Transport-Security header.
+// The max-age is only emitted when the header is present and valid.
+func collectHSTS(ch chan<- prometheus.Metric, header string) {
+	maxAge, ok := parseHSTSMaxAge(header)
+
+	var enabled float64
+	if ok && maxAge > 0 {
+		enabled = 1
+	}
+	emit(ch, prometheus.MustNewConstMetric(hstsEnabled, prometheus.GaugeValue, enabled))
+
+	if ok {
+		emit(ch, prometheus.MustNewConstMetric(hstsMaxAge, prometheus.GaugeValue, float64(maxAge)))
+	}
+}
+
+// parseHSTSMaxAge returns the max-age directive of a Strict-Transport-Security
+// header. It returns false if the header doesn't have exactly one valid
+// max-age directive.
+//
+// See https://tools.ietf.org/html/rfc6797#section-6.1
+func parseHSTSMaxAge(header string) (int64, bool) {
+	var (
+		maxAge int64
+		found  bool
+	)
+	for _, directive := range strings.Split(header, ";") {
+		parts := strings.SplitN(strings.TrimSpace(directive), "=", 2)
+		if !strings.EqualFold(strings.TrimSpace(parts[0]), "max-age") {
+			continue
+		}
+		if found || len(parts) != 2 {
+			return 0, false
+		}
+		value := strings.Trim(strings.TrimSpace(parts[1]), `"`)
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || v < 0 {
+			return 0, false
+		}
+		maxAge = v
+		found = true
+	}
+
+	return maxAge, found
+}
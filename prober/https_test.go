@@ -1,16 +1,26 @@
 package prober
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	pconfig "github.com/prometheus/common/config"
 	"github.com/ribbybibby/ssl_exporter/config"
 	"github.com/ribbybibby/ssl_exporter/test"
@@ -34,7 +44,7 @@ func TestProbeHTTPS(t *testing.T) {
 		},
 	}
 
-	state, err := ProbeHTTPS(server.URL, module, 5*time.Second)
+	state, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil)
 	if err != nil {
 		t.Fatalf("error: %s", err)
 	}
@@ -67,7 +77,7 @@ func TestProbeHTTPSInvalidName(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 
-	if _, err := ProbeHTTPS("https://localhost:"+u.Port(), module, 5*time.Second); err == nil {
+	if _, err := ProbeHTTPS(context.Background(), "https://localhost:"+u.Port(), module, 5*time.Second, nil); err == nil {
 		t.Fatalf("expected error, but err was nil")
 	}
 }
@@ -96,7 +106,7 @@ func TestProbeHTTPSNoScheme(t *testing.T) {
 		t.Fatalf(err.Error())
 	}
 
-	if _, err := ProbeHTTPS(u.Host, module, 5*time.Second); err != nil {
+	if _, err := ProbeHTTPS(context.Background(), u.Host, module, 5*time.Second, nil); err != nil {
 		t.Fatalf("error: %s", err)
 	}
 }
@@ -126,7 +136,7 @@ func TestProbeHTTPSServerName(t *testing.T) {
 		},
 	}
 
-	if _, err := ProbeHTTPS("https://localhost:"+u.Port(), module, 5*time.Second); err != nil {
+	if _, err := ProbeHTTPS(context.Background(), "https://localhost:"+u.Port(), module, 5*time.Second, nil); err != nil {
 		t.Fatalf("error: %s", err)
 	}
 }
@@ -139,7 +149,7 @@ func TestProbeHTTPSHTTP(t *testing.T) {
 	server.Start()
 	defer server.Close()
 
-	if _, err := ProbeHTTPS(server.URL, config.Module{}, 5*time.Second); err == nil {
+	if _, err := ProbeHTTPS(context.Background(), server.URL, config.Module{}, 5*time.Second, nil); err == nil {
 		t.Fatalf("expected error, but err was nil")
 	}
 }
@@ -186,7 +196,7 @@ func TestProbeHTTPSClientAuth(t *testing.T) {
 		},
 	}
 
-	state, err := ProbeHTTPS(server.URL, module, 5*time.Second)
+	state, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil)
 	if err != nil {
 		t.Fatalf("error: %s", err)
 	}
@@ -241,7 +251,93 @@ func TestProbeHTTPSClientAuthWrongClientCert(t *testing.T) {
 		},
 	}
 
-	if _, err := ProbeHTTPS(server.URL, module, 5*time.Second); err == nil {
+	if _, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil); err == nil {
+		t.Fatalf("expected error but err is nil")
+	}
+}
+
+// TestProbeHTTPSClientCertificates tests that the client certificate sent is
+// the one issued by a CA that the server accepts
+func TestProbeHTTPSClientCertificates(t *testing.T) {
+	server, certPEM, keyPEM, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	// Configure client auth on the server
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM(certPEM)
+
+	server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	server.TLS.RootCAs = certPool
+	server.TLS.ClientCAs = certPool
+
+	server.StartTLS()
+	defer server.Close()
+
+	// Create a certificate from another CA, which the server won't accept
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	otherTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 1))
+	otherTmpl.Subject.CommonName = "other.ribbybibby.me"
+	otherTmpl.SerialNumber = big.NewInt(200)
+	_, otherCertPEM := test.GenerateSelfSignedCertificateWithPrivateKey(otherTmpl, otherKey)
+	otherKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(otherKey)})
+
+	var files []string
+	defer func() {
+		for _, file := range files {
+			os.Remove(file)
+		}
+	}()
+	for _, contents := range [][]byte{otherCertPEM, otherKeyPEM, certPEM, keyPEM} {
+		file, err := test.WriteFile("client.pem", contents)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		files = append(files, file)
+	}
+	other := config.ClientCert{CertFile: files[0], KeyFile: files[1]}
+	accepted := config.ClientCert{CertFile: files[2], KeyFile: files[3]}
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+		ClientCertificates: []config.ClientCert{other, accepted},
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	if _, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, ch); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	close(ch)
+
+	var selected []string
+	for m := range ch {
+		if m.Desc() != clientCertSelected {
+			continue
+		}
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatalf(err.Error())
+		}
+		for _, label := range pb.GetLabel() {
+			if label.GetName() == "cn" {
+				selected = append(selected, label.GetValue())
+			}
+		}
+	}
+	if len(selected) != 1 || selected[0] != "example.ribbybibby.me" {
+		t.Errorf("expected the client certificate for example.ribbybibby.me to be selected, got %v", selected)
+	}
+
+	// Without a certificate the server accepts, none is sent
+	module.ClientCertificates = []config.ClientCert{other}
+	if _, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil); err == nil {
 		t.Fatalf("expected error but err is nil")
 	}
 }
@@ -272,7 +368,7 @@ func TestProbeHTTPSExpired(t *testing.T) {
 		},
 	}
 
-	if _, err := ProbeHTTPS(server.URL, module, 5*time.Second); err == nil {
+	if _, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil); err == nil {
 		t.Fatalf("expected error but err is nil")
 	}
 }
@@ -304,7 +400,7 @@ func TestProbeHTTPSExpiredInsecure(t *testing.T) {
 		},
 	}
 
-	state, err := ProbeHTTPS(server.URL, module, 5*time.Second)
+	state, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil)
 	if err != nil {
 		t.Fatalf("error: %s", err)
 	}
@@ -352,7 +448,7 @@ func TestProbeHTTPSProxy(t *testing.T) {
 		},
 	}
 
-	_, err = ProbeHTTPS(server.URL, module, 5*time.Second)
+	_, err = ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil)
 	if err == nil {
 		t.Fatalf("expected error but err was nil")
 	}
@@ -360,7 +456,7 @@ func TestProbeHTTPSProxy(t *testing.T) {
 	// Test with the proxy url, this shouldn't return an error
 	module.HTTPS.ProxyURL = config.URL{URL: proxyURL}
 
-	state, err := ProbeHTTPS(server.URL, module, 5*time.Second)
+	state, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil)
 	if err != nil {
 		t.Fatalf("error: %s", err)
 	}
@@ -368,3 +464,237 @@ func TestProbeHTTPSProxy(t *testing.T) {
 		t.Fatalf("expected state but got nil")
 	}
 }
+
+// TestProbeHTTPSSOCKS5IsolateStreams tests that with isolate_streams every
+// probe authenticates to the SOCKS5 proxy with the target and a different
+// password, and that the proxy is reported without the credentials
+func TestProbeHTTPSSOCKS5IsolateStreams(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	proxyServer, err := test.SetupSOCKS5Server()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer proxyServer.Close()
+
+	proxyURL, err := url.Parse("socks5://" + proxyServer.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+		HTTPS: config.HTTPSProbe{
+			ProxyURL:       config.URL{URL: proxyURL},
+			IsolateStreams: true,
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		ch := make(chan prometheus.Metric, 100)
+		if _, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, ch); err != nil {
+			t.Fatalf("error: %s", err)
+		}
+		close(ch)
+
+		var proxies []string
+		for m := range ch {
+			if m.Desc() != proxyInfo {
+				continue
+			}
+			pb := &dto.Metric{}
+			if err := m.Write(pb); err != nil {
+				t.Fatalf(err.Error())
+			}
+			proxies = append(proxies, pb.GetLabel()[0].GetValue())
+		}
+		if len(proxies) != 1 || proxies[0] != proxyURL.String() {
+			t.Errorf("expected ssl_probe_proxy_info for %s, got %v", proxyURL, proxies)
+		}
+	}
+
+	credentials := proxyServer.Credentials()
+	if len(credentials) != 2 {
+		t.Fatalf("expected 2 connections to authenticate to the proxy, got %v", credentials)
+	}
+	host := strings.TrimPrefix(server.URL, "https://")
+	for _, c := range credentials {
+		if !strings.HasPrefix(c, host+":") {
+			t.Errorf("expected the username to be %s, got %s", host, c)
+		}
+	}
+	if credentials[0] == credentials[1] {
+		t.Errorf("expected each probe to use a different password, got %s twice", credentials[0])
+	}
+
+	// Without a SOCKS5 proxy the probe fails, rather than being sent directly
+	module.HTTPS.ProxyURL = config.URL{}
+	if _, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil); err == nil || !strings.Contains(err.Error(), "isolate_streams") {
+		t.Errorf("expected an isolate_streams error, got %v", err)
+	}
+}
+
+// TestProbeHTTPSPlaintext tests that a http server on the target port returns
+// a NotTLSError
+func TestProbeHTTPSPlaintext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "Hello world")
+	}))
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	_, err = ProbeHTTPS(context.Background(), "https://"+u.Host, config.Module{}, 5*time.Second, nil)
+	if _, ok := err.(*NotTLSError); !ok {
+		t.Fatalf("expected a NotTLSError, got: %v", err)
+	}
+}
+
+// TestParseHSTSMaxAge tests parsing the max-age from a Strict-Transport-Security
+// header
+func TestParseHSTSMaxAge(t *testing.T) {
+	tests := []struct {
+		header string
+		maxAge int64
+		ok     bool
+	}{
+		{"max-age=31536000", 31536000, true},
+		{"max-age=31536000; includeSubDomains; preload", 31536000, true},
+		{`includeSubDomains; Max-Age="600"`, 600, true},
+		{"max-age=0", 0, true},
+		{"", 0, false},
+		{"includeSubDomains", 0, false},
+		{"max-age=abc", 0, false},
+		{"max-age=-1", 0, false},
+		{"max-age=600; max-age=700", 0, false},
+	}
+
+	for _, tt := range tests {
+		maxAge, ok := parseHSTSMaxAge(tt.header)
+		if maxAge != tt.maxAge || ok != tt.ok {
+			t.Errorf("header %q: expected (%d, %t) but got (%d, %t)", tt.header, tt.maxAge, tt.ok, maxAge, ok)
+		}
+	}
+}
+
+// TestProbeHTTPSUserAgent tests that the configured User-Agent is sent to the
+// target
+func TestProbeHTTPSUserAgent(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	var userAgent string
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgent = r.UserAgent()
+	})
+	server.StartTLS()
+	defer server.Close()
+
+	UserAgent = "ssl_exporter/test"
+	defer func() { UserAgent = "" }()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+	}
+
+	if _, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if userAgent != "ssl_exporter/test" {
+		t.Errorf("expected User-Agent ssl_exporter/test but got %q", userAgent)
+	}
+}
+
+// TestProbeHTTPSRequireALPN tests requiring HTTP/2 from a server that
+// supports it
+func TestProbeHTTPSRequireALPN(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+		RequireALPN: "h2",
+	}
+
+	state, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if state.NegotiatedProtocol != "h2" {
+		t.Errorf("expected h2 but got %q", state.NegotiatedProtocol)
+	}
+}
+
+// TestProbeHTTPSRotatedCertificate tests that a probe sees the certificate
+// the server is serving now, rather than one from an earlier connection
+func TestProbeHTTPSRotatedCertificate(t *testing.T) {
+	server, _, _, _, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	var certs []tls.Certificate
+	for i := 0; i < 2; i++ {
+		certPEM, keyPEM := test.GenerateTestCertificate(time.Now().AddDate(0, 0, i+1))
+		cert, err := tls.X509KeyPair(certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		certs = append(certs, cert)
+	}
+
+	// The server name is needed for the server to use GetCertificate over
+	// the certificate httptest adds
+	var current int32
+	server.TLS.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &certs[atomic.LoadInt32(&current)], nil
+	}
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			ServerName:         "example.ribbybibby.me",
+			InsecureSkipVerify: true,
+		},
+	}
+
+	for i := range certs {
+		atomic.StoreInt32(&current, int32(i))
+
+		state, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil)
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+		if !bytes.Equal(state.PeerCertificates[0].Raw, certs[i].Certificate[0]) {
+			t.Errorf("probe %d didn't see the certificate being served", i)
+		}
+	}
+}
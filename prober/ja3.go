@@ -0,0 +1,182 @@
+package prober
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+const (
+	extensionSupportedGroups = 10
+	extensionECPointFormats  = 11
+)
+
+// ClientHelloJA3 returns the JA3 string and hash of the ClientHello that the
+// probers send for the module to the given server name.
+//
+// Go randomises the order of the extensions in the ClientHello, so they are
+// sorted before the fingerprint is computed, otherwise it would change with
+// every probe.
+//
+// See https://github.com/salesforce/ja3
+func ClientHelloJA3(module config.Module, serverName string) (string, string, error) {
+	tlsConfig, err := newTLSConfig(module)
+	if err != nil {
+		return "", "", err
+	}
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = serverName
+	}
+
+	hello, err := captureClientHello(tlsConfig)
+	if err != nil {
+		return "", "", err
+	}
+
+	ja3, err := ja3String(hello)
+	if err != nil {
+		return "", "", err
+	}
+	hash := md5.Sum([]byte(ja3))
+
+	return ja3, hex.EncodeToString(hash[:]), nil
+}
+
+// captureClientHello starts a handshake over an in-memory connection and
+// returns the handshake message in the first record the client writes
+func captureClientHello(tlsConfig *tls.Config) ([]byte, error) {
+	client, server := net.Pipe()
+	defer server.Close()
+
+	go func() {
+		tls.Client(client, tlsConfig).Handshake()
+		client.Close()
+	}()
+
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		return nil, err
+	}
+	record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// ja3String builds the JA3 string from a ClientHello handshake message
+func ja3String(hello []byte) (string, error) {
+	r := &helloReader{b: hello}
+
+	if msgType := r.uint8(); msgType != 1 {
+		return "", fmt.Errorf("not a ClientHello: handshake type %d", msgType)
+	}
+	r.skip(3)
+	version := r.uint16()
+	r.skip(32)
+	r.skip(int(r.uint8()))
+
+	var ciphers []uint16
+	cipherSuites := r.sub(int(r.uint16()))
+	for !cipherSuites.empty() {
+		ciphers = append(ciphers, cipherSuites.uint16())
+	}
+
+	r.skip(int(r.uint8()))
+
+	var extensions, groups []uint16
+	var formats []uint16
+	exts := r.sub(int(r.uint16()))
+	for !exts.empty() {
+		extType := exts.uint16()
+		data := exts.sub(int(exts.uint16()))
+		extensions = append(extensions, extType)
+
+		switch extType {
+		case extensionSupportedGroups:
+			list := data.sub(int(data.uint16()))
+			for !list.empty() {
+				groups = append(groups, list.uint16())
+			}
+		case extensionECPointFormats:
+			list := data.sub(int(data.uint8()))
+			for !list.empty() {
+				formats = append(formats, uint16(list.uint8()))
+			}
+		}
+	}
+
+	if r.err != nil || exts.err != nil {
+		return "", fmt.Errorf("malformed ClientHello")
+	}
+
+	sort.Slice(extensions, func(i, j int) bool { return extensions[i] < extensions[j] })
+
+	return strings.Join([]string{
+		strconv.Itoa(int(version)),
+		joinJA3Values(ciphers),
+		joinJA3Values(extensions),
+		joinJA3Values(groups),
+		joinJA3Values(formats),
+	}, ","), nil
+}
+
+// joinJA3Values joins the values with dashes, leaving out GREASE values
+func joinJA3Values(values []uint16) string {
+	var s []string
+	for _, v := range values {
+		if v&0x0f0f == 0x0a0a {
+			continue
+		}
+		s = append(s, strconv.Itoa(int(v)))
+	}
+	return strings.Join(s, "-")
+}
+
+// helloReader reads big-endian values from a byte slice, recording an error
+// instead of panicking when it runs out of data
+type helloReader struct {
+	b   []byte
+	err error
+}
+
+func (r *helloReader) next(n int) []byte {
+	if r.err != nil || n > len(r.b) {
+		r.err = io.ErrUnexpectedEOF
+		return make([]byte, n)
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b
+}
+
+func (r *helloReader) uint8() uint8 {
+	return r.next(1)[0]
+}
+
+func (r *helloReader) uint16() uint16 {
+	return binary.BigEndian.Uint16(r.next(2))
+}
+
+func (r *helloReader) skip(n int) {
+	r.next(n)
+}
+
+func (r *helloReader) sub(n int) *helloReader {
+	sub := &helloReader{b: r.next(n), err: r.err}
+	return sub
+}
+
+func (r *helloReader) empty() bool {
+	return r.err != nil || len(r.b) == 0
+}
@@ -0,0 +1,83 @@
+package prober
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// TestClientHelloJA3 tests the JA3 string of the ClientHello sent by the
+// probers
+func TestClientHelloJA3(t *testing.T) {
+	ja3, hash, err := ClientHelloJA3(config.Module{}, "example.com")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	fields := strings.Split(ja3, ",")
+	if len(fields) != 5 {
+		t.Fatalf("expected 5 fields in the JA3 string, got: %s", ja3)
+	}
+
+	// TLS 1.2 is the legacy version in every ClientHello
+	if fields[0] != "771" {
+		t.Errorf("expected version 771, got %s", fields[0])
+	}
+
+	// TLS_AES_128_GCM_SHA256
+	if !strings.Contains("-"+fields[1]+"-", "-4865-") {
+		t.Errorf("expected cipher 4865 in %s", fields[1])
+	}
+
+	// server_name
+	if !strings.HasPrefix(fields[2], "0-") {
+		t.Errorf("expected the server_name extension in %s", fields[2])
+	}
+
+	if len(hash) != 32 {
+		t.Errorf("expected an md5 hash, got %s", hash)
+	}
+
+	// The extensions are sorted so the hash is stable
+	_, again, err := ClientHelloJA3(config.Module{}, "example.com")
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if again != hash {
+		t.Errorf("expected the same hash, got %s and %s", hash, again)
+	}
+}
+
+// TestJA3StringGREASE tests that GREASE values are left out of the JA3 string
+func TestJA3StringGREASE(t *testing.T) {
+	hello := []byte{
+		// ClientHello with a length that isn't checked
+		0x01, 0x00, 0x00, 0x00,
+		// Version
+		0x03, 0x03,
+	}
+	hello = append(hello, make([]byte, 32)...)
+	hello = append(hello,
+		// Session ID
+		0x00,
+		// Cipher suites: GREASE, TLS_AES_128_GCM_SHA256
+		0x00, 0x04, 0x0a, 0x0a, 0x13, 0x01,
+		// Compression methods
+		0x01, 0x00,
+		// Extensions
+		0x00, 0x10,
+		// supported_groups: GREASE, x25519
+		0x00, 0x0a, 0x00, 0x06, 0x00, 0x04, 0x1a, 0x1a, 0x00, 0x1d,
+		// ec_point_formats: uncompressed
+		0x00, 0x0b, 0x00, 0x02, 0x01, 0x00,
+	)
+
+	ja3, err := ja3String(hello)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if ja3 != "771,4865,10-11,29,0" {
+		t.Errorf("unexpected JA3 string: %s", ja3)
+	}
+}
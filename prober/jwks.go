@@ -0,0 +1,92 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// maxJWKSSize limits the size of a JWKS document
+const maxJWKSSize = 1 << 20
+
+// jwks is a JSON Web Key Set, with just the fields needed to find the
+// certificates of the keys
+//
+// See https://tools.ietf.org/html/rfc7517#section-5
+type jwks struct {
+	Keys []struct {
+		Kid string   `json:"kid"`
+		X5c []string `json:"x5c"`
+	} `json:"keys"`
+}
+
+// ProbeJWKS fetches a JSON Web Key Set over https and exports the expiry of
+// the certificate in the x5c parameter of each key. The connection state of
+// the request is returned, so the endpoint's own certificate is probed too.
+func ProbeJWKS(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error) {
+	return probeHTTPS(ctx, target, module, timeout, ch, nil, func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status fetching the JWKS: %s", resp.Status)
+		}
+
+		certs, err := parseJWKS(io.LimitReader(resp.Body, maxJWKSSize))
+		if err != nil {
+			return err
+		}
+
+		for kid, cert := range certs {
+			labels := []string{kid, cert.SerialNumber.String(), cert.Issuer.CommonName, cert.Subject.CommonName}
+			emit(ch, prometheus.MustNewConstMetric(
+				jwksCertNotAfter, prometheus.GaugeValue, float64(cert.NotAfter.Unix()), labels...,
+			))
+			emit(ch, prometheus.MustNewConstMetric(
+				jwksCertNotBefore, prometheus.GaugeValue, float64(cert.NotBefore.Unix()), labels...,
+			))
+		}
+
+		return nil
+	})
+}
+
+// parseJWKS returns the certificate containing each key in the set, by kid.
+// The certificate of a key is the first in its x5c parameter. Keys without
+// one are ignored.
+func parseJWKS(r io.Reader) (map[string]*x509.Certificate, error) {
+	var set jwks
+	if err := json.NewDecoder(r).Decode(&set); err != nil {
+		return nil, fmt.Errorf("unable to decode the JWKS: %s", err)
+	}
+
+	certs := map[string]*x509.Certificate{}
+	for _, key := range set.Keys {
+		if len(key.X5c) == 0 {
+			continue
+		}
+		if _, ok := certs[key.Kid]; ok {
+			return nil, fmt.Errorf("duplicate kid %q in the JWKS", key.Kid)
+		}
+
+		// Unlike most JSON Web formats, x5c uses standard base64 with
+		// padding
+		der, err := base64.StdEncoding.DecodeString(key.X5c[0])
+		if err != nil {
+			return nil, fmt.Errorf("unable to decode the x5c of kid %q: %s", key.Kid, err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse the x5c of kid %q: %s", key.Kid, err)
+		}
+		certs[key.Kid] = cert
+	}
+
+	return certs, nil
+}
@@ -0,0 +1,119 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestProbeJWKS tests exporting the certificates of the keys in a JWKS
+func TestProbeJWKS(t *testing.T) {
+	server, certPEM, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	signingPEM, _ := test.GenerateTestCertificate(time.Now().AddDate(0, 0, 30))
+	signingBlock, _ := pem.Decode(signingPEM)
+	servingBlock, _ := pem.Decode(certPEM)
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"keys": []map[string]interface{}{
+				{"kid": "signing", "x5c": []string{base64.StdEncoding.EncodeToString(signingBlock.Bytes)}},
+				{"kid": "serving", "x5c": []string{base64.StdEncoding.EncodeToString(servingBlock.Bytes)}},
+				{"kid": "no-x5c"},
+			},
+		})
+	})
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	state, err := ProbeJWKS(context.Background(), server.URL, module, 5*time.Second, ch)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	close(ch)
+
+	if state == nil || len(state.PeerCertificates) == 0 {
+		t.Errorf("expected the connection state of the request")
+	}
+
+	var count int
+	for m := range ch {
+		if strings.Contains(m.Desc().String(), "ssl_jwks_cert_not_after") {
+			count++
+		}
+	}
+	if count != 2 {
+		t.Errorf("expected ssl_jwks_cert_not_after for 2 keys, got %d", count)
+	}
+}
+
+// TestParseJWKS tests finding the certificate of each key in a JWKS
+func TestParseJWKS(t *testing.T) {
+	certPEM, _ := test.GenerateTestCertificate(time.Now().AddDate(0, 0, 30))
+	block, _ := pem.Decode(certPEM)
+	x5c := base64.StdEncoding.EncodeToString(block.Bytes)
+
+	certs, err := parseJWKS(strings.NewReader(`{"keys": [{"kid": "a", "x5c": ["` + x5c + `"]}, {"kid": "b"}]}`))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(certs) != 1 || certs["a"] == nil {
+		t.Fatalf("expected a certificate for kid a, got %v", certs)
+	}
+	if !bytes.Equal(certs["a"].Raw, block.Bytes) {
+		t.Errorf("unexpected certificate for kid a")
+	}
+
+	if _, err := parseJWKS(strings.NewReader(`{"keys": [{"kid": "a", "x5c": ["` + x5c + `"]}, {"kid": "a", "x5c": ["` + x5c + `"]}]}`)); err == nil {
+		t.Errorf("expected an error for a duplicate kid")
+	}
+
+	if _, err := parseJWKS(strings.NewReader(`{"keys": [{"kid": "a", "x5c": ["not base64"]}]}`)); err == nil {
+		t.Errorf("expected an error for an invalid x5c")
+	}
+}
+
+// TestProbeJWKSInvalid tests that a response that isn't a JWKS fails the
+// probe
+func TestProbeJWKSInvalid(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+	}
+
+	if _, err := ProbeJWKS(context.Background(), server.URL, module, 5*time.Second, nil); err == nil {
+		t.Errorf("expected an error for a response that isn't a JWKS")
+	}
+}
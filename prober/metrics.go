@@ -0,0 +1,77 @@
+package prober
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	namespace = "ssl"
+)
+
+var (
+	hstsEnabled = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "probe", "hsts_enabled"),
+		"If the response had a Strict-Transport-Security header with a non-zero max-age",
+		nil, nil,
+	)
+	hstsMaxAge = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "probe", "hsts_max_age"),
+		"The max-age of the Strict-Transport-Security header in seconds",
+		nil, nil,
+	)
+	requiredAIAFetch = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_required_aia_fetch"),
+		"If the verified chain could only be built by fetching issuers from their caIssuers URLs",
+		nil, nil,
+	)
+	serverAcceptedSignatureSchemes = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "server_accepted_signature_schemes_info"),
+		"The signature schemes the server accepts for client certificates, from its CertificateRequest",
+		[]string{"scheme"}, nil,
+	)
+	clientCertSelected = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "client_cert_selected_info"),
+		"The client certificate sent in response to the CertificateRequest of the server",
+		[]string{"serial_no", "issuer_cn", "cn"}, nil,
+	)
+	handshakeStalled = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "probe", "handshake_stalled"),
+		"If the target sent nothing for longer than the read_deadline of the module during the negotiation or handshake",
+		nil, nil,
+	)
+	proxyInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "probe", "proxy_info"),
+		"The proxy that the request of the probe was sent through",
+		[]string{"proxy"}, nil,
+	)
+	jwksCertNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "jwks", "cert_not_after"),
+		"NotAfter expressed as a Unix Epoch Time for the certificate of a key in the JWKS",
+		[]string{"kid", "serial_no", "issuer_cn", "cn"}, nil,
+	)
+	jwksCertNotBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "jwks", "cert_not_before"),
+		"NotBefore expressed as a Unix Epoch Time for the certificate of a key in the JWKS",
+		[]string{"kid", "serial_no", "issuer_cn", "cn"}, nil,
+	)
+)
+
+// Describe sends the descriptors of the metrics that the probers can emit
+func Describe(ch chan<- *prometheus.Desc) {
+	ch <- hstsEnabled
+	ch <- hstsMaxAge
+	ch <- requiredAIAFetch
+	ch <- serverAcceptedSignatureSchemes
+	ch <- clientCertSelected
+	ch <- proxyInfo
+	ch <- handshakeStalled
+	ch <- jwksCertNotAfter
+	ch <- jwksCertNotBefore
+}
+
+// emit sends the metric to the channel, if there is one
+func emit(ch chan<- prometheus.Metric, m prometheus.Metric) {
+	if ch != nil {
+		ch <- m
+	}
+}
@@ -0,0 +1,261 @@
+package prober
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+const (
+	// Types of the TDS packets exchanged before the login. The handshake is
+	// carried in PRELOGIN packets by the client and in tabular result
+	// packets by the server.
+	tdsPacketReply    = 0x04
+	tdsPacketPrelogin = 0x12
+
+	// tdsStatusEOM marks the last packet of a message
+	tdsStatusEOM = 0x01
+
+	// tdsHeaderLen is the length of the header of a TDS packet
+	tdsHeaderLen = 8
+
+	// tdsPacketSize is the largest packet, including the header, that can
+	// be sent before the login negotiates the packet size
+	tdsPacketSize = 4096
+
+	// Tokens of the options in a PRELOGIN message
+	tdsPreloginVersion    = 0x00
+	tdsPreloginEncryption = 0x01
+	tdsPreloginTerminator = 0xff
+
+	// Values of the ENCRYPTION option
+	tdsEncryptOff    = 0x00
+	tdsEncryptOn     = 0x01
+	tdsEncryptNotSup = 0x02
+	tdsEncryptReq    = 0x03
+)
+
+// ProbeMSSQL performs the TLS handshake that Microsoft SQL Server expects
+// before the login, with the TLS records wrapped in TDS packets
+func ProbeMSSQL(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error) {
+	dialer := newDialer(module, timeout)
+
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("Error setting deadline")
+	}
+
+	tdsConn := &tdsConn{Conn: conn, packetType: tdsPacketPrelogin}
+	if err := tdsConn.prelogin(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newTLSConfig(module)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		targetAddress, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = targetAddress
+	}
+
+	verifier := newAIAVerifier(ctx, tlsConfig, module, tlsConfig.ServerName, timeout)
+	certificateRequest := recordCertificateRequest(tlsConfig)
+	defer certificateRequest.collect(ch)
+
+	tlsConn := tls.Client(tdsConn, tlsConfig)
+	defer tlsConn.Close()
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, handshakeError(err)
+	}
+
+	state := tlsConn.ConnectionState()
+	if err := checkALPN(module, &state); err != nil {
+		return nil, err
+	}
+	verifier.complete(&state, ch)
+
+	return &state, nil
+}
+
+// tdsConn carries a TLS handshake in TDS packets of the given type
+//
+// See https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-tds/60f56408-0188-4cd5-8b90-25c6f2423868
+type tdsConn struct {
+	net.Conn
+	packetType byte
+
+	// packetID is the id of the next packet sent, which wraps around
+	packetID byte
+
+	readBuf bytes.Buffer
+}
+
+// prelogin sends a PRELOGIN message asking for encryption and checks that the
+// server agrees to it. Servers that answer ENCRYPT_OFF only encrypt the login,
+// which still starts with a handshake.
+func (c *tdsConn) prelogin() error {
+	// The option tokens with their offsets and lengths, followed by the
+	// data of the options: a zero version and ENCRYPT_ON
+	req := []byte{
+		tdsPreloginVersion, 0x00, 0x0b, 0x00, 0x06,
+		tdsPreloginEncryption, 0x00, 0x11, 0x00, 0x01,
+		tdsPreloginTerminator,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+		tdsEncryptOn,
+	}
+	if err := c.writeMessage(req); err != nil {
+		return err
+	}
+
+	packetType, rsp, err := c.readMessage()
+	if err != nil {
+		return fmt.Errorf("error reading TDS pre-login response: %s", err)
+	}
+	if packetType != tdsPacketReply {
+		return fmt.Errorf("unexpected TDS packet type in pre-login response: %#x", packetType)
+	}
+
+	encryption, err := tdsPreloginOption(rsp, tdsPreloginEncryption)
+	if err != nil {
+		return err
+	}
+	if len(encryption) != 1 {
+		return fmt.Errorf("the TDS pre-login response doesn't have the encryption option")
+	}
+
+	switch encryption[0] {
+	case tdsEncryptOff, tdsEncryptOn, tdsEncryptReq:
+		return nil
+	case tdsEncryptNotSup:
+		return fmt.Errorf("server doesn't support encryption")
+	default:
+		return fmt.Errorf("unexpected encryption option in TDS pre-login response: %#x", encryption[0])
+	}
+}
+
+// Read reads TLS data from the packets sent by the peer
+func (c *tdsConn) Read(b []byte) (int, error) {
+	for c.readBuf.Len() == 0 {
+		_, _, payload, err := c.readPacket()
+		if err != nil {
+			return 0, err
+		}
+		c.readBuf.Write(payload)
+	}
+
+	return c.readBuf.Read(b)
+}
+
+// Write sends TLS data to the peer in a message
+func (c *tdsConn) Write(b []byte) (int, error) {
+	if err := c.writeMessage(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeMessage sends the data in as many packets as it needs, the last of
+// them marked as the end of the message
+func (c *tdsConn) writeMessage(b []byte) error {
+	for {
+		n := len(b)
+		status := byte(tdsStatusEOM)
+		if n > tdsPacketSize-tdsHeaderLen {
+			n = tdsPacketSize - tdsHeaderLen
+			status = 0
+		}
+
+		packet := make([]byte, tdsHeaderLen, tdsHeaderLen+n)
+		packet[0] = c.packetType
+		packet[1] = status
+		binary.BigEndian.PutUint16(packet[2:], uint16(tdsHeaderLen+n))
+		c.packetID++
+		packet[6] = c.packetID
+		packet = append(packet, b[:n]...)
+
+		if _, err := c.Conn.Write(packet); err != nil {
+			return err
+		}
+
+		b = b[n:]
+		if status == tdsStatusEOM {
+			return nil
+		}
+	}
+}
+
+// readMessage reads packets until the end of a message and returns the type of
+// the packets and the message
+func (c *tdsConn) readMessage() (byte, []byte, error) {
+	var msg []byte
+	for {
+		packetType, status, payload, err := c.readPacket()
+		if err != nil {
+			return 0, nil, err
+		}
+		msg = append(msg, payload...)
+		if status&tdsStatusEOM != 0 {
+			return packetType, msg, nil
+		}
+	}
+}
+
+// readPacket reads a packet and returns its type, status and payload
+func (c *tdsConn) readPacket() (byte, byte, []byte, error) {
+	header := make([]byte, tdsHeaderLen)
+	if _, err := io.ReadFull(c.Conn, header); err != nil {
+		return 0, 0, nil, err
+	}
+	length := int(binary.BigEndian.Uint16(header[2:]))
+	if length < tdsHeaderLen {
+		return 0, 0, nil, fmt.Errorf("TDS packet is too short: %d bytes", length)
+	}
+
+	payload := make([]byte, length-tdsHeaderLen)
+	if _, err := io.ReadFull(c.Conn, payload); err != nil {
+		return 0, 0, nil, err
+	}
+
+	return header[0], header[1], payload, nil
+}
+
+// tdsPreloginOption returns the data of the option with the token in a
+// PRELOGIN message, or nil when the message doesn't have it
+func tdsPreloginOption(msg []byte, token byte) ([]byte, error) {
+	for off := 0; off < len(msg) && msg[off] != tdsPreloginTerminator; off += 5 {
+		if off+5 > len(msg) {
+			return nil, fmt.Errorf("TDS pre-login message is truncated")
+		}
+		if msg[off] != token {
+			continue
+		}
+
+		start := int(binary.BigEndian.Uint16(msg[off+1:]))
+		end := start + int(binary.BigEndian.Uint16(msg[off+3:]))
+		if end > len(msg) {
+			return nil, fmt.Errorf("TDS pre-login option %#x is outside of the message", token)
+		}
+		return msg[start:end], nil
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,161 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestProbeMSSQL tests the handshake with servers that encrypt the whole
+// connection or only the login
+func TestProbeMSSQL(t *testing.T) {
+	for _, encryption := range []byte{tdsEncryptOn, tdsEncryptOff, tdsEncryptReq} {
+		addr, caFile, errc, teardown := setupMSSQLServer(t, encryption)
+
+		module := config.Module{
+			TLSConfig: pconfig.TLSConfig{
+				CAFile: caFile,
+			},
+		}
+
+		state, err := ProbeMSSQL(context.Background(), addr, module, 5*time.Second, nil)
+		if err != nil {
+			t.Errorf("encryption %#x: error: %s", encryption, err)
+		} else if len(state.PeerCertificates) == 0 {
+			t.Errorf("encryption %#x: expected peer certificates", encryption)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("encryption %#x: server error: %s", encryption, err)
+		}
+		teardown()
+	}
+}
+
+// TestProbeMSSQLEncryptionNotSupported tests that the probe fails when the
+// server doesn't support encryption
+func TestProbeMSSQLEncryptionNotSupported(t *testing.T) {
+	addr, caFile, _, teardown := setupMSSQLServer(t, tdsEncryptNotSup)
+	defer teardown()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+	}
+
+	if _, err := ProbeMSSQL(context.Background(), addr, module, 5*time.Second, nil); err == nil {
+		t.Fatalf("expected error, but err was nil")
+	}
+}
+
+// TestTDSConnLargeMessage tests that messages larger than a packet are split
+// and put back together
+func TestTDSConnLargeMessage(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	msg := make([]byte, 3*tdsPacketSize)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- (&tdsConn{Conn: client, packetType: tdsPacketPrelogin}).writeMessage(msg)
+	}()
+
+	packetType, got, err := (&tdsConn{Conn: server, packetType: tdsPacketReply}).readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if packetType != tdsPacketPrelogin {
+		t.Errorf("unexpected packet type: %#x", packetType)
+	}
+	if string(got) != string(msg) {
+		t.Errorf("the message read doesn't match the message written")
+	}
+}
+
+// setupMSSQLServer starts a server that answers a PRELOGIN message with the
+// encryption option and performs the handshake in TDS packets, unless
+// encryption isn't supported
+func setupMSSQLServer(t *testing.T, encryption byte) (string, string, chan error, func()) {
+	certPEM, keyPEM := test.GenerateTestCertificate(time.Now().AddDate(0, 0, 1))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caFile, err := test.WriteFile("certfile.pem", certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		tdsConn := &tdsConn{Conn: conn, packetType: tdsPacketReply}
+		packetType, req, err := tdsConn.readMessage()
+		if err != nil {
+			errc <- err
+			return
+		}
+		if packetType != tdsPacketPrelogin {
+			errc <- fmt.Errorf("unexpected packet type: %#x", packetType)
+			return
+		}
+		if option, err := tdsPreloginOption(req, tdsPreloginEncryption); err != nil || len(option) != 1 || option[0] != tdsEncryptOn {
+			errc <- fmt.Errorf("expected ENCRYPT_ON in the pre-login request: %v %v", option, err)
+			return
+		}
+
+		rsp := []byte{
+			tdsPreloginVersion, 0x00, 0x0b, 0x00, 0x06,
+			tdsPreloginEncryption, 0x00, 0x11, 0x00, 0x01,
+			tdsPreloginTerminator,
+			0x0f, 0x00, 0x07, 0xd0, 0x00, 0x00,
+			encryption,
+		}
+		if err := tdsConn.writeMessage(rsp); err != nil {
+			errc <- err
+			return
+		}
+		if encryption == tdsEncryptNotSup {
+			errc <- nil
+			return
+		}
+
+		tlsConn := tls.Server(tdsConn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		errc <- tlsConn.Handshake()
+	}()
+
+	teardown := func() {
+		ln.Close()
+		os.Remove(caFile)
+	}
+
+	return ln.Addr().String(), caFile, errc, teardown
+}
@@ -0,0 +1,440 @@
+package prober
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+const (
+	// Opcodes of the OpenVPN control channel packets, which are sent in the
+	// top five bits of the first byte alongside a three bit key id
+	openVPNControlV1               = 4
+	openVPNAckV1                   = 5
+	openVPNControlHardResetClient2 = 7
+	openVPNControlHardResetServer2 = 8
+
+	// openVPNMaxPayload is the largest chunk of TLS data sent in a single
+	// control packet
+	openVPNMaxPayload = 1024
+)
+
+var (
+	// openVPNDigests maps the names accepted by OpenVPN's auth option to
+	// the hashes used for the tls-auth HMAC
+	openVPNDigests = map[string]func() hash.Hash{
+		"SHA1":   sha1.New,
+		"SHA256": sha256.New,
+		"SHA512": sha512.New,
+	}
+)
+
+// ProbeOpenVPN performs a TLS handshake over the control channel of an
+// OpenVPN server running in TCP mode
+func ProbeOpenVPN(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error) {
+	var (
+		auth *openVPNTLSAuth
+		err  error
+	)
+	if module.OpenVPN.TLSAuthKeyFile != "" {
+		auth, err = loadOpenVPNTLSAuth(module.OpenVPN.TLSAuthKeyFile, module.OpenVPN.KeyDirection, module.OpenVPN.Auth, false)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := newDialer(module, timeout)
+
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("Error setting deadline")
+	}
+
+	ovpnConn, err := newOpenVPNConn(conn, auth, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := ovpnConn.reset(); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newTLSConfig(module)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		targetAddress, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = targetAddress
+	}
+
+	verifier := newAIAVerifier(ctx, tlsConfig, module, tlsConfig.ServerName, timeout)
+	certificateRequest := recordCertificateRequest(tlsConfig)
+	defer certificateRequest.collect(ch)
+
+	tlsConn := tls.Client(ovpnConn, tlsConfig)
+	defer tlsConn.Close()
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, handshakeError(err)
+	}
+
+	state := tlsConn.ConnectionState()
+	if err := checkALPN(module, &state); err != nil {
+		return nil, err
+	}
+	verifier.complete(&state, ch)
+
+	return &state, nil
+}
+
+// openVPNTLSAuth holds the keys used to authenticate control channel packets
+// with tls-auth
+type openVPNTLSAuth struct {
+	digest  func() hash.Hash
+	sendKey []byte
+	recvKey []byte
+}
+
+// loadOpenVPNTLSAuth reads an OpenVPN static key file and selects the HMAC
+// keys for the key direction. The server selects the opposite keys to the
+// client.
+func loadOpenVPNTLSAuth(file string, direction *int, digest string, server bool) (*openVPNTLSAuth, error) {
+	if digest == "" {
+		digest = "SHA1"
+	}
+	newHash, ok := openVPNDigests[strings.ToUpper(digest)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported tls-auth digest: %s", digest)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	key, err := parseOpenVPNStaticKey(f)
+	if err != nil {
+		return nil, err
+	}
+
+	// The static key is made up of four 64 byte keys: a cipher and an HMAC
+	// key for each direction. Only the HMAC keys are used by tls-auth.
+	size := newHash().Size()
+	hmac0 := key[64 : 64+size]
+	hmac1 := key[192 : 192+size]
+
+	auth := &openVPNTLSAuth{digest: newHash}
+	switch {
+	case direction == nil:
+		auth.sendKey, auth.recvKey = hmac0, hmac0
+	case *direction == 0:
+		auth.sendKey, auth.recvKey = hmac0, hmac1
+	case *direction == 1:
+		auth.sendKey, auth.recvKey = hmac1, hmac0
+	default:
+		return nil, fmt.Errorf("invalid key direction: %d", *direction)
+	}
+	if server {
+		auth.sendKey, auth.recvKey = auth.recvKey, auth.sendKey
+	}
+
+	return auth, nil
+}
+
+// parseOpenVPNStaticKey decodes the 256 byte key in an OpenVPN static key file
+func parseOpenVPNStaticKey(r io.Reader) ([]byte, error) {
+	var (
+		encoded strings.Builder
+		inKey   bool
+	)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "-----BEGIN OpenVPN Static key V1-----":
+			inKey = true
+		case line == "-----END OpenVPN Static key V1-----":
+			inKey = false
+		case inKey:
+			encoded.WriteString(line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(encoded.String())
+	if err != nil {
+		return nil, fmt.Errorf("error decoding OpenVPN static key: %s", err)
+	}
+	if len(key) != 256 {
+		return nil, fmt.Errorf("OpenVPN static key is %d bytes, expected 256", len(key))
+	}
+
+	return key, nil
+}
+
+// openVPNConn carries a TLS session over the reliable control channel of an
+// OpenVPN connection in TCP mode. Every control packet from the peer is
+// acknowledged as soon as it has been read.
+type openVPNConn struct {
+	net.Conn
+	auth   *openVPNTLSAuth
+	server bool
+
+	sessionID       [8]byte
+	remoteSessionID [8]byte
+
+	// The replay protection packet id and time sent in packets
+	// authenticated with tls-auth
+	replayID   uint32
+	replayTime uint32
+
+	// The ids of the next control messages to send and receive
+	sendID uint32
+	recvID uint32
+
+	readBuf bytes.Buffer
+}
+
+// openVPNPacket is a control channel packet
+type openVPNPacket struct {
+	opcode    byte
+	sessionID [8]byte
+	acks      []uint32
+	messageID uint32
+	payload   []byte
+}
+
+func newOpenVPNConn(conn net.Conn, auth *openVPNTLSAuth, server bool) (*openVPNConn, error) {
+	c := &openVPNConn{
+		Conn:       conn,
+		auth:       auth,
+		server:     server,
+		replayID:   1,
+		replayTime: uint32(time.Now().Unix()),
+	}
+	if _, err := rand.Read(c.sessionID[:]); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// reset exchanges the hard reset packets that start the session
+func (c *openVPNConn) reset() error {
+	if !c.server {
+		if err := c.writePacket(openVPNControlHardResetClient2, nil, nil); err != nil {
+			return err
+		}
+	}
+
+	p, err := c.readPacket()
+	if err != nil {
+		return fmt.Errorf("error reading OpenVPN hard reset: %s", err)
+	}
+	expected := byte(openVPNControlHardResetServer2)
+	if c.server {
+		expected = openVPNControlHardResetClient2
+	}
+	if p.opcode != expected {
+		return fmt.Errorf("unexpected OpenVPN opcode in response to hard reset: %d", p.opcode)
+	}
+	c.remoteSessionID = p.sessionID
+	c.recvID = p.messageID + 1
+
+	if c.server {
+		return c.writePacket(openVPNControlHardResetServer2, []uint32{p.messageID}, nil)
+	}
+
+	return c.writePacket(openVPNAckV1, []uint32{p.messageID}, nil)
+}
+
+// Read reads TLS data from the control packets sent by the peer
+func (c *openVPNConn) Read(b []byte) (int, error) {
+	for c.readBuf.Len() == 0 {
+		p, err := c.readPacket()
+		if err != nil {
+			return 0, err
+		}
+
+		switch p.opcode {
+		case openVPNAckV1:
+			continue
+		case openVPNControlV1, openVPNControlHardResetClient2, openVPNControlHardResetServer2:
+			if err := c.writePacket(openVPNAckV1, []uint32{p.messageID}, nil); err != nil {
+				return 0, err
+			}
+			// TCP delivers the packets in order, so anything other than
+			// the next message is a retransmission
+			if p.opcode != openVPNControlV1 || p.messageID != c.recvID {
+				continue
+			}
+			c.recvID++
+			c.readBuf.Write(p.payload)
+		default:
+			return 0, fmt.Errorf("unexpected OpenVPN opcode on the control channel: %d", p.opcode)
+		}
+	}
+
+	return c.readBuf.Read(b)
+}
+
+// Write sends TLS data to the peer in control packets
+func (c *openVPNConn) Write(b []byte) (int, error) {
+	for written := 0; written < len(b); {
+		n := len(b) - written
+		if n > openVPNMaxPayload {
+			n = openVPNMaxPayload
+		}
+		if err := c.writePacket(openVPNControlV1, nil, b[written:written+n]); err != nil {
+			return written, err
+		}
+		written += n
+	}
+
+	return len(b), nil
+}
+
+// writePacket sends a control packet. Every packet other than an ack is
+// given the next message id.
+func (c *openVPNConn) writePacket(opcode byte, acks []uint32, payload []byte) error {
+	header := []byte{opcode << 3}
+	header = append(header, c.sessionID[:]...)
+
+	var rest []byte
+	rest = append(rest, byte(len(acks)))
+	for _, ack := range acks {
+		rest = appendUint32(rest, ack)
+	}
+	if len(acks) > 0 {
+		rest = append(rest, c.remoteSessionID[:]...)
+	}
+	if opcode != openVPNAckV1 {
+		rest = appendUint32(rest, c.sendID)
+		c.sendID++
+	}
+	rest = append(rest, payload...)
+
+	packet := header
+	if c.auth != nil {
+		replay := appendUint32(nil, c.replayID)
+		replay = appendUint32(replay, c.replayTime)
+		c.replayID++
+
+		packet = append(packet, c.auth.sum(c.auth.sendKey, replay, header, rest)...)
+		packet = append(packet, replay...)
+	}
+	packet = append(packet, rest...)
+
+	frame := make([]byte, 2, 2+len(packet))
+	binary.BigEndian.PutUint16(frame, uint16(len(packet)))
+	_, err := c.Conn.Write(append(frame, packet...))
+
+	return err
+}
+
+// readPacket reads a control packet, checking its HMAC when tls-auth is used
+func (c *openVPNConn) readPacket() (*openVPNPacket, error) {
+	var length uint16
+	if err := binary.Read(c.Conn, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(c.Conn, packet); err != nil {
+		return nil, err
+	}
+
+	if len(packet) < 9 {
+		return nil, fmt.Errorf("OpenVPN packet is too short")
+	}
+	p := &openVPNPacket{opcode: packet[0] >> 3}
+	copy(p.sessionID[:], packet[1:9])
+	header, rest := packet[:9], packet[9:]
+
+	if c.auth != nil {
+		size := c.auth.digest().Size()
+		if len(rest) < size+8 {
+			return nil, fmt.Errorf("OpenVPN packet is too short for tls-auth")
+		}
+		mac, replay := rest[:size], rest[size:size+8]
+		rest = rest[size+8:]
+		if !hmac.Equal(mac, c.auth.sum(c.auth.recvKey, replay, header, rest)) {
+			return nil, fmt.Errorf("OpenVPN packet failed tls-auth HMAC verification")
+		}
+	}
+
+	if len(rest) < 1 {
+		return nil, fmt.Errorf("OpenVPN packet is too short")
+	}
+	numAcks := int(rest[0])
+	rest = rest[1:]
+	if len(rest) < numAcks*4 {
+		return nil, fmt.Errorf("OpenVPN packet is too short for its acks")
+	}
+	for i := 0; i < numAcks; i++ {
+		p.acks = append(p.acks, binary.BigEndian.Uint32(rest[i*4:]))
+	}
+	rest = rest[numAcks*4:]
+	if numAcks > 0 {
+		if len(rest) < 8 {
+			return nil, fmt.Errorf("OpenVPN packet is too short for the remote session id")
+		}
+		rest = rest[8:]
+	}
+
+	if p.opcode != openVPNAckV1 {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("OpenVPN packet is too short for the message id")
+		}
+		p.messageID = binary.BigEndian.Uint32(rest)
+		rest = rest[4:]
+	}
+	p.payload = rest
+
+	return p, nil
+}
+
+// sum computes the tls-auth HMAC of a packet, which covers the replay
+// protection fields followed by the rest of the packet
+func (a *openVPNTLSAuth) sum(key, replay, header, rest []byte) []byte {
+	mac := hmac.New(a.digest, key)
+	mac.Write(replay)
+	mac.Write(header)
+	mac.Write(rest)
+	return mac.Sum(nil)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
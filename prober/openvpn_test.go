@@ -0,0 +1,169 @@
+package prober
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+
+	pconfig "github.com/prometheus/common/config"
+)
+
+// TestProbeOpenVPN tests the openvpn prober with and without tls-auth
+func TestProbeOpenVPN(t *testing.T) {
+	keyFile := writeOpenVPNStaticKey(t)
+	defer os.Remove(keyFile)
+	direction := 1
+
+	for _, tc := range []struct {
+		name   string
+		module config.OpenVPNProbe
+	}{
+		{"plain", config.OpenVPNProbe{}},
+		{"tls-auth", config.OpenVPNProbe{TLSAuthKeyFile: keyFile, KeyDirection: &direction}},
+		{"tls-auth bidirectional", config.OpenVPNProbe{TLSAuthKeyFile: keyFile}},
+		{"tls-auth sha256", config.OpenVPNProbe{TLSAuthKeyFile: keyFile, KeyDirection: &direction, Auth: "SHA256"}},
+	} {
+		addr, caFile, errc, teardown := setupOpenVPNServer(t, tc.module)
+
+		module := config.Module{
+			TLSConfig: pconfig.TLSConfig{
+				CAFile: caFile,
+			},
+			OpenVPN: tc.module,
+		}
+
+		state, err := ProbeOpenVPN(context.Background(), addr, module, 5*time.Second, nil)
+		if err != nil {
+			t.Errorf("%s: error: %s", tc.name, err)
+		} else if len(state.PeerCertificates) == 0 {
+			t.Errorf("%s: expected peer certificates", tc.name)
+		}
+		if err := <-errc; err != nil {
+			t.Errorf("%s: server error: %s", tc.name, err)
+		}
+		teardown()
+	}
+}
+
+// TestProbeOpenVPNWrongKey tests that the probe fails when the server doesn't
+// accept the tls-auth key
+func TestProbeOpenVPNWrongKey(t *testing.T) {
+	serverKeyFile := writeOpenVPNStaticKey(t)
+	defer os.Remove(serverKeyFile)
+	clientKeyFile := writeOpenVPNStaticKey(t)
+	defer os.Remove(clientKeyFile)
+	direction := 1
+
+	addr, caFile, errc, teardown := setupOpenVPNServer(t, config.OpenVPNProbe{
+		TLSAuthKeyFile: serverKeyFile,
+		KeyDirection:   &direction,
+	})
+	defer teardown()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+		OpenVPN: config.OpenVPNProbe{
+			TLSAuthKeyFile: clientKeyFile,
+			KeyDirection:   &direction,
+		},
+	}
+
+	if _, err := ProbeOpenVPN(context.Background(), addr, module, 5*time.Second, nil); err == nil {
+		t.Fatalf("expected error, but err was nil")
+	}
+	if err := <-errc; err == nil || !strings.Contains(err.Error(), "HMAC") {
+		t.Errorf("expected the server to reject the HMAC, got: %v", err)
+	}
+}
+
+// setupOpenVPNServer starts a server that accepts a single OpenVPN control
+// channel connection and performs a TLS handshake over it. The result of the
+// handshake is sent to the returned channel.
+func setupOpenVPNServer(t *testing.T, module config.OpenVPNProbe) (string, string, chan error, func()) {
+	certPEM, keyPEM := test.GenerateTestCertificate(time.Now().AddDate(0, 0, 1))
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	caFile, err := test.WriteFile("certfile.pem", certPEM)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var auth *openVPNTLSAuth
+	if module.TLSAuthKeyFile != "" {
+		auth, err = loadOpenVPNTLSAuth(module.TLSAuthKeyFile, module.KeyDirection, module.Auth, true)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			errc <- err
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		ovpnConn, err := newOpenVPNConn(conn, auth, true)
+		if err != nil {
+			errc <- err
+			return
+		}
+		if err := ovpnConn.reset(); err != nil {
+			errc <- err
+			return
+		}
+
+		tlsConn := tls.Server(ovpnConn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		errc <- tlsConn.Handshake()
+	}()
+
+	teardown := func() {
+		ln.Close()
+		os.Remove(caFile)
+	}
+
+	return ln.Addr().String(), caFile, errc, teardown
+}
+
+// writeOpenVPNStaticKey writes a random OpenVPN static key to a file
+func writeOpenVPNStaticKey(t *testing.T) string {
+	key := make([]byte, 256)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	encoded := hex.EncodeToString(key)
+	contents := "#\n# 2048 bit OpenVPN static key\n#\n-----BEGIN OpenVPN Static key V1-----\n"
+	for i := 0; i < len(encoded); i += 32 {
+		contents += encoded[i:i+32] + "\n"
+	}
+	contents += "-----END OpenVPN Static key V1-----\n"
+
+	file, err := test.WriteFile("ta.key", []byte(contents))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	return file
+}
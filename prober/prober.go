@@ -1,20 +1,30 @@
 package prober
 
 import (
+	"context"
 	"crypto/tls"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/ribbybibby/ssl_exporter/config"
 )
 
 var (
 	// Probers maps a friendly name to a corresponding probe function
 	Probers = map[string]ProbeFn{
-		"https": ProbeHTTPS,
-		"http":  ProbeHTTPS,
-		"tcp":   ProbeTCP,
+		"https":     ProbeHTTPS,
+		"http":      ProbeHTTPS,
+		"tcp":       ProbeTCP,
+		"rdp":       ProbeRDP,
+		"openvpn":   ProbeOpenVPN,
+		"jwks":      ProbeJWKS,
+		"cassandra": ProbeCassandra,
+		"websocket": ProbeWebSocket,
+		"mssql":     ProbeMSSQL,
 	}
 )
 
-// ProbeFn probes
-type ProbeFn func(target string, module config.Module, timeout time.Duration) (*tls.ConnectionState, error)
+// ProbeFn probes. The context carries the outbound request budget for the
+// probe. Probers can send metrics of their own to the channel, which may be
+// nil.
+type ProbeFn func(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error)
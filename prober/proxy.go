@@ -0,0 +1,57 @@
+package prober
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// getProxy returns the proxy that the request is sent through, from the
+// proxy_url of the module or the environment, or nil when it's sent
+// directly. With isolate_streams, the SOCKS5 proxy is given credentials made
+// of the target and a random nonce, so that Tor sends every probe over a
+// different circuit.
+func getProxy(module config.Module, req *http.Request) (*url.URL, error) {
+	proxy := http.ProxyFromEnvironment
+	if module.HTTPS.ProxyURL.URL != nil {
+		proxy = http.ProxyURL(module.HTTPS.ProxyURL.URL)
+	}
+
+	proxyURL, err := proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	if !module.HTTPS.IsolateStreams {
+		return proxyURL, nil
+	}
+
+	if proxyURL == nil || !config.IsSOCKS5(proxyURL) {
+		return nil, fmt.Errorf("isolate_streams requires a SOCKS5 proxy, but %s isn't probed through one", req.URL.Host)
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	isolated := *proxyURL
+	isolated.User = url.UserPassword(req.URL.Host, hex.EncodeToString(nonce))
+
+	return &isolated, nil
+}
+
+// collectProxy emits the proxy that the request was sent through, without
+// its credentials
+func collectProxy(ch chan<- prometheus.Metric, proxyURL *url.URL) {
+	if proxyURL == nil {
+		return
+	}
+	redacted := url.URL{Scheme: proxyURL.Scheme, Host: proxyURL.Host}
+	emit(ch, prometheus.MustNewConstMetric(
+		proxyInfo, prometheus.GaugeValue, 1, redacted.String(),
+	))
+}
@@ -0,0 +1,160 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+const (
+	// Security protocols that can be requested in, or selected by, the RDP
+	// negotiation
+	rdpProtocolRDP      = 0x00000000
+	rdpProtocolSSL      = 0x00000001
+	rdpProtocolHybrid   = 0x00000002
+	rdpProtocolHybridEx = 0x00000008
+
+	// Types of the negotiation structures sent after the X.224 header
+	rdpNegReq     = 0x01
+	rdpNegRsp     = 0x02
+	rdpNegFailure = 0x03
+)
+
+var (
+	// rdpNegFailureCodes maps the failure codes in a RDP_NEG_FAILURE to a
+	// description
+	rdpNegFailureCodes = map[uint32]string{
+		0x01: "SSL_REQUIRED_BY_SERVER",
+		0x02: "SSL_NOT_ALLOWED_BY_SERVER",
+		0x03: "SSL_CERT_NOT_ON_SERVER",
+		0x04: "INCONSISTENT_FLAGS",
+		0x05: "HYBRID_REQUIRED_BY_SERVER",
+		0x06: "SSL_WITH_USER_AUTH_REQUIRED_BY_SERVER",
+	}
+)
+
+// ProbeRDP performs a rdp probe
+func ProbeRDP(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error) {
+	dialer := newDialer(module, timeout)
+
+	conn, err := dialer.DialContext(ctx, "tcp", target)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, fmt.Errorf("Error setting deadline")
+	}
+
+	if err := rdpNegotiate(conn); err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := newTLSConfig(module)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig.ServerName == "" {
+		targetAddress, _, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ServerName = targetAddress
+	}
+
+	verifier := newAIAVerifier(ctx, tlsConfig, module, tlsConfig.ServerName, timeout)
+	certificateRequest := recordCertificateRequest(tlsConfig)
+	defer certificateRequest.collect(ch)
+
+	tlsConn := tls.Client(conn, tlsConfig)
+	defer tlsConn.Close()
+
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, handshakeError(err)
+	}
+
+	state := tlsConn.ConnectionState()
+	if err := checkALPN(module, &state); err != nil {
+		return nil, err
+	}
+	verifier.complete(&state, ch)
+
+	return &state, nil
+}
+
+// rdpNegotiate sends an X.224 Connection Request asking for TLS and checks
+// that the server has selected a security protocol that is carried over TLS.
+//
+// See https://docs.microsoft.com/en-us/openspecs/windows_protocols/ms-rdpbcgr/18a27ef9-6f9a-4501-b000-94b1fe3c2c10
+func rdpNegotiate(conn net.Conn) error {
+	// TPKT header, X.224 Connection Request and RDP_NEG_REQ requesting
+	// TLS or CredSSP, both of which start with a TLS handshake
+	req := []byte{
+		0x03, 0x00, 0x00, 0x13,
+		0x0e, 0xe0, 0x00, 0x00, 0x00, 0x00, 0x00,
+		rdpNegReq, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	binary.LittleEndian.PutUint32(req[15:], rdpProtocolSSL|rdpProtocolHybrid)
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	// Read the TPKT header to find out how long the response is
+	tpkt := make([]byte, 4)
+	if _, err := io.ReadFull(conn, tpkt); err != nil {
+		return fmt.Errorf("error reading RDP negotiation response: %s", err)
+	}
+	if tpkt[0] != 0x03 {
+		return fmt.Errorf("unexpected TPKT version in RDP negotiation response: %d", tpkt[0])
+	}
+	length := int(binary.BigEndian.Uint16(tpkt[2:]))
+	if length < 11 {
+		return fmt.Errorf("RDP negotiation response is too short: %d bytes", length)
+	}
+
+	// The X.224 Connection Confirm, possibly followed by a negotiation
+	// response or failure
+	cc := make([]byte, length-4)
+	if _, err := io.ReadFull(conn, cc); err != nil {
+		return fmt.Errorf("error reading RDP negotiation response: %s", err)
+	}
+	if cc[1] != 0xd0 {
+		return fmt.Errorf("unexpected X.224 TPDU code in RDP negotiation response: %#x", cc[1])
+	}
+
+	neg := cc[7:]
+	if len(neg) < 8 {
+		return fmt.Errorf("server only supports standard RDP security")
+	}
+
+	switch neg[0] {
+	case rdpNegRsp:
+		protocol := binary.LittleEndian.Uint32(neg[4:])
+		switch protocol {
+		case rdpProtocolSSL, rdpProtocolHybrid, rdpProtocolHybridEx:
+			return nil
+		case rdpProtocolRDP:
+			return fmt.Errorf("server selected standard RDP security instead of TLS")
+		default:
+			return fmt.Errorf("server selected unsupported RDP security protocol: %#x", protocol)
+		}
+	case rdpNegFailure:
+		code := binary.LittleEndian.Uint32(neg[4:])
+		if desc, ok := rdpNegFailureCodes[code]; ok {
+			return fmt.Errorf("RDP negotiation failed: %s", desc)
+		}
+		return fmt.Errorf("RDP negotiation failed with code: %#x", code)
+	default:
+		return fmt.Errorf("unexpected RDP negotiation response type: %#x", neg[0])
+	}
+}
@@ -0,0 +1,87 @@
+package prober
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+
+	pconfig "github.com/prometheus/common/config"
+)
+
+// TestProbeRDP tests the typical case
+func TestProbeRDP(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartRDP(rdpProtocolSSL)
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	state, err := ProbeRDP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if state == nil {
+		t.Fatalf("expected state but got nil")
+	}
+}
+
+// TestProbeRDPHybrid tests that the probe is successful when the server
+// selects CredSSP, which is carried over TLS
+func TestProbeRDPHybrid(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartRDP(rdpProtocolHybrid)
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	if _, err := ProbeRDP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+}
+
+// TestProbeRDPStandardSecurity tests that the probe fails when the server
+// selects standard RDP security rather than TLS
+func TestProbeRDPStandardSecurity(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartRDP(rdpProtocolRDP)
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	if _, err := ProbeRDP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+}
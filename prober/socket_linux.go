@@ -0,0 +1,49 @@
+package prober
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// setSocketOptions sets the DSCP and mark of the socket
+func setSocketOptions(fd uintptr, network, address string, opts config.SocketOptions) error {
+	if opts.DSCP != 0 {
+		// The DSCP is the upper six bits of the TOS field and the traffic
+		// class
+		level, name := syscall.IPPROTO_IP, syscall.IP_TOS
+		if isIPv6(network, address) {
+			level, name = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+		}
+		if err := syscall.SetsockoptInt(int(fd), level, name, opts.DSCP<<2); err != nil {
+			return fmt.Errorf("error setting the DSCP of the socket: %s", err)
+		}
+	}
+
+	if opts.Mark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, opts.Mark); err != nil {
+			return fmt.Errorf("error setting the mark of the socket: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// isIPv6 returns whether the socket connects to the address over IPv6
+func isIPv6(network, address string) bool {
+	if strings.HasSuffix(network, "6") {
+		return true
+	}
+	if strings.HasSuffix(network, "4") {
+		return false
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
@@ -0,0 +1,57 @@
+package prober
+
+import (
+	"context"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// TestDialerSocketDSCP tests that the dialer marks the packets of the
+// connection with the DSCP in the module
+func TestDialerSocketDSCP(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:0", "[::1]:0"} {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			t.Logf("skipping %s: %s", address, err)
+			continue
+		}
+
+		module := config.Module{Socket: config.SocketOptions{DSCP: 46}}
+		conn, err := newDialer(module, 5*time.Second).DialContext(context.Background(), "tcp", ln.Addr().String())
+		if err != nil {
+			ln.Close()
+			t.Fatalf(err.Error())
+		}
+
+		rawConn, err := conn.(*net.TCPConn).SyscallConn()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		level, name := syscall.IPPROTO_IP, syscall.IP_TOS
+		if ln.Addr().(*net.TCPAddr).IP.To4() == nil {
+			level, name = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+		}
+		var (
+			tos     int
+			sockErr error
+		)
+		if err := rawConn.Control(func(fd uintptr) {
+			tos, sockErr = syscall.GetsockoptInt(int(fd), level, name)
+		}); err != nil {
+			t.Fatalf(err.Error())
+		}
+		conn.Close()
+		ln.Close()
+
+		if sockErr != nil {
+			t.Fatalf(sockErr.Error())
+		}
+		if tos != 46<<2 {
+			t.Errorf("expected the TOS of the connection to %s to be %d, got %d", address, 46<<2, tos)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package prober
+
+import (
+	"fmt"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// setSocketOptions returns an error, because setting socket options is only
+// supported on Linux
+func setSocketOptions(fd uintptr, network, address string, opts config.SocketOptions) error {
+	return fmt.Errorf("socket options are only supported on linux")
+}
@@ -0,0 +1,243 @@
+package prober
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTunnels pools the connections to SSH bastions, so that probes through
+// the same bastion share a connection
+var sshTunnels = &sshTunnelPool{clients: map[config.SSHTunnel]*ssh.Client{}}
+
+// sshTunnelPool holds a client for each bastion that has been connected to.
+// Clients are removed when their connection closes.
+type sshTunnelPool struct {
+	mtx     sync.Mutex
+	clients map[config.SSHTunnel]*ssh.Client
+}
+
+// dialContext connects to the address through the bastion
+func (p *sshTunnelPool) dialContext(ctx context.Context, tunnel config.SSHTunnel, dialer *net.Dialer, network, address string) (net.Conn, error) {
+	if dialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, dialer.Timeout)
+		defer cancel()
+	}
+
+	client, err := p.client(ctx, tunnel, dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	// The ssh client can't be cancelled, so abandon the dial when the
+	// context is done and close the connection if it turns up later
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial(network, address)
+		done <- result{conn, err}
+	}()
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return &sshTunnelConn{Conn: r.conn}, nil
+	case <-ctx.Done():
+		go func() {
+			if r := <-done; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// client returns the pooled client for the bastion, connecting to it if
+// there isn't one. The connection is made without holding the lock, so that a
+// slow bastion doesn't hold up probes through the others. When two probes
+// connect to the same bastion at once, the first client to be pooled is kept
+// and the other is closed.
+func (p *sshTunnelPool) client(ctx context.Context, tunnel config.SSHTunnel, dialer *net.Dialer) (*ssh.Client, error) {
+	p.mtx.Lock()
+	client, ok := p.clients[tunnel]
+	p.mtx.Unlock()
+	if ok {
+		return client, nil
+	}
+
+	client, err := connectSSHTunnel(ctx, tunnel, dialer)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	if pooled, ok := p.clients[tunnel]; ok {
+		client.Close()
+		return pooled, nil
+	}
+	p.clients[tunnel] = client
+
+	go func() {
+		client.Wait()
+
+		p.mtx.Lock()
+		defer p.mtx.Unlock()
+		if p.clients[tunnel] == client {
+			delete(p.clients, tunnel)
+		}
+	}()
+
+	return client, nil
+}
+
+// connectSSHTunnel connects and authenticates to the bastion
+func connectSSHTunnel(ctx context.Context, tunnel config.SSHTunnel, dialer *net.Dialer) (*ssh.Client, error) {
+	if tunnel.KnownHostsFile == "" {
+		return nil, fmt.Errorf("ssh_tunnel requires known_hosts_file to verify the bastion")
+	}
+	hostKeyCallback, err := knownhosts.New(tunnel.KnownHostsFile)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ioutil.ReadFile(tunnel.PrivateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", tunnel.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Bound the SSH handshake by the probe's deadline
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, tunnel.Address, &ssh.ClientConfig{
+		User:            tunnel.User,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeyCallback,
+	})
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		sshConn.Close()
+		return nil, err
+	}
+
+	return ssh.NewClient(sshConn, chans, reqs), nil
+}
+
+// sshTunnelConn is a connection through a bastion. SSH channels don't support
+// deadlines, so the connection is closed when the deadline passes instead.
+type sshTunnelConn struct {
+	net.Conn
+
+	mtx     sync.Mutex
+	timer   *time.Timer
+	expired bool
+}
+
+// sshTimeoutError is returned by a connection through a bastion after its
+// deadline has passed
+type sshTimeoutError struct{}
+
+func (sshTimeoutError) Error() string   { return "i/o timeout" }
+func (sshTimeoutError) Timeout() bool   { return true }
+func (sshTimeoutError) Temporary() bool { return true }
+
+func (c *sshTunnelConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	return n, c.wrapErr(err)
+}
+
+func (c *sshTunnelConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	return n, c.wrapErr(err)
+}
+
+// wrapErr returns a timeout error in place of the error from the closed
+// connection when the deadline has passed
+func (c *sshTunnelConn) wrapErr(err error) error {
+	if err == nil {
+		return nil
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.expired {
+		return sshTimeoutError{}
+	}
+	return err
+}
+
+// SetDeadline closes the connection at the deadline. A zero time removes the
+// deadline.
+func (c *sshTunnelConn) SetDeadline(t time.Time) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.expired {
+		return sshTimeoutError{}
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if t.IsZero() {
+		return nil
+	}
+
+	c.timer = time.AfterFunc(time.Until(t), func() {
+		c.mtx.Lock()
+		c.expired = true
+		c.mtx.Unlock()
+		c.Conn.Close()
+	})
+
+	return nil
+}
+
+// SetReadDeadline sets the deadline for the whole connection
+func (c *sshTunnelConn) SetReadDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for the whole connection
+func (c *sshTunnelConn) SetWriteDeadline(t time.Time) error {
+	return c.SetDeadline(t)
+}
+
+// Close stops the deadline timer and closes the connection
+func (c *sshTunnelConn) Close() error {
+	c.mtx.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.mtx.Unlock()
+
+	return c.Conn.Close()
+}
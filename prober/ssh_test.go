@@ -0,0 +1,205 @@
+package prober
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+
+	pconfig "github.com/prometheus/common/config"
+)
+
+// TestProbeTCPSSHTunnel tests probing targets through a bastion and that the
+// connection to the bastion is reused
+func TestProbeTCPSSHTunnel(t *testing.T) {
+	bastion, teardownBastion, err := test.SetupSSHBastion()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardownBastion()
+
+	for i := 0; i < 2; i++ {
+		server, _, _, caFile, teardown, err := test.SetupTCPServer()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		server.StartTLS()
+
+		module := config.Module{
+			TLSConfig: pconfig.TLSConfig{
+				CAFile: caFile,
+			},
+			SSHTunnel: config.SSHTunnel{
+				Address:        bastion.Listener.Addr().String(),
+				User:           "ssl_exporter",
+				PrivateKeyFile: bastion.PrivateKeyFile,
+				KnownHostsFile: bastion.KnownHostsFile,
+			},
+		}
+
+		_, err = ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil)
+		server.Close()
+		teardown()
+		if err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+
+	if channels := bastion.Channels(); channels != 2 {
+		t.Errorf("expected 2 channels through the bastion, got %d", channels)
+	}
+	if connections := bastion.Connections(); connections != 1 {
+		t.Errorf("expected 1 connection to the bastion, got %d", connections)
+	}
+}
+
+// TestProbeTCPSSHTunnelTimeout tests that the timeout applies to connections
+// through a bastion
+func TestProbeTCPSSHTunnelTimeout(t *testing.T) {
+	bastion, teardownBastion, err := test.SetupSSHBastion()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardownBastion()
+
+	// The server accepts connections but never responds
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	module := config.Module{
+		SSHTunnel: config.SSHTunnel{
+			Address:        bastion.Listener.Addr().String(),
+			User:           "ssl_exporter",
+			PrivateKeyFile: bastion.PrivateKeyFile,
+			KnownHostsFile: bastion.KnownHostsFile,
+		},
+	}
+
+	start := time.Now()
+	if _, err := ProbeTCP(context.Background(), ln.Addr().String(), module, 2*time.Second, nil); err == nil {
+		t.Fatalf("expected error, but err was nil")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the probe to time out after 2s, took %s", elapsed)
+	}
+}
+
+// TestProbeTCPSSHTunnelSlowBastion tests that a bastion that doesn't complete
+// the SSH handshake doesn't hold up probes through other bastions
+func TestProbeTCPSSHTunnelSlowBastion(t *testing.T) {
+	bastion, teardownBastion, err := test.SetupSSHBastion()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardownBastion()
+
+	// The slow bastion accepts connections but never responds
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	slowModule := config.Module{
+		SSHTunnel: config.SSHTunnel{
+			Address:        ln.Addr().String(),
+			User:           "ssl_exporter",
+			PrivateKeyFile: bastion.PrivateKeyFile,
+			KnownHostsFile: bastion.KnownHostsFile,
+		},
+	}
+	slowDone := make(chan struct{})
+	go func() {
+		defer close(slowDone)
+		ProbeTCP(context.Background(), server.Listener.Addr().String(), slowModule, 5*time.Second, nil)
+	}()
+	defer func() { <-slowDone }()
+
+	// Give the slow probe time to start connecting to its bastion
+	time.Sleep(200 * time.Millisecond)
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+		SSHTunnel: config.SSHTunnel{
+			Address:        bastion.Listener.Addr().String(),
+			User:           "ssl_exporter",
+			PrivateKeyFile: bastion.PrivateKeyFile,
+			KnownHostsFile: bastion.KnownHostsFile,
+		},
+	}
+
+	start := time.Now()
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("expected the probe not to wait for the slow bastion, took %s", elapsed)
+	}
+}
+
+// TestProbeTCPSSHTunnelUnknownHost tests that the bastion's host key must be
+// in the known hosts file
+func TestProbeTCPSSHTunnelUnknownHost(t *testing.T) {
+	bastion, teardownBastion, err := test.SetupSSHBastion()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardownBastion()
+
+	other, teardownOther, err := test.SetupSSHBastion()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardownOther()
+
+	module := config.Module{
+		SSHTunnel: config.SSHTunnel{
+			Address:        bastion.Listener.Addr().String(),
+			User:           "ssl_exporter",
+			PrivateKeyFile: bastion.PrivateKeyFile,
+			KnownHostsFile: other.KnownHostsFile,
+		},
+	}
+
+	if _, err := ProbeTCP(context.Background(), "127.0.0.1:443", module, 5*time.Second, nil); err == nil {
+		t.Fatalf("expected error, but err was nil")
+	}
+	if connections := bastion.Connections(); connections != 0 {
+		t.Errorf("expected no connections to be accepted, got %d", connections)
+	}
+}
@@ -0,0 +1,96 @@
+package prober
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// StalledError is returned by the probers when the target didn't send
+// anything for longer than the read_deadline of the module during the
+// negotiation or the handshake
+type StalledError struct {
+	ReadDeadline time.Duration
+	Err          error
+}
+
+func (e *StalledError) Error() string {
+	return fmt.Sprintf("handshake stalled, nothing read for %s: %s", e.ReadDeadline, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *StalledError) Unwrap() error {
+	return e.Err
+}
+
+// stallConn fails reads that wait longer than the read deadline for data, so
+// that a server that trickles its responses can't hold the probe for the
+// whole timeout. The deadline is reset before every read. Deadlines set on
+// the connection still apply when they're sooner.
+type stallConn struct {
+	net.Conn
+	readDeadline time.Duration
+
+	// limit is the read deadline set on the connection
+	limit   time.Time
+	stalled bool
+}
+
+func newStallConn(conn net.Conn, readDeadline time.Duration) *stallConn {
+	return &stallConn{Conn: conn, readDeadline: readDeadline}
+}
+
+// SetDeadline sets the read and write deadlines of the connection
+func (c *stallConn) SetDeadline(t time.Time) error {
+	c.limit = t
+	return c.Conn.SetDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the connection
+func (c *stallConn) SetReadDeadline(t time.Time) error {
+	c.limit = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+// Read reads from the connection, returning a StalledError if nothing arrives
+// within the read deadline
+func (c *stallConn) Read(b []byte) (int, error) {
+	if c.readDeadline <= 0 {
+		return c.Conn.Read(b)
+	}
+
+	deadline := time.Now().Add(c.readDeadline)
+	stallable := c.limit.IsZero() || deadline.Before(c.limit)
+	if !stallable {
+		deadline = c.limit
+	}
+	if err := c.Conn.SetReadDeadline(deadline); err != nil {
+		return 0, err
+	}
+
+	n, err := c.Conn.Read(b)
+	var netErr net.Error
+	if stallable && errors.As(err, &netErr) && netErr.Timeout() {
+		c.stalled = true
+		return n, &StalledError{ReadDeadline: c.readDeadline, Err: err}
+	}
+	return n, err
+}
+
+// done stops resetting the read deadline, once the handshake is complete
+func (c *stallConn) done() error {
+	c.readDeadline = 0
+	return c.Conn.SetReadDeadline(c.limit)
+}
+
+// collect sends whether a read stalled to the channel
+func (c *stallConn) collect(ch chan<- prometheus.Metric) {
+	var stalled float64
+	if c.stalled {
+		stalled = 1
+	}
+	emit(ch, prometheus.MustNewConstMetric(handshakeStalled, prometheus.GaugeValue, stalled))
+}
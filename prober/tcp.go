@@ -2,6 +2,7 @@ package prober
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"fmt"
 	"net"
@@ -10,24 +11,49 @@ import (
 
 	"github.com/ribbybibby/ssl_exporter/config"
 
-	pconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/common/log"
 )
 
 // ProbeTCP performs a tcp probe
-func ProbeTCP(target string, module config.Module, timeout time.Duration) (*tls.ConnectionState, error) {
-	dialer := &net.Dialer{Timeout: timeout}
+func ProbeTCP(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error) {
+	dialer := newDialer(module, timeout)
 
-	conn, err := dialer.Dial("tcp", target)
+	conn, err := dialer.DialContext(ctx, "tcp", target)
 	if err != nil {
 		return nil, err
 	}
 	defer conn.Close()
 
-	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+	// Reads during the negotiation and the handshake can have a deadline of
+	// their own, so that a target that trickles bytes fails fast
+	var stalling *stallConn
+	if module.TCP.ReadDeadline > 0 {
+		stalling = newStallConn(conn, module.TCP.ReadDeadline)
+		defer stalling.collect(ch)
+		conn = stalling
+	}
+
+	deadline := time.Now().Add(timeout)
+	if err := conn.SetDeadline(deadline); err != nil {
 		return nil, fmt.Errorf("Error setting deadline")
 	}
 
+	preTLS, postTLS := splitQueryResponses(module.TCP.QueryResponse)
+	if module.TCP.StartTLS != "" && len(preTLS) > 0 {
+		return nil, fmt.Errorf("query_response can't contain a starttls step when starttls is set")
+	}
+
+	// The plaintext negotiation can have its own, shorter, timeout so that
+	// a slow server can't use up the time left for the handshake
+	if module.TCP.ProtocolTimeout > 0 && (module.TCP.StartTLS != "" || len(preTLS) > 0) {
+		if protocolDeadline := time.Now().Add(module.TCP.ProtocolTimeout); protocolDeadline.Before(deadline) {
+			if err := conn.SetDeadline(protocolDeadline); err != nil {
+				return nil, fmt.Errorf("Error setting deadline")
+			}
+		}
+	}
+
 	if module.TCP.StartTLS != "" {
 		err = startTLS(conn, module.TCP.StartTLS)
 		if err != nil {
@@ -35,27 +61,57 @@ func ProbeTCP(target string, module config.Module, timeout time.Duration) (*tls.
 		}
 	}
 
-	tlsConfig, err := pconfig.NewTLSConfig(&module.TLSConfig)
+	if err := doQueryResponses(conn, preTLS); err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetDeadline(deadline); err != nil {
+		return nil, fmt.Errorf("Error setting deadline")
+	}
+
+	tlsConfig, err := newTLSConfig(module)
 	if err != nil {
 		return nil, err
 	}
 
+	targetAddress, targetPort, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, err
+	}
 	if tlsConfig.ServerName == "" {
-		targetAddress, _, err := net.SplitHostPort(target)
-		if err != nil {
-			return nil, err
-		}
 		tlsConfig.ServerName = targetAddress
 	}
 
+	if err := setECHConfig(ctx, tlsConfig, module, tlsConfig.ServerName, targetPort); err != nil {
+		return nil, err
+	}
+
+	verifier := newAIAVerifier(ctx, tlsConfig, module, tlsConfig.ServerName, timeout)
+	certificateRequest := recordCertificateRequest(tlsConfig)
+	defer certificateRequest.collect(ch)
+
 	tlsConn := tls.Client(conn, tlsConfig)
 	defer tlsConn.Close()
 
 	if err := tlsConn.Handshake(); err != nil {
+		return nil, handshakeError(err)
+	}
+
+	if stalling != nil {
+		if err := stalling.done(); err != nil {
+			return nil, fmt.Errorf("Error setting deadline")
+		}
+	}
+
+	if err := doQueryResponses(tlsConn, postTLS); err != nil {
 		return nil, err
 	}
 
 	state := tlsConn.ConnectionState()
+	if err := checkALPN(module, &state); err != nil {
+		return nil, err
+	}
+	verifier.complete(&state, ch)
 
 	return &state, nil
 }
@@ -126,13 +182,42 @@ var (
 
 // startTLS will send the STARTTLS command for the given protocol
 func startTLS(conn net.Conn, proto string) error {
-	var err error
-
 	qr, ok := startTLSqueryResponses[proto]
 	if !ok {
 		return fmt.Errorf("STARTTLS is not supported for %s", proto)
 	}
 
+	return doQueryResponses(conn, qr)
+}
+
+// splitQueryResponses converts the configured query_response steps and splits
+// them into the steps that should be performed before the TLS handshake and
+// those that should be performed after it. If no step has starttls set then
+// every step is performed after the handshake.
+func splitQueryResponses(steps []config.QueryResponse) ([]queryResponse, []queryResponse) {
+	var (
+		qrs   []queryResponse
+		split int
+	)
+	for i, step := range steps {
+		qr := queryResponse{send: step.Send}
+		if step.Expect.Regexp != nil {
+			qr.expect = step.Expect.String()
+		}
+		qrs = append(qrs, qr)
+		if step.StartTLS && split == 0 {
+			split = i + 1
+		}
+	}
+
+	return qrs[:split], qrs[split:]
+}
+
+// doQueryResponses sends and expects lines on the connection in the order
+// given by the query responses
+func doQueryResponses(conn net.Conn, qr []queryResponse) error {
+	var err error
+
 	scanner := bufio.NewScanner(conn)
 	for _, qr := range qr {
 		if qr.expect != "" {
@@ -1,14 +1,21 @@
 package prober
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
+	"errors"
 	"net"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/ribbybibby/ssl_exporter/config"
 	"github.com/ribbybibby/ssl_exporter/test"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	pconfig "github.com/prometheus/common/config"
 )
 
@@ -30,7 +37,7 @@ func TestProbeTCP(t *testing.T) {
 		},
 	}
 
-	if _, err := ProbeTCP(server.Listener.Addr().String(), module, 10*time.Second); err != nil {
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err != nil {
 		t.Fatalf("error: %s", err)
 	}
 }
@@ -56,7 +63,7 @@ func TestProbeTCPInvalidName(t *testing.T) {
 
 	_, listenPort, _ := net.SplitHostPort(server.Listener.Addr().String())
 
-	if _, err := ProbeTCP("localhost:"+listenPort, module, 10*time.Second); err == nil {
+	if _, err := ProbeTCP(context.Background(), "localhost:"+listenPort, module, 10*time.Second, nil); err == nil {
 		t.Fatalf("expected error but err was nil")
 	}
 }
@@ -83,7 +90,7 @@ func TestProbeTCPServerName(t *testing.T) {
 		},
 	}
 
-	if _, err := ProbeTCP("localhost:"+listenPort, module, 10*time.Second); err != nil {
+	if _, err := ProbeTCP(context.Background(), "localhost:"+listenPort, module, 10*time.Second, nil); err != nil {
 		t.Fatalf("error: %s", err)
 	}
 }
@@ -114,7 +121,7 @@ func TestProbeTCPExpired(t *testing.T) {
 		},
 	}
 
-	if _, err := ProbeTCP(server.Listener.Addr().String(), module, 5*time.Second); err == nil {
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 5*time.Second, nil); err == nil {
 		t.Fatalf("expected error but err is nil")
 	}
 }
@@ -146,7 +153,7 @@ func TestProbeTCPExpiredInsecure(t *testing.T) {
 		},
 	}
 
-	state, err := ProbeTCP(server.Listener.Addr().String(), module, 5*time.Second)
+	state, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 5*time.Second, nil)
 	if err != nil {
 		t.Fatalf("error: %s", err)
 	}
@@ -176,7 +183,7 @@ func TestProbeTCPStartTLSSMTP(t *testing.T) {
 		},
 	}
 
-	if _, err := ProbeTCP(server.Listener.Addr().String(), module, 10*time.Second); err != nil {
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err != nil {
 		t.Fatalf("error: %s", err)
 	}
 }
@@ -202,7 +209,7 @@ func TestProbeTCPStartTLSFTP(t *testing.T) {
 		},
 	}
 
-	if _, err := ProbeTCP(server.Listener.Addr().String(), module, 10*time.Second); err != nil {
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err != nil {
 		t.Fatalf("error: %s", err)
 	}
 }
@@ -228,7 +235,322 @@ func TestProbeTCPStartTLSIMAP(t *testing.T) {
 		},
 	}
 
-	if _, err := ProbeTCP(server.Listener.Addr().String(), module, 10*time.Second); err != nil {
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err != nil {
 		t.Fatalf("error: %s", err)
 	}
 }
+
+// TestProbeTCPKeyLog tests that the TLS secrets are written to the
+// KeyLogWriter when it is set
+func TestProbeTCPKeyLog(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	keyLog := &bytes.Buffer{}
+	KeyLogWriter = keyLog
+	defer func() { KeyLogWriter = nil }()
+
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	if !strings.Contains(keyLog.String(), "CLIENT_TRAFFIC_SECRET_0") {
+		t.Fatalf("expected TLS secrets in the key log, got: %s", keyLog.String())
+	}
+}
+
+// TestProbeTCPQueryResponse tests query_response steps after the handshake
+func TestProbeTCPQueryResponse(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TCP: config.TCPProbe{
+			QueryResponse: []config.QueryResponse{
+				config.QueryResponse{
+					Expect: config.Regexp{Regexp: regexp.MustCompile("^Hello World!$")},
+				},
+			},
+		},
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+}
+
+// TestProbeTCPQueryResponseNoMatch tests that the probe fails when a
+// query_response step doesn't match
+func TestProbeTCPQueryResponseNoMatch(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TCP: config.TCPProbe{
+			QueryResponse: []config.QueryResponse{
+				config.QueryResponse{
+					Expect: config.Regexp{Regexp: regexp.MustCompile("^Goodbye")},
+				},
+			},
+		},
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+}
+
+// TestProbeTCPQueryResponseStartTLS tests a STARTTLS conversation described
+// with query_response steps
+func TestProbeTCPQueryResponseStartTLS(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartSMTP()
+	defer server.Close()
+
+	module := config.Module{
+		TCP: config.TCPProbe{
+			QueryResponse: []config.QueryResponse{
+				config.QueryResponse{
+					Expect: config.Regexp{Regexp: regexp.MustCompile("^220")},
+					Send:   "EHLO prober",
+				},
+				config.QueryResponse{
+					Expect: config.Regexp{Regexp: regexp.MustCompile("^250-STARTTLS")},
+					Send:   "STARTTLS",
+				},
+				config.QueryResponse{
+					Expect:   config.Regexp{Regexp: regexp.MustCompile("^220")},
+					StartTLS: true,
+				},
+			},
+		},
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+}
+
+// TestProbeTCPPlaintext tests that a target answering with plaintext returns
+// a NotTLSError
+func TestProbeTCPPlaintext(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartPlaintext()
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	_, err = ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil)
+	if _, ok := err.(*NotTLSError); !ok {
+		t.Fatalf("expected a NotTLSError, got: %v", err)
+	}
+}
+
+// TestProbeTCPProtocolTimeout tests that a slow STARTTLS negotiation is
+// limited by the protocol timeout rather than the probe timeout
+func TestProbeTCPProtocolTimeout(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartSlowBanner(2 * time.Second)
+	defer server.Close()
+
+	module := config.Module{
+		TCP: config.TCPProbe{
+			StartTLS:        "smtp",
+			ProtocolTimeout: 100 * time.Millisecond,
+		},
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	start := time.Now()
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil); err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the probe to fail after the protocol timeout, took %s", elapsed)
+	}
+}
+
+// TestProbeTCPReadDeadline tests that a stalled STARTTLS negotiation fails
+// after the read deadline rather than the probe timeout
+func TestProbeTCPReadDeadline(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartSlowBanner(2 * time.Second)
+	defer server.Close()
+
+	module := config.Module{
+		TCP: config.TCPProbe{
+			StartTLS:     "smtp",
+			ReadDeadline: 100 * time.Millisecond,
+		},
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	ch := make(chan prometheus.Metric, 1)
+	start := time.Now()
+	_, err = ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, ch)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the probe to fail after the read deadline, took %s", elapsed)
+	}
+	var stalledErr *StalledError
+	if !errors.As(err, &stalledErr) {
+		t.Fatalf("expected a StalledError, got %v", err)
+	}
+	checkHandshakeStalled(t, ch, 1)
+}
+
+// TestProbeTCPReadDeadlineNotStalled tests that the read deadline doesn't
+// affect a target that answers in time
+func TestProbeTCPReadDeadlineNotStalled(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartSMTP()
+	defer server.Close()
+
+	module := config.Module{
+		TCP: config.TCPProbe{
+			StartTLS:     "smtp",
+			ReadDeadline: 5 * time.Second,
+		},
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:             caFile,
+			InsecureSkipVerify: false,
+		},
+	}
+
+	ch := make(chan prometheus.Metric, 1)
+	if _, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, ch); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	checkHandshakeStalled(t, ch, 0)
+}
+
+func checkHandshakeStalled(t *testing.T, ch chan prometheus.Metric, expected float64) {
+	select {
+	case m := <-ch:
+		if m.Desc() != handshakeStalled {
+			t.Fatalf("unexpected metric: %s", m.Desc())
+		}
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatalf(err.Error())
+		}
+		if got := pb.GetGauge().GetValue(); got != expected {
+			t.Errorf("expected %s to be %v, got %v", handshakeStalled, expected, got)
+		}
+	default:
+		t.Errorf("expected the prober to emit %s", handshakeStalled)
+	}
+}
+
+// TestProbeTCPRequireALPN tests that the probe fails unless the required
+// application protocol is negotiated
+func TestProbeTCPRequireALPN(t *testing.T) {
+	for _, tc := range []struct {
+		serverProtos []string
+		success      bool
+	}{
+		{[]string{"h2", "http/1.1"}, true},
+		{nil, false},
+	} {
+		server, _, _, caFile, teardown, err := test.SetupTCPServer()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.TLS.NextProtos = tc.serverProtos
+		server.StartTLS()
+
+		module := config.Module{
+			TLSConfig: pconfig.TLSConfig{
+				CAFile: caFile,
+			},
+			RequireALPN: "h2",
+		}
+
+		state, err := ProbeTCP(context.Background(), server.Listener.Addr().String(), module, 10*time.Second, nil)
+		server.Close()
+		if tc.success {
+			if err != nil {
+				t.Fatalf("error: %s", err)
+			}
+			if state.NegotiatedProtocol != "h2" {
+				t.Errorf("expected h2 but got %q", state.NegotiatedProtocol)
+			}
+		} else if err == nil {
+			t.Errorf("expected error when the server doesn't support ALPN, but err was nil")
+		}
+	}
+}
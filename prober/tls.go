@@ -0,0 +1,150 @@
+package prober
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+
+	pconfig "github.com/prometheus/common/config"
+)
+
+var (
+	// KeyLogWriter, when set, receives the TLS master secrets of every
+	// probe in NSS key log format. This allows captured traffic to be
+	// decrypted and must only be used for debugging.
+	KeyLogWriter io.Writer
+
+	// UserAgent, when set, is sent in the User-Agent header of the HTTP
+	// requests made by the probers
+	UserAgent string
+)
+
+// newTLSConfig creates the tls.Config used by the probers from the module.
+// Every probe gets a new config without a session cache, so that a session
+// can't be resumed with the certificate seen by an earlier probe.
+func newTLSConfig(module config.Module) (*tls.Config, error) {
+	tlsConfig, err := newVaultTLSConfig(module.TLSConfig)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.ClientSessionCache = nil
+
+	if KeyLogWriter != nil {
+		tlsConfig.KeyLogWriter = KeyLogWriter
+	}
+
+	if len(module.ClientCertificates) > 0 {
+		if module.TLSConfig.CertFile != "" || module.TLSConfig.KeyFile != "" {
+			return nil, fmt.Errorf("client_certificates can't be used with the cert_file and key_file of tls_config")
+		}
+		certs, err := loadClientCertificates(module.ClientCertificates)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = selectClientCertificate(certs)
+	}
+
+	if module.RequireALPN != "" {
+		tlsConfig.NextProtos = []string{module.RequireALPN}
+	}
+
+	if module.TLSVersion != 0 {
+		tlsConfig.MinVersion = module.TLSVersion
+		tlsConfig.MaxVersion = module.TLSVersion
+	}
+
+	return tlsConfig, nil
+}
+
+// newVaultTLSConfig creates a tls.Config from the TLS config of the module,
+// reading the CA, certificate and key from Vault when they refer to it
+func newVaultTLSConfig(cfg pconfig.TLSConfig) (*tls.Config, error) {
+	caFile, certFile, keyFile := cfg.CAFile, cfg.CertFile, cfg.KeyFile
+	if isVaultRef(caFile) {
+		cfg.CAFile = ""
+	}
+	vaultCert := isVaultRef(certFile) || isVaultRef(keyFile)
+	if vaultCert {
+		cfg.CertFile, cfg.KeyFile = "", ""
+	}
+
+	tlsConfig, err := pconfig.NewTLSConfig(&cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if isVaultRef(caFile) {
+		caPEM, err := ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("unable to use specified CA cert %s", caFile)
+		}
+	}
+
+	if vaultCert {
+		if certFile == "" || keyFile == "" {
+			return nil, fmt.Errorf("client cert %q and key %q must be specified together", certFile, keyFile)
+		}
+		cert, err := loadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to use specified client cert (%s) & key (%s): %s", certFile, keyFile, err)
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// checkALPN returns an error if the module requires an application protocol
+// and the handshake didn't negotiate it
+func checkALPN(module config.Module, state *tls.ConnectionState) error {
+	if module.RequireALPN == "" || state.NegotiatedProtocol == module.RequireALPN {
+		return nil
+	}
+	if state.NegotiatedProtocol == "" {
+		return fmt.Errorf("no application protocol was negotiated, expected %q", module.RequireALPN)
+	}
+	return fmt.Errorf("negotiated application protocol %q, expected %q", state.NegotiatedProtocol, module.RequireALPN)
+}
+
+// NotTLSError is returned by the probers when the target answers the
+// handshake with something that doesn't look like a TLS record
+type NotTLSError struct {
+	Err error
+}
+
+func (e *NotTLSError) Error() string {
+	return e.Err.Error()
+}
+
+// Unwrap returns the underlying error
+func (e *NotTLSError) Unwrap() error {
+	return e.Err
+}
+
+// handshakeError wraps errors that show the target didn't respond with TLS
+// in a NotTLSError
+func handshakeError(err error) error {
+	var recordHeaderErr tls.RecordHeaderError
+	if errors.As(err, &recordHeaderErr) {
+		return &NotTLSError{Err: err}
+	}
+
+	// The http client replaces the record header error when the response
+	// looks like HTTP
+	if strings.Contains(err.Error(), "server gave HTTP response to HTTPS client") {
+		return &NotTLSError{Err: err}
+	}
+
+	return err
+}
@@ -0,0 +1,314 @@
+package prober
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// vaultScheme prefixes the files in a module that are read from Vault,
+	// in the form vault://<path>#<field>
+	vaultScheme = "vault://"
+
+	// maxVaultResponseSize limits the size of the responses from Vault
+	maxVaultResponseSize = 1 << 20
+
+	// vaultLoginPath is the path that the AppRole logs in at
+	vaultLoginPath = "auth/approle/login"
+)
+
+var (
+	// Vault, when set, reads the files in the modules that refer to a secret
+	// in Vault
+	Vault *VaultClient
+)
+
+// VaultClient reads the fields of secrets from HashiCorp Vault. It logs in
+// with the token or, when there isn't one, with the AppRole. Secrets are
+// cached for the TTL, or for their lease when it's shorter, so that rotated
+// certificates are picked up without reading Vault on every probe. The lock
+// is only held to use the cache, and probes that need the same secret at once
+// wait for a single request to Vault.
+type VaultClient struct {
+	address  string
+	token    string
+	roleID   string
+	secretID string
+	ttl      time.Duration
+	client   *http.Client
+
+	mtx         sync.Mutex
+	loginToken  string
+	loginExpiry time.Time
+	secrets     map[string]vaultSecret
+	calls       map[string]*vaultCall
+}
+
+// vaultCall is a request to Vault that is in flight. Callers that need the
+// same response wait for it rather than making the request again.
+type vaultCall struct {
+	done chan struct{}
+	resp *vaultResponse
+	err  error
+}
+
+// vaultSecret is the data of a secret and when it must be read again
+type vaultSecret struct {
+	data    map[string]interface{}
+	expires time.Time
+}
+
+// vaultResponse is the body of the responses from Vault
+type vaultResponse struct {
+	Data          map[string]interface{} `json:"data"`
+	LeaseDuration int                    `json:"lease_duration"`
+	Auth          *struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// NewVaultClient returns a client for the Vault server at the address, which
+// authenticates with the token or, when it's empty, the AppRole role ID and
+// secret ID
+func NewVaultClient(address, token, roleID, secretID string, ttl time.Duration) (*VaultClient, error) {
+	if address == "" {
+		return nil, fmt.Errorf("the address of the Vault server is required")
+	}
+	if token != "" && roleID != "" {
+		return nil, fmt.Errorf("a Vault token and an AppRole can't be used together")
+	}
+	if token == "" && (roleID == "" || secretID == "") {
+		return nil, fmt.Errorf("either a Vault token or an AppRole role ID and secret ID are required")
+	}
+
+	return &VaultClient{
+		address:  strings.TrimSuffix(address, "/"),
+		token:    token,
+		roleID:   roleID,
+		secretID: secretID,
+		ttl:      ttl,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		secrets:  map[string]vaultSecret{},
+		calls:    map[string]*vaultCall{},
+	}, nil
+}
+
+// ReadFile returns the contents of the file, or of the field of the secret in
+// Vault when the name is a vault://<path>#<field> reference
+func ReadFile(name string) ([]byte, error) {
+	if !strings.HasPrefix(name, vaultScheme) {
+		return ioutil.ReadFile(name)
+	}
+	if Vault == nil {
+		return nil, fmt.Errorf("unable to read %s: Vault isn't configured", name)
+	}
+
+	return Vault.ReadField(name)
+}
+
+// isVaultRef returns true if the file is read from Vault
+func isVaultRef(name string) bool {
+	return strings.HasPrefix(name, vaultScheme)
+}
+
+// ReadField returns the field of the secret in a vault://<path>#<field>
+// reference. The fields of KV version 2 secrets are read from inside their
+// data.
+func (v *VaultClient) ReadField(ref string) ([]byte, error) {
+	path, field, err := parseVaultRef(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := v.read(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %s", ref, err)
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return nil, fmt.Errorf("unable to read %s: the secret doesn't have the field %q", ref, field)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("unable to read %s: the field %q isn't a string", ref, field)
+	}
+
+	return []byte(s), nil
+}
+
+// parseVaultRef splits a vault://<path>#<field> reference into the path and
+// the field
+func parseVaultRef(ref string) (string, string, error) {
+	s := strings.TrimPrefix(ref, vaultScheme)
+	i := strings.LastIndex(s, "#")
+	if i < 0 {
+		return "", "", fmt.Errorf("invalid Vault reference %s, expected vault://<path>#<field>", ref)
+	}
+	path, field := strings.Trim(s[:i], "/"), s[i+1:]
+	if path == "" || field == "" {
+		return "", "", fmt.Errorf("invalid Vault reference %s, expected vault://<path>#<field>", ref)
+	}
+
+	return path, field, nil
+}
+
+// read returns the data of the secret at the path, from the cache when it
+// hasn't expired
+func (v *VaultClient) read(path string) (map[string]interface{}, error) {
+	now := time.Now()
+
+	v.mtx.Lock()
+	s, ok := v.secrets[path]
+	v.mtx.Unlock()
+	if ok && now.Before(s.expires) {
+		return s.data, nil
+	}
+
+	resp, err := v.singleflight("read:"+path, func() (*vaultResponse, error) {
+		token, err := v.login(now)
+		if err != nil {
+			return nil, err
+		}
+		return v.do("GET", path, token, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	expires := now.Add(v.ttl)
+	if lease := time.Duration(resp.LeaseDuration) * time.Second; lease > 0 && lease < v.ttl {
+		expires = now.Add(lease)
+	}
+
+	v.mtx.Lock()
+	v.secrets[path] = vaultSecret{data: data, expires: expires}
+	v.mtx.Unlock()
+
+	return data, nil
+}
+
+// login returns the token used to read secrets, logging in with the AppRole
+// when there isn't a token or the last one has expired
+func (v *VaultClient) login(now time.Time) (string, error) {
+	if v.token != "" {
+		return v.token, nil
+	}
+
+	v.mtx.Lock()
+	token, expiry := v.loginToken, v.loginExpiry
+	v.mtx.Unlock()
+	if token != "" && now.Before(expiry) {
+		return token, nil
+	}
+
+	resp, err := v.singleflight("login", func() (*vaultResponse, error) {
+		body, err := json.Marshal(map[string]string{
+			"role_id":   v.roleID,
+			"secret_id": v.secretID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		return v.do("POST", vaultLoginPath, "", body)
+	})
+	if err != nil {
+		return "", fmt.Errorf("unable to log in with the AppRole: %s", err)
+	}
+	if resp.Auth == nil || resp.Auth.ClientToken == "" {
+		return "", fmt.Errorf("unable to log in with the AppRole: no token in the response")
+	}
+
+	v.mtx.Lock()
+	v.loginToken = resp.Auth.ClientToken
+	v.loginExpiry = now.Add(time.Duration(resp.Auth.LeaseDuration) * time.Second)
+	v.mtx.Unlock()
+
+	return resp.Auth.ClientToken, nil
+}
+
+// singleflight calls fn, unless a call with the same key is already in
+// flight, in which case it waits for that call and returns its response
+func (v *VaultClient) singleflight(key string, fn func() (*vaultResponse, error)) (*vaultResponse, error) {
+	v.mtx.Lock()
+	if call, ok := v.calls[key]; ok {
+		v.mtx.Unlock()
+		<-call.done
+		return call.resp, call.err
+	}
+	call := &vaultCall{done: make(chan struct{})}
+	v.calls[key] = call
+	v.mtx.Unlock()
+
+	call.resp, call.err = fn()
+
+	v.mtx.Lock()
+	delete(v.calls, key)
+	v.mtx.Unlock()
+	close(call.done)
+
+	return call.resp, call.err
+}
+
+// do makes a request to the Vault API and decodes the response
+func (v *VaultClient) do(method, path, token string, body []byte) (*vaultResponse, error) {
+	req, err := http.NewRequest(method, v.address+"/v1/"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+	setUserAgent(req)
+
+	httpResp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+
+	resp := &vaultResponse{}
+	if err := json.NewDecoder(io.LimitReader(httpResp.Body, maxVaultResponseSize)).Decode(resp); err != nil && httpResp.StatusCode == http.StatusOK {
+		return nil, err
+	}
+	if httpResp.StatusCode != http.StatusOK {
+		if len(resp.Errors) > 0 {
+			return nil, fmt.Errorf("unexpected status from Vault: %s: %s", httpResp.Status, strings.Join(resp.Errors, ", "))
+		}
+		return nil, fmt.Errorf("unexpected status from Vault: %s", httpResp.Status)
+	}
+
+	return resp, nil
+}
+
+// loadX509KeyPair reads a certificate and key pair from the files, which may
+// be in Vault
+func loadX509KeyPair(certFile, keyFile string) (tls.Certificate, error) {
+	certPEM, err := ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyPEM, err := ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
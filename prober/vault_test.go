@@ -0,0 +1,305 @@
+package prober
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// vaultTestServer is a Vault server with an AppRole and a KV version 1 and 2
+// secret
+type vaultTestServer struct {
+	*httptest.Server
+
+	mtx   sync.Mutex
+	reads map[string]int
+}
+
+func newVaultTestServer(secret map[string]interface{}, leaseDuration int) *vaultTestServer {
+	v := &vaultTestServer{reads: map[string]int{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/auth/approle/login", func(w http.ResponseWriter, r *http.Request) {
+		var login map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&login); err != nil || login["role_id"] != "role" || login["secret_id"] != "secret" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"invalid role or secret ID"}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": "approle-token", "lease_duration": 3600},
+		})
+	})
+	secretHandler := func(data map[string]interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			token := r.Header.Get("X-Vault-Token")
+			if token != "token" && token != "approle-token" {
+				w.WriteHeader(http.StatusForbidden)
+				json.NewEncoder(w).Encode(map[string]interface{}{"errors": []string{"permission denied"}})
+				return
+			}
+			v.mtx.Lock()
+			v.reads[r.URL.Path]++
+			v.mtx.Unlock()
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": data, "lease_duration": leaseDuration})
+		}
+	}
+	mux.HandleFunc("/v1/secret/data/pki", secretHandler(map[string]interface{}{
+		"data":     secret,
+		"metadata": map[string]interface{}{"version": 1},
+	}))
+	mux.HandleFunc("/v1/kv/pki", secretHandler(secret))
+	v.Server = httptest.NewServer(mux)
+
+	return v
+}
+
+func (v *vaultTestServer) Reads(path string) int {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+
+	return v.reads[path]
+}
+
+// TestProbeHTTPSVault tests that the CA, client certificate and key are read
+// from Vault and cached between probes
+func TestProbeHTTPSVault(t *testing.T) {
+	server, certPEM, keyPEM, _, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	certPool := x509.NewCertPool()
+	certPool.AppendCertsFromPEM(certPEM)
+
+	server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+	server.TLS.ClientCAs = certPool
+
+	server.StartTLS()
+	defer server.Close()
+
+	vault := newVaultTestServer(map[string]interface{}{
+		"ca":   string(certPEM),
+		"cert": string(certPEM),
+		"key":  string(keyPEM),
+	}, 0)
+	defer vault.Close()
+
+	Vault, err = NewVaultClient(vault.URL, "", "role", "secret", time.Hour)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer func() { Vault = nil }()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile:   "vault://secret/data/pki#ca",
+			CertFile: "vault://secret/data/pki#cert",
+			KeyFile:  "vault://secret/data/pki#key",
+		},
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := ProbeHTTPS(context.Background(), server.URL, module, 5*time.Second, nil); err != nil {
+			t.Fatalf("error: %s", err)
+		}
+	}
+
+	if reads := vault.Reads("/v1/secret/data/pki"); reads != 1 {
+		t.Errorf("expected the secret to be read once, but it was read %d times", reads)
+	}
+}
+
+// TestVaultClientTTL tests that secrets are read again when the lease of the
+// secret or the TTL expires
+func TestVaultClientTTL(t *testing.T) {
+	vault := newVaultTestServer(map[string]interface{}{"ca": "ca"}, 1)
+	defer vault.Close()
+
+	v, err := NewVaultClient(vault.URL, "token", "", "", time.Hour)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for i := 0; i < 2; i++ {
+		b, err := v.ReadField("vault://kv/pki#ca")
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if string(b) != "ca" {
+			t.Errorf("expected ca, but got %s", b)
+		}
+	}
+	if reads := vault.Reads("/v1/kv/pki"); reads != 1 {
+		t.Errorf("expected the secret to be read once, but it was read %d times", reads)
+	}
+
+	time.Sleep(1100 * time.Millisecond)
+
+	if _, err := v.ReadField("vault://kv/pki#ca"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	if reads := vault.Reads("/v1/kv/pki"); reads != 2 {
+		t.Errorf("expected the secret to be read again when the lease expired, but it was read %d times", reads)
+	}
+}
+
+// TestVaultClientConcurrentReads tests that a slow read from Vault doesn't
+// hold up reads from the cache, and that reads of the same secret at once
+// share a single request
+func TestVaultClientConcurrentReads(t *testing.T) {
+	var (
+		mtx       sync.Mutex
+		slowReads int
+	)
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/kv/pki", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"ca": "ca"}})
+	})
+	mux.HandleFunc("/v1/kv/slow", func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		slowReads++
+		mtx.Unlock()
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"ca": "slow"}})
+	})
+	vault := httptest.NewServer(mux)
+	defer vault.Close()
+
+	v, err := NewVaultClient(vault.URL, "token", "", "", time.Hour)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := v.ReadField("vault://kv/pki#ca"); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if b, err := v.ReadField("vault://kv/slow#ca"); err != nil || string(b) != "slow" {
+				t.Errorf("expected slow, but got %s and %v", b, err)
+			}
+		}()
+	}
+	<-started
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if _, err := v.ReadField("vault://kv/pki#ca"); err != nil {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the cached secret to be read while another secret was being read from Vault")
+	}
+
+	close(release)
+	wg.Wait()
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	if slowReads != 1 {
+		t.Errorf("expected the secret to be read from Vault once, but it was read %d times", slowReads)
+	}
+}
+
+// TestVaultClientErrors tests the errors reading secrets from Vault
+func TestVaultClientErrors(t *testing.T) {
+	vault := newVaultTestServer(map[string]interface{}{"ca": "ca", "version": 1}, 0)
+	defer vault.Close()
+
+	v, err := NewVaultClient(vault.URL, "token", "", "", time.Hour)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	wrongToken, err := NewVaultClient(vault.URL, "wrong", "", "", time.Hour)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	wrongSecret, err := NewVaultClient(vault.URL, "", "role", "wrong", time.Hour)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	tests := []struct {
+		name   string
+		client *VaultClient
+		ref    string
+		err    string
+	}{
+		{"missing field", v, "vault://kv/pki#cert", `doesn't have the field "cert"`},
+		{"not a string", v, "vault://kv/pki#version", `the field "version" isn't a string`},
+		{"no field", v, "vault://kv/pki", "invalid Vault reference"},
+		{"no path", v, "vault://#ca", "invalid Vault reference"},
+		{"missing secret", v, "vault://kv/missing#ca", "404 Not Found"},
+		{"wrong token", wrongToken, "vault://kv/pki#ca", "permission denied"},
+		{"wrong secret ID", wrongSecret, "vault://kv/pki#ca", "unable to log in with the AppRole"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.client.ReadField(tt.ref)
+			if err == nil {
+				t.Fatalf("expected error, but err was nil")
+			}
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, but got %q", tt.err, err)
+			}
+		})
+	}
+
+	if _, err := ReadFile("vault://kv/pki#ca"); err == nil || !strings.Contains(err.Error(), "Vault isn't configured") {
+		t.Errorf("expected an error when Vault isn't configured, but got %v", err)
+	}
+}
+
+// TestNewVaultClient tests the validation of the Vault client options
+func TestNewVaultClient(t *testing.T) {
+	tests := []struct {
+		name                             string
+		address, token, roleID, secretID string
+		valid                            bool
+	}{
+		{"token", "http://vault:8200", "token", "", "", true},
+		{"approle", "http://vault:8200", "", "role", "secret", true},
+		{"no address", "", "token", "", "", false},
+		{"no credentials", "http://vault:8200", "", "", "", false},
+		{"no secret ID", "http://vault:8200", "", "role", "", false},
+		{"token and approle", "http://vault:8200", "token", "role", "secret", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewVaultClient(tt.address, tt.token, tt.roleID, tt.secretID, time.Hour)
+			if tt.valid && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+			if !tt.valid && err == nil {
+				t.Errorf("expected error, but err was nil")
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package prober
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// webSocketGUID is appended to the key by the server when it computes the
+// Sec-WebSocket-Accept header
+//
+// See https://tools.ietf.org/html/rfc6455#section-1.3
+const webSocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// ProbeWebSocket performs the WebSocket opening handshake with a wss://
+// target, for endpoints behind gateways that only route upgrade requests to
+// the backend. The connection is closed once the response is received.
+func ProbeWebSocket(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error) {
+	if strings.HasPrefix(target, "ws://") {
+		return nil, fmt.Errorf("Target is using ws scheme: %s", target)
+	}
+	target = strings.TrimPrefix(target, "wss://")
+
+	var key string
+
+	return probeHTTPS(ctx, target, module, timeout, ch, func(req *http.Request) error {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		key = base64.StdEncoding.EncodeToString(nonce)
+
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", key)
+
+		return nil
+	}, func(resp *http.Response) error {
+		if !module.WebSocket.RequireSwitchingProtocols {
+			return nil
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			return fmt.Errorf("the WebSocket upgrade wasn't accepted: %s", resp.Status)
+		}
+		if accept := resp.Header.Get("Sec-WebSocket-Accept"); accept != webSocketAccept(key) {
+			return fmt.Errorf("unexpected Sec-WebSocket-Accept in the response to the upgrade: %q", accept)
+		}
+
+		return nil
+	})
+}
+
+// webSocketAccept returns the Sec-WebSocket-Accept header that a server
+// should respond to the key with
+func webSocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,152 @@
+package prober
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// webSocketHandler accepts WebSocket upgrades and holds the connections open
+// until the done channel is closed. Other requests get a 200.
+func webSocketHandler(accept string, done chan struct{}) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			fmt.Fprintln(w, "Hello world")
+			return
+		}
+		if accept == "" {
+			accept = webSocketAccept(r.Header.Get("Sec-WebSocket-Key"))
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn, buf *bufio.ReadWriter) {
+			defer conn.Close()
+			fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", accept)
+			buf.Flush()
+			<-done
+		}(conn, buf)
+	})
+}
+
+// TestProbeWebSocket tests the upgrade handshake with a wss:// target
+func TestProbeWebSocket(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	server.Config.Handler = webSocketHandler("", done)
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+		WebSocket: config.WebSocketProbe{
+			RequireSwitchingProtocols: true,
+		},
+	}
+
+	target := "wss://" + server.Listener.Addr().String() + "/socket"
+
+	start := time.Now()
+	state, err := ProbeWebSocket(context.Background(), target, module, 5*time.Second, nil)
+	if err != nil {
+		t.Fatalf("error: %s", err)
+	}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		t.Errorf("expected the connection state of the upgrade")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the probe to return after the upgrade, took %s", elapsed)
+	}
+}
+
+// TestProbeWebSocketNotUpgraded tests a target that doesn't accept the upgrade
+func TestProbeWebSocketNotUpgraded(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+	}
+
+	target := "wss://" + server.Listener.Addr().String()
+
+	if _, err := ProbeWebSocket(context.Background(), target, module, 5*time.Second, nil); err != nil {
+		t.Fatalf("error: %s", err)
+	}
+
+	module.WebSocket.RequireSwitchingProtocols = true
+	if _, err := ProbeWebSocket(context.Background(), target, module, 5*time.Second, nil); err == nil {
+		t.Fatalf("expected error, but err was nil")
+	}
+}
+
+// TestProbeWebSocketBadAccept tests a target that responds with the wrong
+// Sec-WebSocket-Accept header
+func TestProbeWebSocketBadAccept(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	done := make(chan struct{})
+	defer close(done)
+
+	server.Config.Handler = webSocketHandler("invalid", done)
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+		WebSocket: config.WebSocketProbe{
+			RequireSwitchingProtocols: true,
+		},
+	}
+
+	if _, err := ProbeWebSocket(context.Background(), "wss://"+server.Listener.Addr().String(), module, 5*time.Second, nil); err == nil {
+		t.Fatalf("expected error, but err was nil")
+	}
+}
+
+// TestProbeWebSocketUnencrypted tests that ws:// targets are rejected
+func TestProbeWebSocketUnencrypted(t *testing.T) {
+	if _, err := ProbeWebSocket(context.Background(), "ws://example.com", config.Module{}, 5*time.Second, nil); err == nil {
+		t.Fatalf("expected error, but err was nil")
+	}
+}
+
+// TestWebSocketAccept tests the example from RFC 6455
+func TestWebSocketAccept(t *testing.T) {
+	if accept := webSocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); accept != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("unexpected Sec-WebSocket-Accept %q", accept)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/x509"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// systemRootsFiles are the files that Go loads the system roots from on
+	// Linux, in the order that they are tried
+	systemRootsFiles = []string{
+		"/etc/ssl/certs/ca-certificates.crt",
+		"/etc/pki/tls/certs/ca-bundle.crt",
+		"/etc/ssl/ca-bundle.pem",
+		"/etc/pki/tls/cacert.pem",
+		"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem",
+		"/etc/ssl/cert.pem",
+	}
+)
+
+// newSystemRootsGauge returns a gauge with the number of certificates in the
+// system cert pool and where they were loaded from
+func newSystemRootsGauge() (*prometheus.GaugeVec, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, err
+	}
+
+	systemRoots := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "system_roots_count",
+			Help:      "The number of certificates in the system cert pool loaded at startup",
+		},
+		[]string{"source"},
+	)
+	systemRoots.WithLabelValues(getSystemRootsSource()).Set(float64(len(pool.Subjects())))
+
+	return systemRoots, nil
+}
+
+// getSystemRootsSource returns the file the system roots were loaded from, or
+// "system" when they come from the platform's own store
+func getSystemRootsSource() string {
+	if file := os.Getenv("SSL_CERT_FILE"); file != "" {
+		return file
+	}
+	for _, file := range systemRootsFiles {
+		if _, err := os.Stat(file); err == nil {
+			return file
+		}
+	}
+	return "system"
+}
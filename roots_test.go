@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/x509"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestSystemRootsGauge tests that the gauge reports the number of
+// certificates in the system pool and where they were loaded from
+func TestSystemRootsGauge(t *testing.T) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		t.Skipf("system cert pool unavailable: %s", err)
+	}
+
+	systemRoots, err := newSystemRootsGauge()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(systemRoots)
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if len(mfs) != 1 || len(mfs[0].GetMetric()) != 1 {
+		t.Fatalf("expected a single metric, got: %v", mfs)
+	}
+
+	if name := mfs[0].GetName(); name != "ssl_exporter_system_roots_count" {
+		t.Errorf("expected ssl_exporter_system_roots_count, got %s", name)
+	}
+
+	metric := mfs[0].GetMetric()[0]
+	if source := metric.GetLabel()[0].GetValue(); source != getSystemRootsSource() {
+		t.Errorf("expected source %s, got %s", getSystemRootsSource(), source)
+	}
+	if count := metric.GetGauge().GetValue(); count != float64(len(pool.Subjects())) {
+		t.Errorf("expected %d certificates, got %v", len(pool.Subjects()), count)
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rotationTracker, when set, counts the changes of the leaf certificate of
+// every target that is probed
+var rotationTracker *certRotationTracker
+
+var certRotations = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "cert", "rotations_total"),
+	"The number of times the leaf certificate of the target has changed since it was first probed",
+	[]string{"target", "module"}, nil,
+)
+
+// rotationKey identifies a target probed with a module
+type rotationKey struct {
+	target string
+	module string
+}
+
+// certRotation is the last leaf certificate seen for a target and the number
+// of times it has changed
+type certRotation struct {
+	fingerprint [sha256.Size]byte
+	rotations   float64
+	seen        time.Time
+}
+
+// certRotationTracker remembers the fingerprint of the last leaf certificate
+// seen for each target and counts the probes that see a different one.
+// Targets that haven't been probed for the retention period are forgotten.
+type certRotationTracker struct {
+	retention time.Duration
+
+	mtx     sync.Mutex
+	targets map[rotationKey]*certRotation
+}
+
+func newCertRotationTracker(retention time.Duration) *certRotationTracker {
+	return &certRotationTracker{
+		retention: retention,
+		targets:   map[rotationKey]*certRotation{},
+	}
+}
+
+// record notes the leaf certificate seen by a probe of the target, counting
+// a rotation when it differs from the last one
+func (r *certRotationTracker) record(target, module string, leaf *x509.Certificate) {
+	now := time.Now()
+	fingerprint := sha256.Sum256(leaf.Raw)
+	key := rotationKey{target: target, module: module}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	rotation, ok := r.targets[key]
+	if !ok {
+		rotation = &certRotation{fingerprint: fingerprint}
+		r.targets[key] = rotation
+	}
+	if rotation.fingerprint != fingerprint {
+		rotation.fingerprint = fingerprint
+		rotation.rotations++
+	}
+	rotation.seen = now
+
+	r.prune(now)
+}
+
+// prune forgets the targets that haven't been probed within the retention
+// period. The caller must hold the lock.
+func (r *certRotationTracker) prune(now time.Time) {
+	for key, rotation := range r.targets {
+		if now.Sub(rotation.seen) > r.retention {
+			delete(r.targets, key)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector
+func (r *certRotationTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- certRotations
+}
+
+// Collect implements prometheus.Collector
+func (r *certRotationTracker) Collect(ch chan<- prometheus.Metric) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	r.prune(time.Now())
+
+	for key, rotation := range r.targets {
+		ch <- prometheus.MustNewConstMetric(
+			certRotations, prometheus.CounterValue, rotation.rotations, key.target, key.module,
+		)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestCertRotationTracker tests that a rotation is counted when the leaf
+// certificate of a target changes and that targets are forgotten after the
+// retention period
+func TestCertRotationTracker(t *testing.T) {
+	// Only the raw certificate is needed to tell the certificates apart
+	cert1 := &x509.Certificate{Raw: []byte("cert 1")}
+	cert2 := &x509.Certificate{Raw: []byte("cert 2")}
+
+	tracker := newCertRotationTracker(time.Hour)
+	tracker.record("example.com:443", "tcp", cert1)
+	tracker.record("example.com:443", "tcp", cert1)
+	tracker.record("example.org:443", "tcp", cert1)
+
+	expected := map[string]float64{
+		"example.com:443/tcp": 0,
+		"example.org:443/tcp": 0,
+	}
+	checkCertRotations(t, tracker, expected)
+
+	tracker.record("example.com:443", "tcp", cert2)
+	tracker.record("example.com:443", "tcp", cert1)
+	tracker.record("example.com:443", "https", cert2)
+
+	expected = map[string]float64{
+		"example.com:443/tcp":   2,
+		"example.com:443/https": 0,
+		"example.org:443/tcp":   0,
+	}
+	checkCertRotations(t, tracker, expected)
+
+	// Age the targets beyond the retention period
+	tracker.mtx.Lock()
+	for _, rotation := range tracker.targets {
+		rotation.seen = time.Now().Add(-2 * time.Hour)
+	}
+	tracker.mtx.Unlock()
+
+	checkCertRotations(t, tracker, map[string]float64{})
+	if len(tracker.targets) != 0 {
+		t.Errorf("expected every target to be pruned, got %d", len(tracker.targets))
+	}
+}
+
+// TestProbeHandlerCertRotations tests that the leaf certificate seen by a
+// probe is recorded by the rotation tracker
+func TestProbeHandlerCertRotations(t *testing.T) {
+	rotationTracker = newCertRotationTracker(time.Hour)
+	defer func() { rotationTracker = nil }()
+
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober:    "tcp",
+				TLSConfig: pconfig.TLSConfig{CAFile: caFile},
+			},
+		},
+	}
+
+	target := server.Listener.Addr().String()
+	if _, err := probe(target, "tcp", conf); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	checkCertRotations(t, rotationTracker, map[string]float64{target + "/tcp": 0})
+}
+
+// checkCertRotations checks the ssl_cert_rotations_total collected from the
+// tracker, by target and module
+func checkCertRotations(t *testing.T, tracker *certRotationTracker, expected map[string]float64) {
+	t.Helper()
+
+	ch := make(chan prometheus.Metric, 10)
+	tracker.Collect(ch)
+	close(ch)
+
+	got := map[string]float64{}
+	for m := range ch {
+		pb := &dto.Metric{}
+		if err := m.Write(pb); err != nil {
+			t.Fatalf(err.Error())
+		}
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		got[labels["target"]+"/"+labels["module"]] = pb.GetCounter().GetValue()
+	}
+
+	if len(got) != len(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+	for key, value := range expected {
+		if v, ok := got[key]; !ok || v != value {
+			t.Errorf("expected ssl_cert_rotations_total %v for %s, got %v", value, key, got)
+		}
+	}
+}
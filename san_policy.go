@@ -0,0 +1,72 @@
+package main
+
+import (
+	"crypto/x509"
+	"net"
+	"strings"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// privateIPRanges are the address ranges that shouldn't be in the SANs of a
+// publicly trusted certificate. Modules can give other ranges with
+// private_ip_ranges.
+var privateIPRanges = mustParseCIDRs(
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+func mustParseCIDRs(cidrs ...string) []config.CIDR {
+	var ranges []config.CIDR
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		ranges = append(ranges, config.CIDR{IPNet: ipNet})
+	}
+	return ranges
+}
+
+// getHasPrivateIPSAN returns 1 if one of the IP address SANs of the
+// certificate is in one of the ranges, or in one of the private ranges when
+// there aren't any
+func getHasPrivateIPSAN(cert *x509.Certificate, ranges []config.CIDR) float64 {
+	if len(ranges) == 0 {
+		ranges = privateIPRanges
+	}
+
+	for _, ip := range cert.IPAddresses {
+		for _, r := range ranges {
+			if r.Contains(ip) {
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+// getHasInternalSAN returns 1 if one of the DNS SANs of the certificate is one
+// of the suffixes, or a subdomain of one of them
+func getHasInternalSAN(cert *x509.Certificate, suffixes []string) float64 {
+	for _, name := range cert.DNSNames {
+		name = strings.ToLower(strings.TrimSuffix(name, "."))
+		for _, suffix := range suffixes {
+			suffix = strings.ToLower(strings.Trim(suffix, "."))
+			if suffix == "" {
+				continue
+			}
+			if name == suffix || strings.HasSuffix(name, "."+suffix) {
+				return 1
+			}
+		}
+	}
+	return 0
+}
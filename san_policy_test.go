@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+func TestGetHasPrivateIPSAN(t *testing.T) {
+	for _, tc := range []struct {
+		ips      []string
+		ranges   []config.CIDR
+		expected float64
+	}{
+		{nil, nil, 0},
+		{[]string{"203.0.113.1"}, nil, 0},
+		{[]string{"203.0.113.1", "10.1.2.3"}, nil, 1},
+		{[]string{"172.31.255.255"}, nil, 1},
+		{[]string{"172.32.0.1"}, nil, 0},
+		{[]string{"192.168.1.1"}, nil, 1},
+		{[]string{"fd00::1"}, nil, 1},
+		{[]string{"2001:db8::1"}, nil, 0},
+		{[]string{"10.1.2.3"}, mustParseCIDRs("203.0.113.0/24"), 0},
+		{[]string{"203.0.113.1"}, mustParseCIDRs("203.0.113.0/24"), 1},
+	} {
+		cert := &x509.Certificate{}
+		for _, ip := range tc.ips {
+			cert.IPAddresses = append(cert.IPAddresses, net.ParseIP(ip))
+		}
+		if got := getHasPrivateIPSAN(cert, tc.ranges); got != tc.expected {
+			t.Errorf("expected %v for %v but got %v", tc.expected, tc.ips, got)
+		}
+	}
+}
+
+func TestGetHasInternalSAN(t *testing.T) {
+	suffixes := []string{"corp", ".internal.example.com"}
+
+	for _, tc := range []struct {
+		names    []string
+		expected float64
+	}{
+		{nil, 0},
+		{[]string{"example.com"}, 0},
+		{[]string{"example.com", "host.corp"}, 1},
+		{[]string{"HOST.CORP."}, 1},
+		{[]string{"corp"}, 1},
+		{[]string{"notcorp"}, 0},
+		{[]string{"db.internal.example.com"}, 1},
+		{[]string{"internal.example.com"}, 1},
+		{[]string{"external.example.com"}, 0},
+	} {
+		cert := &x509.Certificate{DNSNames: tc.names}
+		if got := getHasInternalSAN(cert, suffixes); got != tc.expected {
+			t.Errorf("expected %v for %v but got %v", tc.expected, tc.names, got)
+		}
+	}
+}
+
+// TestProbeHandlerSANPolicy tests the metrics about private and internal SANs
+// in the leaf certificate, which has 127.0.0.1 and ::1 in its IP SANs
+func TestProbeHandlerSANPolicy(t *testing.T) {
+	for _, tc := range []struct {
+		module     config.Module
+		expected   []string
+		unexpected []string
+	}{
+		{
+			expected:   []string{"ssl_cert_has_private_ip_san 1"},
+			unexpected: []string{"ssl_cert_has_internal_san"},
+		},
+		{
+			module: config.Module{
+				PrivateIPRanges:  mustParseCIDRs("10.0.0.0/8"),
+				InternalSuffixes: []string{"ribbybibby.me"},
+			},
+			expected: []string{"ssl_cert_has_private_ip_san 0", "ssl_cert_has_internal_san 1"},
+		},
+		{
+			module: config.Module{
+				InternalSuffixes: []string{"corp"},
+			},
+			expected: []string{"ssl_cert_has_internal_san 0"},
+		},
+	} {
+		server, _, _, caFile, teardown, err := test.SetupTCPServer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		server.StartTLS()
+
+		module := tc.module
+		module.Prober = "tcp"
+		module.TLSConfig = pconfig.TLSConfig{CAFile: caFile}
+		conf := &config.Config{
+			Modules: map[string]config.Module{"tcp": module},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		server.Close()
+		teardown()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, expected := range tc.expected {
+			if !strings.Contains(rr.Body.String(), expected) {
+				t.Errorf("expected `%s`", expected)
+			}
+		}
+		for _, unexpected := range tc.unexpected {
+			if strings.Contains(rr.Body.String(), unexpected) {
+				t.Errorf("unexpected `%s`", unexpected)
+			}
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/prober"
+)
+
+// scheduledTarget is a target from the config that is probed in the
+// background. It collects the metrics from the latest probe.
+type scheduledTarget struct {
+	exporter *Exporter
+
+	mtx     sync.RWMutex
+	metrics []prometheus.Metric
+}
+
+// Describe metrics
+func (s *scheduledTarget) Describe(ch chan<- *prometheus.Desc) {
+	s.exporter.Describe(ch)
+}
+
+// Collect the metrics from the latest probe
+func (s *scheduledTarget) Collect(ch chan<- prometheus.Metric) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+
+	for _, m := range s.metrics {
+		ch <- m
+	}
+}
+
+// probe probes the target and replaces the metrics from the previous probe
+func (s *scheduledTarget) probe() {
+	var (
+		metrics  []prometheus.Metric
+		metricCh = make(chan prometheus.Metric)
+		done     = make(chan struct{})
+	)
+	go func() {
+		for m := range metricCh {
+			metrics = append(metrics, m)
+		}
+		close(done)
+	}()
+	s.exporter.Collect(metricCh)
+	close(metricCh)
+	<-done
+
+	s.mtx.Lock()
+	s.metrics = metrics
+	s.mtx.Unlock()
+}
+
+// scheduleTargets registers the targets in the config with the registerer,
+// labelled with the target and module, and probes them every interval until
+// the stop channel is closed. Targets that can't be registered are logged and
+// skipped.
+func scheduleTargets(conf *config.Config, reg prometheus.Registerer, interval, timeout time.Duration, stop <-chan struct{}) error {
+	var targets []*scheduledTarget
+	for _, t := range conf.Targets {
+		moduleName := t.Module
+		if moduleName == "" {
+			moduleName = "tcp"
+		}
+		module, ok := conf.Modules[moduleName]
+		if !ok {
+			return fmt.Errorf("Unknown module %q for target %q", moduleName, t.Target)
+		}
+
+		probeFn, ok := prober.Probers[module.Prober]
+		if !ok {
+			return fmt.Errorf("Unknown prober %q for target %q", module.Prober, t.Target)
+		}
+
+		target := &scheduledTarget{
+			exporter: &Exporter{
+				target:     t.Target,
+				prober:     probeFn,
+				timeout:    timeout,
+				module:     config.ExpandModule(module, t.Target),
+				moduleName: moduleName,
+			},
+		}
+
+		// A target that can't be registered isn't probed, rather than
+		// stopping the others from being probed
+		labels := prometheus.Labels{"target": t.Target, "module": moduleName}
+		if err := prometheus.WrapRegistererWith(labels, reg).Register(target); err != nil {
+			log.Errorf("error=%s target=%s module=%s msg=unable to register the target, it won't be probed", err, t.Target, moduleName)
+			continue
+		}
+		targets = append(targets, target)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			var wg sync.WaitGroup
+			for _, target := range targets {
+				wg.Add(1)
+				go func(target *scheduledTarget) {
+					defer wg.Done()
+					target.probe()
+				}(target)
+			}
+			wg.Wait()
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestScheduleTargets tests that the targets in the config are probed and
+// exposed with target and module labels
+func TestScheduleTargets(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+		Targets: []config.Target{
+			config.Target{
+				Target: server.URL,
+				Module: "https",
+			},
+		},
+	}
+
+	registry := prometheus.NewRegistry()
+	stop := make(chan struct{})
+	defer close(stop)
+
+	if err := scheduleTargets(conf, registry, time.Hour, 10*time.Second, stop); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for _, mf := range mfs {
+			if mf.GetName() != "ssl_tls_connect_success" {
+				continue
+			}
+			labels := map[string]string{}
+			for _, l := range mf.GetMetric()[0].GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["target"] != server.URL || labels["module"] != "https" {
+				t.Fatalf("expected target and module labels, got: %v", labels)
+			}
+			if v := mf.GetMetric()[0].GetGauge().GetValue(); v != 1 {
+				t.Fatalf("expected ssl_tls_connect_success 1, got %v", v)
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for the target to be probed")
+}
+
+// TestScheduleTargetsUnknownModule tests that a target with a module that
+// isn't in the config is rejected
+func TestScheduleTargetsUnknownModule(t *testing.T) {
+	conf := &config.Config{
+		Modules: map[string]config.Module{},
+		Targets: []config.Target{
+			config.Target{
+				Target: "example.com:443",
+				Module: "foobar",
+			},
+		},
+	}
+
+	if err := scheduleTargets(conf, prometheus.NewRegistry(), time.Hour, 10*time.Second, make(chan struct{})); err == nil {
+		t.Fatalf("expected error but err was nil")
+	}
+}
+
+// TestScheduleTargetsCertLabels tests that a target that can't be registered,
+// because its module has different cert_labels, is skipped rather than
+// stopping the other targets from being probed
+func TestScheduleTargetsCertLabels(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+			"https_cn": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				CertLabels: config.CertLabels{"serial_no", "issuer_cn"},
+			},
+		},
+		Targets: []config.Target{
+			config.Target{
+				Target: server.URL,
+				Module: "https",
+			},
+			config.Target{
+				Target: server.URL,
+				Module: "https_cn",
+			},
+		},
+	}
+
+	registry := prometheus.NewRegistry()
+	stop := make(chan struct{})
+	defer close(stop)
+
+	if err := scheduleTargets(conf, registry, time.Hour, 10*time.Second, stop); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		for _, mf := range mfs {
+			if mf.GetName() != "ssl_tls_connect_success" {
+				continue
+			}
+			if len(mf.GetMetric()) != 1 {
+				t.Fatalf("expected only the first target to be probed, got %d metrics", len(mf.GetMetric()))
+			}
+			for _, l := range mf.GetMetric()[0].GetLabel() {
+				if l.GetName() == "module" && l.GetValue() != "https" {
+					t.Fatalf("expected the target with the https module, got %s", l.GetValue())
+				}
+			}
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	t.Fatalf("timed out waiting for the target to be probed")
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/prober"
+)
+
+// selfTestCase is a server started by the self test and the metrics that
+// probing it is expected to produce
+type selfTestCase struct {
+	name     string
+	cert     tls.Certificate
+	module   config.Module
+	expected map[string]float64
+}
+
+// selfTest probes local servers with an expiring, an expired and a
+// self-signed certificate, writes the results to out and returns whether
+// every probe produced the expected metrics
+func selfTest(out io.Writer, timeout time.Duration) (bool, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return false, err
+	}
+	caTmpl := selfTestTemplate(1, "ssl_exporter self test CA", time.Now().AddDate(0, 0, -7), time.Now().AddDate(0, 0, 30))
+	caTmpl.IsCA = true
+	caTmpl.KeyUsage |= x509.KeyUsageCertSign
+	caCert, _, err := selfTestCertificate(caTmpl, nil, caKey)
+	if err != nil {
+		return false, err
+	}
+
+	caFile, err := ioutil.TempFile("", "ssl_exporter_selftest")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(caFile.Name())
+	if err := pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}); err != nil {
+		return false, err
+	}
+	if err := caFile.Close(); err != nil {
+		return false, err
+	}
+
+	expiringTmpl := selfTestTemplate(2, "expiring", time.Now().Add(-time.Hour), time.Now().AddDate(0, 0, 1))
+	_, expiring, err := selfTestCertificate(expiringTmpl, caCert, caKey)
+	if err != nil {
+		return false, err
+	}
+
+	expiredTmpl := selfTestTemplate(3, "expired", time.Now().AddDate(0, 0, -2), time.Now().AddDate(0, 0, -1))
+	_, expired, err := selfTestCertificate(expiredTmpl, caCert, caKey)
+	if err != nil {
+		return false, err
+	}
+
+	selfSignedTmpl := selfTestTemplate(4, "self-signed", time.Now().Add(-time.Hour), time.Now().AddDate(0, 0, 1))
+	_, selfSigned, err := selfTestCertificate(selfSignedTmpl, nil, nil)
+	if err != nil {
+		return false, err
+	}
+
+	cases := []selfTestCase{
+		{
+			name: "expiring",
+			cert: expiring,
+			module: config.Module{
+				Prober:    "tcp",
+				TLSConfig: pconfig.TLSConfig{CAFile: caFile.Name()},
+			},
+			expected: map[string]float64{
+				"tls_connect_success":        1,
+				"chain_has_expired_cert":     0,
+				"cert_trusted_ignoring_time": 1,
+			},
+		},
+		{
+			name: "expired",
+			cert: expired,
+			module: config.Module{
+				Prober:    "tcp",
+				TLSConfig: pconfig.TLSConfig{CAFile: caFile.Name(), InsecureSkipVerify: true},
+			},
+			expected: map[string]float64{
+				"tls_connect_success":        1,
+				"chain_has_expired_cert":     1,
+				"cert_trusted_ignoring_time": 1,
+			},
+		},
+		{
+			name: "self-signed",
+			cert: selfSigned,
+			module: config.Module{
+				Prober:    "tcp",
+				TLSConfig: pconfig.TLSConfig{CAFile: caFile.Name()},
+			},
+			expected: map[string]float64{
+				"tls_connect_success": 0,
+			},
+		},
+	}
+
+	passed := true
+	for _, tc := range cases {
+		failures, err := tc.run(timeout)
+		if err != nil {
+			return false, err
+		}
+		if len(failures) == 0 {
+			fmt.Fprintf(out, "PASS %s\n", tc.name)
+			continue
+		}
+		passed = false
+		for _, failure := range failures {
+			fmt.Fprintf(out, "FAIL %s: %s\n", tc.name, failure)
+		}
+	}
+
+	return passed, nil
+}
+
+// run starts a server for the case, probes it and returns a description of
+// each metric that didn't have the expected value
+func (tc selfTestCase) run(timeout time.Duration) ([]string, error) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{tc.cert},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_ = conn.SetDeadline(time.Now().Add(timeout))
+				_ = conn.(*tls.Conn).Handshake()
+			}()
+		}
+	}()
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(&Exporter{
+		target:     ln.Addr().String(),
+		prober:     prober.ProbeTCP,
+		timeout:    timeout,
+		module:     tc.module,
+		moduleName: tc.name,
+	})
+
+	mfs, err := registry.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]float64{}
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			values[mf.GetName()] = m.GetGauge().GetValue()
+		}
+	}
+
+	var failures []string
+	for name, expected := range tc.expected {
+		name = prometheus.BuildFQName(namespace, "", name)
+		value, ok := values[name]
+		if !ok {
+			failures = append(failures, fmt.Sprintf("%s is missing", name))
+			continue
+		}
+		if value != expected {
+			failures = append(failures, fmt.Sprintf("%s is %v, expected %v", name, value, expected))
+		}
+	}
+
+	return failures, nil
+}
+
+// selfTestTemplate returns a template for a certificate valid for the
+// loopback address
+func selfTestTemplate(serial int64, cn string, notBefore, notAfter time.Time) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+}
+
+// selfTestCertificate creates a certificate from the template, signed by the
+// parent or self-signed if the parent is nil. A key is generated for the
+// certificate unless it is self-signed and a key is given.
+func selfTestCertificate(tmpl, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, tls.Certificate, error) {
+	key := parentKey
+	if parent != nil || key == nil {
+		var err error
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			return nil, tls.Certificate{}, err
+		}
+	}
+	if parent == nil {
+		parent = tmpl
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, tls.Certificate{}, err
+	}
+
+	return cert, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}, nil
+}
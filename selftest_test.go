@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSelfTest tests that the self test passes
+func TestSelfTest(t *testing.T) {
+	out := &bytes.Buffer{}
+	passed, err := selfTest(out, 10*time.Second)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if !passed {
+		t.Errorf("expected the self test to pass, got:\n%s", out.String())
+	}
+
+	for _, name := range []string{"expiring", "expired", "self-signed"} {
+		if ok := strings.Contains(out.String(), "PASS "+name); !ok {
+			t.Errorf("expected `PASS %s`", name)
+		}
+	}
+}
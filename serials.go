@@ -0,0 +1,104 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// serialTracker, when set, records the serial numbers of the certificates
+// seen by every probe
+var serialTracker *serialCollisionTracker
+
+var serialCollision = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "exporter", "serial_collision"),
+	"The number of different issuers that a serial number has been seen from, for serial numbers seen from more than one",
+	[]string{"serial_no"}, nil,
+)
+
+// serialCollisionTracker remembers the issuers that each serial number has
+// been seen from across all the probes. A serial number should be unique to
+// its issuer, so seeing it from more than one can indicate a problem with a
+// CA. Serials that haven't been seen for the retention period are forgotten.
+type serialCollisionTracker struct {
+	retention time.Duration
+
+	mtx     sync.Mutex
+	serials map[string]map[string]time.Time
+}
+
+func newSerialCollisionTracker(retention time.Duration) *serialCollisionTracker {
+	return &serialCollisionTracker{
+		retention: retention,
+		serials:   map[string]map[string]time.Time{},
+	}
+}
+
+// record notes the serial number and issuer of each certificate
+func (s *serialCollisionTracker) record(certs []*x509.Certificate) {
+	now := time.Now()
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, cert := range certs {
+		serial := cert.SerialNumber.String()
+		if s.serials[serial] == nil {
+			s.serials[serial] = map[string]time.Time{}
+		}
+		s.serials[serial][getIssuerFingerprint(cert)] = now
+	}
+
+	s.prune(now)
+}
+
+// prune forgets the issuers that haven't been seen within the retention
+// period. The caller must hold the lock.
+func (s *serialCollisionTracker) prune(now time.Time) {
+	for serial, issuers := range s.serials {
+		for issuer, seen := range issuers {
+			if now.Sub(seen) > s.retention {
+				delete(issuers, issuer)
+			}
+		}
+		if len(issuers) == 0 {
+			delete(s.serials, serial)
+		}
+	}
+}
+
+// Describe implements prometheus.Collector
+func (s *serialCollisionTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- serialCollision
+}
+
+// Collect implements prometheus.Collector
+func (s *serialCollisionTracker) Collect(ch chan<- prometheus.Metric) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.prune(time.Now())
+
+	for serial, issuers := range s.serials {
+		if len(issuers) < 2 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(
+			serialCollision, prometheus.GaugeValue, float64(len(issuers)), serial,
+		)
+	}
+}
+
+// getIssuerFingerprint identifies the issuer of the certificate by the
+// SHA-256 of its name and the authority key identifier, so that certificates
+// can be grouped by issuer without the issuer's certificate
+func getIssuerFingerprint(cert *x509.Certificate) string {
+	h := sha256.New()
+	h.Write(cert.RawIssuer)
+	h.Write(cert.AuthorityKeyId)
+	return hex.EncodeToString(h.Sum(nil))
+}
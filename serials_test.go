@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TestSerialCollisionTracker tests that a serial number is only exported when
+// it has been seen from more than one issuer and is forgotten after the
+// retention period
+func TestSerialCollisionTracker(t *testing.T) {
+	// Only the raw issuer name is needed to tell the issuers apart
+	newCert := func(serial int64, issuer string) *x509.Certificate {
+		return &x509.Certificate{SerialNumber: big.NewInt(serial), RawIssuer: []byte(issuer)}
+	}
+
+	tracker := newSerialCollisionTracker(time.Hour)
+	tracker.record([]*x509.Certificate{newCert(1, "CA 1"), newCert(2, "CA 1")})
+	tracker.record([]*x509.Certificate{newCert(1, "CA 1")})
+
+	if n := collectSerialCollisions(tracker); n != 0 {
+		t.Fatalf("expected no collisions, got %d", n)
+	}
+
+	tracker.record([]*x509.Certificate{newCert(1, "CA 2")})
+	if n := collectSerialCollisions(tracker); n != 1 {
+		t.Fatalf("expected 1 collision, got %d", n)
+	}
+
+	// Age the serials beyond the retention period
+	tracker.mtx.Lock()
+	for _, issuers := range tracker.serials {
+		for issuer := range issuers {
+			issuers[issuer] = time.Now().Add(-2 * time.Hour)
+		}
+	}
+	tracker.mtx.Unlock()
+
+	if n := collectSerialCollisions(tracker); n != 0 {
+		t.Fatalf("expected the collision to be pruned, got %d", n)
+	}
+	if len(tracker.serials) != 0 {
+		t.Errorf("expected every serial to be pruned, got %d", len(tracker.serials))
+	}
+}
+
+// collectSerialCollisions returns the number of metrics collected from the
+// tracker
+func collectSerialCollisions(tracker *serialCollisionTracker) int {
+	ch := make(chan prometheus.Metric, 10)
+	tracker.Collect(ch)
+	close(ch)
+	return len(ch)
+}
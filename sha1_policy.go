@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+)
+
+// getSHA1Free returns 1 if none of the certificates are signed with SHA-1,
+// or a weaker algorithm. Clients don't check the signatures of the roots
+// they trust, so self-issued certificates are skipped unless includeRoots is
+// set, for clients that reject SHA-1 anywhere in the chain.
+func getSHA1Free(certs []*x509.Certificate, includeRoots bool) float64 {
+	for _, cert := range certs {
+		if !includeRoots && isSelfIssued(cert) {
+			continue
+		}
+		if isWeakSignature(cert.SignatureAlgorithm) {
+			return 0
+		}
+	}
+	return 1
+}
+
+// isSelfIssued returns true if the certificate names itself as its issuer.
+// Unlike isSelfSigned, it doesn't check the signature, which fails for the
+// SHA-1 signatures that this is used to look for.
+func isSelfIssued(cert *x509.Certificate) bool {
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return false
+	}
+	return len(cert.AuthorityKeyId) == 0 || bytes.Equal(cert.AuthorityKeyId, cert.SubjectKeyId)
+}
+
+// getVerifiedChainSHA1Free returns getSHA1Free for a verified chain. The last
+// certificate in the chain is the trusted root, whether or not it's
+// self-issued, so it's skipped unless includeRoots is set.
+func getVerifiedChainSHA1Free(chain []*x509.Certificate, includeRoots bool) float64 {
+	if !includeRoots && len(chain) > 1 {
+		chain = chain[:len(chain)-1]
+	}
+	return getSHA1Free(chain, includeRoots)
+}
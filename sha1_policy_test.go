@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+func TestGetSHA1Free(t *testing.T) {
+	// Only the names and the signature algorithm are needed
+	newCert := func(subject, issuer string, alg x509.SignatureAlgorithm) *x509.Certificate {
+		return &x509.Certificate{RawSubject: []byte(subject), RawIssuer: []byte(issuer), SignatureAlgorithm: alg}
+	}
+	leaf := newCert("leaf", "intermediate", x509.SHA256WithRSA)
+	sha1Leaf := newCert("leaf", "intermediate", x509.SHA1WithRSA)
+	intermediate := newCert("intermediate", "root", x509.SHA256WithRSA)
+	sha1Intermediate := newCert("intermediate", "root", x509.ECDSAWithSHA1)
+	md5Intermediate := newCert("intermediate", "root", x509.MD5WithRSA)
+	root := newCert("root", "root", x509.SHA256WithRSA)
+	sha1Root := newCert("root", "root", x509.SHA1WithRSA)
+	sha1CrossSignedRoot := newCert("root", "old root", x509.SHA1WithRSA)
+
+	for _, tc := range []struct {
+		name         string
+		certs        []*x509.Certificate
+		includeRoots bool
+		served       float64
+		verified     float64
+	}{
+		{"sha-256", []*x509.Certificate{leaf, intermediate, root}, false, 1, 1},
+		{"sha-1 leaf", []*x509.Certificate{sha1Leaf, intermediate, root}, false, 0, 0},
+		{"sha-1 intermediate", []*x509.Certificate{leaf, sha1Intermediate, root}, false, 0, 0},
+		{"md5 intermediate", []*x509.Certificate{leaf, md5Intermediate, root}, false, 0, 0},
+		{"sha-1 root", []*x509.Certificate{leaf, intermediate, sha1Root}, false, 1, 1},
+		{"sha-1 root included", []*x509.Certificate{leaf, intermediate, sha1Root}, true, 0, 0},
+		{"sha-1 cross-signed root", []*x509.Certificate{leaf, intermediate, sha1CrossSignedRoot}, false, 0, 1},
+		{"sha-1 cross-signed root included", []*x509.Certificate{leaf, intermediate, sha1CrossSignedRoot}, true, 0, 0},
+	} {
+		if got := getSHA1Free(tc.certs, tc.includeRoots); got != tc.served {
+			t.Errorf("%s: expected %v for the served chain but got %v", tc.name, tc.served, got)
+		}
+		if got := getVerifiedChainSHA1Free(tc.certs, tc.includeRoots); got != tc.verified {
+			t.Errorf("%s: expected %v for the verified chain but got %v", tc.name, tc.verified, got)
+		}
+	}
+}
+
+// TestProbeHandlerSHA1Free tests ssl_chain_sha1_free and
+// ssl_verified_chain_sha1_free for the test certificate, which is signed with
+// SHA-256
+func TestProbeHandlerSHA1Free(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober:           "tcp",
+				TLSConfig:        pconfig.TLSConfig{CAFile: caFile},
+				SHA1IncludeRoots: true,
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{
+		"ssl_chain_sha1_free 1",
+		`ssl_verified_chain_sha1_free{chain_no="0"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected `%s`", expected)
+		}
+	}
+}
@@ -1,13 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
+	"math/big"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -16,6 +30,7 @@ import (
 	"github.com/prometheus/common/version"
 	"github.com/ribbybibby/ssl_exporter/config"
 	"github.com/ribbybibby/ssl_exporter/prober"
+	"golang.org/x/crypto/ocsp"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -24,6 +39,48 @@ const (
 )
 
 var (
+	// tlsAlertNames maps the descriptions crypto/tls gives to TLS alerts to
+	// the names used for them in the RFCs
+	tlsAlertNames = map[string]string{
+		"close notify":                    "close_notify",
+		"unexpected message":              "unexpected_message",
+		"bad record MAC":                  "bad_record_mac",
+		"decryption failed":               "decryption_failed",
+		"record overflow":                 "record_overflow",
+		"decompression failure":           "decompression_failure",
+		"handshake failure":               "handshake_failure",
+		"bad certificate":                 "bad_certificate",
+		"unsupported certificate":         "unsupported_certificate",
+		"revoked certificate":             "certificate_revoked",
+		"expired certificate":             "certificate_expired",
+		"unknown certificate":             "certificate_unknown",
+		"illegal parameter":               "illegal_parameter",
+		"unknown certificate authority":   "unknown_ca",
+		"access denied":                   "access_denied",
+		"error decoding message":          "decode_error",
+		"error decrypting message":        "decrypt_error",
+		"export restriction":              "export_restriction",
+		"protocol version not supported":  "protocol_version",
+		"insufficient security level":     "insufficient_security",
+		"internal error":                  "internal_error",
+		"inappropriate fallback":          "inappropriate_fallback",
+		"user canceled":                   "user_canceled",
+		"no renegotiation":                "no_renegotiation",
+		"missing extension":               "missing_extension",
+		"unsupported extension":           "unsupported_extension",
+		"certificate unobtainable":        "certificate_unobtainable",
+		"unrecognized name":               "unrecognized_name",
+		"bad certificate status response": "bad_certificate_status_response",
+		"bad certificate hash value":      "bad_certificate_hash_value",
+		"unknown PSK identity":            "unknown_psk_identity",
+		"certificate required":            "certificate_required",
+		"no application protocol":         "no_application_protocol",
+		"encrypted client hello required": "ech_required",
+	}
+
+	// certLabels are the labels that identify a certificate
+	certLabels = config.CertLabelNames
+
 	tlsConnectSuccess = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "tls_connect_success"),
 		"If the TLS connection was a success",
@@ -34,266 +91,1776 @@ var (
 		"The TLS version used",
 		[]string{"version"}, nil,
 	)
+	keyExchange = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tls_key_exchange_info"),
+		"The group negotiated for the key exchange",
+		[]string{"group"}, nil,
+	)
+	handshakeInfo = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tls_handshake_info"),
+		"The parameters negotiated in the handshake",
+		[]string{"version", "cipher", "alpn", "resumed", "group"}, nil,
+	)
+	echAccepted = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tls_ech_accepted"),
+		"Did the target accept the encrypted client hello? Only exported by modules with ECH enabled",
+		nil, nil,
+	)
+	forwardSecrecy = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "tls_forward_secrecy"),
+		"If the negotiated cipher suite provides forward secrecy",
+		nil, nil,
+	)
+	probeIsTLS = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "probe_is_tls"),
+		"If the target responded with TLS. Absent when the probe failed before the target responded",
+		nil, nil,
+	)
+	probeJA3 = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "probe_ja3"),
+		"The JA3 hash of the ClientHello sent by the prober, with the extensions sorted",
+		[]string{"hash"}, nil,
+	)
+	probeFailureReason = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "probe", "failure_reason"),
+		"The reason the probe failed, using the name of the TLS alert where there is one",
+		[]string{"reason"}, nil,
+	)
 	proberType = prometheus.NewDesc(
 		prometheus.BuildFQName(namespace, "", "prober"),
 		"The prober used by the exporter to connect to the target",
 		[]string{"prober"}, nil,
 	)
-	notBefore = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cert_not_before"),
-		"NotBefore expressed as a Unix Epoch Time",
-		[]string{"serial_no", "issuer_cn", "cn", "dnsnames", "ips", "emails", "ou"}, nil,
+	probeBudgetExhausted = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "probe_budget_exhausted"),
+		"If a connection made on behalf of the probe was refused because --probe.max-outbound-requests was reached",
+		nil, nil,
+	)
+	probeModuleDefaulted = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "probe_module_defaulted"),
+		"If the probe used the default module because the module parameter wasn't set",
+		nil, nil,
+	)
+	verifiedChainNotBefore = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "verified_chain_not_before"),
+		"The latest NotBefore of the certificates in a verified chain, expressed as a Unix Epoch Time",
+		[]string{"chain_no"}, nil,
+	)
+	verifiedChainNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "verified_chain_not_after"),
+		"The earliest NotAfter of the certificates in a verified chain, expressed as a Unix Epoch Time",
+		[]string{"chain_no"}, nil,
+	)
+	verifiedChainIntermediateCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "verified_chain_intermediate_count"),
+		"The number of intermediate certificates between the leaf and the root in a verified chain",
+		[]string{"chain_no"}, nil,
+	)
+	verifiedChainsPerRoot = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "verified_chains_per_root"),
+		"The number of verified chains that end at a root, by the SHA-256 fingerprint of the root",
+		[]string{"root_fingerprint"}, nil,
+	)
+	peerCountRaw = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_peer_count_raw"),
+		"The number of certificates sent by the target, including duplicates",
+		nil, nil,
+	)
+	peerCount = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_peer_count"),
+		"The number of distinct certificates sent by the target",
+		nil, nil,
+	)
+	spkiPinned = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_spki_pinned"),
+		"If the SHA-256 hash of the leaf certificate's SubjectPublicKeyInfo matches one of the pins",
+		nil, nil,
+	)
+	hasPrivateIPSAN = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_has_private_ip_san"),
+		"If the leaf certificate has an IP address SAN in a private range",
+		nil, nil,
+	)
+	hasInternalSAN = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_has_internal_san"),
+		"If the leaf certificate has a DNS SAN under one of the internal_suffixes of the module",
+		nil, nil,
+	)
+	isEV = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_is_ev"),
+		"If the leaf certificate looks like an extended validation certificate, going by its policies and subject",
+		nil, nil,
+	)
+	cnInSAN = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_cn_in_san"),
+		"If the common name of the leaf certificate is also one of its SANs, or it has no common name",
+		nil, nil,
+	)
+	isACMEValidation = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_is_acme_validation"),
+		"If the leaf certificate has the acmeIdentifier extension of an ACME TLS-ALPN-01 challenge certificate",
+		nil, nil,
+	)
+	ctInclusionVerified = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_ct_inclusion_verified"),
+		"If a log that issued an SCT embedded in the leaf certificate proved that it includes the certificate",
+		nil, nil,
+	)
+	caaPresent = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "dns_caa_present"),
+		"If the target host or one of its parent domains has CAA records",
+		nil, nil,
+	)
+	caaIssuerAuthorized = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "dns_caa_issuer_authorized"),
+		"If the CAA records of the target host allow the CA that issued the leaf certificate to issue it",
+		nil, nil,
+	)
+	lifetimeElapsed = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_lifetime_elapsed_ratio"),
+		"The fraction of the leaf certificate's validity period that has elapsed",
+		nil, nil,
+	)
+	browserPolicyCompliant = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_browser_policy_compliant"),
+		"If the validity period of the leaf certificate is within the limit browsers enforce for the date it was issued",
+		nil, nil,
+	)
+	renewalWindowRemaining = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_renewal_window_remaining_ratio"),
+		"The time until the leaf certificate expires as a fraction of the renew_before of the module",
+		nil, nil,
+	)
+	belowMinDaysValid = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_below_min_days_valid"),
+		"If the leaf certificate expires within the min_days_valid of the module",
+		nil, nil,
+	)
+	serialRotated = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_serial_rotated"),
+		"If the serial number of the leaf certificate differs from expected_not_serial",
+		nil, nil,
+	)
+	matchesTarget = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_matches_target"),
+		"If the leaf certificate is valid for the host in the target, regardless of the server_name in the module",
+		nil, nil,
+	)
+	chainHasExpiredCert = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "chain_has_expired_cert"),
+		"If any of the peer certificates has expired",
+		nil, nil,
+	)
+	chainSHA1Free = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "chain_sha1_free"),
+		"If none of the peer certificates are signed with SHA-1 or a weaker algorithm, not counting self-issued roots unless sha1_include_roots is set",
+		nil, nil,
+	)
+	verifiedChainSHA1Free = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "verified_chain_sha1_free"),
+		"If none of the certificates in a verified chain are signed with SHA-1 or a weaker algorithm, not counting the root unless sha1_include_roots is set",
+		[]string{"chain_no"}, nil,
+	)
+	verifiedChainHasExpiredCert = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "verified_chain_has_expired_cert"),
+		"If any of the certificates in a verified chain has expired",
+		[]string{"chain_no"}, nil,
+	)
+	ipTLSConnectSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "ip_tls_connect_success"),
+		"If the TLS connection to a resolved address of the target was a success",
+		[]string{"ip"}, nil,
+	)
+	ipCertFingerprint = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "ip_cert_fingerprint_info"),
+		"The SHA-256 fingerprint of the leaf certificate served on a resolved address of the target",
+		[]string{"ip", "fingerprint"}, nil,
+	)
+	sniTLSConnectSuccess = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "sni_tls_connect_success"),
+		"If the TLS connection to the target with a server name from server_names was a success",
+		[]string{"server_name"}, nil,
+	)
+	sniCertFingerprint = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "sni_cert_fingerprint_info"),
+		"The SHA-256 fingerprint of the leaf certificate served for a server name from server_names",
+		[]string{"server_name", "fingerprint"}, nil,
 	)
-	notAfter = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "cert_not_after"),
-		"NotAfter expressed as a Unix Epoch Time",
-		[]string{"serial_no", "issuer_cn", "cn", "dnsnames", "ips", "emails", "ou"}, nil,
+	sniCertNotAfter = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "sni_cert_not_after"),
+		"NotAfter expressed as a Unix Epoch Time for the leaf certificate served for a server name from server_names",
+		[]string{"server_name"}, nil,
 	)
-	verifiedNotBefore = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "verified_cert_not_before"),
-		"NotBefore expressed as a Unix Epoch Time for a certificate in the list of verified chains",
-		[]string{"chain_no", "serial_no", "issuer_cn", "cn", "dnsnames", "ips", "emails", "ou"}, nil,
+	serverSupportsTLS13 = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "server_supports_tls13"),
+		"If the target completed an additional handshake limited to TLS 1.3",
+		nil, nil,
+	)
+	probeSNIRequired = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "probe_sni_required"),
+		"If an additional handshake without SNI failed when the probe with SNI succeeded",
+		nil, nil,
+	)
+	ocspStapleStale = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "ocsp_staple_stale"),
+		"If the thisUpdate of the stapled OCSP response is older than the configured maximum age",
+		nil, nil,
+	)
+	revocationInfoUntilStale = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "revocation_info_seconds_until_stale"),
+		"The number of seconds until the nextUpdate of the stapled OCSP response",
+		nil, nil,
+	)
+	ocspProducedAtSkew = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "ocsp_produced_at_skew_seconds"),
+		"The number of seconds between the producedAt of the stapled OCSP response and the clock of the exporter",
+		nil, nil,
+	)
+	chainCompleteWithoutAIA = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_chain_complete_without_aia"),
+		"If the leaf certificate verifies using only the intermediates served by the target, without fetching issuers from the AIA extension",
+		nil, nil,
+	)
+	chainStatus = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "probe_chain_status"),
+		"The outcome of verifying the chain: verified, untrusted when it ends at a root that isn't trusted or fails verification, or incomplete when an issuer is missing",
+		[]string{"status"}, nil,
+	)
+	trustedIgnoringTime = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_trusted_ignoring_time"),
+		"If the leaf certificate chains to a trusted root and matches the server name when the current time is ignored",
+		nil, nil,
+	)
+	successRequiresInsecure = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "probe_success_requires_insecure"),
+		"If the probe succeeded only because insecure_skip_verify is set, and the leaf certificate fails verification",
+		nil, nil,
 	)
-	verifiedNotAfter = prometheus.NewDesc(
-		prometheus.BuildFQName(namespace, "", "verfied_cert_not_after"),
-		"NotAfter expressed as a Unix Epoch Time for a certificate in the list of verified chains",
-		[]string{"chain_no", "serial_no", "issuer_cn", "cn", "dnsnames", "ips", "emails", "ou"}, nil,
+	expiryWarning = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "", "cert_expiry_warning"),
+		"If the earliest expiring peer certificate is within the configured expiry threshold",
+		[]string{"level"}, nil,
 	)
 )
 
+var (
+	// schemeProbers describe how to probe a target with the given URL scheme
+	// when a module isn't provided
+	schemeProbers = map[string]struct {
+		prober   string
+		startTLS string
+		port     string
+	}{
+		"https": {prober: "https"},
+		"tcp":   {prober: "tcp"},
+		"tls":   {prober: "tcp"},
+		"smtp":  {prober: "tcp", startTLS: "smtp", port: "25"},
+		"ftp":   {prober: "tcp", startTLS: "ftp", port: "21"},
+		"imap":  {prober: "tcp", startTLS: "imap", port: "143"},
+		"rdp":   {prober: "rdp", port: "3389"},
+		"mssql": {prober: "mssql", port: "1433"},
+		"wss":   {prober: "websocket"},
+	}
+)
+
+var (
+	probesInFlight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "probes_in_flight",
+			Help:      "The number of probes currently being performed",
+		},
+	)
+	certAgeDays = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "exporter",
+			Name:      "cert_age_days",
+			Help:      "The age in days of the leaf certificates of successful probes",
+			Buckets:   []float64{1, 7, 14, 30, 60, 90, 180, 365, 730},
+		},
+	)
+)
+
+var (
+	expiryWarn          = kingpin.Flag("expiry.warn", "Set ssl_cert_expiry_warning{level=\"warn\"} when a peer certificate expires within this duration. Disabled when 0.").Default("0s").Duration()
+	expiryCritical      = kingpin.Flag("expiry.critical", "Set ssl_cert_expiry_warning{level=\"critical\"} when a peer certificate expires within this duration. Disabled when 0.").Default("0s").Duration()
+	maxOutboundRequests = kingpin.Flag("probe.max-outbound-requests", "The maximum number of outbound connections a single probe can make, including connections to proxies and to the addresses probed with probe_all_ips. No limit when 0.").Default("0").Int()
+	ocspMaxStapleAge    = kingpin.Flag("ocsp.max-staple-age", "Set ssl_ocsp_staple_stale when the thisUpdate of a stapled OCSP response is older than this duration. Disabled when 0.").Default("72h").Duration()
+	maxTimeout          = kingpin.Flag("probe.max-timeout", "The maximum timeout that can be asked for with the timeout parameter of a probe. Longer timeouts are reduced to it.").Default("60s").Duration()
+)
+
 // Exporter is the exporter type...
 type Exporter struct {
-	target  string
-	prober  prober.ProbeFn
-	timeout time.Duration
-	module  config.Module
+	target     string
+	prober     prober.ProbeFn
+	timeout    time.Duration
+	module     config.Module
+	moduleName string
+
+	// moduleDefaulted is set when the scrape didn't ask for a module
+	moduleDefaulted bool
 }
 
 // Describe metrics
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- tlsConnectSuccess
 	ch <- tlsVersion
+	ch <- keyExchange
+	ch <- forwardSecrecy
+	ch <- handshakeInfo
+	ch <- echAccepted
+	ch <- probeIsTLS
+	ch <- probeFailureReason
 	ch <- proberType
-	ch <- notAfter
-	ch <- notBefore
-	ch <- verifiedNotAfter
-	ch <- verifiedNotBefore
+	ch <- probeModuleDefaulted
+	ch <- probeJA3
+	ch <- probeBudgetExhausted
+	getCertDescs(e.module.CertLabels).describe(ch)
+	ch <- verifiedChainNotAfter
+	ch <- verifiedChainNotBefore
+	ch <- verifiedChainIntermediateCount
+	ch <- verifiedChainsPerRoot
+	ch <- peerCountRaw
+	ch <- peerCount
+	ch <- spkiPinned
+	ch <- serialRotated
+	ch <- belowMinDaysValid
+	ch <- cnInSAN
+	ch <- hasPrivateIPSAN
+	ch <- hasInternalSAN
+	ch <- isEV
+	ch <- isACMEValidation
+	ch <- ctInclusionVerified
+	ch <- caaPresent
+	ch <- caaIssuerAuthorized
+	ch <- lifetimeElapsed
+	ch <- browserPolicyCompliant
+	ch <- renewalWindowRemaining
+	ch <- matchesTarget
+	ch <- chainHasExpiredCert
+	ch <- verifiedChainHasExpiredCert
+	ch <- chainSHA1Free
+	ch <- verifiedChainSHA1Free
+	ch <- ipTLSConnectSuccess
+	ch <- ipCertFingerprint
+	ch <- sniTLSConnectSuccess
+	ch <- sniCertFingerprint
+	ch <- sniCertNotAfter
+	ch <- serverSupportsTLS13
+	ch <- probeSNIRequired
+	ch <- ocspStapleStale
+	ch <- revocationInfoUntilStale
+	ch <- ocspProducedAtSkew
+	ch <- chainCompleteWithoutAIA
+	ch <- trustedIgnoringTime
+	ch <- successRequiresInsecure
+	ch <- chainStatus
+	ch <- expiryWarning
+	prober.Describe(ch)
+}
+
+// Collect metrics
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	ch <- prometheus.MustNewConstMetric(
+		proberType, prometheus.GaugeValue, 1, e.module.Prober,
+	)
+
+	// Scrape jobs that forgot the module parameter are probed with the tcp
+	// module, which is rarely what was intended
+	var defaulted float64
+	if e.moduleDefaulted {
+		defaulted = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		probeModuleDefaulted, prometheus.GaugeValue, defaulted,
+	)
+
+	// Fingerprint the ClientHello so that changes in how the exporter
+	// probes can be told apart from changes in the target
+	if _, hash, err := prober.ClientHelloJA3(e.module, getTargetHost(e.target)); err != nil {
+		log.Debugf("error=%s target=%s prober=%s msg=unable to compute the JA3 hash", err, e.target, e.module.Prober)
+	} else {
+		ch <- prometheus.MustNewConstMetric(
+			probeJA3, prometheus.GaugeValue, 1, hash,
+		)
+	}
+
+	// Every connection made on behalf of this probe comes out of the same
+	// budget. Whether it ran out is reported once the sub-probes below have
+	// finished, so this is deferred before waiting on them.
+	budget := prober.NewBudget(*maxOutboundRequests)
+	ctx := prober.WithBudget(context.Background(), budget)
+	if budget != nil {
+		defer func() {
+			var exhausted float64
+			if budget.Exhausted() {
+				exhausted = 1
+				log.Errorf("error=%s target=%s prober=%s msg=some connections weren't made, raise --probe.max-outbound-requests", prober.ErrBudgetExhausted, e.target, e.module.Prober)
+			}
+			ch <- prometheus.MustNewConstMetric(
+				probeBudgetExhausted, prometheus.GaugeValue, exhausted,
+			)
+		}()
+	}
+
+	// Probe every address behind the target alongside the main probe so
+	// that backends serving different certificates can be told apart
+	if e.module.ProbeAllIPs {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.probeAllIPs(ctx, ch)
+		}()
+		defer wg.Wait()
+	}
+
+	// Handshake with each of the server names alongside the main probe to
+	// check the certificate that SNI routing picks for them
+	if len(e.module.ServerNames) > 0 {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.probeServerNames(ctx, ch)
+		}()
+		defer wg.Wait()
+	}
+
+	// Servers can negotiate an older version by default while still
+	// supporting TLS 1.3, so try it on its own
+	if e.module.CheckTLS13 {
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.probeTLS13(ctx, ch)
+		}()
+		defer wg.Wait()
+	}
+
+	// Servers that select the certificate by the server name can fail
+	// handshakes without it, so try one alongside the probe
+	var withoutSNI chan error
+	if e.module.CheckSNIRequired && e.sendsSNI() {
+		withoutSNI = make(chan error, 1)
+		go func() {
+			withoutSNI <- e.probeWithoutSNI(ctx)
+		}()
+	}
+
+	state, err := e.prober(ctx, e.target, e.module, e.timeout, ch)
+	if err != nil {
+		log.Errorf("error=%s target=%s prober=%s timeout=%s", err, e.target, e.module.Prober, e.timeout)
+		if reason := getFailureReason(err); !e.sendsSNI() && (reason == "handshake_failure" || reason == "unrecognized_name") {
+			log.Errorf("target=%s prober=%s msg=the handshake was made without SNI because the target is an IP address, set server_name in tls_config if the target requires it", e.target, e.module.Prober)
+		}
+		if alerter != nil {
+			alerter.record(e.target, e.moduleName, err)
+		}
+		if isTLS, ok := getIsTLS(err); ok {
+			ch <- prometheus.MustNewConstMetric(
+				probeIsTLS, prometheus.GaugeValue, isTLS,
+			)
+		}
+		if e.module.ECH.Enabled() && isECHRejected(err) {
+			ch <- prometheus.MustNewConstMetric(
+				echAccepted, prometheus.GaugeValue, 0,
+			)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			probeFailureReason, prometheus.GaugeValue, 1, getFailureReason(err),
+		)
+		ch <- prometheus.MustNewConstMetric(
+			tlsConnectSuccess, prometheus.GaugeValue, 0,
+		)
+		e.collectPlaceholders(ch)
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		probeIsTLS, prometheus.GaugeValue, 1,
+	)
+
+	// Get the TLS version from the connection state and export it as a metric
+	ch <- prometheus.MustNewConstMetric(
+		tlsVersion, prometheus.GaugeValue, 1, getTLSVersion(state),
+	)
+
+	// The negotiated group is only available from newer versions of go
+	if group, ok := getKeyExchange(state); ok {
+		ch <- prometheus.MustNewConstMetric(
+			keyExchange, prometheus.GaugeValue, 1, group,
+		)
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		forwardSecrecy, prometheus.GaugeValue, getForwardSecrecy(state),
+	)
+
+	// The negotiated parameters in a single series, so that they don't have
+	// to be joined. The group is empty when it isn't available.
+	group, _ := getKeyExchange(state)
+	ch <- prometheus.MustNewConstMetric(
+		handshakeInfo, prometheus.GaugeValue, 1,
+		getTLSVersion(state), tls.CipherSuiteName(state.CipherSuite), state.NegotiatedProtocol, strconv.FormatBool(state.DidResume), group,
+	)
+
+	if withoutSNI != nil {
+		var required float64
+		if err := <-withoutSNI; err != nil {
+			log.Debugf("error=%s target=%s prober=%s msg=handshake without SNI failed", err, e.target, e.module.Prober)
+			required = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			probeSNIRequired, prometheus.GaugeValue, required,
+		)
+	}
+
+	if accepted, ok := getECHAccepted(state); ok && e.module.ECH.Enabled() {
+		ch <- prometheus.MustNewConstMetric(
+			echAccepted, prometheus.GaugeValue, accepted,
+		)
+	}
+
+	// Retrieve certificates from the connection state
+	peerCertificates := state.PeerCertificates
+	if len(peerCertificates) < 1 {
+		log.Errorf("error=No certificates found in connection state. target=%s prober=%s", e.target, e.module.Prober)
+		if alerter != nil {
+			alerter.record(e.target, e.moduleName, fmt.Errorf("No certificates found in connection state"))
+		}
+		ch <- prometheus.MustNewConstMetric(
+			tlsConnectSuccess, prometheus.GaugeValue, 0,
+		)
+		e.collectPlaceholders(ch)
+		return
+	}
+
+	// Compare the public key of the leaf certificate with the pins in the
+	// module, failing the probe on a mismatch in strict mode
+	if len(e.module.PinSPKISHA256) > 0 {
+		pinned := getSPKIPinned(peerCertificates[0], e.module.PinSPKISHA256)
+		ch <- prometheus.MustNewConstMetric(
+			spkiPinned, prometheus.GaugeValue, pinned,
+		)
+		if pinned == 0 && e.module.PinSPKIStrict {
+			err := fmt.Errorf("The public key of the leaf certificate doesn't match any of the pins")
+			log.Errorf("error=%s target=%s prober=%s", err, e.target, e.module.Prober)
+			if alerter != nil {
+				alerter.record(e.target, e.moduleName, err)
+			}
+			ch <- prometheus.MustNewConstMetric(
+				probeFailureReason, prometheus.GaugeValue, 1, "spki_pin_mismatch",
+			)
+			ch <- prometheus.MustNewConstMetric(
+				tlsConnectSuccess, prometheus.GaugeValue, 0,
+			)
+			e.collectPlaceholders(ch)
+			return
+		}
+	}
+
+	// Check that the leaf certificate is valid for long enough, failing the
+	// probe when it isn't if the module asks for it
+	if e.module.MinDaysValid > 0 {
+		var belowMin float64
+		if time.Until(peerCertificates[0].NotAfter) < time.Duration(e.module.MinDaysValid)*24*time.Hour {
+			belowMin = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			belowMinDaysValid, prometheus.GaugeValue, belowMin,
+		)
+		if belowMin == 1 && e.module.MinDaysValidFail {
+			err := fmt.Errorf("The leaf certificate expires within %d days", e.module.MinDaysValid)
+			log.Errorf("error=%s target=%s prober=%s", err, e.target, e.module.Prober)
+			if alerter != nil {
+				alerter.record(e.target, e.moduleName, err)
+			}
+			ch <- prometheus.MustNewConstMetric(
+				probeFailureReason, prometheus.GaugeValue, 1, "min_days_valid",
+			)
+			ch <- prometheus.MustNewConstMetric(
+				tlsConnectSuccess, prometheus.GaugeValue, 0,
+			)
+			e.collectPlaceholders(ch)
+			return
+		}
+	}
+
+	// If there are peer certificates in the connection state then consider
+	// the tls connection a success
+	ch <- prometheus.MustNewConstMetric(
+		tlsConnectSuccess, prometheus.GaugeValue, 1,
+	)
+	if alerter != nil {
+		alerter.record(e.target, e.moduleName, nil)
+	}
+
+	log.Debugf(
+		"msg=probe succeeded target=%s prober=%s version=%q cipher=%s leaf_not_after=%s",
+		e.target, e.module.Prober, getTLSVersion(state), tls.CipherSuiteName(state.CipherSuite),
+		peerCertificates[0].NotAfter.UTC().Format(time.RFC3339),
+	)
+
+	certAgeDays.Observe(time.Since(peerCertificates[0].NotBefore).Hours() / 24)
+
+	if serialTracker != nil {
+		serialTracker.record(peerCertificates)
+	}
+	if rotationTracker != nil {
+		rotationTracker.record(e.target, e.moduleName, peerCertificates[0])
+	}
+
+	// Clients that ignore the common name need to find it in the SANs
+	ch <- prometheus.MustNewConstMetric(
+		cnInSAN, prometheus.GaugeValue, getCNInSAN(peerCertificates[0]),
+	)
+
+	// Publicly trusted certificates shouldn't name private addresses or
+	// internal hosts
+	ch <- prometheus.MustNewConstMetric(
+		hasPrivateIPSAN, prometheus.GaugeValue, getHasPrivateIPSAN(peerCertificates[0], e.module.PrivateIPRanges),
+	)
+	if len(e.module.InternalSuffixes) > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			hasInternalSAN, prometheus.GaugeValue, getHasInternalSAN(peerCertificates[0], e.module.InternalSuffixes),
+		)
+	}
+
+	// A heuristic that catches a certificate that was replaced with one that
+	// isn't EV
+	ch <- prometheus.MustNewConstMetric(
+		isEV, prometheus.GaugeValue, getIsEV(peerCertificates[0], e.module.EVPolicyOIDs),
+	)
+
+	// A challenge certificate left behind by an ACME client isn't trusted by
+	// anyone else
+	ch <- prometheus.MustNewConstMetric(
+		isACMEValidation, prometheus.GaugeValue, getIsACMEValidation(peerCertificates[0]),
+	)
+
+	ch <- prometheus.MustNewConstMetric(
+		lifetimeElapsed, prometheus.GaugeValue, getLifetimeElapsed(peerCertificates[0], time.Now()),
+	)
+
+	// Browsers reject certificates that were issued for longer than the
+	// policy allowed at the time, even before they expire
+	ch <- prometheus.MustNewConstMetric(
+		browserPolicyCompliant, prometheus.GaugeValue, getBrowserPolicyCompliant(peerCertificates[0], e.module.BrowserPolicy),
+	)
+
+	// How much of the time the module allows for renewal is left
+	if e.module.RenewBefore > 0 {
+		ch <- prometheus.MustNewConstMetric(
+			renewalWindowRemaining, prometheus.GaugeValue, getRenewalWindowRemaining(peerCertificates[0], e.module.RenewBefore, time.Now()),
+		)
+	}
+
+	// Confirm that a rotation has replaced the old leaf certificate
+	if e.module.ExpectedNotSerial != "" {
+		rotated, err := getSerialRotated(peerCertificates[0], e.module.ExpectedNotSerial)
+		if err != nil {
+			log.Errorf("error=%s target=%s prober=%s msg=unable to parse expected_not_serial", err, e.target, e.module.Prober)
+		} else {
+			ch <- prometheus.MustNewConstMetric(
+				serialRotated, prometheus.GaugeValue, rotated,
+			)
+		}
+	}
+
+	// Check the leaf certificate against the host we actually dialed, rather
+	// than the server name that may have been provided in the module
+	var matches float64
+	if err := peerCertificates[0].VerifyHostname(getTargetHost(e.target)); err == nil {
+		matches = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		matchesTarget, prometheus.GaugeValue, matches,
+	)
+
+	// SCTs only promise that a certificate will be logged, so ask the logs
+	// to prove that it was
+	if e.module.VerifyCTInclusion {
+		var verified float64
+		issuer, err := getIssuer(state)
+		if err == nil {
+			var ok bool
+			ok, err = prober.VerifyCTInclusion(ctx, e.module, peerCertificates[0], issuer, e.timeout)
+			if ok {
+				verified = 1
+			}
+		}
+		if err != nil {
+			log.Errorf("error=%s target=%s prober=%s msg=unable to verify CT inclusion", err, e.target, e.module.Prober)
+		}
+		ch <- prometheus.MustNewConstMetric(
+			ctInclusionVerified, prometheus.GaugeValue, verified,
+		)
+	}
+
+	// Catch certificates issued by a CA that the CAA records of the target
+	// don't allow
+	if e.module.CheckCAA {
+		e.collectCAA(ctx, peerCertificates[0], ch)
+	}
+
+	// Remove duplicate certificates from the response, counting them before
+	// and after so that servers sending redundant certificates stand out
+	ch <- prometheus.MustNewConstMetric(
+		peerCountRaw, prometheus.GaugeValue, float64(len(peerCertificates)),
+	)
+	chainIndexes := uniqIndexes(peerCertificates)
+	peerCertificates = uniq(peerCertificates)
+	ch <- prometheus.MustNewConstMetric(
+		peerCount, prometheus.GaugeValue, float64(len(peerCertificates)),
+	)
+
+	if e.module.ZeroOnFailure {
+		lastCertLabels.record(e.target, e.moduleName, peerCertificates, chainIndexes, e.module.SANLabels)
+	}
+
+	// The certificate metrics only have the labels selected in the module
+	descs := getCertDescs(e.module.CertLabels)
+
+	// Loop through peer certificates and create metrics. The dates have
+	// the position of the certificate in the chain presented by the target,
+	// so that the leaf can be told apart from the intermediates.
+	for i, cert := range peerCertificates {
+		chainIndex := strconv.Itoa(chainIndexes[i])
+
+		if !cert.NotAfter.IsZero() {
+			ch <- prometheus.MustNewConstMetric(
+				descs.notAfter,
+				prometheus.GaugeValue,
+				float64(cert.NotAfter.UnixNano()/1e9),
+				append(descs.labelValues(cert, e.module.SANLabels), chainIndex)...,
+			)
+		}
+
+		if !cert.NotBefore.IsZero() {
+			ch <- prometheus.MustNewConstMetric(
+				descs.notBefore,
+				prometheus.GaugeValue,
+				float64(cert.NotBefore.UnixNano()/1e9),
+				append(descs.labelValues(cert, e.module.SANLabels), chainIndex)...,
+			)
+		}
+
+		var weak float64
+		if isWeakSignature(cert.SignatureAlgorithm) {
+			weak = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			descs.weakSignature,
+			prometheus.GaugeValue,
+			weak,
+			descs.labelValues(cert, e.module.SANLabels)...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			descs.uriSANsCount,
+			prometheus.GaugeValue,
+			float64(len(cert.URIs)),
+			descs.labelValues(cert, e.module.SANLabels)...,
+		)
+
+		ch <- prometheus.MustNewConstMetric(
+			descs.subjectDN,
+			prometheus.GaugeValue,
+			1,
+			append(descs.labelValues(cert, e.module.SANLabels), cert.Subject.String())...,
+		)
+		ch <- prometheus.MustNewConstMetric(
+			descs.issuerDN,
+			prometheus.GaugeValue,
+			1,
+			append(descs.labelValues(cert, e.module.SANLabels), cert.Issuer.String())...,
+		)
+
+		if len(cert.OCSPServer) > 0 || len(cert.IssuingCertificateURL) > 0 {
+			ch <- prometheus.MustNewConstMetric(
+				descs.aiaInfo,
+				prometheus.GaugeValue,
+				1,
+				append(descs.labelValues(cert, e.module.SANLabels), getOCSPServers(cert), getIssuingCertificateURLs(cert))...,
+			)
+		}
+
+		if cert.IsCA {
+			ch <- prometheus.MustNewConstMetric(
+				descs.maxPathLen,
+				prometheus.GaugeValue,
+				float64(getMaxPathLen(cert)),
+				descs.labelValues(cert, e.module.SANLabels)...,
+			)
+		}
+
+		if e.module.RFC3339Timestamps {
+			if !cert.NotAfter.IsZero() {
+				ch <- prometheus.MustNewConstMetric(
+					descs.notAfterTimestamp,
+					prometheus.GaugeValue,
+					1,
+					append(descs.labelValues(cert, e.module.SANLabels), cert.NotAfter.UTC().Format(time.RFC3339))...,
+				)
+			}
+
+			if !cert.NotBefore.IsZero() {
+				ch <- prometheus.MustNewConstMetric(
+					descs.notBeforeTimestamp,
+					prometheus.GaugeValue,
+					1,
+					append(descs.labelValues(cert, e.module.SANLabels), cert.NotBefore.UTC().Format(time.RFC3339))...,
+				)
+			}
+		}
+	}
+
+	// An expired intermediate breaks clients even when the leaf is valid, so
+	// consider every certificate the server presented
+	ch <- prometheus.MustNewConstMetric(
+		chainHasExpiredCert, prometheus.GaugeValue, hasExpiredCert(peerCertificates),
+	)
+
+	// Strict clients reject a chain with SHA-1 anywhere in it, including in
+	// intermediates that are still served after the leaf has been replaced
+	ch <- prometheus.MustNewConstMetric(
+		chainSHA1Free, prometheus.GaugeValue, getSHA1Free(peerCertificates, e.module.SHA1IncludeRoots),
+	)
+
+	// The roots are read once for the checks of the served chain below,
+	// rather than reading the CA file, which may be in Vault, for each of them
+	serverName := e.module.TLSConfig.ServerName
+	if serverName == "" {
+		serverName = getTargetHost(e.target)
+	}
+	if roots, err := getRoots(e.module); err != nil {
+		log.Errorf("error=%s target=%s prober=%s msg=unable to load the roots to verify the served chain", err, e.target, e.module.Prober)
+	} else {
+		// Servers that omit intermediates only work for clients that chase
+		// the AIA extension, so verify with just the intermediates that were
+		// served
+		ch <- prometheus.MustNewConstMetric(
+			chainCompleteWithoutAIA, prometheus.GaugeValue, getChainCompleteWithoutAIA(peerCertificates, roots),
+		)
+
+		// Separate certificates that only need renewing from those that
+		// aren't trusted at all
+		ch <- prometheus.MustNewConstMetric(
+			trustedIgnoringTime, prometheus.GaugeValue, getTrustedIgnoringTime(peerCertificates, roots, serverName),
+		)
+
+		// A success with insecure_skip_verify says nothing about whether
+		// clients trust the target
+		ch <- prometheus.MustNewConstMetric(
+			successRequiresInsecure, prometheus.GaugeValue, getSuccessRequiresInsecure(peerCertificates, e.module, roots, serverName),
+		)
+
+		// Summarise the trust outcome in one series, so that an untrusted
+		// certificate doesn't have to be inferred from missing metrics
+		ch <- prometheus.MustNewConstMetric(
+			chainStatus, prometheus.GaugeValue, 1, getChainStatus(state, peerCertificates, roots),
+		)
+	}
+
+	// Some servers staple a response once and never refresh it, which strict
+	// clients will reject
+	if len(state.OCSPResponse) > 0 {
+		var issuer *x509.Certificate
+		if len(peerCertificates) > 1 {
+			issuer = peerCertificates[1]
+		}
+		resp, err := ocsp.ParseResponse(state.OCSPResponse, issuer)
+		if err != nil {
+			log.Errorf("error=%s target=%s prober=%s msg=unable to parse the stapled OCSP response", err, e.target, e.module.Prober)
+		} else {
+			if *ocspMaxStapleAge > 0 {
+				var stale float64
+				if time.Since(resp.ThisUpdate) > *ocspMaxStapleAge {
+					stale = 1
+				}
+				ch <- prometheus.MustNewConstMetric(
+					ocspStapleStale, prometheus.GaugeValue, stale,
+				)
+			}
+			if !resp.NextUpdate.IsZero() {
+				ch <- prometheus.MustNewConstMetric(
+					revocationInfoUntilStale, prometheus.GaugeValue, time.Until(resp.NextUpdate).Seconds(),
+				)
+			}
+
+			// A staple produced in the future points at the clock of
+			// the responder or of the exporter
+			if !resp.ProducedAt.IsZero() {
+				ch <- prometheus.MustNewConstMetric(
+					ocspProducedAtSkew, prometheus.GaugeValue, time.Since(resp.ProducedAt).Seconds(),
+				)
+			}
+		}
+	}
+
+	// Compare the earliest expiry in the peer certificates against the
+	// configured thresholds, in a fixed order so that the output is the same
+	// on every scrape
+	expiry := earliestExpiry(peerCertificates)
+	for _, t := range []struct {
+		level     string
+		threshold time.Duration
+	}{
+		{"warn", *expiryWarn},
+		{"critical", *expiryCritical},
+	} {
+		if t.threshold <= 0 || expiry.IsZero() {
+			continue
+		}
+		var warning float64
+		if time.Until(expiry) < t.threshold {
+			warning = 1
+		}
+		ch <- prometheus.MustNewConstMetric(
+			expiryWarning, prometheus.GaugeValue, warning, t.level,
+		)
+	}
+
+	// Retrieve the list of verified chains from the connection state
+	verifiedChains := state.VerifiedChains
+
+	// Sort the verified chains from the chain that is valid for longest to the chain
+	// that expires the soonest
+	sort.Slice(verifiedChains, func(i, j int) bool {
+		return earliestExpiry(verifiedChains[i]).After(earliestExpiry(verifiedChains[j]))
+	})
+
+	// Loop through the verified chains creating metrics. Label the metrics
+	// with the index of the chain.
+	for i, chain := range verifiedChains {
+		chain = uniq(chain)
+
+		ch <- prometheus.MustNewConstMetric(
+			verifiedChainHasExpiredCert, prometheus.GaugeValue, hasExpiredCert(chain), strconv.Itoa(i),
+		)
+		ch <- prometheus.MustNewConstMetric(
+			verifiedChainSHA1Free, prometheus.GaugeValue, getVerifiedChainSHA1Free(chain, e.module.SHA1IncludeRoots), strconv.Itoa(i),
+		)
+
+		// Every certificate other than the leaf and the root is an
+		// intermediate
+		intermediates := len(chain) - 2
+		if intermediates < 0 {
+			intermediates = 0
+		}
+		ch <- prometheus.MustNewConstMetric(
+			verifiedChainIntermediateCount, prometheus.GaugeValue, float64(intermediates), strconv.Itoa(i),
+		)
+
+		// The chain can only be used while every certificate in it is
+		// valid
+		if notBefore := latestNotBefore(chain); !notBefore.IsZero() {
+			ch <- prometheus.MustNewConstMetric(
+				verifiedChainNotBefore, prometheus.GaugeValue, float64(notBefore.Unix()), strconv.Itoa(i),
+			)
+		}
+		if notAfter := earliestExpiry(chain); !notAfter.IsZero() {
+			ch <- prometheus.MustNewConstMetric(
+				verifiedChainNotAfter, prometheus.GaugeValue, float64(notAfter.Unix()), strconv.Itoa(i),
+			)
+		}
+
+		for _, cert := range chain {
+			chainNo := strconv.Itoa(i)
+
+			if !cert.NotAfter.IsZero() {
+				ch <- prometheus.MustNewConstMetric(
+					descs.verifiedNotAfter,
+					prometheus.GaugeValue,
+					float64(cert.NotAfter.UnixNano()/1e9),
+					append([]string{chainNo}, descs.labelValues(cert, e.module.SANLabels)...)...,
+				)
+			}
+
+			if !cert.NotBefore.IsZero() {
+				ch <- prometheus.MustNewConstMetric(
+					descs.verifiedNotBefore,
+					prometheus.GaugeValue,
+					float64(cert.NotBefore.UnixNano()/1e9),
+					append([]string{chainNo}, descs.labelValues(cert, e.module.SANLabels)...)...,
+				)
+			}
+		}
+	}
+
+	// Alternate chains through cross-signed certificates can end at
+	// different roots, which clients may or may not trust
+	for fingerprint, count := range getChainsPerRoot(verifiedChains) {
+		ch <- prometheus.MustNewConstMetric(
+			verifiedChainsPerRoot, prometheus.GaugeValue, count, fingerprint,
+		)
+	}
+}
+
+// probeAllIPs resolves the host in the target and probes each of the
+// addresses, exporting the result and the leaf certificate fingerprint for
+// every IP
+func (e *Exporter) probeAllIPs(ctx context.Context, ch chan<- prometheus.Metric) {
+	deadline := time.Now().Add(e.timeout)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	host := getTargetHost(e.target)
+	addrs, err := prober.NewResolver(e.module).LookupIPAddr(ctx, host)
+	if err != nil {
+		log.Errorf("error=%s target=%s prober=%s", err, e.target, e.module.Prober)
+		return
+	}
+
+	// Connecting to an IP rather than the hostname would otherwise change
+	// the server name sent in the handshake
+	module := e.module
+	if module.TLSConfig.ServerName == "" && net.ParseIP(host) == nil {
+		module.TLSConfig.ServerName = host
+	}
+
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		wg.Add(1)
+		go func(ip string) {
+			defer wg.Done()
+
+			target := setTargetHost(e.target, ip)
+			state, err := e.prober(ctx, target, module, time.Until(deadline), nil)
+			if err != nil || len(state.PeerCertificates) < 1 {
+				if err != nil {
+					log.Errorf("error=%s target=%s prober=%s ip=%s", err, e.target, e.module.Prober, ip)
+				}
+				ch <- prometheus.MustNewConstMetric(
+					ipTLSConnectSuccess, prometheus.GaugeValue, 0, ip,
+				)
+				return
+			}
+
+			ch <- prometheus.MustNewConstMetric(
+				ipTLSConnectSuccess, prometheus.GaugeValue, 1, ip,
+			)
+
+			fingerprint := sha256.Sum256(state.PeerCertificates[0].Raw)
+			ch <- prometheus.MustNewConstMetric(
+				ipCertFingerprint, prometheus.GaugeValue, 1, ip, hex.EncodeToString(fingerprint[:]),
+			)
+		}(addr.IP.String())
+	}
+	wg.Wait()
+}
+
+// probeServerNames probes the target once for each of the server names in
+// the module, sending the name with SNI
+func (e *Exporter) probeServerNames(ctx context.Context, ch chan<- prometheus.Metric) {
+	deadline := time.Now().Add(e.timeout)
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, serverName := range e.module.ServerNames {
+		wg.Add(1)
+		go func(serverName string) {
+			defer wg.Done()
+
+			module := e.module
+			module.TLSConfig.ServerName = serverName
+
+			state, err := e.prober(ctx, e.target, module, time.Until(deadline), nil)
+			if err != nil || len(state.PeerCertificates) < 1 {
+				if err != nil {
+					log.Errorf("error=%s target=%s prober=%s server_name=%s", err, e.target, e.module.Prober, serverName)
+				}
+				ch <- prometheus.MustNewConstMetric(
+					sniTLSConnectSuccess, prometheus.GaugeValue, 0, serverName,
+				)
+				return
+			}
+
+			ch <- prometheus.MustNewConstMetric(
+				sniTLSConnectSuccess, prometheus.GaugeValue, 1, serverName,
+			)
+
+			leaf := state.PeerCertificates[0]
+			fingerprint := sha256.Sum256(leaf.Raw)
+			ch <- prometheus.MustNewConstMetric(
+				sniCertFingerprint, prometheus.GaugeValue, 1, serverName, hex.EncodeToString(fingerprint[:]),
+			)
+			ch <- prometheus.MustNewConstMetric(
+				sniCertNotAfter, prometheus.GaugeValue, float64(leaf.NotAfter.Unix()), serverName,
+			)
+		}(serverName)
+	}
+	wg.Wait()
+}
+
+// probeTLS13 probes the target with a handshake that only allows TLS 1.3.
+// The certificate isn't verified, so that only the version decides whether
+// the handshake succeeds.
+func (e *Exporter) probeTLS13(ctx context.Context, ch chan<- prometheus.Metric) {
+	module := e.module
+	module.TLSVersion = tls.VersionTLS13
+	module.TLSConfig.InsecureSkipVerify = true
+
+	var supported float64
+	state, err := e.prober(ctx, e.target, module, e.timeout, nil)
+	if err != nil {
+		log.Debugf("error=%s target=%s prober=%s msg=TLS 1.3 handshake failed", err, e.target, e.module.Prober)
+	} else if state.Version == tls.VersionTLS13 {
+		supported = 1
+	}
+
+	ch <- prometheus.MustNewConstMetric(
+		serverSupportsTLS13, prometheus.GaugeValue, supported,
+	)
+}
+
+// sendsSNI returns whether the probe sends a server name with SNI, which
+// crypto/tls leaves out when the name is an IP address
+func (e *Exporter) sendsSNI() bool {
+	serverName := e.module.TLSConfig.ServerName
+	if serverName == "" {
+		serverName = getTargetHost(e.target)
+	}
+	return serverName != "" && net.ParseIP(serverName) == nil
+}
+
+// probeWithoutSNI probes the target with a handshake that doesn't send SNI.
+// The certificate isn't verified, so that only the missing server name decides
+// whether the handshake succeeds.
+func (e *Exporter) probeWithoutSNI(ctx context.Context) error {
+	module := e.module
+	module.TLSConfig.InsecureSkipVerify = true
+	// An IP address as the server name keeps it out of the client hello
+	module.TLSConfig.ServerName = net.IPv4zero.String()
+	// ECH hides the server name, so it can't be used without one
+	module.ECH = config.ECH{}
+
+	_, err := e.prober(ctx, e.target, module, e.timeout, nil)
+	return err
+}
+
+func probeHandler(w http.ResponseWriter, r *http.Request, conf *config.Config) {
+	moduleName := r.URL.Query().Get("module")
+	inferModule := moduleName == ""
+	if moduleName == "" {
+		moduleName = "tcp"
+	}
+	module, ok := conf.Modules[moduleName]
+	if !ok {
+		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
+		return
+	}
+
+	// The following timeout block was taken wholly from the blackbox exporter
+	//   https://github.com/prometheus/blackbox_exporter/blob/master/main.go
+	var timeoutSeconds float64
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		var err error
+		timeoutSeconds, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse timeout from Prometheus header: %s", err), http.StatusInternalServerError)
+			return
+		}
+	} else if v := r.URL.Query().Get("timeout"); v != "" {
+		// Scrapers that don't send the header, and people probing by
+		// hand, can ask for a timeout in seconds with a parameter
+		var err error
+		timeoutSeconds, err = strconv.ParseFloat(v, 64)
+		if err != nil || timeoutSeconds <= 0 || math.IsInf(timeoutSeconds, 0) || math.IsNaN(timeoutSeconds) {
+			http.Error(w, fmt.Sprintf("Invalid timeout parameter %q, expected a positive number of seconds", v), http.StatusBadRequest)
+			return
+		}
+		if max := maxTimeout.Seconds(); max > 0 && timeoutSeconds > max {
+			timeoutSeconds = max
+		}
+	} else {
+		timeoutSeconds = 10
+	}
+	if timeoutSeconds == 0 {
+		timeoutSeconds = 10
+	}
+
+	timeout := time.Duration((timeoutSeconds) * 1e9)
+
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
+		return
+	}
+
+	// Without an explicit module, the scheme of the target decides how to
+	// probe it
+	if inferModule && strings.Contains(target, "://") {
+		module, target = moduleFromScheme(module, target)
+	}
+
+	if !allowedTargets.allows(target) {
+		http.Error(w, (&targetNotAllowedError{target: target}).Error(), http.StatusForbidden)
+		return
+	}
+
+	registry := prometheus.NewRegistry()
+
+	// An aggregate module probes the target with each of its sub-modules
+	if module.Prober == aggregateProber {
+		exporters, err := newAggregateExporters(target, module, conf, timeout)
+		if err != nil {
+			status := http.StatusBadRequest
+			var notAllowedErr *targetNotAllowedError
+			if errors.As(err, &notAllowedErr) {
+				status = http.StatusForbidden
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		if err := registerAggregate(registry, exporters); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		// Fill in the settings that the module derives from the target
+		module = config.ExpandModule(module, target)
+
+		prober, ok := prober.Probers[module.Prober]
+		if !ok {
+			http.Error(w, fmt.Sprintf("Unknown prober %q", module.Prober), http.StatusBadRequest)
+			return
+		}
+
+		exporter := &Exporter{
+			target:          target,
+			prober:          prober,
+			timeout:         timeout,
+			module:          module,
+			moduleName:      moduleName,
+			moduleDefaulted: inferModule,
+		}
+		registry.MustRegister(exporter)
+	}
+
+	probesInFlight.Inc()
+	defer probesInFlight.Dec()
+
+	// Serve, in the OpenMetrics format if the scraper asks for it
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		EnableOpenMetrics: true,
+	})
+	h.ServeHTTP(w, r)
+}
+
+func uniq(certs []*x509.Certificate) []*x509.Certificate {
+	r := []*x509.Certificate{}
+
+	for _, c := range certs {
+		if !contains(r, c) {
+			r = append(r, c)
+		}
+	}
+
+	return r
+}
+
+// uniqIndexes returns the positions in the list of the certificates that uniq
+// keeps, which are the first of each
+func uniqIndexes(certs []*x509.Certificate) []int {
+	r := []int{}
+
+	for i, c := range certs {
+		if !contains(certs[:i], c) {
+			r = append(r, i)
+		}
+	}
+
+	return r
+}
+
+func contains(certs []*x509.Certificate, cert *x509.Certificate) bool {
+	for _, c := range certs {
+		if (c.SerialNumber.String() == cert.SerialNumber.String()) && (c.Issuer.CommonName == cert.Issuer.CommonName) {
+			return true
+		}
+	}
+	return false
+}
+
+// earliestExpiry returns the earliest NotAfter date in the list of
+// certificates
+func earliestExpiry(certs []*x509.Certificate) time.Time {
+	expiry := time.Time{}
+	for _, cert := range certs {
+		if (expiry.IsZero() || cert.NotAfter.Before(expiry)) && !cert.NotAfter.IsZero() {
+			expiry = cert.NotAfter
+		}
+	}
+	return expiry
+}
+
+// getIsTLS works out from a probe error whether the target responded with TLS.
+// The second value is false when the error doesn't tell us either way.
+func getIsTLS(err error) (float64, bool) {
+	var notTLSErr *prober.NotTLSError
+	if errors.As(err, &notTLSErr) {
+		return 0, true
+	}
+
+	// Certificate verification only fails once the target has sent its
+	// certificates in a TLS handshake
+	var (
+		unknownAuthorityErr   x509.UnknownAuthorityError
+		certificateInvalidErr x509.CertificateInvalidError
+		hostnameErr           x509.HostnameError
+	)
+	if errors.As(err, &unknownAuthorityErr) || errors.As(err, &certificateInvalidErr) || errors.As(err, &hostnameErr) {
+		return 1, true
+	}
+
+	return 0, false
+}
+
+// getSPKIPinned returns 1 if the SHA-256 hash of the certificate's
+// SubjectPublicKeyInfo matches one of the pins, which can be base64 encoded
+// like HPKP pins or hex encoded
+func getSPKIPinned(cert *x509.Certificate, pins []string) float64 {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	b64 := base64.StdEncoding.EncodeToString(sum[:])
+	hx := hex.EncodeToString(sum[:])
+	for _, pin := range pins {
+		pin = strings.TrimSpace(pin)
+		if pin == b64 || strings.EqualFold(pin, hx) {
+			return 1
+		}
+	}
+	return 0
+}
+
+// getCNInSAN returns 1 if the common name of the certificate is one of its
+// DNS or IP address SANs, or if the certificate doesn't have a common name
+func getCNInSAN(cert *x509.Certificate) float64 {
+	cn := cert.Subject.CommonName
+	if cn == "" {
+		return 1
+	}
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, cn) {
+			return 1
+		}
+	}
+	if ip := net.ParseIP(cn); ip != nil {
+		for _, addr := range cert.IPAddresses {
+			if addr.Equal(ip) {
+				return 1
+			}
+		}
+	}
+	return 0
+}
+
+// getIssuer returns the issuer of the leaf certificate, from the verified
+// chain if there is one or else the certificates presented by the peer
+func getIssuer(state *tls.ConnectionState) (*x509.Certificate, error) {
+	for _, chain := range state.VerifiedChains {
+		if len(chain) > 1 {
+			return chain[1], nil
+		}
+	}
+	if len(state.PeerCertificates) > 1 {
+		return state.PeerCertificates[1], nil
+	}
+	return nil, fmt.Errorf("the issuer of the leaf certificate is unknown")
+}
+
+// oidACMEIdentifier is the id-pe-acmeIdentifier extension from RFC 8737
+var oidACMEIdentifier = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}
+
+// getIsACMEValidation returns 1 if the certificate has the acmeIdentifier
+// extension used by TLS-ALPN-01 challenge certificates
+func getIsACMEValidation(cert *x509.Certificate) float64 {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(oidACMEIdentifier) {
+			return 1
+		}
+	}
+	return 0
+}
+
+// getLifetimeElapsed returns the fraction of the certificate's validity
+// period that has elapsed at the given time, clamped between 0 and 1
+func getLifetimeElapsed(cert *x509.Certificate, now time.Time) float64 {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	if lifetime <= 0 {
+		return 1
+	}
+
+	ratio := float64(now.Sub(cert.NotBefore)) / float64(lifetime)
+	if ratio < 0 {
+		return 0
+	}
+	if ratio > 1 {
+		return 1
+	}
+	return ratio
+}
+
+// getRenewalWindowRemaining returns the time until the certificate expires at
+// the given time as a fraction of the renewal window, clamped between 0 and 1.
+// It's 1 until the certificate enters the window and 0 once it has expired.
+func getRenewalWindowRemaining(cert *x509.Certificate, renewBefore time.Duration, now time.Time) float64 {
+	ratio := float64(cert.NotAfter.Sub(now)) / float64(renewBefore)
+	if ratio < 0 {
+		return 0
+	}
+	if ratio > 1 {
+		return 1
+	}
+	return ratio
+}
+
+// getSerialRotated returns 1 if the serial number of the certificate differs
+// from the old serial. The old serial can be given in decimal, like the
+// serial_no label, or in hex with a 0x prefix or colon separated bytes.
+func getSerialRotated(cert *x509.Certificate, oldSerial string) (float64, error) {
+	oldSerial = strings.TrimSpace(oldSerial)
+
+	var (
+		old = new(big.Int)
+		ok  bool
+	)
+	switch {
+	case strings.HasPrefix(oldSerial, "0x"), strings.HasPrefix(oldSerial, "0X"):
+		_, ok = old.SetString(oldSerial[2:], 16)
+	case strings.Contains(oldSerial, ":"):
+		_, ok = old.SetString(strings.Replace(oldSerial, ":", "", -1), 16)
+	default:
+		_, ok = old.SetString(oldSerial, 10)
+	}
+	if !ok {
+		return 0, fmt.Errorf("invalid serial number: %q", oldSerial)
+	}
+
+	if cert.SerialNumber.Cmp(old) == 0 {
+		return 0, nil
+	}
+	return 1, nil
 }
 
-// Collect metrics
-func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	ch <- prometheus.MustNewConstMetric(
-		proberType, prometheus.GaugeValue, 1, e.module.Prober,
+// getFailureReason classifies the error returned by a prober. Alerts sent by
+// the target and certificates rejected by the prober are named after the
+// TLS alert.
+func getFailureReason(err error) string {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "remote error" {
+		text := strings.TrimPrefix(opErr.Err.Error(), "tls: ")
+		if name, ok := tlsAlertNames[text]; ok {
+			return name
+		}
+		return "unknown_alert"
+	}
+
+	var (
+		unknownAuthorityErr   x509.UnknownAuthorityError
+		certificateInvalidErr x509.CertificateInvalidError
+		hostnameErr           x509.HostnameError
 	)
+	switch {
+	case errors.As(err, &unknownAuthorityErr):
+		return "unknown_ca"
+	case errors.As(err, &certificateInvalidErr):
+		if certificateInvalidErr.Reason == x509.Expired {
+			return "certificate_expired"
+		}
+		return "bad_certificate"
+	case errors.As(err, &hostnameErr):
+		return "bad_certificate"
+	}
 
-	state, err := e.prober(e.target, e.module, e.timeout)
-	if err != nil {
-		log.Errorf("error=%s target=%s prober=%s timeout=%s", err, e.target, e.module.Prober, e.timeout)
-		ch <- prometheus.MustNewConstMetric(
-			tlsConnectSuccess, prometheus.GaugeValue, 0,
-		)
-		return
+	if isECHRejected(err) {
+		return "ech_rejected"
 	}
 
-	// Get the TLS version from the connection state and export it as a metric
-	ch <- prometheus.MustNewConstMetric(
-		tlsVersion, prometheus.GaugeValue, 1, getTLSVersion(state),
-	)
+	var notTLSErr *prober.NotTLSError
+	if errors.As(err, &notTLSErr) {
+		return "not_tls"
+	}
 
-	// Retrieve certificates from the connection state
-	peerCertificates := state.PeerCertificates
-	if len(peerCertificates) < 1 {
-		log.Errorf("error=No certificates found in connection state. target=%s prober=%s", e.target, e.module.Prober)
-		ch <- prometheus.MustNewConstMetric(
-			tlsConnectSuccess, prometheus.GaugeValue, 0,
-		)
-		return
+	var stalledErr *prober.StalledError
+	if errors.As(err, &stalledErr) {
+		return "handshake_stalled"
 	}
 
-	// If there are peer certificates in the connection state then consider
-	// the tls connection a success
-	ch <- prometheus.MustNewConstMetric(
-		tlsConnectSuccess, prometheus.GaugeValue, 1,
-	)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return "dns"
+	}
 
-	// Remove duplicate certificates from the response
-	peerCertificates = uniq(peerCertificates)
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return "connection_refused"
+	}
 
-	// Loop through peer certificates and create metrics
-	for _, cert := range peerCertificates {
-		if !cert.NotAfter.IsZero() {
-			ch <- prometheus.MustNewConstMetric(
-				notAfter,
-				prometheus.GaugeValue,
-				float64(cert.NotAfter.UnixNano()/1e9),
-				cert.SerialNumber.String(),
-				cert.Issuer.CommonName,
-				cert.Subject.CommonName,
-				getDNSNames(cert),
-				getIPAddresses(cert),
-				getEmailAddresses(cert),
-				getOrganizationalUnits(cert),
-			)
-		}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return "timeout"
+	}
 
-		if !cert.NotBefore.IsZero() {
-			ch <- prometheus.MustNewConstMetric(
-				notBefore,
-				prometheus.GaugeValue,
-				float64(cert.NotBefore.UnixNano()/1e9),
-				cert.SerialNumber.String(),
-				cert.Issuer.CommonName,
-				cert.Subject.CommonName,
-				getDNSNames(cert),
-				getIPAddresses(cert),
-				getEmailAddresses(cert),
-				getOrganizationalUnits(cert),
-			)
+	return "other"
+}
+
+// setTargetHost replaces the host portion of the target, which may be a URL or
+// a host:port address
+func setTargetHost(target, host string) string {
+	if strings.Contains(target, "://") {
+		if u, err := url.Parse(target); err == nil {
+			u.Host = setTargetHost(u.Host, host)
+			return u.String()
 		}
 	}
+	if _, port, err := net.SplitHostPort(target); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	if strings.Contains(host, ":") {
+		return "[" + host + "]"
+	}
+	return host
+}
 
-	// Retrieve the list of verified chains from the connection state
-	verifiedChains := state.VerifiedChains
+// getTrustedIgnoringTime returns 1 if the first certificate chains to one of
+// the roots and is valid for the host at some point during its validity
+// period, regardless of whether it is valid now
+func getTrustedIgnoringTime(certs []*x509.Certificate, roots *x509.CertPool, host string) float64 {
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
 
-	// Sort the verified chains from the chain that is valid for longest to the chain
-	// that expires the soonest
-	sort.Slice(verifiedChains, func(i, j int) bool {
-		iExpiry := time.Time{}
-		for _, cert := range verifiedChains[i] {
-			if (iExpiry.IsZero() || cert.NotAfter.Before(iExpiry)) && !cert.NotAfter.IsZero() {
-				iExpiry = cert.NotAfter
-			}
+	leaf := certs[0]
+	for _, t := range []time.Time{
+		latestNotBefore(certs),
+		earliestExpiry(certs),
+		leaf.NotBefore.Add(leaf.NotAfter.Sub(leaf.NotBefore) / 2),
+	} {
+		opts := x509.VerifyOptions{
+			DNSName:       host,
+			Roots:         roots,
+			Intermediates: intermediates,
+			CurrentTime:   t,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
 		}
-		jExpiry := time.Time{}
-		for _, cert := range verifiedChains[j] {
-			if (jExpiry.IsZero() || cert.NotAfter.Before(jExpiry)) && !cert.NotAfter.IsZero() {
-				jExpiry = cert.NotAfter
-			}
+		if _, err := leaf.Verify(opts); err == nil {
+			return 1
 		}
+	}
 
-		return iExpiry.After(jExpiry)
-	})
+	return 0
+}
 
-	// Loop through the verified chains creating metrics. Label the metrics
-	// with the index of the chain.
-	for i, chain := range verifiedChains {
-		chain = uniq(chain)
-		for _, cert := range chain {
-			chainNo := strconv.Itoa(i)
+// getSuccessRequiresInsecure returns 1 if the module skips verification and
+// the first certificate doesn't verify for the host against the roots in the
+// module, using the rest of the certificates as intermediates
+func getSuccessRequiresInsecure(certs []*x509.Certificate, module config.Module, roots *x509.CertPool, host string) float64 {
+	if !module.TLSConfig.InsecureSkipVerify {
+		return 0
+	}
 
-			if !cert.NotAfter.IsZero() {
-				ch <- prometheus.MustNewConstMetric(
-					verifiedNotAfter,
-					prometheus.GaugeValue,
-					float64(cert.NotAfter.UnixNano()/1e9),
-					chainNo,
-					cert.SerialNumber.String(),
-					cert.Issuer.CommonName,
-					cert.Subject.CommonName,
-					getDNSNames(cert),
-					getIPAddresses(cert),
-					getEmailAddresses(cert),
-					getOrganizationalUnits(cert),
-				)
-			}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
 
-			if !cert.NotBefore.IsZero() {
-				ch <- prometheus.MustNewConstMetric(
-					verifiedNotBefore,
-					prometheus.GaugeValue,
-					float64(cert.NotBefore.UnixNano()/1e9),
-					chainNo,
-					cert.SerialNumber.String(),
-					cert.Issuer.CommonName,
-					cert.Subject.CommonName,
-					getDNSNames(cert),
-					getIPAddresses(cert),
-					getEmailAddresses(cert),
-					getOrganizationalUnits(cert),
-				)
-			}
-		}
+	opts := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
 	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return 1
+	}
+
+	return 0
 }
 
-func probeHandler(w http.ResponseWriter, r *http.Request, conf *config.Config) {
-	moduleName := r.URL.Query().Get("module")
-	if moduleName == "" {
-		moduleName = "tcp"
+// getRoots returns the roots from the CA file in the module, or nil for the
+// system roots when there isn't one
+func getRoots(module config.Module) (*x509.CertPool, error) {
+	if module.TLSConfig.CAFile == "" {
+		return nil, nil
 	}
-	module, ok := conf.Modules[moduleName]
-	if !ok {
-		http.Error(w, fmt.Sprintf("Unknown module %q", moduleName), http.StatusBadRequest)
-		return
+
+	caPEM, err := prober.ReadFile(module.TLSConfig.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("unable to use specified CA cert %s", module.TLSConfig.CAFile)
 	}
 
-	// The following timeout block was taken wholly from the blackbox exporter
-	//   https://github.com/prometheus/blackbox_exporter/blob/master/main.go
-	var timeoutSeconds float64
-	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
-		var err error
-		timeoutSeconds, err = strconv.ParseFloat(v, 64)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to parse timeout from Prometheus header: %s", err), http.StatusInternalServerError)
-			return
+	return roots, nil
+}
+
+// latestNotBefore returns the latest NotBefore date in the list of
+// certificates
+func latestNotBefore(certs []*x509.Certificate) time.Time {
+	notBefore := time.Time{}
+	for _, cert := range certs {
+		if cert.NotBefore.After(notBefore) {
+			notBefore = cert.NotBefore
 		}
-	} else {
-		timeoutSeconds = 10
 	}
-	if timeoutSeconds == 0 {
-		timeoutSeconds = 10
+	return notBefore
+}
+
+// getChainsPerRoot returns the number of chains that end at each root, by the
+// hex encoded SHA-256 fingerprint of the root
+func getChainsPerRoot(chains [][]*x509.Certificate) map[string]float64 {
+	roots := map[string]float64{}
+	for _, chain := range chains {
+		if len(chain) == 0 {
+			continue
+		}
+		fingerprint := sha256.Sum256(chain[len(chain)-1].Raw)
+		roots[hex.EncodeToString(fingerprint[:])]++
 	}
+	return roots
+}
 
-	timeout := time.Duration((timeoutSeconds) * 1e9)
+// getChainCompleteWithoutAIA returns 1 if the first certificate verifies
+// against the roots using only the rest of the certificates as intermediates.
+// Go never fetches issuers from the AIA extension, so this reflects the chain
+// as served.
+func getChainCompleteWithoutAIA(certs []*x509.Certificate, roots *x509.CertPool) float64 {
 
-	target := r.URL.Query().Get("target")
-	if target == "" {
-		http.Error(w, "Target parameter is missing", http.StatusBadRequest)
-		return
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
 	}
 
-	prober, ok := prober.Probers[module.Prober]
-	if !ok {
-		http.Error(w, fmt.Sprintf("Unknown prober %q", module.Prober), http.StatusBadRequest)
-		return
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	if _, err := certs[0].Verify(opts); err != nil {
+		return 0
 	}
 
-	exporter := &Exporter{
-		target:  target,
-		prober:  prober,
-		timeout: timeout,
-		module:  module,
+	return 1
+}
+
+// getChainStatus returns verified when the handshake verified the chain, or
+// it verifies against the roots when verification was skipped. Otherwise it
+// returns incomplete when the served chain doesn't end at a self-signed
+// certificate and the missing issuer is unknown, and untrusted for every
+// other failure.
+func getChainStatus(state *tls.ConnectionState, certs []*x509.Certificate, roots *x509.CertPool) string {
+	if len(state.VerifiedChains) > 0 {
+		return "verified"
 	}
 
-	registry := prometheus.NewRegistry()
-	registry.MustRegister(exporter)
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
 
-	// Serve
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
-	h.ServeHTTP(w, r)
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}
+	_, err := certs[0].Verify(opts)
+	if err == nil {
+		return "verified"
+	}
+
+	last := certs[len(certs)-1]
+	if _, ok := err.(x509.UnknownAuthorityError); ok && !isSelfSigned(last) {
+		return "incomplete"
+	}
+
+	return "untrusted"
 }
 
-func uniq(certs []*x509.Certificate) []*x509.Certificate {
-	r := []*x509.Certificate{}
+// isSelfSigned returns true if the certificate is its own issuer
+func isSelfSigned(cert *x509.Certificate) bool {
+	return bytes.Equal(cert.RawIssuer, cert.RawSubject) &&
+		cert.CheckSignature(cert.SignatureAlgorithm, cert.RawTBSCertificate, cert.Signature) == nil
+}
 
-	for _, c := range certs {
-		if !contains(r, c) {
-			r = append(r, c)
+// hasExpiredCert returns 1 if any of the certificates has expired and 0
+// otherwise
+func hasExpiredCert(certs []*x509.Certificate) float64 {
+	now := time.Now()
+	for _, cert := range certs {
+		if !cert.NotAfter.IsZero() && now.After(cert.NotAfter) {
+			return 1
 		}
 	}
+	return 0
+}
+
+// moduleFromScheme returns a copy of the module with the prober selected by
+// the scheme of the target, along with the target in the form that prober
+// expects. Targets with an unknown scheme are probed with the module as it is.
+func moduleFromScheme(module config.Module, target string) (config.Module, string) {
+	u, err := url.Parse(target)
+	if err != nil {
+		log.Warnf("error=%s target=%s msg=unable to infer the prober from the target", err, target)
+		return module, target
+	}
 
-	return r
+	scheme, ok := schemeProbers[strings.ToLower(u.Scheme)]
+	if !ok {
+		log.Warnf("target=%s msg=unknown scheme %q, falling back to the default module", target, u.Scheme)
+		return module, u.Host
+	}
+
+	module.Prober = scheme.prober
+	if scheme.prober == "https" || scheme.prober == "websocket" {
+		return module, target
+	}
+
+	module.TCP.StartTLS = scheme.startTLS
+	if u.Port() == "" && scheme.port != "" {
+		return module, net.JoinHostPort(u.Hostname(), scheme.port)
+	}
+	return module, u.Host
 }
 
-func contains(certs []*x509.Certificate, cert *x509.Certificate) bool {
-	for _, c := range certs {
-		if (c.SerialNumber.String() == cert.SerialNumber.String()) && (c.Issuer.CommonName == cert.Issuer.CommonName) {
-			return true
+// getTargetHost returns the host portion of the target, which may be a URL or
+// a host:port address
+func getTargetHost(target string) string {
+	if strings.Contains(target, "://") {
+		if u, err := url.Parse(target); err == nil {
+			return u.Hostname()
 		}
 	}
+	if host, _, err := net.SplitHostPort(target); err == nil {
+		return host
+	}
+	return target
+}
+
+// isWeakSignature returns true for signature algorithms that use MD2, MD5 or
+// SHA-1
+func isWeakSignature(alg x509.SignatureAlgorithm) bool {
+	switch alg {
+	case x509.MD2WithRSA, x509.MD5WithRSA, x509.SHA1WithRSA, x509.DSAWithSHA1, x509.ECDSAWithSHA1:
+		return true
+	}
 	return false
 }
 
+// getMaxPathLen returns the basic constraints path length of the certificate,
+// or -1 if it isn't constrained
+func getMaxPathLen(cert *x509.Certificate) int {
+	if cert.MaxPathLen > 0 || (cert.MaxPathLen == 0 && cert.MaxPathLenZero) {
+		return cert.MaxPathLen
+	}
+	return -1
+}
+
 func getTLSVersion(state *tls.ConnectionState) string {
 	switch state.Version {
 	case tls.VersionTLS10:
@@ -309,32 +1876,76 @@ func getTLSVersion(state *tls.ConnectionState) string {
 	}
 }
 
-func getDNSNames(cert *x509.Certificate) string {
-	if len(cert.DNSNames) > 0 {
-		return "," + strings.Join(cert.DNSNames, ",") + ","
+// getForwardSecrecy returns 1 if the negotiated cipher suite uses an ephemeral
+// key exchange. Every TLS 1.3 cipher suite does.
+func getForwardSecrecy(state *tls.ConnectionState) float64 {
+	if state.Version == tls.VersionTLS13 {
+		return 1
 	}
 
-	return ""
+	name := tls.CipherSuiteName(state.CipherSuite)
+	if strings.HasPrefix(name, "TLS_ECDHE_") || strings.HasPrefix(name, "TLS_DHE_") {
+		return 1
+	}
+
+	return 0
 }
 
-func getEmailAddresses(cert *x509.Certificate) string {
-	if len(cert.EmailAddresses) > 0 {
-		return "," + strings.Join(cert.EmailAddresses, ",") + ","
+// getCertLabelValues returns the values for certLabels
+func getCertLabelValues(cert *x509.Certificate, sanLabels config.SANLabels) []string {
+	return []string{
+		cert.SerialNumber.String(),
+		cert.Issuer.CommonName,
+		cert.Subject.CommonName,
+		getDNSNames(cert, sanLabels),
+		getIPAddresses(cert, sanLabels),
+		getEmailAddresses(cert, sanLabels),
+		getOrganizationalUnits(cert),
 	}
+}
 
-	return ""
+func getDNSNames(cert *x509.Certificate, sanLabels config.SANLabels) string {
+	return joinSANs(cert.DNSNames, sanLabels)
+}
+
+func getEmailAddresses(cert *x509.Certificate, sanLabels config.SANLabels) string {
+	return joinSANs(cert.EmailAddresses, sanLabels)
 }
 
-func getIPAddresses(cert *x509.Certificate) string {
-	if len(cert.IPAddresses) > 0 {
-		ips := ","
-		for _, ip := range cert.IPAddresses {
-			ips = ips + ip.String() + ","
+func getIPAddresses(cert *x509.Certificate, sanLabels config.SANLabels) string {
+	var ips []string
+	for _, ip := range cert.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	return joinSANs(ips, sanLabels)
+}
+
+// joinSANs joins the SANs into a label value. By default the value is wrapped
+// in commas, so that a single SAN can be matched with ".*,example.com,.*".
+// The canonical form is sorted and deduplicated, without whitespace.
+func joinSANs(sans []string, sanLabels config.SANLabels) string {
+	if sanLabels.Canonical {
+		seen := map[string]bool{}
+		var canonical []string
+		for _, san := range sans {
+			san = strings.Join(strings.Fields(san), "")
+			if san == "" || seen[san] {
+				continue
+			}
+			seen[san] = true
+			canonical = append(canonical, san)
 		}
-		return ips
+		sort.Strings(canonical)
+		sans = canonical
 	}
 
-	return ""
+	if len(sans) == 0 {
+		return ""
+	}
+	if sanLabels.TrimCommas {
+		return strings.Join(sans, ",")
+	}
+	return "," + strings.Join(sans, ",") + ","
 }
 
 func getOrganizationalUnits(cert *x509.Certificate) string {
@@ -345,8 +1956,49 @@ func getOrganizationalUnits(cert *x509.Certificate) string {
 	return ""
 }
 
-func init() {
-	prometheus.MustRegister(version.NewCollector(namespace + "_exporter"))
+func getOCSPServers(cert *x509.Certificate) string {
+	if len(cert.OCSPServer) > 0 {
+		return "," + strings.Join(cert.OCSPServer, ",") + ","
+	}
+
+	return ""
+}
+
+func getIssuingCertificateURLs(cert *x509.Certificate) string {
+	if len(cert.IssuingCertificateURL) > 0 {
+		return "," + strings.Join(cert.IssuingCertificateURL, ",") + ","
+	}
+
+	return ""
+}
+
+// newMetricsRegistry returns the registry served on the metrics path. It has
+// the go and process collectors, like the default registry, and the build info
+// of the exporter unless they're disabled.
+func newMetricsRegistry(disableDefaultMetrics, disableBuildInfo bool) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	if !disableDefaultMetrics {
+		registry.MustRegister(
+			prometheus.NewGoCollector(),
+			prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		)
+	}
+	if !disableBuildInfo {
+		registry.MustRegister(version.NewCollector(namespace + "_exporter"))
+	}
+
+	return registry
+}
+
+// newMetricsHandler serves the metrics in the registry. The scrapes are
+// counted in the registry like they are by promhttp.Handler, unless the
+// default metrics are disabled.
+func newMetricsHandler(registry *prometheus.Registry, disableDefaultMetrics bool) http.Handler {
+	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+	if disableDefaultMetrics {
+		return h
+	}
+	return promhttp.InstrumentMetricHandler(registry, h)
 }
 
 func main() {
@@ -355,6 +2007,33 @@ func main() {
 		metricsPath   = kingpin.Flag("web.metrics-path", "Path under which to expose metrics").Default("/metrics").String()
 		probePath     = kingpin.Flag("web.probe-path", "Path under which to expose the probe endpoint").Default("/probe").String()
 		configFile    = kingpin.Flag("config.file", "SSL exporter configuration file").Default("").String()
+		oneshotProbe  = kingpin.Flag("probe.oneshot", "Probe the target given as an argument once, print the metrics to stdout and exit. Exits with a non-zero code if the probe fails.").Bool()
+		oneshotTarget = kingpin.Arg("target", "The target to probe in oneshot mode.").String()
+		oneshotModule = kingpin.Arg("module", "The module to use in oneshot mode.").Default("tcp").String()
+		pushURL       = kingpin.Flag("push.gateway", "Push the metrics of the oneshot probe to the Prometheus Pushgateway at this URL, as well as printing them.").Default("").String()
+		pushJob       = kingpin.Flag("push.job", "The job label of the metrics pushed to the Pushgateway.").Default(namespace + "_exporter").String()
+		pushGrouping  = kingpin.Flag("push.grouping", "A name=value label of the group the metrics are pushed to in the Pushgateway, in addition to the job. Repeat the flag for more than one. The instance label is the target unless it's given.").StringMap()
+		keyLogFile    = kingpin.Flag("debug.keylog-file", "Write the TLS secrets of every probe to this file in NSS key log format. INSECURE: only enable this temporarily for debugging.").Default("").String()
+		canaryTarget  = kingpin.Flag("probe.canary-target", "Only report ready on /-/ready once a probe of this target succeeds, to check that the exporter can reach the network and complete handshakes. The target is probed at startup and every 10s until it succeeds.").Default("").String()
+		canaryModule  = kingpin.Flag("probe.canary-module", "The module used to probe the canary target.").Default("tcp").String()
+		probeInterval = kingpin.Flag("probe.interval", "How often to probe the targets in the configuration file.").Default("1m").Duration()
+		webhookURL    = kingpin.Flag("alert.webhook-url", "POST a JSON payload to this URL when a target fails for --alert.webhook-threshold consecutive probes.").Default("").String()
+		webhookThresh = kingpin.Flag("alert.webhook-threshold", "The number of consecutive failed probes of a target before the webhook is sent.").Default("3").Int()
+		webhookRetain = kingpin.Flag("alert.webhook-retention", "Forget the consecutive failures of a target when it hasn't been probed for this duration. Never forgotten when 0.").Default("24h").Duration()
+		userAgent     = kingpin.Flag("probe.user-agent", "The User-Agent header sent in the HTTP requests made by the exporter.").Default(namespace + "_exporter/" + version.Version).String()
+		ctLogListURL  = kingpin.Flag("ct.log-list-url", "The list of Certificate Transparency logs queried by modules with verify_ct_inclusion.").Default("https://www.gstatic.com/ct/log_list/v3/log_list.json").String()
+		allowTargets  = kingpin.Flag("probe.allowed-targets", "Only probe targets matching one of these CIDRs or regular expressions, which match the host or host:port of the target. Repeat the flag for more than one. Every target is allowed when it isn't set.").Strings()
+		serialRetain  = kingpin.Flag("serial.collision-retention", "Track the serial numbers of the certificates seen by every probe and export ssl_exporter_serial_collision when one is seen from more than one issuer. Serial numbers are forgotten when they haven't been seen for this duration. Disabled when 0.").Default("0s").Duration()
+		rotationKeep  = kingpin.Flag("cert.rotation-retention", "Count the changes of the leaf certificate of every target that is probed and export them as ssl_cert_rotations_total. Targets are forgotten when they haven't been probed for this duration. Disabled when 0.").Default("0s").Duration()
+		zeroRetention = kingpin.Flag("cert.placeholder-retention", "Forget the certificates of a target whose module has zero_on_failure set when it hasn't been probed successfully for this duration, and stop exporting placeholders for them. Never forgotten when 0.").Default("24h").Duration()
+		selfTestRun   = kingpin.Flag("selftest", "Probe local servers with an expiring, an expired and a self-signed certificate, check the metrics and exit. Exits with a non-zero code if a check fails.").Bool()
+		noDefaults    = kingpin.Flag("web.disable-default-metrics", "Leave the go and process metrics, and the promhttp metrics about scrapes of the metrics path, out of the metrics path.").Bool()
+		noBuildInfo   = kingpin.Flag("web.disable-build-info", "Leave ssl_exporter_build_info out of the metrics path.").Bool()
+		vaultAddress  = kingpin.Flag("vault.address", "The address of the Vault server that vault://<path>#<field> references in the ca_file, cert_file and key_file of modules are read from.").Envar("VAULT_ADDR").Default("").String()
+		vaultToken    = kingpin.Flag("vault.token-file", "Read the Vault token from this file. The VAULT_TOKEN environment variable is used when it isn't set.").Default("").String()
+		vaultRoleID   = kingpin.Flag("vault.role-id", "Log in to Vault with this AppRole role ID, instead of a token.").Default("").String()
+		vaultSecretID = kingpin.Flag("vault.secret-id-file", "Read the secret ID of the AppRole from this file.").Default("").String()
+		vaultTTL      = kingpin.Flag("vault.cache-ttl", "How long the secrets read from Vault are cached for, or their lease when it's shorter.").Default("5m").Duration()
 		err           error
 	)
 
@@ -363,6 +2042,40 @@ func main() {
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
 
+	prober.UserAgent = *userAgent
+	prober.CTLogListURL = *ctLogListURL
+
+	if *vaultAddress != "" {
+		prober.Vault, err = newVaultClient(*vaultAddress, *vaultToken, *vaultRoleID, *vaultSecretID, *vaultTTL)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	// Set up key logging before the selftest and oneshot modes, which are
+	// where traffic is most likely to be captured
+	if *keyLogFile != "" {
+		f, err := os.OpenFile(*keyLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer f.Close()
+
+		log.Warnf("!!! TLS key logging is enabled. The secrets of every probe are being written to %s, which allows the traffic to be decrypted. Do not leave this enabled. !!!", *keyLogFile)
+		prober.KeyLogWriter = f
+	}
+
+	if *selfTestRun {
+		passed, err := selfTest(os.Stdout, 10*time.Second)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !passed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	conf := config.DefaultConfig
 	if *configFile != "" {
 		conf, err = config.LoadConfig(*configFile)
@@ -371,10 +2084,84 @@ func main() {
 		}
 	}
 
+	if *pushURL != "" && !*oneshotProbe {
+		log.Fatalln("--push.gateway can only be used with --probe.oneshot")
+	}
+
+	if *oneshotProbe {
+		var gateway *pushGateway
+		if *pushURL != "" {
+			gateway = &pushGateway{url: *pushURL, job: *pushJob, grouping: *pushGrouping}
+		}
+		success, err := oneshot(os.Stdout, *oneshotTarget, *oneshotModule, conf, 10*time.Second, gateway)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		if !success {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	log.Infoln("Starting "+namespace+"_exporter", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 
-	http.Handle(*metricsPath, promhttp.Handler())
+	registry := newMetricsRegistry(*noDefaults, *noBuildInfo)
+	registry.MustRegister(probesInFlight)
+	registry.MustRegister(certAgeDays)
+
+	systemRoots, err := newSystemRootsGauge()
+	if err != nil {
+		log.Errorf("error=%s msg=unable to load the system roots", err)
+	} else {
+		registry.MustRegister(systemRoots)
+	}
+
+	if *webhookURL != "" {
+		alerter = newWebhookAlerter(*webhookURL, *webhookThresh, *webhookRetain)
+	}
+
+	if len(*allowTargets) > 0 {
+		allowedTargets, err = newTargetAllowlist(*allowTargets)
+		if err != nil {
+			log.Fatalln(err)
+		}
+	}
+
+	if *serialRetain > 0 {
+		serialTracker = newSerialCollisionTracker(*serialRetain)
+		registry.MustRegister(serialTracker)
+	}
+
+	if *rotationKeep > 0 {
+		rotationTracker = newCertRotationTracker(*rotationKeep)
+		registry.MustRegister(rotationTracker)
+	}
+
+	lastCertLabels = newCertLabelCache(*zeroRetention)
+
+	if len(conf.Targets) > 0 {
+		timeout := 10 * time.Second
+		if *probeInterval < timeout {
+			timeout = *probeInterval
+		}
+		if err := scheduleTargets(conf, registry, *probeInterval, timeout, make(chan struct{})); err != nil {
+			log.Fatalln(err)
+		}
+		log.Infof("Probing %d targets from the configuration file every %s", len(conf.Targets), *probeInterval)
+	}
+
+	var readiness *canary
+	if *canaryTarget != "" {
+		readiness, err = newCanary(*canaryTarget, *canaryModule, conf, 10*time.Second)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		go readiness.run(canaryRetryInterval, make(chan struct{}))
+	}
+
+	http.Handle(*metricsPath, newMetricsHandler(registry, *noDefaults))
+	http.Handle("/-/ready", readyHandler(readiness))
 	http.HandleFunc(*probePath, func(w http.ResponseWriter, r *http.Request) {
 		probeHandler(w, r, conf)
 	})
@@ -2,25 +2,40 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	pconfig "github.com/prometheus/common/config"
+	"github.com/prometheus/common/log"
 	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/prober"
 	"github.com/ribbybibby/ssl_exporter/test"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/ocsp"
 )
 
 // TestProbeHandlerHTTPS tests a typical HTTPS probe
@@ -70,6 +85,18 @@ func TestProbeHandlerHTTPS(t *testing.T) {
 	if !ok {
 		t.Errorf("expected `ssl_tls_version_info{version=\"TLS 1.3\"} 1`")
 	}
+
+	// Check forward secrecy metric
+	ok = strings.Contains(rr.Body.String(), "ssl_tls_forward_secrecy 1")
+	if !ok {
+		t.Errorf("expected `ssl_tls_forward_secrecy 1`")
+	}
+
+	// Check the handshake info metric
+	ok = regexp.MustCompile(`ssl_tls_handshake_info{alpn="",cipher="TLS_[A-Z0-9_]+",group="[^"]*",resumed="false",version="TLS 1.3"} 1`).MatchString(rr.Body.String())
+	if !ok {
+		t.Errorf("expected `ssl_tls_handshake_info{alpn=\"\",cipher=...,group=...,resumed=\"false\",version=\"TLS 1.3\"} 1`")
+	}
 }
 
 // TestProbeHandlerHTTPSVerifiedChains checks that metrics are generated
@@ -557,6 +584,19 @@ func TestProbeHandlerDefaultModule(t *testing.T) {
 	if ok := strings.Contains(rr.Body.String(), "ssl_prober{prober=\"tcp\"} 1"); !ok {
 		t.Errorf("expected `ssl_prober{prober=\"tcp\"} 1`")
 	}
+
+	// Check that the module is reported as defaulted
+	if ok := strings.Contains(rr.Body.String(), "ssl_probe_module_defaulted 1"); !ok {
+		t.Errorf("expected `ssl_probe_module_defaulted 1`")
+	}
+
+	rr, err = probe("localhost:6666", "tcp", config.DefaultConfig)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ok := strings.Contains(rr.Body.String(), "ssl_probe_module_defaulted 0"); !ok {
+		t.Errorf("expected `ssl_probe_module_defaulted 0`")
+	}
 }
 
 func TestProbeHandlerProxy(t *testing.T) {
@@ -778,56 +818,2800 @@ func TestProbeHandlerTCPStartTLSIMAP(t *testing.T) {
 	}
 }
 
-func checkDates(certPEM []byte, body string) error {
-	// Check notAfter and notBefore metrics
+// TestProbeHandlerExpiryWarning tests that the expiry warning levels are set
+// from the configured thresholds
+func TestProbeHandlerExpiryWarning(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	// The test certificate expires in a day
+	*expiryWarn = 48 * time.Hour
+	*expiryCritical = 1 * time.Hour
+	defer func() {
+		*expiryWarn = 0
+		*expiryCritical = 0
+	}()
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_cert_expiry_warning{level=\"warn\"} 1"); !ok {
+		t.Errorf("expected `ssl_cert_expiry_warning{level=\"warn\"} 1`")
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_cert_expiry_warning{level=\"critical\"} 0"); !ok {
+		t.Errorf("expected `ssl_cert_expiry_warning{level=\"critical\"} 0`")
+	}
+}
+
+// TestProbeHandlerRFC3339Timestamps tests that the timestamp info metrics are
+// exported when enabled in the module
+func TestProbeHandlerRFC3339Timestamps(t *testing.T) {
+	server, certPEM, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				RFC3339Timestamps: true,
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
 	block, _ := pem.Decode(certPEM)
 	cert, err := x509.ParseCertificate(block.Bytes)
 	if err != nil {
-		return err
+		t.Fatalf(err.Error())
 	}
-	notAfter := strconv.FormatFloat(float64(cert.NotAfter.UnixNano()/1e9), 'g', -1, 64)
-	if ok := strings.Contains(body, "ssl_cert_not_after{cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"100\"} "+notAfter); !ok {
-		return fmt.Errorf("expected `ssl_cert_not_after{cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"100\"} " + notAfter + "`")
+
+	notAfter := "ssl_cert_not_after_timestamp{cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"100\",value=\"" + cert.NotAfter.UTC().Format(time.RFC3339) + "\"} 1"
+	if ok := strings.Contains(rr.Body.String(), notAfter); !ok {
+		t.Errorf("expected `%s`", notAfter)
 	}
-	notBefore := strconv.FormatFloat(float64(cert.NotBefore.UnixNano()/1e9), 'g', -1, 64)
-	if ok := strings.Contains(body, "ssl_cert_not_before{cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"100\"} "+notBefore); !ok {
-		return fmt.Errorf("expected `ssl_cert_not_before{cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"100\"} " + notBefore + "`")
+
+	notBefore := "ssl_cert_not_before_timestamp{cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"100\",value=\"" + cert.NotBefore.UTC().Format(time.RFC3339) + "\"} 1"
+	if ok := strings.Contains(rr.Body.String(), notBefore); !ok {
+		t.Errorf("expected `%s`", notBefore)
 	}
-	return nil
 }
 
-func checkVerifiedChainDates(verifiedChains [][]*x509.Certificate, body string) error {
-	for i, chain := range verifiedChains {
-		for _, cert := range chain {
-			notAfter := strconv.FormatFloat(float64(cert.NotAfter.UnixNano()/1e9), 'g', -1, 64)
-			notAfterMetric := "ssl_verified_cert_not_after{" + strings.Join([]string{
-				"chain_no=\"" + strconv.Itoa(i) + "\"",
-				"cn=\"example.ribbybibby.me\"",
-				"dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\"",
-				"emails=\",me@ribbybibby.me,example@ribbybibby.me,\"",
-				"ips=\",127.0.0.1,::1,\"",
-				"issuer_cn=\"example.ribbybibby.me\"",
-				"ou=\",ribbybibbys org,\"",
-				"serial_no=\"" + cert.SerialNumber.String() + "\"",
-			}, ",") + "} " + notAfter
-			if ok := strings.Contains(body, notAfter); !ok {
-				return fmt.Errorf("expected `%s` in: %s", notAfterMetric, body)
-			}
+// TestProbeHandlerMatchesTarget tests that ssl_cert_matches_target reflects
+// the host in the target rather than the server_name in the module
+func TestProbeHandlerMatchesTarget(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
 
-			notBefore := strconv.FormatFloat(float64(cert.NotBefore.UnixNano()/1e9), 'g', -1, 64)
-			notBeforeMetric := "ssl_verified_cert_not_before{" + strings.Join([]string{
-				"chain_no=\"" + strconv.Itoa(i) + "\"",
-				"cn=\"example.ribbybibby.me\"",
-				"dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\"",
-				"emails=\",me@ribbybibby.me,example@ribbybibby.me,\"",
-				"ips=\",127.0.0.1,::1,\"",
-				"issuer_cn=\"example.ribbybibby.me\"",
-				"ou=\",ribbybibbys org,\"",
-				"serial_no=\"" + cert.SerialNumber.String() + "\"",
-			}, ",") + "} " + notBefore
-			if ok := strings.Contains(body, notBeforeMetric); !ok {
-				return fmt.Errorf("expected `%s` in: %s", notBeforeMetric, body)
-			}
+	server.StartTLS()
+	defer server.Close()
+
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile:     caFile,
+					ServerName: u.Hostname(),
+				},
+			},
+		},
+	}
+
+	// 127.0.0.1 is in the certificate's SANs
+	rr, err := probe(server.URL, "https", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_cert_matches_target 1"); !ok {
+		t.Errorf("expected `ssl_cert_matches_target 1`")
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_cert_cn_in_san 1"); !ok {
+		t.Errorf("expected `ssl_cert_cn_in_san 1`")
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_cert_lifetime_elapsed_ratio "); !ok {
+		t.Errorf("expected `ssl_cert_lifetime_elapsed_ratio`")
+	}
+
+	// localhost isn't, even though the probe succeeds because of the server
+	// name override
+	rr, err = probe("https://localhost:"+u.Port(), "https", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_tls_connect_success 1"); !ok {
+		t.Errorf("expected `ssl_tls_connect_success 1`")
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_cert_matches_target 0"); !ok {
+		t.Errorf("expected `ssl_cert_matches_target 0`")
+	}
+}
+
+// TestProbeHandlerMaxPathLen tests that the path length constraint is
+// exported for CA certificates
+func TestProbeHandlerMaxPathLen(t *testing.T) {
+	rootPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rootCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 5))
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.SerialNumber = big.NewInt(1)
+	rootCert, rootCertPem := test.GenerateSelfSignedCertificateWithPrivateKey(rootCertTmpl, rootPrivateKey)
+
+	intermediateCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 4))
+	intermediateCertTmpl.IsCA = true
+	intermediateCertTmpl.MaxPathLen = 0
+	intermediateCertTmpl.MaxPathLenZero = true
+	intermediateCertTmpl.SerialNumber = big.NewInt(2)
+	intermediateCert, intermediateCertPem, intermediateKeyPem := test.GenerateSignedCertificate(intermediateCertTmpl, rootCert, rootPrivateKey)
+
+	block, _ := pem.Decode(intermediateKeyPem)
+	intermediateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	serverCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 3))
+	serverCertTmpl.SerialNumber = big.NewInt(3)
+	_, serverCertPem, serverKey := test.GenerateSignedCertificate(serverCertTmpl, intermediateCert, intermediateKey)
+
+	server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(
+		rootCertPem,
+		bytes.Join([][]byte{serverCertPem, intermediateCertPem, rootCertPem}, []byte("")),
+		serverKey,
+	)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "serial_no=\"1\"} -1"); !ok {
+		t.Errorf("expected an unconstrained path length for the root")
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "serial_no=\"2\"} 0"); !ok {
+		t.Errorf("expected a path length of 0 for the intermediate")
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_cert_max_path_len{cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"3\"}"); ok {
+		t.Errorf("unexpected path length for the leaf")
+	}
+}
+
+// TestProbeHandlerChainHasExpiredCert tests a valid leaf served with an
+// expired intermediate
+func TestProbeHandlerChainHasExpiredCert(t *testing.T) {
+	rootPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rootCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 5))
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.SerialNumber = big.NewInt(1)
+	rootCert, rootCertPem := test.GenerateSelfSignedCertificateWithPrivateKey(rootCertTmpl, rootPrivateKey)
+
+	intermediateCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, -1))
+	intermediateCertTmpl.IsCA = true
+	intermediateCertTmpl.SerialNumber = big.NewInt(2)
+	intermediateCert, intermediateCertPem, intermediateKeyPem := test.GenerateSignedCertificate(intermediateCertTmpl, rootCert, rootPrivateKey)
+
+	block, _ := pem.Decode(intermediateKeyPem)
+	intermediateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	serverCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 3))
+	serverCertTmpl.SerialNumber = big.NewInt(3)
+	_, serverCertPem, serverKey := test.GenerateSignedCertificate(serverCertTmpl, intermediateCert, intermediateKey)
+
+	server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(
+		rootCertPem,
+		bytes.Join([][]byte{serverCertPem, intermediateCertPem}, []byte("")),
+		serverKey,
+	)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile:             caFile,
+					InsecureSkipVerify: true,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_chain_has_expired_cert 1"); !ok {
+		t.Errorf("expected `ssl_chain_has_expired_cert 1`")
+	}
+}
+
+// TestProbeHandlerVerifiedChainHasExpiredCert tests that a verified chain
+// without any expired certificates is reported as such
+func TestProbeHandlerVerifiedChainHasExpiredCert(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_chain_has_expired_cert 0"); !ok {
+		t.Errorf("expected `ssl_chain_has_expired_cert 0`")
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_verified_chain_has_expired_cert{chain_no=\"0\"} 0"); !ok {
+		t.Errorf("expected `ssl_verified_chain_has_expired_cert{chain_no=\"0\"} 0`")
+	}
+}
+
+// TestProbeHandlerProbeAllIPs tests probing every address behind the target
+func TestProbeHandlerProbeAllIPs(t *testing.T) {
+	server, certPEM, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				ProbeAllIPs: true,
+			},
+		},
+	}
+
+	rr, err := probe(server.URL, "https", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_ip_tls_connect_success{ip=\"127.0.0.1\"} 1"); !ok {
+		t.Errorf("expected `ssl_ip_tls_connect_success{ip=\"127.0.0.1\"} 1`")
+	}
+
+	block, _ := pem.Decode(certPEM)
+	fingerprint := sha256.Sum256(block.Bytes)
+	expectedFingerprint := "ssl_ip_cert_fingerprint_info{fingerprint=\"" + hex.EncodeToString(fingerprint[:]) + "\",ip=\"127.0.0.1\"} 1"
+	if ok := strings.Contains(rr.Body.String(), expectedFingerprint); !ok {
+		t.Errorf("expected `%s`", expectedFingerprint)
+	}
+}
+
+// TestSetTargetHost tests replacing the host in the different forms a target
+// can take
+func TestSetTargetHost(t *testing.T) {
+	tests := map[string]string{
+		"example.com:443":              "127.0.0.1:443",
+		"https://example.com:8443/foo": "https://127.0.0.1:8443/foo",
+		"https://example.com":          "https://127.0.0.1",
+		"example.com":                  "127.0.0.1",
+	}
+	for target, expected := range tests {
+		if got := setTargetHost(target, "127.0.0.1"); got != expected {
+			t.Errorf("expected %s, got %s", expected, got)
+		}
+	}
+
+	if got := setTargetHost("example.com:443", "::1"); got != "[::1]:443" {
+		t.Errorf("expected [::1]:443, got %s", got)
+	}
+}
+
+// TestProbeHandlerIsTLS tests ssl_probe_is_tls for a target that completes
+// the handshake
+func TestProbeHandlerIsTLS(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_probe_is_tls 1"); !ok {
+		t.Errorf("expected `ssl_probe_is_tls 1`")
+	}
+}
+
+// TestProbeHandlerIsTLSPlaintext tests ssl_probe_is_tls for a target that
+// answers with plaintext
+func TestProbeHandlerIsTLSPlaintext(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartPlaintext()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_probe_is_tls 0"); !ok {
+		t.Errorf("expected `ssl_probe_is_tls 0`")
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_tls_connect_success 0"); !ok {
+		t.Errorf("expected `ssl_tls_connect_success 0`")
+	}
+}
+
+// TestProbeHandlerIsTLSExpired tests that a certificate verification failure
+// still reports the target as TLS
+func TestProbeHandlerIsTLSExpired(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	certPEM, keyPEM := test.GenerateTestCertificate(time.Now().AddDate(0, 0, -1))
+	testcert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	server.TLS.Certificates = []tls.Certificate{testcert}
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_probe_is_tls 1"); !ok {
+		t.Errorf("expected `ssl_probe_is_tls 1`")
+	}
+}
+
+// TestProbeHandlerOCSPStapleStale tests ssl_ocsp_staple_stale for stapled
+// responses of different ages
+func TestProbeHandlerOCSPStapleStale(t *testing.T) {
+	for _, tc := range []struct {
+		thisUpdate time.Time
+		expected   string
+	}{
+		{time.Now().Add(-1 * time.Hour), "ssl_ocsp_staple_stale 0"},
+		{time.Now().Add(-100 * time.Hour), "ssl_ocsp_staple_stale 1"},
+	} {
+		server, certPEM, keyPEM, caFile, teardown, err := test.SetupTCPServer()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		block, _ := pem.Decode(certPEM)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		block, _ = pem.Decode(keyPEM)
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		staple, err := ocsp.CreateResponse(cert, cert, ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: cert.SerialNumber,
+			ThisUpdate:   tc.thisUpdate,
+			NextUpdate:   tc.thisUpdate.Add(168 * time.Hour),
+		}, key)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		server.TLS.Certificates[0].OCSPStaple = staple
+
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"tcp": config.Module{
+					Prober: "tcp",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile: caFile,
+					},
+				},
+			},
+		}
+
+		*ocspMaxStapleAge = 72 * time.Hour
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		*ocspMaxStapleAge = 0
+		server.Close()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if ok := strings.Contains(rr.Body.String(), tc.expected); !ok {
+			t.Errorf("expected `%s`", tc.expected)
+		}
+
+		// The nextUpdate is a week after the thisUpdate
+		untilStale := time.Until(tc.thisUpdate.Add(168 * time.Hour)).Seconds()
+		found := false
+		for _, line := range strings.Split(rr.Body.String(), "\n") {
+			if !strings.HasPrefix(line, "ssl_revocation_info_seconds_until_stale ") {
+				continue
+			}
+			found = true
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, "ssl_revocation_info_seconds_until_stale "), 64)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if value > untilStale+60 || value < untilStale-60 {
+				t.Errorf("expected ssl_revocation_info_seconds_until_stale to be about %v but got %v", untilStale, value)
+			}
+		}
+		if !found {
+			t.Errorf("expected `ssl_revocation_info_seconds_until_stale`")
+		}
+
+		// The producedAt is set to the current time, truncated to the
+		// minute, when the response is created
+		found = false
+		for _, line := range strings.Split(rr.Body.String(), "\n") {
+			if !strings.HasPrefix(line, "ssl_ocsp_produced_at_skew_seconds ") {
+				continue
+			}
+			found = true
+			value, err := strconv.ParseFloat(strings.TrimPrefix(line, "ssl_ocsp_produced_at_skew_seconds "), 64)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			if value < 0 || value > 120 {
+				t.Errorf("expected ssl_ocsp_produced_at_skew_seconds to be between 0 and 120 but got %v", value)
+			}
+		}
+		if !found {
+			t.Errorf("expected `ssl_ocsp_produced_at_skew_seconds`")
+		}
+	}
+}
+
+// TestProbeHandlerOCSPNoStaple tests that ssl_ocsp_staple_stale is absent when
+// the target doesn't staple a response
+func TestProbeHandlerOCSPNoStaple(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	*ocspMaxStapleAge = 72 * time.Hour
+	defer func() { *ocspMaxStapleAge = 0 }()
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_ocsp_staple_stale"); ok {
+		t.Errorf("unexpected `ssl_ocsp_staple_stale`")
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_revocation_info_seconds_until_stale"); ok {
+		t.Errorf("unexpected `ssl_revocation_info_seconds_until_stale`")
+	}
+}
+
+// TestProbeHandlerProbesInFlight tests that the in flight gauge counts the
+// probe while it is being performed
+func TestProbeHandlerProbesInFlight(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(probesInFlight)
+
+	inFlight := func() float64 {
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return mfs[0].GetMetric()[0].GetGauge().GetValue()
+	}
+
+	var during float64
+	prober.Probers["in_flight"] = func(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error) {
+		during = inFlight()
+		return nil, fmt.Errorf("in flight")
+	}
+	defer delete(prober.Probers, "in_flight")
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"in_flight": config.Module{
+				Prober: "in_flight",
+			},
+		},
+	}
+
+	if _, err := probe("localhost:6666", "in_flight", conf); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if during != 1 {
+		t.Errorf("expected 1 probe in flight during the probe, got %v", during)
+	}
+	if after := inFlight(); after != 0 {
+		t.Errorf("expected 0 probes in flight after the probe, got %v", after)
+	}
+}
+
+// TestProbeHandlerChainCompleteWithoutAIA tests a server that serves its
+// intermediate and one that relies on clients fetching it
+func TestProbeHandlerChainCompleteWithoutAIA(t *testing.T) {
+	rootPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rootCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 5))
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.SerialNumber = big.NewInt(1)
+	rootCert, rootCertPem := test.GenerateSelfSignedCertificateWithPrivateKey(rootCertTmpl, rootPrivateKey)
+
+	intermediateCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 4))
+	intermediateCertTmpl.IsCA = true
+	intermediateCertTmpl.SerialNumber = big.NewInt(2)
+	intermediateCert, intermediateCertPem, intermediateKeyPem := test.GenerateSignedCertificate(intermediateCertTmpl, rootCert, rootPrivateKey)
+
+	block, _ := pem.Decode(intermediateKeyPem)
+	intermediateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	serverCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 3))
+	serverCertTmpl.SerialNumber = big.NewInt(3)
+	serverCertTmpl.IssuingCertificateURL = []string{"http://localhost:6666/intermediate.crt"}
+	_, serverCertPem, serverKey := test.GenerateSignedCertificate(serverCertTmpl, intermediateCert, intermediateKey)
+
+	for _, tc := range []struct {
+		certPem  []byte
+		expected string
+	}{
+		{bytes.Join([][]byte{serverCertPem, intermediateCertPem}, []byte("")), "ssl_cert_chain_complete_without_aia 1"},
+		{serverCertPem, "ssl_cert_chain_complete_without_aia 0"},
+	} {
+		server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(rootCertPem, tc.certPem, serverKey)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"tcp": config.Module{
+					Prober: "tcp",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile:             caFile,
+						InsecureSkipVerify: true,
+					},
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		server.Close()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if ok := strings.Contains(rr.Body.String(), tc.expected); !ok {
+			t.Errorf("expected `%s`", tc.expected)
+		}
+	}
+}
+
+// TestProbeHandlerSchemeSMTP tests inferring the STARTTLS protocol from the
+// target's scheme
+func TestProbeHandlerSchemeSMTP(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartSMTP()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe("smtp://"+server.Listener.Addr().String(), "", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_tls_connect_success 1"); !ok {
+		t.Errorf("expected `ssl_tls_connect_success 1`")
+	}
+}
+
+// TestProbeHandlerSchemeHTTPS tests inferring the https prober from the
+// target's scheme
+func TestProbeHandlerSchemeHTTPS(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.URL, "", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_prober{prober=\"https\"} 1"); !ok {
+		t.Errorf("expected `ssl_prober{prober=\"https\"} 1`")
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_tls_connect_success 1"); !ok {
+		t.Errorf("expected `ssl_tls_connect_success 1`")
+	}
+}
+
+// TestModuleFromScheme tests the module and target inferred from different
+// schemes
+func TestModuleFromScheme(t *testing.T) {
+	for _, tc := range []struct {
+		target   string
+		prober   string
+		startTLS string
+		expected string
+	}{
+		{"https://example.com/foo", "https", "", "https://example.com/foo"},
+		{"smtp://example.com", "tcp", "smtp", "example.com:25"},
+		{"smtp://example.com:587", "tcp", "smtp", "example.com:587"},
+		{"imap://example.com", "tcp", "imap", "example.com:143"},
+		{"rdp://example.com", "rdp", "", "example.com:3389"},
+		{"mssql://example.com", "mssql", "", "example.com:1433"},
+		{"tls://example.com:443", "tcp", "", "example.com:443"},
+		{"wss://example.com/socket", "websocket", "", "wss://example.com/socket"},
+		{"gopher://example.com:70", "tcp", "", "example.com:70"},
+	} {
+		module, target := moduleFromScheme(config.Module{Prober: "tcp"}, tc.target)
+		if module.Prober != tc.prober {
+			t.Errorf("%s: expected prober %s, got %s", tc.target, tc.prober, module.Prober)
+		}
+		if module.TCP.StartTLS != tc.startTLS {
+			t.Errorf("%s: expected starttls %q, got %q", tc.target, tc.startTLS, module.TCP.StartTLS)
+		}
+		if target != tc.expected {
+			t.Errorf("%s: expected target %s, got %s", tc.target, tc.expected, target)
+		}
+	}
+}
+
+// TestProbeHandlerTrustedIgnoringTime tests an expired certificate that is
+// otherwise trusted and one that isn't trusted at all
+func TestProbeHandlerTrustedIgnoringTime(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	certTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, -1))
+	certTmpl.NotBefore = time.Now().AddDate(0, 0, -2)
+	certTmpl.IsCA = true
+	_, certPEM := test.GenerateSelfSignedCertificateWithPrivateKey(certTmpl, privateKey)
+
+	otherCertPEM, _ := test.GenerateTestCertificate(time.Now().AddDate(0, 0, 1))
+
+	for _, tc := range []struct {
+		caPEM    []byte
+		expected string
+	}{
+		{certPEM, "ssl_cert_trusted_ignoring_time 1"},
+		{otherCertPEM, "ssl_cert_trusted_ignoring_time 0"},
+	} {
+		server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(tc.caPEM, certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"tcp": config.Module{
+					Prober: "tcp",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile:             caFile,
+						InsecureSkipVerify: true,
+					},
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		server.Close()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if ok := strings.Contains(rr.Body.String(), tc.expected); !ok {
+			t.Errorf("expected `%s`", tc.expected)
+		}
+	}
+}
+
+// TestProbeHandlerVerifiedChainIntermediateCount tests counting the
+// intermediates in a verified chain
+func TestProbeHandlerVerifiedChainIntermediateCount(t *testing.T) {
+	rootPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rootCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 5))
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.SerialNumber = big.NewInt(1)
+	rootCert, rootCertPem := test.GenerateSelfSignedCertificateWithPrivateKey(rootCertTmpl, rootPrivateKey)
+
+	intermediateCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 4))
+	intermediateCertTmpl.IsCA = true
+	intermediateCertTmpl.SerialNumber = big.NewInt(2)
+	intermediateCert, intermediateCertPem, intermediateKeyPem := test.GenerateSignedCertificate(intermediateCertTmpl, rootCert, rootPrivateKey)
+
+	block, _ := pem.Decode(intermediateKeyPem)
+	intermediateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	serverCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 3))
+	serverCertTmpl.SerialNumber = big.NewInt(3)
+	_, serverCertPem, serverKey := test.GenerateSignedCertificate(serverCertTmpl, intermediateCert, intermediateKey)
+
+	server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(
+		rootCertPem,
+		bytes.Join([][]byte{serverCertPem, intermediateCertPem}, []byte("")),
+		serverKey,
+	)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_verified_chain_intermediate_count{chain_no=\"0\"} 1"); !ok {
+		t.Errorf("expected `ssl_verified_chain_intermediate_count{chain_no=\"0\"} 1`")
+	}
+
+	rootFingerprint := sha256.Sum256(rootCert.Raw)
+	perRoot := fmt.Sprintf("ssl_verified_chains_per_root{root_fingerprint=\"%s\"} 1", hex.EncodeToString(rootFingerprint[:]))
+	if ok := strings.Contains(rr.Body.String(), perRoot); !ok {
+		t.Errorf("expected `%s`", perRoot)
+	}
+}
+
+// TestProbeHandlerWeakSignature tests a certificate signed with SHA-1 and one
+// signed with SHA-256
+func TestProbeHandlerWeakSignature(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	for _, tc := range []struct {
+		alg      x509.SignatureAlgorithm
+		expected string
+	}{
+		{x509.SHA1WithRSA, "} 1"},
+		{x509.SHA256WithRSA, "} 0"},
+	} {
+		certTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 1))
+		certTmpl.IsCA = true
+		certTmpl.SignatureAlgorithm = tc.alg
+		_, certPEM := test.GenerateSelfSignedCertificateWithPrivateKey(certTmpl, privateKey)
+
+		server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(certPEM, certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"tcp": config.Module{
+					Prober: "tcp",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile:             caFile,
+						InsecureSkipVerify: true,
+					},
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		server.Close()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		expected := "ssl_cert_weak_signature{cn=\"example.ribbybibby.me\""
+		found := false
+		for _, line := range strings.Split(rr.Body.String(), "\n") {
+			if strings.HasPrefix(line, expected) && strings.HasSuffix(line, tc.expected) {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected `%s...%s` for %s", expected, tc.expected, tc.alg)
+		}
+	}
+}
+
+// TestProbeHandlerHSTS tests that the HSTS metrics are exported when the
+// module asks for them
+func TestProbeHandlerHSTS(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+	})
+	server.StartTLS()
+	defer server.Close()
+
+	module := config.Module{
+		Prober: "https",
+		TLSConfig: pconfig.TLSConfig{
+			CAFile: caFile,
+		},
+	}
+
+	rr, err := probe(server.URL, "https", &config.Config{Modules: map[string]config.Module{"https": module}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if strings.Contains(rr.Body.String(), "ssl_probe_hsts") {
+		t.Errorf("expected no HSTS metrics when the module doesn't enable them")
+	}
+
+	module.HTTPS.HSTS = true
+	rr, err = probe(server.URL, "https", &config.Config{Modules: map[string]config.Module{"https": module}})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, m := range []string{"ssl_probe_hsts_enabled 1", "ssl_probe_hsts_max_age 3.1536e+07"} {
+		if ok := strings.Contains(rr.Body.String(), m); !ok {
+			t.Errorf("expected `%s`", m)
+		}
+	}
+}
+
+// TestProbeHandlerOpenMetrics tests that the probe handler responds in the
+// OpenMetrics format when the scraper asks for it
+func TestProbeHandlerOpenMetrics(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	req, err := http.NewRequest("GET", "/probe?module=tcp&target="+server.Listener.Addr().String(), nil)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+
+	rr := httptest.NewRecorder()
+	probeHandler(rr, req, conf)
+
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/openmetrics-text") {
+		t.Errorf("expected an OpenMetrics content type but got %s", ct)
+	}
+	for _, m := range []string{"# TYPE ssl_cert_not_after gauge", "ssl_tls_connect_success 1", "# EOF"} {
+		if ok := strings.Contains(rr.Body.String(), m); !ok {
+			t.Errorf("expected `%s`", m)
+		}
+	}
+}
+
+// TestProbeHandlerURISANs tests the count of URI SANs in a certificate
+func TestProbeHandlerURISANs(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	spiffe, err := url.Parse("spiffe://example.ribbybibby.me/server")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	certTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 1))
+	certTmpl.IsCA = true
+	certTmpl.URIs = []*url.URL{spiffe}
+	_, certPEM := test.GenerateSelfSignedCertificateWithPrivateKey(certTmpl, privateKey)
+
+	server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(certPEM, certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := "ssl_cert_uri_sans_count{cn=\"example.ribbybibby.me\""
+	found := false
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if strings.HasPrefix(line, expected) && strings.HasSuffix(line, "} 1") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected `%s...} 1`", expected)
+	}
+}
+
+// TestProbeHandlerFetchIntermediates tests that fetching a missing
+// intermediate is reported and the chain is verified
+func TestProbeHandlerFetchIntermediates(t *testing.T) {
+	rootPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rootCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 5))
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.SerialNumber = big.NewInt(1)
+	rootCert, rootCertPem := test.GenerateSelfSignedCertificateWithPrivateKey(rootCertTmpl, rootPrivateKey)
+
+	intermediateCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 4))
+	intermediateCertTmpl.IsCA = true
+	intermediateCertTmpl.SerialNumber = big.NewInt(2)
+	intermediateCert, intermediateCertPem, intermediateKeyPem := test.GenerateSignedCertificate(intermediateCertTmpl, rootCert, rootPrivateKey)
+
+	block, _ := pem.Decode(intermediateKeyPem)
+	intermediateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	aiaServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(intermediateCertPem)
+	}))
+	defer aiaServer.Close()
+
+	serverCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 3))
+	serverCertTmpl.SerialNumber = big.NewInt(3)
+	serverCertTmpl.IssuingCertificateURL = []string{aiaServer.URL + "/intermediate.pem"}
+	_, serverCertPem, serverKey := test.GenerateSignedCertificate(serverCertTmpl, intermediateCert, intermediateKey)
+
+	server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(rootCertPem, serverCertPem, serverKey)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				FetchIntermediates: true,
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, m := range []string{
+		"ssl_tls_connect_success 1",
+		"ssl_cert_required_aia_fetch 1",
+		"ssl_verified_chain_intermediate_count{chain_no=\"0\"} 1",
+	} {
+		if ok := strings.Contains(rr.Body.String(), m); !ok {
+			t.Errorf("expected `%s`", m)
+		}
+	}
+}
+
+// TestProbeHandlerFailureReason tests ssl_probe_failure_reason when the
+// prober doesn't trust the target's certificate
+func TestProbeHandlerFailureReason(t *testing.T) {
+	server, _, _, _, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_probe_failure_reason{reason=\"unknown_ca\"} 1"); !ok {
+		t.Errorf("expected `ssl_probe_failure_reason{reason=\"unknown_ca\"} 1`")
+	}
+}
+
+// TestGetFailureReason tests classifying the errors returned by the probers
+func TestGetFailureReason(t *testing.T) {
+	tests := []struct {
+		err    error
+		reason string
+	}{
+		{&net.OpError{Op: "remote error", Err: errors.New("tls: handshake failure")}, "handshake_failure"},
+		{&url.Error{Op: "Get", URL: "https://example.com", Err: &net.OpError{Op: "remote error", Err: errors.New("tls: protocol version not supported")}}, "protocol_version"},
+		{&net.OpError{Op: "remote error", Err: errors.New("tls: alert(200)")}, "unknown_alert"},
+		{x509.UnknownAuthorityError{}, "unknown_ca"},
+		{fmt.Errorf("tls: failed to verify certificate: %w", x509.CertificateInvalidError{Reason: x509.Expired}), "certificate_expired"},
+		{x509.CertificateInvalidError{Reason: x509.NotAuthorizedToSign}, "bad_certificate"},
+		{x509.HostnameError{Host: "example.com"}, "bad_certificate"},
+		{&prober.NotTLSError{Err: tls.RecordHeaderError{}}, "not_tls"},
+		{&prober.StalledError{ReadDeadline: time.Second, Err: context.DeadlineExceeded}, "handshake_stalled"},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "example.invalid"}}, "dns"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connection_refused"},
+		{&net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, "dns"},
+		{context.DeadlineExceeded, "timeout"},
+		{errors.New("something else"), "other"},
+	}
+
+	for _, tt := range tests {
+		if reason := getFailureReason(tt.err); reason != tt.reason {
+			t.Errorf("%s: expected %s but got %s", tt.err, tt.reason, reason)
+		}
+	}
+}
+
+// TestProbeHandlerSPKIPinned tests pinning the public key of the leaf
+// certificate
+func TestProbeHandlerSPKIPinned(t *testing.T) {
+	certPEM, keyPEM := test.GenerateTestCertificate(time.Now().AddDate(0, 0, 1))
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	for _, tc := range []struct {
+		pins     []string
+		strict   bool
+		expected []string
+	}{
+		{[]string{"AAAA", pin}, true, []string{"ssl_cert_spki_pinned 1", "ssl_tls_connect_success 1"}},
+		{[]string{strings.ToUpper(hex.EncodeToString(sum[:]))}, true, []string{"ssl_cert_spki_pinned 1", "ssl_tls_connect_success 1"}},
+		{[]string{"AAAA"}, false, []string{"ssl_cert_spki_pinned 0", "ssl_tls_connect_success 1"}},
+		{[]string{"AAAA"}, true, []string{"ssl_cert_spki_pinned 0", "ssl_tls_connect_success 0", "ssl_probe_failure_reason{reason=\"spki_pin_mismatch\"} 1"}},
+	} {
+		server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(certPEM, certPEM, keyPEM)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"tcp": config.Module{
+					Prober: "tcp",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile: caFile,
+					},
+					PinSPKISHA256: tc.pins,
+					PinSPKIStrict: tc.strict,
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		server.Close()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		for _, m := range tc.expected {
+			if ok := strings.Contains(rr.Body.String(), m); !ok {
+				t.Errorf("expected `%s` for pins %v", m, tc.pins)
+			}
+		}
+	}
+}
+
+// TestGetForwardSecrecy tests identifying cipher suites with forward secrecy
+func TestGetForwardSecrecy(t *testing.T) {
+	tests := []struct {
+		state    tls.ConnectionState
+		expected float64
+	}{
+		{tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256}, 1},
+		{tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, 1},
+		{tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305}, 1},
+		{tls.ConnectionState{Version: tls.VersionTLS12, CipherSuite: tls.TLS_RSA_WITH_AES_128_GCM_SHA256}, 0},
+		{tls.ConnectionState{Version: tls.VersionTLS10, CipherSuite: tls.TLS_RSA_WITH_AES_256_CBC_SHA}, 0},
+	}
+
+	for _, tt := range tests {
+		if fs := getForwardSecrecy(&tt.state); fs != tt.expected {
+			t.Errorf("%s: expected %v but got %v", tls.CipherSuiteName(tt.state.CipherSuite), tt.expected, fs)
+		}
+	}
+}
+
+// TestProbeHandlerSerialRotated tests ssl_cert_serial_rotated against the
+// serial of the test certificate, which is 100
+func TestProbeHandlerSerialRotated(t *testing.T) {
+	for _, tc := range []struct {
+		oldSerial string
+		expected  string
+	}{
+		{"100", "ssl_cert_serial_rotated 0"},
+		{"99", "ssl_cert_serial_rotated 1"},
+	} {
+		server, _, _, caFile, teardown, err := test.SetupTCPServer()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"tcp": config.Module{
+					Prober: "tcp",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile: caFile,
+					},
+					ExpectedNotSerial: tc.oldSerial,
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		server.Close()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if ok := strings.Contains(rr.Body.String(), tc.expected); !ok {
+			t.Errorf("expected `%s`", tc.expected)
+		}
+	}
+}
+
+// TestGetSerialRotated tests the formats accepted for the old serial number
+func TestGetSerialRotated(t *testing.T) {
+	cert := &x509.Certificate{SerialNumber: big.NewInt(0x0a1b2c)}
+
+	tests := []struct {
+		oldSerial string
+		rotated   float64
+		err       bool
+	}{
+		{"662316", 0, false},
+		{"0x0a1b2c", 0, false},
+		{"0A:1B:2C", 0, false},
+		{"662317", 1, false},
+		{"0a:1b:2d", 1, false},
+		{"not a serial", 0, true},
+	}
+
+	for _, tt := range tests {
+		rotated, err := getSerialRotated(cert, tt.oldSerial)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: unexpected error: %v", tt.oldSerial, err)
+		}
+		if rotated != tt.rotated {
+			t.Errorf("%s: expected %v but got %v", tt.oldSerial, tt.rotated, rotated)
+		}
+	}
+}
+
+// TestGetCNInSAN tests checking for the common name in the SANs
+func TestGetCNInSAN(t *testing.T) {
+	tests := []struct {
+		cert     *x509.Certificate
+		expected float64
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}, DNSNames: []string{"www.example.com", "Example.com"}}, 1},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}, DNSNames: []string{"www.example.com"}}, 0},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "127.0.0.1"}, IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}}, 1},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "127.0.0.1"}}, 0},
+		{&x509.Certificate{DNSNames: []string{"example.com"}}, 1},
+	}
+
+	for _, tt := range tests {
+		if inSAN := getCNInSAN(tt.cert); inSAN != tt.expected {
+			t.Errorf("%s: expected %v but got %v", tt.cert.Subject.CommonName, tt.expected, inSAN)
+		}
+	}
+}
+
+// TestGetLifetimeElapsed tests the fraction of a certificate's lifetime that
+// has elapsed
+func TestGetLifetimeElapsed(t *testing.T) {
+	notBefore := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: notBefore, NotAfter: notBefore.AddDate(0, 0, 100)}
+
+	tests := []struct {
+		now      time.Time
+		expected float64
+	}{
+		{notBefore.AddDate(0, 0, -1), 0},
+		{notBefore, 0},
+		{notBefore.AddDate(0, 0, 80), 0.8},
+		{notBefore.AddDate(0, 0, 100), 1},
+		{notBefore.AddDate(0, 0, 101), 1},
+	}
+
+	for _, tt := range tests {
+		if ratio := getLifetimeElapsed(cert, tt.now); ratio != tt.expected {
+			t.Errorf("%s: expected %v but got %v", tt.now, tt.expected, ratio)
+		}
+	}
+}
+
+// TestGetChainsPerRoot tests counting the chains that end at each root
+func TestGetChainsPerRoot(t *testing.T) {
+	leaf := &x509.Certificate{Raw: []byte("leaf")}
+	cross := &x509.Certificate{Raw: []byte("cross")}
+	rootA := &x509.Certificate{Raw: []byte("root a")}
+	rootB := &x509.Certificate{Raw: []byte("root b")}
+
+	fingerprint := func(cert *x509.Certificate) string {
+		sum := sha256.Sum256(cert.Raw)
+		return hex.EncodeToString(sum[:])
+	}
+
+	roots := getChainsPerRoot([][]*x509.Certificate{
+		{leaf, rootA},
+		{leaf, cross, rootA},
+		{leaf, cross, rootB},
+		{},
+	})
+	expected := map[string]float64{
+		fingerprint(rootA): 2,
+		fingerprint(rootB): 1,
+	}
+	if len(roots) != len(expected) {
+		t.Fatalf("expected %v but got %v", expected, roots)
+	}
+	for root, count := range expected {
+		if roots[root] != count {
+			t.Errorf("expected %v chains ending at %s but got %v", count, root, roots[root])
+		}
+	}
+}
+
+// TestGetRenewalWindowRemaining tests the fraction of the renewal window that
+// remains before a certificate expires
+func TestGetRenewalWindowRemaining(t *testing.T) {
+	notAfter := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	cert := &x509.Certificate{NotBefore: notAfter.AddDate(0, 0, -90), NotAfter: notAfter}
+	renewBefore := 30 * 24 * time.Hour
+
+	tests := []struct {
+		now      time.Time
+		expected float64
+	}{
+		{notAfter.AddDate(0, 0, -60), 1},
+		{notAfter.AddDate(0, 0, -30), 1},
+		{notAfter.AddDate(0, 0, -6), 0.2},
+		{notAfter, 0},
+		{notAfter.AddDate(0, 0, 1), 0},
+	}
+
+	for _, tt := range tests {
+		if ratio := getRenewalWindowRemaining(cert, renewBefore, tt.now); ratio != tt.expected {
+			t.Errorf("%s: expected %v but got %v", tt.now, tt.expected, ratio)
+		}
+	}
+}
+
+// TestProbeHandlerServerAcceptedSignatureSchemes tests exporting the
+// signature schemes from the server's CertificateRequest
+func TestProbeHandlerServerAcceptedSignatureSchemes(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.TLS.ClientAuth = tls.RequestClientCert
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, m := range []string{
+		"ssl_tls_connect_success 1",
+		"ssl_server_accepted_signature_schemes_info{scheme=\"ecdsa_secp256r1_sha256\"} 1",
+		"ssl_server_accepted_signature_schemes_info{scheme=\"rsa_pss_rsae_sha256\"} 1",
+	} {
+		if ok := strings.Contains(rr.Body.String(), m); !ok {
+			t.Errorf("expected `%s`", m)
+		}
+	}
+}
+
+// TestProbeHandlerMinDaysValid tests min_days_valid against a certificate
+// that expires in a day
+func TestProbeHandlerMinDaysValid(t *testing.T) {
+	for _, tc := range []struct {
+		minDays  int
+		fail     bool
+		expected []string
+	}{
+		{7, false, []string{"ssl_cert_below_min_days_valid 1", "ssl_tls_connect_success 1"}},
+		{7, true, []string{"ssl_cert_below_min_days_valid 1", "ssl_tls_connect_success 0", "ssl_probe_failure_reason{reason=\"min_days_valid\"} 1"}},
+		{0, true, []string{"ssl_tls_connect_success 1"}},
+	} {
+		server, _, _, caFile, teardown, err := test.SetupTCPServer()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"tcp": config.Module{
+					Prober: "tcp",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile: caFile,
+					},
+					MinDaysValid:     tc.minDays,
+					MinDaysValidFail: tc.fail,
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		server.Close()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		for _, m := range tc.expected {
+			if ok := strings.Contains(rr.Body.String(), m); !ok {
+				t.Errorf("expected `%s` with min_days_valid %d", m, tc.minDays)
+			}
+		}
+	}
+}
+
+// TestProbeHandlerCertAgeDays tests that the age of the leaf certificate is
+// observed by the histogram on the metrics path
+func TestProbeHandlerCertAgeDays(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(certAgeDays)
+
+	sampleCount := func() uint64 {
+		mfs, err := registry.Gather()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		return mfs[0].GetMetric()[0].GetHistogram().GetSampleCount()
+	}
+
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	before := sampleCount()
+
+	if _, err := probe(server.Listener.Addr().String(), "tcp", conf); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if after := sampleCount(); after != before+1 {
+		t.Errorf("expected one observation, got %d", after-before)
+	}
+}
+
+// TestGetIsACMEValidation tests detecting ACME TLS-ALPN-01 challenge
+// certificates
+func TestGetIsACMEValidation(t *testing.T) {
+	tests := []struct {
+		cert     *x509.Certificate
+		expected float64
+	}{
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "challenge"}, Extensions: []pkix.Extension{{Id: oidACMEIdentifier, Critical: true}}}, 1},
+		{&x509.Certificate{Subject: pkix.Name{CommonName: "example.com"}}, 0},
+	}
+
+	for _, tt := range tests {
+		if isACME := getIsACMEValidation(tt.cert); isACME != tt.expected {
+			t.Errorf("%s: expected %v but got %v", tt.cert.Subject.CommonName, tt.expected, isACME)
+		}
+	}
+}
+
+// TestProbeHandlerServerNames tests probing the target with each of the server
+// names in the module
+func TestProbeHandlerServerNames(t *testing.T) {
+	server, certPEM, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				ServerNames: []string{"example-2.ribbybibby.me", "wrong.ribbybibby.me"},
+			},
+		},
+	}
+
+	rr, err := probe(server.URL, "https", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	fingerprint := sha256.Sum256(block.Bytes)
+
+	for _, expected := range []string{
+		"ssl_sni_tls_connect_success{server_name=\"example-2.ribbybibby.me\"} 1",
+		"ssl_sni_tls_connect_success{server_name=\"wrong.ribbybibby.me\"} 0",
+		"ssl_sni_cert_fingerprint_info{fingerprint=\"" + hex.EncodeToString(fingerprint[:]) + "\",server_name=\"example-2.ribbybibby.me\"} 1",
+		"ssl_sni_cert_not_after{server_name=\"example-2.ribbybibby.me\"} " + strconv.FormatFloat(float64(cert.NotAfter.Unix()), 'g', -1, 64),
+	} {
+		if ok := strings.Contains(rr.Body.String(), expected); !ok {
+			t.Errorf("expected `%s`", expected)
+		}
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_sni_cert_fingerprint_info{fingerprint=\"" + hex.EncodeToString(fingerprint[:]) + "\",server_name=\"wrong.ribbybibby.me\"}"); ok {
+		t.Errorf("unexpected fingerprint for wrong.ribbybibby.me")
+	}
+}
+
+// TestProbeHandlerCheckTLS13 tests the additional TLS 1.3 handshake against
+// servers with and without TLS 1.3
+func TestProbeHandlerCheckTLS13(t *testing.T) {
+	for _, tc := range []struct {
+		maxVersion uint16
+		expected   string
+	}{
+		{0, "ssl_server_supports_tls13 1"},
+		{tls.VersionTLS12, "ssl_server_supports_tls13 0"},
+	} {
+		server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.TLS.MaxVersion = tc.maxVersion
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"https": config.Module{
+					Prober: "https",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile: caFile,
+					},
+					CheckTLS13: true,
+				},
+			},
+		}
+
+		rr, err := probe(server.URL, "https", conf)
+		server.Close()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if ok := strings.Contains(rr.Body.String(), tc.expected); !ok {
+			t.Errorf("expected `%s`", tc.expected)
+		}
+		if ok := strings.Contains(rr.Body.String(), "ssl_tls_connect_success 1"); !ok {
+			t.Errorf("expected `ssl_tls_connect_success 1`")
+		}
+	}
+}
+
+// TestProbeHandlerAIAInfo tests exporting the URLs in the Authority
+// Information Access extension of a certificate
+func TestProbeHandlerAIAInfo(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+
+	certTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 1))
+	certTmpl.IsCA = true
+	certTmpl.OCSPServer = []string{"http://ocsp.example.com", "http://ocsp2.example.com"}
+	certTmpl.IssuingCertificateURL = []string{"http://ca.example.com/ca.crt"}
+	_, certPEM := test.GenerateSelfSignedCertificateWithPrivateKey(certTmpl, privateKey)
+
+	server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(certPEM, certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := "ssl_cert_aia_info{ca_issuer=\",http://ca.example.com/ca.crt,\",cn=\"example.ribbybibby.me\""
+	found := false
+	for _, line := range strings.Split(rr.Body.String(), "\n") {
+		if strings.HasPrefix(line, expected) && strings.Contains(line, "ocsp_server=\",http://ocsp.example.com,http://ocsp2.example.com,\"") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected `%s...ocsp_server=...} 1`", expected)
+	}
+}
+
+// TestProbeHandlerVerifyCTInclusion tests that a certificate without embedded
+// SCTs isn't reported as logged
+func TestProbeHandlerVerifyCTInclusion(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				VerifyCTInclusion: true,
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "ssl_cert_ct_inclusion_verified 0"); !ok {
+		t.Errorf("expected `ssl_cert_ct_inclusion_verified 0`")
+	}
+}
+
+// TestJoinSANs tests the formats of the SAN labels
+func TestJoinSANs(t *testing.T) {
+	sans := []string{"www.example.com", "example.com", "www.example.com", "bad\nname.example.com"}
+
+	tests := []struct {
+		sanLabels config.SANLabels
+		expected  string
+	}{
+		{config.SANLabels{}, ",www.example.com,example.com,www.example.com,bad\nname.example.com,"},
+		{config.SANLabels{Canonical: true}, ",badname.example.com,example.com,www.example.com,"},
+		{config.SANLabels{TrimCommas: true}, "www.example.com,example.com,www.example.com,bad\nname.example.com"},
+		{config.SANLabels{Canonical: true, TrimCommas: true}, "badname.example.com,example.com,www.example.com"},
+	}
+
+	for _, tt := range tests {
+		if joined := joinSANs(sans, tt.sanLabels); joined != tt.expected {
+			t.Errorf("%+v: expected %q but got %q", tt.sanLabels, tt.expected, joined)
+		}
+	}
+
+	if joined := joinSANs(nil, config.SANLabels{Canonical: true}); joined != "" {
+		t.Errorf("expected an empty label for no SANs, got %q", joined)
+	}
+}
+
+// TestProbeHandlerDistinguishedNames tests exporting the subject and issuer
+// of a certificate as distinguished names
+func TestProbeHandlerDistinguishedNames(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupTCPServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	dn := "dn=\"CN=example.ribbybibby.me,OU=ribbybibbys org,O=ribbybibby\""
+	for _, name := range []string{"ssl_cert_subject_dn", "ssl_cert_issuer_dn"} {
+		found := false
+		for _, line := range strings.Split(rr.Body.String(), "\n") {
+			if strings.HasPrefix(line, name+"{") && strings.Contains(line, dn) && strings.HasSuffix(line, "} 1") {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected `%s{...%s...} 1`", name, dn)
+		}
+	}
+}
+
+// TestProbeHandlerZeroOnFailure tests that the certificates from the last
+// successful probe are exported with a value of 0 when a probe fails
+func TestProbeHandlerZeroOnFailure(t *testing.T) {
+	server, certPEM, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				ZeroOnFailure: true,
+			},
+		},
+	}
+
+	rr, err := probe(server.URL, "https", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ok := strings.Contains(rr.Body.String(), "ssl_tls_connect_success 1"); !ok {
+		t.Fatalf("expected `ssl_tls_connect_success 1`")
+	}
+
+	server.Close()
+
+	rr, err = probe(server.URL, "https", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if ok := strings.Contains(rr.Body.String(), "ssl_tls_connect_success 0"); !ok {
+		t.Errorf("expected `ssl_tls_connect_success 0`")
+	}
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, metric := range []string{"ssl_cert_not_after", "ssl_cert_not_before"} {
+		expected := regexp.MustCompile(metric + `{[^}]*serial_no="` + cert.SerialNumber.String() + `"} 0\n`)
+		if ok := expected.MatchString(rr.Body.String()); !ok {
+			t.Errorf("expected `%s{...,serial_no=\"%s\"} 0`", metric, cert.SerialNumber.String())
+		}
+	}
+}
+
+// TestProbeHandlerCertLabels tests that the certificate metrics only have the
+// labels selected in the module
+func TestProbeHandlerCertLabels(t *testing.T) {
+	server, certPEM, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				CertLabels: config.CertLabels{"serial_no", "issuer_cn", "cn"},
+			},
+		},
+	}
+
+	rr, err := probe(server.URL, "https", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, expected := range []string{
+		"ssl_cert_not_after{chain_index=\"0\",cn=\"example.ribbybibby.me\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"" + cert.SerialNumber.String() + "\"} " + strconv.FormatFloat(float64(cert.NotAfter.Unix()), 'g', -1, 64),
+		"ssl_cert_subject_dn{cn=\"example.ribbybibby.me\",dn=\"" + cert.Subject.String() + "\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"" + cert.SerialNumber.String() + "\"} 1",
+		"ssl_verified_cert_not_before{chain_no=\"0\",cn=\"example.ribbybibby.me\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"" + cert.SerialNumber.String() + "\"} " + strconv.FormatFloat(float64(cert.NotBefore.Unix()), 'g', -1, 64),
+	} {
+		if ok := strings.Contains(rr.Body.String(), expected); !ok {
+			t.Errorf("expected `%s`", expected)
+		}
+	}
+
+	if ok := strings.Contains(rr.Body.String(), "dnsnames="); ok {
+		t.Errorf("expected no dnsnames labels")
+	}
+}
+
+// TestProbeHandlerPeerCount tests counting the certificates sent by a server
+// that repeats one of them
+func TestProbeHandlerPeerCount(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	// Send the leaf certificate twice
+	cert := &server.TLS.Certificates[0]
+	cert.Certificate = append(cert.Certificate, cert.Certificate[0])
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.URL, "https", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, expected := range []string{
+		"ssl_cert_peer_count_raw 2",
+		"ssl_cert_peer_count 1",
+	} {
+		if ok := strings.Contains(rr.Body.String(), expected); !ok {
+			t.Errorf("expected `%s`", expected)
+		}
+	}
+}
+
+// TestProbeHandlerChainStatus tests the trust outcome of a complete chain, a
+// chain missing its intermediate and a self-signed certificate
+func TestProbeHandlerChainStatus(t *testing.T) {
+	rootPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rootCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 5))
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.SerialNumber = big.NewInt(1)
+	rootCert, rootCertPem := test.GenerateSelfSignedCertificateWithPrivateKey(rootCertTmpl, rootPrivateKey)
+
+	intermediateCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 4))
+	intermediateCertTmpl.IsCA = true
+	intermediateCertTmpl.SerialNumber = big.NewInt(2)
+	intermediateCert, intermediateCertPem, intermediateKeyPem := test.GenerateSignedCertificate(intermediateCertTmpl, rootCert, rootPrivateKey)
+
+	block, _ := pem.Decode(intermediateKeyPem)
+	intermediateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	serverCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 3))
+	serverCertTmpl.SerialNumber = big.NewInt(3)
+	_, serverCertPem, serverKey := test.GenerateSignedCertificate(serverCertTmpl, intermediateCert, intermediateKey)
+
+	selfSignedCertPem, selfSignedKey := test.GenerateTestCertificate(time.Now().AddDate(0, 0, 3))
+
+	for _, tc := range []struct {
+		certPem  []byte
+		keyPem   []byte
+		expected string
+	}{
+		{bytes.Join([][]byte{serverCertPem, intermediateCertPem}, []byte("")), serverKey, "ssl_probe_chain_status{status=\"verified\"} 1"},
+		{serverCertPem, serverKey, "ssl_probe_chain_status{status=\"incomplete\"} 1"},
+		{selfSignedCertPem, selfSignedKey, "ssl_probe_chain_status{status=\"untrusted\"} 1"},
+	} {
+		server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(rootCertPem, tc.certPem, tc.keyPem)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		defer teardown()
+
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"tcp": config.Module{
+					Prober: "tcp",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile:             caFile,
+						InsecureSkipVerify: true,
+					},
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		server.Close()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if ok := strings.Contains(rr.Body.String(), tc.expected); !ok {
+			t.Errorf("expected `%s`", tc.expected)
+		}
+	}
+}
+
+// TestProbeHandlerTimeoutParameter tests the precedence, validation and
+// clamping of the timeout parameter
+func TestProbeHandlerTimeoutParameter(t *testing.T) {
+	var got time.Duration
+	prober.Probers["timeout"] = func(ctx context.Context, target string, module config.Module, timeout time.Duration, ch chan<- prometheus.Metric) (*tls.ConnectionState, error) {
+		got = timeout
+		return nil, fmt.Errorf("timeout")
+	}
+	defer delete(prober.Probers, "timeout")
+
+	oldMaxTimeout := *maxTimeout
+	*maxTimeout = 30 * time.Second
+	defer func() { *maxTimeout = oldMaxTimeout }()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"timeout": config.Module{
+				Prober: "timeout",
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		param    string
+		header   string
+		code     int
+		expected time.Duration
+	}{
+		{"", "", http.StatusOK, 10 * time.Second},
+		{"5", "", http.StatusOK, 5 * time.Second},
+		{"2.5", "", http.StatusOK, 2500 * time.Millisecond},
+		{"5", "3", http.StatusOK, 3 * time.Second},
+		{"120", "", http.StatusOK, 30 * time.Second},
+		{"0", "", http.StatusBadRequest, 0},
+		{"-1", "", http.StatusBadRequest, 0},
+		{"NaN", "", http.StatusBadRequest, 0},
+		{"soon", "", http.StatusBadRequest, 0},
+	} {
+		got = 0
+
+		uri := "/probe?target=localhost:6666&module=timeout"
+		if tc.param != "" {
+			uri = uri + "&timeout=" + tc.param
+		}
+		req, err := http.NewRequest("GET", uri, nil)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if tc.header != "" {
+			req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", tc.header)
+		}
+
+		rr := httptest.NewRecorder()
+		probeHandler(rr, req, conf)
+
+		if rr.Code != tc.code {
+			t.Errorf("timeout=%q header=%q: expected status %d, got %d", tc.param, tc.header, tc.code, rr.Code)
+		}
+		if got != tc.expected {
+			t.Errorf("timeout=%q header=%q: expected timeout %s, got %s", tc.param, tc.header, tc.expected, got)
+		}
+	}
+}
+
+// TestMetricsHandlerDefaultMetrics tests leaving the default metrics and
+// build info out of the metrics path
+func TestMetricsHandlerDefaultMetrics(t *testing.T) {
+	for _, tc := range []struct {
+		disableDefaultMetrics bool
+		disableBuildInfo      bool
+		expected              []string
+		unexpected            []string
+	}{
+		{
+			expected: []string{"go_goroutines", "ssl_exporter_build_info", "promhttp_metric_handler_requests_total"},
+		},
+		{
+			disableDefaultMetrics: true,
+			expected:              []string{"ssl_exporter_build_info"},
+			unexpected:            []string{"go_goroutines", "process_", "promhttp_metric_handler_requests_total"},
+		},
+		{
+			disableDefaultMetrics: true,
+			disableBuildInfo:      true,
+			unexpected:            []string{"go_goroutines", "process_", "promhttp_metric_handler_requests_total", "ssl_exporter_build_info"},
+		},
+	} {
+		registry := newMetricsRegistry(tc.disableDefaultMetrics, tc.disableBuildInfo)
+		h := newMetricsHandler(registry, tc.disableDefaultMetrics)
+
+		// Scrape twice, so that the first scrape is counted
+		var rr *httptest.ResponseRecorder
+		for i := 0; i < 2; i++ {
+			req, err := http.NewRequest("GET", "/metrics", nil)
+			if err != nil {
+				t.Fatalf(err.Error())
+			}
+			rr = httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+		}
+
+		for _, name := range tc.expected {
+			if !strings.Contains(rr.Body.String(), name) {
+				t.Errorf("expected `%s` with disableDefaultMetrics=%t disableBuildInfo=%t", name, tc.disableDefaultMetrics, tc.disableBuildInfo)
+			}
+		}
+		for _, name := range tc.unexpected {
+			if strings.Contains(rr.Body.String(), name) {
+				t.Errorf("unexpected `%s` with disableDefaultMetrics=%t disableBuildInfo=%t", name, tc.disableDefaultMetrics, tc.disableBuildInfo)
+			}
+		}
+	}
+}
+
+// TestProbeHandlerSNIRequired tests the additional handshake without SNI
+func TestProbeHandlerSNIRequired(t *testing.T) {
+	for _, requireSNI := range []bool{true, false} {
+		server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		if requireSNI {
+			server.TLS.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				if hello.ServerName == "" {
+					return nil, fmt.Errorf("no server name")
+				}
+				return nil, nil
+			}
+		}
+		server.StartTLS()
+
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"sni": config.Module{
+					Prober: "https",
+					TLSConfig: pconfig.TLSConfig{
+						CAFile:     caFile,
+						ServerName: "example.ribbybibby.me",
+					},
+					CheckSNIRequired: true,
+				},
+			},
+		}
+
+		rr, err := probe(server.URL, "sni", conf)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		server.Close()
+		teardown()
+
+		expected := "ssl_probe_sni_required 0"
+		if requireSNI {
+			expected = "ssl_probe_sni_required 1"
+		}
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected `%s`", expected)
+		}
+		if !strings.Contains(rr.Body.String(), "ssl_tls_connect_success 1") {
+			t.Errorf("expected `ssl_tls_connect_success 1`")
+		}
+	}
+}
+
+// TestProbeHandlerChainIndex tests that the dates of the peer certificates
+// have their position in the chain presented by the target
+func TestProbeHandlerChainIndex(t *testing.T) {
+	rootPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rootCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 5))
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.SerialNumber = big.NewInt(1)
+	rootCert, rootCertPem := test.GenerateSelfSignedCertificateWithPrivateKey(rootCertTmpl, rootPrivateKey)
+
+	intermediateCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 4))
+	intermediateCertTmpl.IsCA = true
+	intermediateCertTmpl.SerialNumber = big.NewInt(2)
+	intermediateCert, intermediateCertPem, intermediateKeyPem := test.GenerateSignedCertificate(intermediateCertTmpl, rootCert, rootPrivateKey)
+
+	block, _ := pem.Decode(intermediateKeyPem)
+	intermediateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	serverCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 3))
+	serverCertTmpl.SerialNumber = big.NewInt(3)
+	_, serverCertPem, serverKey := test.GenerateSignedCertificate(serverCertTmpl, intermediateCert, intermediateKey)
+
+	server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(
+		rootCertPem,
+		bytes.Join([][]byte{serverCertPem, intermediateCertPem, rootCertPem}, []byte("")),
+		serverKey,
+	)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				CertLabels: config.CertLabels{"serial_no", "issuer_cn"},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, metric := range []string{
+		"ssl_cert_not_after{chain_index=\"0\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"3\"}",
+		"ssl_cert_not_after{chain_index=\"1\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"2\"}",
+		"ssl_cert_not_after{chain_index=\"2\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"1\"}",
+		"ssl_cert_not_before{chain_index=\"0\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"3\"}",
+		"ssl_cert_not_before{chain_index=\"1\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"2\"}",
+		"ssl_cert_not_before{chain_index=\"2\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"1\"}",
+	} {
+		if ok := strings.Contains(rr.Body.String(), metric); !ok {
+			t.Errorf("expected `%s`", metric)
+		}
+	}
+}
+
+// TestProbeHandlerSuccessRequiresInsecure tests detecting probes that only
+// succeed because verification is skipped
+func TestProbeHandlerSuccessRequiresInsecure(t *testing.T) {
+	for _, tc := range []struct {
+		insecure bool
+		withCA   bool
+		expected string
+	}{
+		{insecure: false, withCA: true, expected: "ssl_probe_success_requires_insecure 0"},
+		{insecure: true, withCA: true, expected: "ssl_probe_success_requires_insecure 0"},
+		{insecure: true, withCA: false, expected: "ssl_probe_success_requires_insecure 1"},
+	} {
+		server, _, _, caFile, teardown, err := test.SetupTCPServer()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+		server.StartTLS()
+
+		tlsConfig := pconfig.TLSConfig{InsecureSkipVerify: tc.insecure}
+		if tc.withCA {
+			tlsConfig.CAFile = caFile
+		}
+		conf := &config.Config{
+			Modules: map[string]config.Module{
+				"tcp": config.Module{
+					Prober:    "tcp",
+					TLSConfig: tlsConfig,
+				},
+			},
+		}
+
+		rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+		server.Close()
+		teardown()
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if ok := strings.Contains(rr.Body.String(), "ssl_tls_connect_success 1"); !ok {
+			t.Errorf("expected `ssl_tls_connect_success 1`")
+		}
+		if ok := strings.Contains(rr.Body.String(), tc.expected); !ok {
+			t.Errorf("expected `%s` with insecure_skip_verify %v and the CA %v", tc.expected, tc.insecure, tc.withCA)
+		}
+	}
+}
+
+// TestProbeHandlerDebugLog tests that a successful probe is logged at the
+// debug level
+func TestProbeHandlerDebugLog(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+			},
+		},
+	}
+
+	hook := &logHook{}
+	log.AddHook(hook)
+	if err := log.Base().SetLevel("debug"); err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer log.Base().SetLevel("info")
+
+	if _, err := probe(server.URL, "https", conf); err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	expected := fmt.Sprintf("msg=probe succeeded target=%s prober=https version=\"TLS 1.3\"", server.URL)
+	for _, msg := range hook.Messages(logrus.DebugLevel) {
+		if strings.Contains(msg, expected) {
+			return
+		}
+	}
+	t.Errorf("expected a debug message containing `%s`", expected)
+}
+
+// logHook records the messages that are logged
+type logHook struct {
+	mtx      sync.Mutex
+	messages map[logrus.Level][]string
+}
+
+func (h *logHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (h *logHook) Fire(entry *logrus.Entry) error {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	if h.messages == nil {
+		h.messages = map[logrus.Level][]string{}
+	}
+	h.messages[entry.Level] = append(h.messages[entry.Level], entry.Message)
+
+	return nil
+}
+
+// Messages returns the messages logged at the level
+func (h *logHook) Messages(level logrus.Level) []string {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	return append([]string{}, h.messages[level]...)
+}
+
+// TestProbeHandlerBudgetExhausted tests that ssl_probe_budget_exhausted is set
+// when the sub-probes run out of outbound requests
+func TestProbeHandlerBudgetExhausted(t *testing.T) {
+	server, _, _, caFile, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				ServerNames: []string{"example-2.ribbybibby.me", "example-3.ribbybibby.me"},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		limit    int
+		expected string
+	}{
+		{limit: 0, expected: ""},
+		{limit: 10, expected: "ssl_probe_budget_exhausted 0"},
+		{limit: 2, expected: "ssl_probe_budget_exhausted 1"},
+	} {
+		*maxOutboundRequests = tc.limit
+
+		rr, err := probe(server.URL, "https", conf)
+		if err != nil {
+			t.Fatalf(err.Error())
+		}
+
+		if tc.expected == "" {
+			if strings.Contains(rr.Body.String(), "ssl_probe_budget_exhausted") {
+				t.Errorf("unexpected ssl_probe_budget_exhausted without a limit")
+			}
+			continue
+		}
+		if ok := strings.Contains(rr.Body.String(), tc.expected); !ok {
+			t.Errorf("expected `%s` with a limit of %d", tc.expected, tc.limit)
+		}
+	}
+	*maxOutboundRequests = 0
+}
+
+// TestProbeHandlerCertLabelsChain tests that the certificates in a chain don't
+// collide when only the required cert labels are selected
+func TestProbeHandlerCertLabelsChain(t *testing.T) {
+	rootPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rootCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 5))
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.SerialNumber = big.NewInt(1)
+	rootCert, rootCertPem := test.GenerateSelfSignedCertificateWithPrivateKey(rootCertTmpl, rootPrivateKey)
+
+	intermediateCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 4))
+	intermediateCertTmpl.IsCA = true
+	intermediateCertTmpl.SerialNumber = big.NewInt(2)
+	intermediateCert, intermediateCertPem, intermediateKeyPem := test.GenerateSignedCertificate(intermediateCertTmpl, rootCert, rootPrivateKey)
+
+	block, _ := pem.Decode(intermediateKeyPem)
+	intermediateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	serverCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 3))
+	serverCertTmpl.SerialNumber = big.NewInt(3)
+	_, serverCertPem, serverKey := test.GenerateSignedCertificate(serverCertTmpl, intermediateCert, intermediateKey)
+
+	server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(
+		rootCertPem,
+		bytes.Join([][]byte{serverCertPem, intermediateCertPem}, []byte("")),
+		serverKey,
+	)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				CertLabels: config.CertLabels{"serial_no", "issuer_cn"},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	if rr.Code != 200 {
+		t.Fatalf("expected 200 status code, got %v", rr.Code)
+	}
+
+	for _, metric := range []string{
+		"ssl_cert_weak_signature{issuer_cn=\"example.ribbybibby.me\",serial_no=\"3\"} 0",
+		"ssl_cert_weak_signature{issuer_cn=\"example.ribbybibby.me\",serial_no=\"2\"} 0",
+		"ssl_cert_uri_sans_count{issuer_cn=\"example.ribbybibby.me\",serial_no=\"3\"}",
+		"ssl_cert_uri_sans_count{issuer_cn=\"example.ribbybibby.me\",serial_no=\"2\"}",
+		"ssl_verified_cert_not_before{chain_no=\"0\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"3\"}",
+		"ssl_verified_cert_not_before{chain_no=\"0\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"2\"}",
+		"ssl_verified_cert_not_before{chain_no=\"0\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"1\"}",
+	} {
+		if ok := strings.Contains(rr.Body.String(), metric); !ok {
+			t.Errorf("expected `%s`", metric)
+		}
+	}
+}
+
+// TestProbeHandlerChainIndexDuplicate tests that the position of a certificate
+// in the chain is the one presented by the target when the chain contains a
+// duplicate
+func TestProbeHandlerChainIndexDuplicate(t *testing.T) {
+	rootPrivateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	rootCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 5))
+	rootCertTmpl.IsCA = true
+	rootCertTmpl.SerialNumber = big.NewInt(1)
+	rootCert, rootCertPem := test.GenerateSelfSignedCertificateWithPrivateKey(rootCertTmpl, rootPrivateKey)
+
+	intermediateCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 4))
+	intermediateCertTmpl.IsCA = true
+	intermediateCertTmpl.SerialNumber = big.NewInt(2)
+	intermediateCert, intermediateCertPem, intermediateKeyPem := test.GenerateSignedCertificate(intermediateCertTmpl, rootCert, rootPrivateKey)
+
+	block, _ := pem.Decode(intermediateKeyPem)
+	intermediateKey, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	serverCertTmpl := test.GenerateCertificateTemplate(time.Now().AddDate(0, 0, 3))
+	serverCertTmpl.SerialNumber = big.NewInt(3)
+	_, serverCertPem, serverKey := test.GenerateSignedCertificate(serverCertTmpl, intermediateCert, intermediateKey)
+
+	server, caFile, teardown, err := test.SetupTCPServerWithCertAndKey(
+		rootCertPem,
+		bytes.Join([][]byte{serverCertPem, serverCertPem, intermediateCertPem, rootCertPem}, []byte("")),
+		serverKey,
+	)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"tcp": config.Module{
+				Prober: "tcp",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile: caFile,
+				},
+				CertLabels: config.CertLabels{"serial_no", "issuer_cn"},
+			},
+		},
+	}
+
+	rr, err := probe(server.Listener.Addr().String(), "tcp", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+
+	for _, metric := range []string{
+		"ssl_cert_not_after{chain_index=\"0\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"3\"}",
+		"ssl_cert_not_after{chain_index=\"2\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"2\"}",
+		"ssl_cert_not_after{chain_index=\"3\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"1\"}",
+		"ssl_cert_not_before{chain_index=\"0\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"3\"}",
+		"ssl_cert_not_before{chain_index=\"2\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"2\"}",
+		"ssl_cert_not_before{chain_index=\"3\",issuer_cn=\"example.ribbybibby.me\",serial_no=\"1\"}",
+		"ssl_cert_peer_count_raw 4",
+		"ssl_cert_peer_count 3",
+	} {
+		if ok := strings.Contains(rr.Body.String(), metric); !ok {
+			t.Errorf("expected `%s`", metric)
+		}
+	}
+
+	if strings.Contains(rr.Body.String(), "chain_index=\"1\"") {
+		t.Errorf("expected no certificate at the position of the duplicate")
+	}
+}
+
+func checkDates(certPEM []byte, body string) error {
+	// Check notAfter and notBefore metrics
+	block, _ := pem.Decode(certPEM)
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return err
+	}
+	notAfter := strconv.FormatFloat(float64(cert.NotAfter.UnixNano()/1e9), 'g', -1, 64)
+	if ok := strings.Contains(body, "ssl_cert_not_after{chain_index=\"0\",cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"100\"} "+notAfter); !ok {
+		return fmt.Errorf("expected `ssl_cert_not_after{chain_index=\"0\",cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"100\"} " + notAfter + "`")
+	}
+	notBefore := strconv.FormatFloat(float64(cert.NotBefore.UnixNano()/1e9), 'g', -1, 64)
+	if ok := strings.Contains(body, "ssl_cert_not_before{chain_index=\"0\",cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"100\"} "+notBefore); !ok {
+		return fmt.Errorf("expected `ssl_cert_not_before{chain_index=\"0\",cn=\"example.ribbybibby.me\",dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\",emails=\",me@ribbybibby.me,example@ribbybibby.me,\",ips=\",127.0.0.1,::1,\",issuer_cn=\"example.ribbybibby.me\",ou=\",ribbybibbys org,\",serial_no=\"100\"} " + notBefore + "`")
+	}
+	return nil
+}
+
+func checkVerifiedChainDates(verifiedChains [][]*x509.Certificate, body string) error {
+	for i, chain := range verifiedChains {
+		for _, cert := range chain {
+			notAfter := strconv.FormatFloat(float64(cert.NotAfter.UnixNano()/1e9), 'g', -1, 64)
+			notAfterMetric := "ssl_verified_cert_not_after{" + strings.Join([]string{
+				"chain_no=\"" + strconv.Itoa(i) + "\"",
+				"cn=\"example.ribbybibby.me\"",
+				"dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\"",
+				"emails=\",me@ribbybibby.me,example@ribbybibby.me,\"",
+				"ips=\",127.0.0.1,::1,\"",
+				"issuer_cn=\"example.ribbybibby.me\"",
+				"ou=\",ribbybibbys org,\"",
+				"serial_no=\"" + cert.SerialNumber.String() + "\"",
+			}, ",") + "} " + notAfter
+			if ok := strings.Contains(body, notAfter); !ok {
+				return fmt.Errorf("expected `%s` in: %s", notAfterMetric, body)
+			}
+
+			notBefore := strconv.FormatFloat(float64(cert.NotBefore.UnixNano()/1e9), 'g', -1, 64)
+			notBeforeMetric := "ssl_verified_cert_not_before{" + strings.Join([]string{
+				"chain_no=\"" + strconv.Itoa(i) + "\"",
+				"cn=\"example.ribbybibby.me\"",
+				"dnsnames=\",example.ribbybibby.me,example-2.ribbybibby.me,example-3.ribbybibby.me,\"",
+				"emails=\",me@ribbybibby.me,example@ribbybibby.me,\"",
+				"ips=\",127.0.0.1,::1,\"",
+				"issuer_cn=\"example.ribbybibby.me\"",
+				"ou=\",ribbybibbys org,\"",
+				"serial_no=\"" + cert.SerialNumber.String() + "\"",
+			}, ",") + "} " + notBefore
+			if ok := strings.Contains(body, notBeforeMetric); !ok {
+				return fmt.Errorf("expected `%s` in: %s", notBeforeMetric, body)
+			}
+		}
+
+		chainNotAfterMetric := "ssl_verified_chain_not_after{chain_no=\"" + strconv.Itoa(i) + "\"} " + strconv.FormatFloat(float64(earliestExpiry(chain).Unix()), 'g', -1, 64)
+		if ok := strings.Contains(body, chainNotAfterMetric); !ok {
+			return fmt.Errorf("expected `%s` in: %s", chainNotAfterMetric, body)
+		}
+
+		chainNotBeforeMetric := "ssl_verified_chain_not_before{chain_no=\"" + strconv.Itoa(i) + "\"} " + strconv.FormatFloat(float64(latestNotBefore(chain).Unix()), 'g', -1, 64)
+		if ok := strings.Contains(body, chainNotBeforeMetric); !ok {
+			return fmt.Errorf("expected `%s` in: %s", chainNotBeforeMetric, body)
 		}
 	}
 
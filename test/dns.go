@@ -0,0 +1,151 @@
+package test
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+)
+
+// DNSServer is a minimal DNS server that answers every A query with the same
+// address. HTTPS and CAA queries are answered with the records set with
+// SetECHConfigList and SetCAA.
+type DNSServer struct {
+	Conn net.PacketConn
+	IP   net.IP
+
+	mtx           sync.Mutex
+	echConfigList []byte
+	caa           map[string][]string
+}
+
+// SetupDNSServer sets up a DNS server for testing that resolves every name to
+// the given IPv4 address
+func SetupDNSServer(ip net.IP) (*DNSServer, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	server := &DNSServer{
+		Conn: conn,
+		IP:   ip.To4(),
+	}
+	go server.serve()
+
+	return server, nil
+}
+
+// SetECHConfigList answers HTTPS queries with a record that has the
+// ECHConfigList in its ech parameter
+func (d *DNSServer) SetECHConfigList(configList []byte) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	d.echConfigList = configList
+}
+
+// SetCAA answers CAA queries for the name with the records, each a tag and
+// value separated by a space
+func (d *DNSServer) SetCAA(name string, records ...string) {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+	if d.caa == nil {
+		d.caa = map[string][]string{}
+	}
+	d.caa[name] = records
+}
+
+// Close stops the server
+func (d *DNSServer) Close() {
+	d.Conn.Close()
+}
+
+func (d *DNSServer) serve() {
+	buf := make([]byte, 512)
+	for {
+		n, addr, err := d.Conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if resp := d.answer(buf[:n]); resp != nil {
+			d.Conn.WriteTo(resp, addr)
+		}
+	}
+}
+
+// answer builds a response to a query with a single question. A queries are
+// answered with the server's address, HTTPS queries with the ECHConfigList,
+// CAA queries with the records for the name and every other type with no
+// records.
+func (d *DNSServer) answer(query []byte) []byte {
+	d.mtx.Lock()
+	defer d.mtx.Unlock()
+
+	if len(query) < 12 {
+		return nil
+	}
+
+	// Find the end of the question, which is the name followed by the
+	// type and class
+	end := 12
+	var labels []string
+	for end < len(query) && query[end] != 0 {
+		if next := end + int(query[end]) + 1; next <= len(query) {
+			labels = append(labels, string(query[end+1:next]))
+		}
+		end += int(query[end]) + 1
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+
+	resp := make([]byte, end)
+	copy(resp, query[:end])
+	// Response, recursion desired and available
+	binary.BigEndian.PutUint16(resp[2:], 0x8180)
+	binary.BigEndian.PutUint16(resp[6:], 0)
+	binary.BigEndian.PutUint16(resp[8:], 0)
+	binary.BigEndian.PutUint16(resp[10:], 0)
+
+	if qtype == 1 {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		// A pointer to the name in the question, type A, class IN, a TTL of
+		// 60 seconds and the address
+		resp = append(resp, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x04)
+		resp = append(resp, d.IP...)
+	}
+
+	if qtype == 65 && d.echConfigList != nil {
+		binary.BigEndian.PutUint16(resp[6:], 1)
+		// A priority of 1, the root as the target name and the ech
+		// parameter
+		rdata := []byte{0x00, 0x01, 0x00, 0x00, 0x05, 0x00, 0x00}
+		binary.BigEndian.PutUint16(rdata[5:], uint16(len(d.echConfigList)))
+		rdata = append(rdata, d.echConfigList...)
+
+		resp = append(resp, 0xc0, 0x0c, 0x00, 0x41, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x00)
+		binary.BigEndian.PutUint16(resp[len(resp)-2:], uint16(len(rdata)))
+		resp = append(resp, rdata...)
+	}
+
+	if records := d.caa[strings.Join(labels, ".")]; qtype == 257 && len(records) > 0 {
+		binary.BigEndian.PutUint16(resp[6:], uint16(len(records)))
+		for _, record := range records {
+			tag, value := record, ""
+			if i := strings.Index(record, " "); i >= 0 {
+				tag, value = record[:i], record[i+1:]
+			}
+			// No flags, the tag and the value
+			rdata := append([]byte{0x00, byte(len(tag))}, tag...)
+			rdata = append(rdata, value...)
+
+			resp = append(resp, 0xc0, 0x0c, 0x01, 0x01, 0x00, 0x01, 0x00, 0x00, 0x00, 0x3c, 0x00, 0x00)
+			binary.BigEndian.PutUint16(resp[len(resp)-2:], uint16(len(rdata)))
+			resp = append(resp, rdata...)
+		}
+	}
+
+	return resp
+}
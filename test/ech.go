@@ -0,0 +1,50 @@
+//go:build go1.24
+// +build go1.24
+
+package test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+)
+
+// GenerateECHKey generates an X25519 key for Encrypted Client Hello. It
+// returns the ECHConfigList that a client uses to encrypt the client hello
+// and the key that the server decrypts it with.
+//
+// See https://datatracker.ietf.org/doc/html/draft-ietf-tls-esni-22#section-4
+func GenerateECHKey(configID uint8, publicName string) ([]byte, tls.EncryptedClientHelloKey, error) {
+	privateKey, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, tls.EncryptedClientHelloKey{}, err
+	}
+	publicKey := privateKey.PublicKey().Bytes()
+
+	// The key config: the id, the DHKEM(X25519, HKDF-SHA256) KEM, the public
+	// key and a single HKDF-SHA256 and AES-128-GCM cipher suite
+	contents := []byte{configID, 0x00, 0x20}
+	contents = appendUint16Prefixed(contents, publicKey)
+	contents = appendUint16Prefixed(contents, []byte{0x00, 0x01, 0x00, 0x01})
+	// The maximum name length, the public name and no extensions
+	contents = append(contents, 0, byte(len(publicName)))
+	contents = append(contents, publicName...)
+	contents = append(contents, 0x00, 0x00)
+
+	// The version of the draft that crypto/tls implements
+	echConfig := []byte{0xfe, 0x0d}
+	echConfig = appendUint16Prefixed(echConfig, contents)
+
+	key := tls.EncryptedClientHelloKey{
+		Config:     echConfig,
+		PrivateKey: privateKey.Bytes(),
+	}
+
+	return appendUint16Prefixed(nil, echConfig), key, nil
+}
+
+func appendUint16Prefixed(b, data []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
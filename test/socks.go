@@ -0,0 +1,172 @@
+package test
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SOCKS5Server is a SOCKS5 proxy that accepts any username and password and
+// records the credentials of each connection
+type SOCKS5Server struct {
+	Listener net.Listener
+
+	mtx         sync.Mutex
+	credentials []string
+}
+
+// SetupSOCKS5Server starts a SOCKS5 proxy on a local port
+func SetupSOCKS5Server() (*SOCKS5Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SOCKS5Server{Listener: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+
+	return s, nil
+}
+
+// Credentials returns the username:password of each connection that
+// authenticated, in the order they connected
+func (s *SOCKS5Server) Credentials() []string {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	return append([]string{}, s.credentials...)
+}
+
+// Close stops the proxy
+func (s *SOCKS5Server) Close() {
+	s.Listener.Close()
+}
+
+func (s *SOCKS5Server) serve(conn net.Conn) {
+	defer conn.Close()
+
+	dest, err := s.handshake(conn)
+	if err != nil {
+		return
+	}
+
+	destConn, err := net.DialTimeout("tcp", dest, 10*time.Second)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer destConn.Close()
+
+	if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return
+	}
+
+	go io.Copy(destConn, conn)
+	io.Copy(conn, destConn)
+}
+
+// handshake negotiates the authentication method, authenticates the client
+// with a username and password when it offers them and returns the address
+// that it asks to connect to
+func (s *SOCKS5Server) handshake(conn net.Conn) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", err
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", err
+	}
+
+	method := byte(0)
+	for _, m := range methods {
+		if m == 2 {
+			method = 2
+		}
+	}
+	if _, err := conn.Write([]byte{5, method}); err != nil {
+		return "", err
+	}
+
+	if method == 2 {
+		username, err := readSOCKSString(conn, 1)
+		if err != nil {
+			return "", err
+		}
+		password, err := readSOCKSString(conn, 0)
+		if err != nil {
+			return "", err
+		}
+		s.mtx.Lock()
+		s.credentials = append(s.credentials, username+":"+password)
+		s.mtx.Unlock()
+		if _, err := conn.Write([]byte{1, 0}); err != nil {
+			return "", err
+		}
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", err
+	}
+	if request[1] != 1 {
+		return "", fmt.Errorf("unsupported command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, net.IPv4len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	case 3:
+		name, err := readSOCKSString(conn, 0)
+		if err != nil {
+			return "", err
+		}
+		host = name
+	case 4:
+		ip := make([]byte, net.IPv6len)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", err
+		}
+		host = net.IP(ip).String()
+	default:
+		return "", fmt.Errorf("unsupported address type %d", request[3])
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))), nil
+}
+
+// readSOCKSString reads a length prefixed string, after skipping the given
+// number of bytes
+func readSOCKSString(conn net.Conn, skip int) (string, error) {
+	b := make([]byte, skip+1)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return "", err
+	}
+	s := make([]byte, b[skip])
+	if _, err := io.ReadFull(conn, s); err != nil {
+		return "", err
+	}
+	return string(s), nil
+}
@@ -0,0 +1,176 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SSHBastion is an SSH server that forwards direct-tcpip channels to their
+// destination
+type SSHBastion struct {
+	Listener       net.Listener
+	PrivateKeyFile string
+	KnownHostsFile string
+
+	mtx         sync.Mutex
+	connections int
+	channels    int
+}
+
+// SetupSSHBastion starts a bastion that accepts the client key in
+// PrivateKeyFile and whose host key is in KnownHostsFile
+func SetupSSHBastion() (*SSHBastion, func(), error) {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	privateKeyFile, err := WriteFile("ssh_key", pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		ln.Close()
+		return nil, nil, err
+	}
+	knownHostsFile, err := WriteFile("known_hosts", []byte(knownhosts.Line([]string{ln.Addr().String()}, hostSigner.PublicKey())+"\n"))
+	if err != nil {
+		ln.Close()
+		os.Remove(privateKeyFile)
+		return nil, nil, err
+	}
+
+	b := &SSHBastion{
+		Listener:       ln,
+		PrivateKeyFile: privateKeyFile,
+		KnownHostsFile: knownHostsFile,
+	}
+
+	serverConfig := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) != string(clientSigner.PublicKey().Marshal()) {
+				return nil, fmt.Errorf("unknown public key for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	serverConfig.AddHostKey(hostSigner)
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn, serverConfig)
+		}
+	}()
+
+	teardown := func() {
+		ln.Close()
+		os.Remove(privateKeyFile)
+		os.Remove(knownHostsFile)
+	}
+
+	return b, teardown, nil
+}
+
+// Connections returns the number of SSH connections that have been accepted
+func (b *SSHBastion) Connections() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.connections
+}
+
+// Channels returns the number of channels that have been forwarded
+func (b *SSHBastion) Channels() int {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.channels
+}
+
+// serve forwards the direct-tcpip channels opened on the connection
+func (b *SSHBastion) serve(conn net.Conn, serverConfig *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, serverConfig)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	b.mtx.Lock()
+	b.connections++
+	b.mtx.Unlock()
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "direct-tcpip" {
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported channel type")
+			continue
+		}
+
+		var dest struct {
+			Host     string
+			Port     uint32
+			OrigHost string
+			OrigPort uint32
+		}
+		if err := ssh.Unmarshal(newChannel.ExtraData(), &dest); err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		target, err := net.Dial("tcp", net.JoinHostPort(dest.Host, fmt.Sprint(dest.Port)))
+		if err != nil {
+			newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			target.Close()
+			continue
+		}
+		go ssh.DiscardRequests(requests)
+
+		b.mtx.Lock()
+		b.channels++
+		b.mtx.Unlock()
+
+		go func() {
+			defer channel.Close()
+			defer target.Close()
+			go io.Copy(target, channel)
+			io.Copy(channel, target)
+		}()
+	}
+}
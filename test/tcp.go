@@ -2,7 +2,9 @@ package test
 
 import (
 	"crypto/tls"
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"time"
@@ -39,6 +41,39 @@ func (t *TCPServer) StartTLS() {
 	}()
 }
 
+// StartPlaintext starts a listener that responds with plaintext rather than
+// performing a TLS handshake
+func (t *TCPServer) StartPlaintext() {
+	go func() {
+		conn, err := t.Listener.Accept()
+		if err != nil {
+			panic(fmt.Sprintf("Error accepting on socket: %s", err))
+		}
+		defer conn.Close()
+
+		fmt.Fprintf(conn, "Hello World!\n")
+
+		t.stopCh <- struct{}{}
+	}()
+}
+
+// StartSlowBanner starts a listener that waits for the given delay before
+// sending an smtp greeting
+func (t *TCPServer) StartSlowBanner(delay time.Duration) {
+	go func() {
+		conn, err := t.Listener.Accept()
+		if err != nil {
+			panic(fmt.Sprintf("Error accepting on socket: %s", err))
+		}
+		defer conn.Close()
+
+		time.Sleep(delay)
+		fmt.Fprintf(conn, "220 ESMTP StartTLS pseudo-server\n")
+
+		t.stopCh <- struct{}{}
+	}()
+}
+
 // StartSMTP starts a listener that negotiates a TLS connection with an smtp
 // client using STARTTLS
 func (t *TCPServer) StartSMTP() {
@@ -136,6 +171,85 @@ func (t *TCPServer) StartIMAP() {
 	}()
 }
 
+// StartRDP starts a listener that negotiates a TLS connection with an rdp
+// client, selecting the given security protocol
+func (t *TCPServer) StartRDP(protocol uint32) {
+	go func() {
+		conn, err := t.Listener.Accept()
+		if err != nil {
+			panic(fmt.Sprintf("Error accepting on socket: %s", err))
+		}
+		defer conn.Close()
+
+		if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			panic("Error setting deadline")
+		}
+
+		// Read the TPKT header, X.224 Connection Request and RDP_NEG_REQ
+		req := make([]byte, 19)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			panic("Error in dialog. No RDP negotiation request received.")
+		}
+
+		// Respond with a X.224 Connection Confirm and RDP_NEG_RSP
+		rsp := []byte{
+			0x03, 0x00, 0x00, 0x13,
+			0x0e, 0xd0, 0x00, 0x00, 0x12, 0x34, 0x00,
+			0x02, 0x00, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00,
+		}
+		binary.LittleEndian.PutUint32(rsp[15:], protocol)
+		if _, err := conn.Write(rsp); err != nil {
+			panic("Error in dialog. Couldn't send RDP negotiation response.")
+		}
+
+		if protocol != 0 {
+			// Upgrade to TLS.
+			tlsConn := tls.Server(conn, t.TLS)
+			if err := tlsConn.Handshake(); err != nil {
+				log.Errorln(err)
+			}
+			defer tlsConn.Close()
+		}
+
+		t.stopCh <- struct{}{}
+	}()
+}
+
+// StartCassandra starts a listener that performs a TLS handshake and then
+// answers an OPTIONS request from a cassandra client with SUPPORTED, or with
+// an error when supported is false
+func (t *TCPServer) StartCassandra(supported bool) {
+	go func() {
+		ln := tls.NewListener(t.Listener, t.TLS)
+		conn, err := ln.Accept()
+		if err != nil {
+			panic(fmt.Sprintf("Error accepting on socket: %s", err))
+		}
+		defer conn.Close()
+
+		if err := conn.SetDeadline(time.Now().Add(5 * time.Second)); err != nil {
+			panic("Error setting deadline")
+		}
+
+		// The client may close the connection after the handshake
+		// without sending a request
+		req := make([]byte, 9)
+		if _, err := io.ReadFull(conn, req); err == nil {
+			rsp := []byte{0x84, 0x00, req[2], req[3], 0x06, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00}
+			if !supported {
+				msg := "unavailable"
+				rsp = []byte{0x84, 0x00, req[2], req[3], 0x00, 0x00, 0x00, 0x00, byte(6 + len(msg)), 0x00, 0x00, 0x10, 0x00, 0x00, byte(len(msg))}
+				rsp = append(rsp, msg...)
+			}
+			if _, err := conn.Write(rsp); err != nil {
+				panic("Error in dialog. Couldn't send the response to OPTIONS.")
+			}
+		}
+
+		t.stopCh <- struct{}{}
+	}()
+}
+
 // Close stops the server and closes the listener
 func (t *TCPServer) Close() {
 	<-t.stopCh
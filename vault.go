@@ -0,0 +1,36 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/prober"
+)
+
+// newVaultClient creates the client that reads the vault:// references in the
+// modules. The token is read from the token file or, when there isn't one,
+// the VAULT_TOKEN environment variable. It isn't used with an AppRole.
+func newVaultClient(address, tokenFile, roleID, secretIDFile string, ttl time.Duration) (*prober.VaultClient, error) {
+	var token, secretID string
+	if tokenFile != "" {
+		b, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(b))
+	} else if roleID == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+
+	if secretIDFile != "" {
+		b, err := ioutil.ReadFile(secretIDFile)
+		if err != nil {
+			return nil, err
+		}
+		secretID = strings.TrimSpace(string(b))
+	}
+
+	return prober.NewVaultClient(address, token, roleID, secretID, ttl)
+}
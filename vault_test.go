@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	pconfig "github.com/prometheus/common/config"
+	"github.com/ribbybibby/ssl_exporter/config"
+	"github.com/ribbybibby/ssl_exporter/prober"
+	"github.com/ribbybibby/ssl_exporter/test"
+)
+
+// TestNewVaultClient tests that the Vault token is read from the token file
+// or the environment, and the secret ID of the AppRole from its file
+func TestNewVaultClient(t *testing.T) {
+	tokenFile, err := test.WriteFile("vault_token", []byte("token\n"))
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer os.Remove(tokenFile)
+
+	if _, err := newVaultClient("http://vault:8200", tokenFile, "", "", time.Minute); err != nil {
+		t.Errorf("unexpected error with a token file: %s", err)
+	}
+
+	if _, err := newVaultClient("http://vault:8200", "", "role", tokenFile, time.Minute); err != nil {
+		t.Errorf("unexpected error with an AppRole: %s", err)
+	}
+
+	os.Setenv("VAULT_TOKEN", "")
+	if _, err := newVaultClient("http://vault:8200", "", "", "", time.Minute); err == nil {
+		t.Errorf("expected an error without a token, but err was nil")
+	}
+
+	os.Setenv("VAULT_TOKEN", "token")
+	defer os.Unsetenv("VAULT_TOKEN")
+	if _, err := newVaultClient("http://vault:8200", "", "", "", time.Minute); err != nil {
+		t.Errorf("unexpected error with VAULT_TOKEN: %s", err)
+	}
+
+	if _, err := newVaultClient("http://vault:8200", "/does/not/exist", "", "", time.Minute); err == nil {
+		t.Errorf("expected an error with a missing token file, but err was nil")
+	}
+}
+
+// TestProbeHandlerVaultRoots tests that the CA file is read from Vault once for
+// the checks of the served chain, rather than once for each check
+func TestProbeHandlerVaultRoots(t *testing.T) {
+	server, certPEM, _, _, teardown, err := test.SetupHTTPSServer()
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer teardown()
+
+	server.StartTLS()
+	defer server.Close()
+
+	var (
+		mtx   sync.Mutex
+		reads int
+	)
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		reads++
+		mtx.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"data": map[string]interface{}{"ca": string(certPEM)},
+		})
+	}))
+	defer vault.Close()
+
+	// Secrets aren't cached without a TTL, so every read reaches Vault
+	prober.Vault, err = prober.NewVaultClient(vault.URL, "token", "", "", 0)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	defer func() { prober.Vault = nil }()
+
+	conf := &config.Config{
+		Modules: map[string]config.Module{
+			"https": config.Module{
+				Prober: "https",
+				TLSConfig: pconfig.TLSConfig{
+					CAFile:             "vault://kv/pki#ca",
+					InsecureSkipVerify: true,
+				},
+			},
+		},
+	}
+
+	rr, err := probe(server.URL, "https", conf)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	for _, expected := range []string{
+		"ssl_tls_connect_success 1",
+		"ssl_cert_chain_complete_without_aia 1",
+		"ssl_cert_trusted_ignoring_time 1",
+		"ssl_probe_success_requires_insecure 0",
+		"ssl_probe_chain_status{status=\"verified\"} 1",
+	} {
+		if ok := strings.Contains(rr.Body.String(), expected); !ok {
+			t.Errorf("expected `%s`", expected)
+		}
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+	// Once for the JA3 hash, once to make the connection and once for the
+	// checks
+	if reads != 3 {
+		t.Errorf("expected the CA file to be read from Vault 3 times, but it was read %d times", reads)
+	}
+}
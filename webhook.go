@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/ribbybibby/ssl_exporter/prober"
+)
+
+// alerter, when set, is notified of the result of every probe
+var alerter *webhookAlerter
+
+// webhookPayload is the JSON body posted to the webhook
+type webhookPayload struct {
+	Target              string `json:"target"`
+	Module              string `json:"module"`
+	Error               string `json:"error"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+}
+
+// webhookAlerter posts to a webhook when a target has failed for a number of
+// consecutive probes. Targets that haven't been probed for the retention
+// period are forgotten, unless it's 0.
+type webhookAlerter struct {
+	url       string
+	threshold int
+	retention time.Duration
+	client    *http.Client
+
+	mtx      sync.Mutex
+	failures map[string]*targetFailures
+}
+
+// targetFailures is the number of consecutive failed probes of a target and
+// when the last one was made
+type targetFailures struct {
+	count int
+	seen  time.Time
+}
+
+func newWebhookAlerter(url string, threshold int, retention time.Duration) *webhookAlerter {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &webhookAlerter{
+		url:       url,
+		threshold: threshold,
+		retention: retention,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		failures:  map[string]*targetFailures{},
+	}
+}
+
+// record tracks the result of a probe of the target with the given module. A
+// nil error is a success. The webhook is sent once, when the number of
+// consecutive failures reaches the threshold.
+func (w *webhookAlerter) record(target, module string, err error) {
+	key := module + "/" + target
+	now := time.Now()
+
+	w.mtx.Lock()
+	w.prune(now)
+	if err == nil {
+		delete(w.failures, key)
+		w.mtx.Unlock()
+		return
+	}
+	f, ok := w.failures[key]
+	if !ok {
+		f = &targetFailures{}
+		w.failures[key] = f
+	}
+	f.count++
+	f.seen = now
+	failures := f.count
+	w.mtx.Unlock()
+
+	if failures != w.threshold {
+		return
+	}
+
+	payload := webhookPayload{
+		Target:              target,
+		Module:              module,
+		Error:               err.Error(),
+		ConsecutiveFailures: failures,
+	}
+
+	// Send the webhook in the background so that it doesn't hold up the
+	// scrape
+	go func() {
+		if err := w.send(payload); err != nil {
+			log.Errorf("error=%s target=%s module=%s webhook=%s", err, target, module, w.url)
+		}
+	}()
+}
+
+// prune forgets the targets that haven't been probed within the retention
+// period. The caller must hold the lock.
+func (w *webhookAlerter) prune(now time.Time) {
+	if w.retention <= 0 {
+		return
+	}
+	for key, f := range w.failures {
+		if now.Sub(f.seen) > w.retention {
+			delete(w.failures, key)
+		}
+	}
+}
+
+func (w *webhookAlerter) send(payload webhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if prober.UserAgent != "" {
+		req.Header.Set("User-Agent", prober.UserAgent)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status code from webhook: %d", resp.StatusCode)
+	}
+
+	return nil
+}
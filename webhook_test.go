@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ribbybibby/ssl_exporter/config"
+)
+
+// TestWebhook tests that the webhook is sent once a target has failed for the
+// threshold number of consecutive probes
+func TestWebhook(t *testing.T) {
+	payloads := make(chan webhookPayload, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload webhookPayload
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf(err.Error())
+		}
+		payloads <- payload
+	}))
+	defer server.Close()
+
+	alerter = newWebhookAlerter(server.URL, 2, time.Hour)
+	defer func() { alerter = nil }()
+
+	for i := 0; i < 3; i++ {
+		if _, err := probe("localhost:6666", "tcp", config.DefaultConfig); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+
+	select {
+	case payload := <-payloads:
+		if payload.Target != "localhost:6666" {
+			t.Errorf("expected target localhost:6666, got %s", payload.Target)
+		}
+		if payload.Module != "tcp" {
+			t.Errorf("expected module tcp, got %s", payload.Module)
+		}
+		if payload.Error == "" {
+			t.Errorf("expected an error in the payload")
+		}
+		if payload.ConsecutiveFailures != 2 {
+			t.Errorf("expected 2 consecutive failures, got %d", payload.ConsecutiveFailures)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for the webhook")
+	}
+
+	select {
+	case <-payloads:
+		t.Errorf("expected only one webhook")
+	case <-time.After(500 * time.Millisecond):
+	}
+}
+
+// TestWebhookReset tests that a successful probe resets the consecutive
+// failures
+func TestWebhookReset(t *testing.T) {
+	w := newWebhookAlerter("http://localhost:6666", 2, time.Hour)
+
+	w.record("example.com:443", "tcp", errors.New("failed"))
+	w.record("example.com:443", "tcp", nil)
+	w.record("example.com:443", "tcp", errors.New("failed"))
+
+	if failures := w.failures["tcp/example.com:443"].count; failures != 1 {
+		t.Errorf("expected 1 consecutive failure, got %d", failures)
+	}
+}
+
+// TestWebhookRetention tests that the failures of targets that haven't been
+// probed for the retention period are forgotten
+func TestWebhookRetention(t *testing.T) {
+	w := newWebhookAlerter("http://localhost:6666", 2, time.Hour)
+
+	w.record("example.com:443", "tcp", errors.New("failed"))
+	w.record("example.org:443", "tcp", errors.New("failed"))
+
+	// Age one of the targets beyond the retention period
+	w.mtx.Lock()
+	w.failures["tcp/example.org:443"].seen = time.Now().Add(-2 * time.Hour)
+	w.mtx.Unlock()
+
+	w.record("example.com:443", "tcp", errors.New("failed"))
+
+	if _, ok := w.failures["tcp/example.org:443"]; ok {
+		t.Errorf("expected example.org:443 to be forgotten")
+	}
+	if failures := w.failures["tcp/example.com:443"].count; failures != 2 {
+		t.Errorf("expected 2 consecutive failures, got %d", failures)
+	}
+}